@@ -0,0 +1,79 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// backup-tprs backs up the persistence instances and actions stored as
+// ThirdPartyResources in Secrets, before the cluster is upgraded to a
+// Kubernetes version without TPRs. The operator restores them to the
+// CustomResourceDefinitions when started with --restore-tpr-backups.
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/pkg/k8sutil"
+	persistencecontroller "github.com/mmerrill3/persistence-operator/pkg/persistence"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	host        string
+	tlsInsecure bool
+	tlsConfig   rest.TLSClientConfig
+	namespace   string
+)
+
+func init() {
+	flagset := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	flagset.StringVar(&host, "apiserver", "", "API Server addr, e.g. ' - NOT RECOMMENDED FOR PRODUCTION - http://127.0.0.1:8080'. Omit parameter to run in on-cluster mode and utilize the service account token.")
+	flagset.StringVar(&tlsConfig.CertFile, "cert-file", "", " - NOT RECOMMENDED FOR PRODUCTION - Path to public TLS certificate file.")
+	flagset.StringVar(&tlsConfig.KeyFile, "key-file", "", "- NOT RECOMMENDED FOR PRODUCTION - Path to private TLS certificate file.")
+	flagset.StringVar(&tlsConfig.CAFile, "ca-file", "", "- NOT RECOMMENDED FOR PRODUCTION - Path to TLS CA file.")
+	flagset.BoolVar(&tlsInsecure, "tls-insecure", false, "- NOT RECOMMENDED FOR PRODUCTION - Don't verify API server's CA certificate.")
+	flagset.StringVar(&namespace, "namespace", "", "Namespace the operator runs in, which the backups are written to.")
+	flagset.Parse(os.Args[1:])
+}
+
+func Main() int {
+	if namespace == "" {
+		glog.Fatal("--namespace is required. Exiting...")
+	}
+
+	cfg, err := k8sutil.NewClusterConfig(host, tlsInsecure, &tlsConfig)
+	if err != nil {
+		glog.Fatalf("Issue with the cluster config. Exiting... %s", err)
+	}
+	kclient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		glog.Fatalf("Issue with creating the Kubernetes client. Exiting... %s", err)
+	}
+	// TPRs are served under the same paths as the CRDs replacing them.
+	mclient, err := v1alpha1.NewForConfig(cfg)
+	if err != nil {
+		glog.Fatalf("Issue with creating the persistence client. Exiting... %s", err)
+	}
+
+	if err := persistencecontroller.BackupTPRs(kclient, mclient, namespace); err != nil {
+		glog.Fatalf("Issue with backing up the TPRs. Exiting... %s", err)
+	}
+	return 0
+}
+
+func main() {
+	os.Exit(Main())
+}
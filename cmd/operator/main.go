@@ -17,21 +17,38 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/admission"
 	"github.com/mmerrill3/persistence-operator/pkg/api"
+	"github.com/mmerrill3/persistence-operator/pkg/conversion"
 	persistencecontroller "github.com/mmerrill3/persistence-operator/pkg/persistence"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sync/errgroup"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 )
 
 var (
 	cfg persistencecontroller.Config
+
+	conversionListenAddress string
+	conversionCertFile      string
+	conversionKeyFile       string
+
+	admissionListenAddress string
+	admissionCertFile      string
+	admissionKeyFile       string
+
+	enableSQLite bool
 )
 
 func init() {
@@ -45,17 +62,89 @@ func init() {
 	flagset.BoolVar(&cfg.TLSInsecure, "tls-insecure", false, "- NOT RECOMMENDED FOR PRODUCTION - Don't verify API server's CA certificate.")
 	flagset.StringVar(&cfg.PersistenceConfigReloader, "persistence-config-reloader", "quay.io/coreos/persistence-config-reloader:v0.0.1", "Config and rule reload image")
 	flagset.StringVar(&cfg.ConfigReloaderImage, "config-reloader-image", "quay.io/coreos/configmap-reload:v0.0.1", "Reload Image")
+	flagset.DurationVar(&cfg.ProbeInterval, "probe-interval", time.Minute, "Interval in which the connectivity to persistence instances is probed.")
+	flagset.StringVar(&cfg.ExecutorMode, "executor", persistencecontroller.ExecutorJob, "Executor running persistence actions which don't specify one. Either Job, which needs an executor image for the persistence type, or InProcess.")
+	flagset.DurationVar(&cfg.ConnectTimeout, "connect-timeout", 30*time.Second, "Timeout of connecting to a persistence instance when executing persistence actions in-process. Zero disables the timeout.")
+	flagset.DurationVar(&cfg.StatementTimeout, "statement-timeout", 30*time.Minute, "Timeout of a single statement when executing persistence actions in-process. Zero disables the timeout.")
+	cfg.ExecutorImages = map[string]string{}
+	flagset.Var(executorImages(cfg.ExecutorImages), "executor-image", "Image running persistence actions in Jobs for a persistence type, in format \"type=image\". May be repeated. The images implement the executor contract documented in the README and override the default image of the persistence type, if the operator was built with one.")
+	flagset.IntVar(&cfg.Workers, "workers", 4, "Number of persistence actions synced concurrently, and of persistence instances probed concurrently. Actions targeting the same persistence instance are never synced concurrently.")
+	flagset.DurationVar(&cfg.SweepInterval, "sweep-interval", 10*time.Minute, "Interval in which workloads left behind by deleted persistence actions are removed.")
+	flagset.BoolVar(&cfg.RestoreTPRBackups, "restore-tpr-backups", false, "Restore persistence instances and actions which were stored as ThirdPartyResources from the Secrets written by backup-tprs in the namespace of the operator on startup, removing the Secrets afterwards.")
+	flagset.StringVar(&cfg.Namespace, "namespace", operatorNamespace(), "Namespace the operator runs in. Defaults to the namespace of its pod.")
+	flagset.StringVar(&cfg.ConversionWebhookService, "conversion-webhook-service", "", "Service serving the conversion webhook in format \"namespace/name\". The v1beta1 API is only served if set.")
+	flagset.StringVar(&cfg.ConversionWebhookCAFile, "conversion-webhook-ca-file", "", "Path to the CA bundle the API server verifies the webhook certificate with.")
+	flagset.StringVar(&conversionListenAddress, "conversion-listen-address", ":8443", "Address the conversion webhook is served on.")
+	flagset.StringVar(&conversionCertFile, "conversion-cert-file", "", "Path to the TLS certificate of the conversion webhook. The conversion webhook is only served if set.")
+	flagset.StringVar(&conversionKeyFile, "conversion-key-file", "", "Path to the TLS key of the conversion webhook.")
+	flagset.StringVar(&admissionListenAddress, "admission-listen-address", ":9443", "Address the admission webhooks are served on.")
+	flagset.StringVar(&admissionCertFile, "admission-cert-file", "", "Path to the TLS certificate of the admission webhooks. The admission webhooks are only served if set.")
+	flagset.StringVar(&admissionKeyFile, "admission-key-file", "", "Path to the TLS key of the admission webhooks.")
+	flagset.BoolVar(&cfg.LeaderElection.Enabled, "leader-elect", true, "Elect a leader among the replicas of the operator. Only the leader executes persistence actions.")
+	flagset.StringVar(&cfg.LeaderElection.Namespace, "leader-elect-namespace", operatorNamespace(), "Namespace of the ConfigMap and Lease holding the leader election lease. Defaults to the namespace of the operator.")
+	flagset.StringVar(&cfg.LeaderElection.Name, "leader-elect-name", "persistence-operator", "Name of the ConfigMap and Lease holding the leader election lease.")
+	flagset.StringVar(&cfg.LeaderElection.Identity, "leader-elect-identity", "", "Identity of the replica in the leader election. Defaults to the hostname.")
+	flagset.DurationVar(&cfg.LeaderElection.LeaseDuration, "leader-elect-lease-duration", 15*time.Second, "Duration candidates wait before taking over a lease which is not renewed.")
+	flagset.DurationVar(&cfg.LeaderElection.RenewDeadline, "leader-elect-renew-deadline", 10*time.Second, "Duration the leader retries renewing its lease before giving it up. Must be less than the lease duration.")
+	flagset.DurationVar(&cfg.LeaderElection.RetryPeriod, "leader-elect-retry-period", 2*time.Second, "Duration candidates wait between attempts to acquire or renew the lease.")
+	flagset.BoolVar(&enableSQLite, "enable-sqlite", false, "- NOT RECOMMENDED FOR PRODUCTION - Support persistence instances of type SQLite, whose database files are files in the operator container, to try out persistence actions with the InProcess executor.")
 	flagset.Parse(os.Args[1:])
 }
 
+// executorImages collects the executor images given as "type=image" by lower
+// case persistence type.
+type executorImages map[string]string
+
+func (f executorImages) String() string {
+	res := make([]string, 0, len(f))
+	for t, image := range f {
+		res = append(res, t+"="+image)
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+func (f executorImages) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected \"type=image\", got %q", v)
+	}
+	f[strings.ToLower(parts[0])] = parts[1]
+	return nil
+}
+
+// operatorNamespace returns the namespace the operator runs in, as exposed
+// through the downward API or the service account.
+func operatorNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if ns, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		return strings.TrimSpace(string(ns))
+	}
+	return "default"
+}
+
 func Main() int {
+	if enableSQLite {
+		persistencecontroller.EnableSQLite()
+	}
+	// Actions on persistence types without an image fail when they are
+	// synced, rather than keeping the operator from starting.
+	if cfg.ExecutorMode != persistencecontroller.ExecutorInProcess && len(cfg.ExecutorImages) == 0 {
+		glog.Warningf("no --executor-image given, the %s executor only runs actions on persistence types with a default image", persistencecontroller.ExecutorJob)
+	}
+
 	r := prometheus.NewRegistry()
 	r.MustRegister(prometheus.NewGoCollector())
+	// The work queues pick up their metrics provider when they are created.
+	persistencecontroller.RegisterWorkqueueMetrics(r)
 
 	pcontroller, err := persistencecontroller.New(cfg)
 	if err != nil {
 		glog.Fatalf("Issue with starting Persistence Controller. Exiting... %s", err)
 	}
+	pcontroller.RegisterMetrics(r)
 
 	mux := http.NewServeMux()
 	web, err := api.New(cfg)
@@ -70,16 +159,37 @@ func Main() int {
 	}
 
 	mux.Handle("/metrics", promhttp.HandlerFor(r, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", pcontroller.ServeHealthz)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	wg, ctx := errgroup.WithContext(ctx)
 
-	wg.Go(func() error { return pcontroller.Run(ctx.Done()) })
+	wg.Go(func() error { return pcontroller.RunWithLeaderElection(ctx.Done()) })
 
 	srv := &http.Server{Handler: mux}
 	go srv.Serve(l)
 
-	term := make(chan os.Signal)
+	// The API server only calls webhooks over TLS.
+	if conversionCertFile != "" {
+		conversionMux := http.NewServeMux()
+		conversion.New().Register(conversionMux)
+		wg.Go(func() error {
+			return serveTLS(ctx, conversionListenAddress, conversionCertFile, conversionKeyFile, conversionMux)
+		})
+	}
+	if admissionCertFile != "" {
+		admissionWebhook, err := admission.New(cfg)
+		if err != nil {
+			glog.Fatalf("Issue with starting admission webhook. Exiting... %s", err)
+		}
+		admissionMux := http.NewServeMux()
+		admissionWebhook.Register(admissionMux)
+		wg.Go(func() error {
+			return serveTLS(ctx, admissionListenAddress, admissionCertFile, admissionKeyFile, admissionMux)
+		})
+	}
+
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
 	select {
@@ -96,6 +206,19 @@ func Main() int {
 	return 0
 }
 
+// serveTLS serves handler on addr over TLS until ctx is done.
+func serveTLS(ctx context.Context, addr, certFile, keyFile string, handler http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServeTLS(certFile, keyFile); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
 func main() {
 	os.Exit(Main())
 }
@@ -0,0 +1,11 @@
+#!/bin/sh
+# Generates the deepcopy functions of the API types. deepcopy-gen is built
+# from k8s.io/code-generator.
+
+set -e
+
+cd "$(dirname "$0")/.."
+deepcopy-gen \
+	--go-header-file hack/boilerplate.go.txt \
+	--output-file zz_generated.deepcopy.go \
+	./pkg/client/persistence/v1alpha1
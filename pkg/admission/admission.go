@@ -0,0 +1,337 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admission implements the webhooks validating and defaulting
+// PersistenceInstances and PersistenceActions on behalf of the API server.
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/pkg/k8sutil"
+	"github.com/mmerrill3/persistence-operator/pkg/persistence"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// ValidatePath is the path the validating webhook is served at.
+	ValidatePath = "/validate"
+	// MutatePath is the path the defaulting webhook is served at.
+	MutatePath = "/mutate"
+)
+
+// Webhook reviews PersistenceInstances and PersistenceActions of the
+// v1alpha1 API.
+type Webhook struct {
+	mclient v1alpha1.PersistenceInstanceGetter
+}
+
+// New creates an admission webhook, which looks up PersistenceInstances in
+// the cluster configured by conf.
+func New(conf persistence.Config) (*Webhook, error) {
+	cfg, err := k8sutil.NewClusterConfig(conf.Host, conf.TLSInsecure, &conf.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	mclient, err := v1alpha1.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Webhook{mclient: mclient}, nil
+}
+
+// Register serves the webhooks at ValidatePath and MutatePath on mux.
+func (wh *Webhook) Register(mux *http.ServeMux) {
+	mux.HandleFunc(ValidatePath, func(w http.ResponseWriter, req *http.Request) {
+		serve(w, req, wh.Validate)
+	})
+	mux.HandleFunc(MutatePath, func(w http.ResponseWriter, req *http.Request) {
+		serve(w, req, Mutate)
+	})
+}
+
+// serve decodes the AdmissionReview of req and responds with the outcome of
+// review.
+func serve(w http.ResponseWriter, req *http.Request, review func(*admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		glog.Errorf("Problem while reading the admission review : %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var ar admissionv1beta1.AdmissionReview
+	if err := json.Unmarshal(body, &ar); err != nil || ar.Request == nil {
+		glog.Errorf("Problem while decoding the admission review : %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ar.Response = review(ar.Request)
+	ar.Response.UID = ar.Request.UID
+	ar.Request = nil
+	b, err := json.Marshal(ar)
+	if err != nil {
+		glog.Errorf("Problem while marshalling the admission review : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// Validate admits valid PersistenceInstances and PersistenceActions. Actions
+// have to select at least one instance.
+func (wh *Webhook) Validate(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	if req.Operation == admissionv1beta1.Delete {
+		return allowed()
+	}
+	if err := checkVersion(req); err != nil {
+		return denied(err)
+	}
+
+	switch req.Kind.Kind {
+	case v1alpha1.TPRPersistenceInstancesKind:
+		var i v1alpha1.PersistenceInstance
+		if err := json.Unmarshal(req.Object.Raw, &i); err != nil {
+			return denied(err)
+		}
+		if err := persistence.ValidateInstance(&i); err != nil {
+			return denied(err)
+		}
+
+	case v1alpha1.TPRPersistenceActionsKind:
+		var p v1alpha1.PersistenceAction
+		if err := json.Unmarshal(req.Object.Raw, &p); err != nil {
+			return denied(err)
+		}
+		if err := persistence.ValidateAction(&p); err != nil {
+			return denied(err)
+		}
+		var old *v1alpha1.PersistenceAction
+		if req.Operation == admissionv1beta1.Update {
+			old = &v1alpha1.PersistenceAction{}
+			if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+				return denied(err)
+			}
+			if err := persistence.ValidateActionUpdate(old, &p); err != nil {
+				return denied(err)
+			}
+		}
+		// The instances selected by a deleted action may be gone already,
+		// which must not keep its finalizers from being removed.
+		if p.DeletionTimestamp == nil && (old == nil || selectionChanged(old, &p)) {
+			if err := wh.checkSelector(req.Namespace, &p); err != nil {
+				return denied(err)
+			}
+		}
+
+	default:
+		return denied(fmt.Errorf("unexpected kind %s", req.Kind.Kind))
+	}
+	return allowed()
+}
+
+// selectionChanged returns whether the update of old to cur changes the
+// instances cur has to select, so that they have to be checked again.
+func selectionChanged(old, cur *v1alpha1.PersistenceAction) bool {
+	return !reflect.DeepEqual(old.Spec.PersistenceInstanceSelector, cur.Spec.PersistenceInstanceSelector) ||
+		(old.Spec.Applied && !cur.Spec.Applied)
+}
+
+// checkSelector verifies the selector of p matches at least one instance in
+// its namespace. Actions marked as applied are exempt, as they don't run
+// anymore.
+func (wh *Webhook) checkSelector(ns string, p *v1alpha1.PersistenceAction) error {
+	if p.Spec.Applied {
+		return nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(p.Spec.PersistenceInstanceSelector)
+	if err != nil {
+		return err
+	}
+	obj, err := wh.mclient.PersistenceInstances(ns).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing persistence instances failed: %s", err)
+	}
+	for _, i := range obj.(*v1alpha1.PersistenceInstanceList).Items {
+		if selector.Matches(labels.Set(i.Labels)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("spec.persistenceInstanceSelector: matches no persistence instance in namespace %s", ns)
+}
+
+// Mutate sets the defaults of PersistenceInstances and PersistenceActions.
+// The patch only sets the defaulted fields, the rest of the object is left as
+// it was submitted.
+func Mutate(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	if req.Operation != admissionv1beta1.Create && req.Operation != admissionv1beta1.Update {
+		return allowed()
+	}
+	if err := checkVersion(req); err != nil {
+		return denied(err)
+	}
+
+	var (
+		before []byte
+		spec   interface{}
+		err    error
+	)
+	var obj struct {
+		Spec json.RawMessage `json:"spec"`
+	}
+	if err := json.Unmarshal(req.Object.Raw, &obj); err != nil {
+		return denied(err)
+	}
+	switch req.Kind.Kind {
+	case v1alpha1.TPRPersistenceInstancesKind:
+		var i v1alpha1.PersistenceInstance
+		if err := json.Unmarshal(req.Object.Raw, &i); err != nil {
+			return denied(err)
+		}
+		if before, err = json.Marshal(i.Spec); err != nil {
+			return denied(err)
+		}
+		persistence.DefaultInstance(&i)
+		spec = i.Spec
+
+	case v1alpha1.TPRPersistenceActionsKind:
+		var p v1alpha1.PersistenceAction
+		if err := json.Unmarshal(req.Object.Raw, &p); err != nil {
+			return denied(err)
+		}
+		if before, err = json.Marshal(p.Spec); err != nil {
+			return denied(err)
+		}
+		persistence.DefaultAction(&p)
+		spec = p.Spec
+
+	default:
+		return denied(fmt.Errorf("unexpected kind %s", req.Kind.Kind))
+	}
+
+	after, err := json.Marshal(spec)
+	if err != nil {
+		return denied(err)
+	}
+	if bytes.Equal(before, after) {
+		return allowed()
+	}
+	var ops []patchOperation
+	if len(obj.Spec) == 0 || bytes.Equal(obj.Spec, []byte("null")) {
+		ops = []patchOperation{{Op: "add", Path: "/spec", Value: spec}}
+	} else {
+		var b, a map[string]interface{}
+		if err := json.Unmarshal(before, &b); err != nil {
+			return denied(err)
+		}
+		if err := json.Unmarshal(after, &a); err != nil {
+			return denied(err)
+		}
+		ops = diff("/spec", b, a)
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return denied(err)
+	}
+	pt := admissionv1beta1.PatchTypeJSONPatch
+	res := allowed()
+	res.Patch = patch
+	res.PatchType = &pt
+	return res
+}
+
+// patchOperation is a JSON patch operation.
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// diff returns the operations patching the fields of the JSON object before
+// at path to the values they have in after. Defaulting only sets fields, so
+// fields missing in after are left alone.
+func diff(path string, before, after map[string]interface{}) []patchOperation {
+	keys := make([]string, 0, len(after))
+	for k := range after {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var ops []patchOperation
+	for _, k := range keys {
+		p := path + "/" + pointerEscaper.Replace(k)
+		old, ok := before[k]
+		if !ok {
+			ops = append(ops, patchOperation{Op: "add", Path: p, Value: after[k]})
+			continue
+		}
+		if reflect.DeepEqual(old, after[k]) {
+			continue
+		}
+		o, oldIsObject := old.(map[string]interface{})
+		n, newIsObject := after[k].(map[string]interface{})
+		if oldIsObject && newIsObject {
+			ops = append(ops, diff(p, o, n)...)
+			continue
+		}
+		ops = append(ops, patchOperation{Op: "replace", Path: p, Value: after[k]})
+	}
+	return ops
+}
+
+// pointerEscaper escapes the reference tokens of JSON pointers.
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// checkVersion rejects requests for other versions than v1alpha1. The API
+// server converts objects of other versions if the webhooks are registered
+// with the Equivalent match policy.
+func checkVersion(req *admissionv1beta1.AdmissionRequest) error {
+	if req.Kind.Group != v1alpha1.TPRGroup || req.Kind.Version != v1alpha1.TPRVersion {
+		return fmt.Errorf("unexpected version %s/%s, expected %s/%s", req.Kind.Group, req.Kind.Version, v1alpha1.TPRGroup, v1alpha1.TPRVersion)
+	}
+	return nil
+}
+
+func allowed() *admissionv1beta1.AdmissionResponse {
+	return &admissionv1beta1.AdmissionResponse{Allowed: true}
+}
+
+func denied(err error) *admissionv1beta1.AdmissionResponse {
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: err.Error(),
+		},
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// fakeInstances serves the PersistenceInstances items and counts how often
+// they were listed.
+type fakeInstances struct {
+	v1alpha1.PersistenceInstanceInterface
+	items  []*v1alpha1.PersistenceInstance
+	listed int
+}
+
+func (f *fakeInstances) PersistenceInstances(string) v1alpha1.PersistenceInstanceInterface {
+	return f
+}
+
+func (f *fakeInstances) List(metav1.ListOptions) (runtime.Object, error) {
+	f.listed++
+	return &v1alpha1.PersistenceInstanceList{Items: f.items}, nil
+}
+
+// review posts the AdmissionReview in testdata/name to the webhook at path
+// and returns the response.
+func review(t *testing.T, wh *Webhook, path, name string) *admissionv1beta1.AdmissionResponse {
+	body, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	wh.Register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: unexpected status %d", name, rec.Code)
+	}
+
+	var req, res admissionv1beta1.AdmissionReview
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response == nil || res.Response.UID != req.Request.UID {
+		t.Fatalf("%s: expected a response to request %s, got %+v", name, req.Request.UID, res.Response)
+	}
+	return res.Response
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		fixture string
+		allowed bool
+		listed  bool
+	}{
+		{fixture: "instance-create.json", allowed: true},
+		{fixture: "action-create.json", allowed: true, listed: true},
+		// Updates leaving the selector alone are not checked again.
+		{fixture: "action-update.json", allowed: true},
+		{fixture: "action-update-selector.json", allowed: false, listed: true},
+		// Removing the finalizers of deleted actions always succeeds.
+		{fixture: "action-finalize.json", allowed: true},
+	} {
+		instances := &fakeInstances{items: []*v1alpha1.PersistenceInstance{{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "orders-db",
+				Namespace: "shop",
+				Labels:    map[string]string{"app": "shop"},
+			},
+		}}}
+		res := review(t, &Webhook{mclient: instances}, ValidatePath, tc.fixture)
+		if res.Allowed != tc.allowed {
+			t.Errorf("%s: expected allowed to be %t, got %t: %+v", tc.fixture, tc.allowed, res.Allowed, res.Result)
+		}
+		if listed := instances.listed > 0; listed != tc.listed {
+			t.Errorf("%s: expected the instances to be listed to be %t, got %t", tc.fixture, tc.listed, listed)
+		}
+	}
+}
+
+func TestMutate(t *testing.T) {
+	for _, tc := range []struct {
+		fixture string
+		patch   string
+	}{
+		{
+			fixture: "instance-create.json",
+			patch:   `[{"op":"add","path":"/spec/tls/mode","value":"VerifyFull"}]`,
+		},
+		{
+			fixture: "action-create.json",
+			patch: `[{"op":"add","path":"/spec/checksumPolicy","value":"Fail"},` +
+				`{"op":"add","path":"/spec/concurrencyPolicy","value":"Forbid"},` +
+				`{"op":"add","path":"/spec/failedJobsHistoryLimit","value":1},` +
+				`{"op":"add","path":"/spec/successfulJobsHistoryLimit","value":3}]`,
+		},
+		{fixture: "action-update.json"},
+	} {
+		res := review(t, &Webhook{}, MutatePath, tc.fixture)
+		if !res.Allowed {
+			t.Errorf("%s: expected the object to be allowed, got %+v", tc.fixture, res.Result)
+		}
+		if string(res.Patch) != tc.patch {
+			t.Errorf("%s: expected patch %s, got %s", tc.fixture, tc.patch, res.Patch)
+		}
+	}
+}
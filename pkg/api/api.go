@@ -15,11 +15,17 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"regexp"
+	"strings"
 
 	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
@@ -28,8 +34,9 @@ import (
 )
 
 type API struct {
-	kclient *kubernetes.Clientset
+	kclient kubernetes.Interface
 	mclient *v1alpha1.PersistenceV1alpha1Client
+	planner *persistence.Planner
 }
 
 func New(conf persistence.Config) (*API, error) {
@@ -51,17 +58,21 @@ func New(conf persistence.Config) (*API, error) {
 	return &API{
 		kclient: kclient,
 		mclient: mclient,
+		planner: persistence.NewPlanner(kclient, mclient),
 	}, nil
 }
 
 var (
-	instanceRoute = regexp.MustCompile("/apis/persistence.mmerrill3.com/v1alpha1/namespaces/(.*)/persistence-actions/(.*)/status")
+	instanceRoute = regexp.MustCompile("^/apis/persistence.mmerrill3.com/v1alpha1/namespaces/([^/]+)/persistence-actions/([^/]+)/status$")
+	planRoute     = regexp.MustCompile("^/apis/persistence.mmerrill3.com/v1alpha1/namespaces/([^/]+)/persistence-actions/([^/]+)/plan$")
 )
 
 func (api *API) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		if instanceRoute.MatchString(req.URL.Path) {
 			api.status(w, req)
+		} else if planRoute.MatchString(req.URL.Path) {
+			api.plan(w, req)
 		} else {
 			w.WriteHeader(404)
 		}
@@ -73,8 +84,8 @@ type objectReference struct {
 	namespace string
 }
 
-func parseStatusUrl(path string) objectReference {
-	matches := instanceRoute.FindAllStringSubmatch(path, -1)
+func parseUrl(route *regexp.Regexp, path string) objectReference {
+	matches := route.FindAllStringSubmatch(path, -1)
 	ns := ""
 	name := ""
 	if len(matches) == 1 {
@@ -90,8 +101,13 @@ func parseStatusUrl(path string) objectReference {
 	}
 }
 
+// status reports the action along with its status. The status holds the plan
+// of dry runs, so it is only served to callers allowed to get the action.
 func (api *API) status(w http.ResponseWriter, req *http.Request) {
-	or := parseStatusUrl(req.URL.Path)
+	or := parseUrl(instanceRoute, req.URL.Path)
+	if !api.allow(w, req, or) {
+		return
+	}
 
 	p, err := api.mclient.PersistenceActions(or.namespace).Get(or.name)
 	if err != nil {
@@ -102,17 +118,107 @@ func (api *API) status(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	p.Status, err = persistence.PersistenceActionStatus(api.kclient, p)
+	b, err := json.Marshal(p)
 	if err != nil {
-		glog.Errorf("Problem while checking the status of the action from k8s : %s", err)
+		glog.Errorf("Problem while marshalling the status of the action from k8s : %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// plan reports what the action would do, without executing anything. The
+// rendered statements may contain values read from ConfigMaps and Secrets, so
+// the plan is only served to callers allowed to get the action.
+func (api *API) plan(w http.ResponseWriter, req *http.Request) {
+	or := parseUrl(planRoute, req.URL.Path)
+	if !api.allow(w, req, or) {
+		return
+	}
+
+	p, err := api.planner.Plan(req.Context(), or.namespace, or.name)
+	if err != nil {
+		if k8sutil.IsResourceNotFoundError(err) {
+			w.WriteHeader(404)
+		} else {
+			w.WriteHeader(500)
+		}
+		glog.Errorf("Problem while planning the action : %s", err)
+		return
 	}
 
 	b, err := json.Marshal(p)
 	if err != nil {
-		glog.Errorf("Problem while marshalling the status of the action from k8s : %s", err)
+		glog.Errorf("Problem while marshalling the plan of the action : %s", err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
 	w.Write(b)
 }
+
+// allow reports whether req is authorized to get the referenced action. It
+// responds with 401 or 403 if it isn't.
+func (api *API) allow(w http.ResponseWriter, req *http.Request, or objectReference) bool {
+	allowed, err := api.authorize(req, or)
+	if err != nil {
+		w.WriteHeader(401)
+		glog.Errorf("Problem while authenticating the request : %s", err)
+		return false
+	}
+	if !allowed {
+		w.WriteHeader(403)
+		return false
+	}
+	return true
+}
+
+// authorize authenticates the bearer token of req with a TokenReview and asks
+// the API server with a SubjectAccessReview whether its user may get the
+// referenced PersistenceAction. An error is returned if the request isn't
+// authenticated.
+func (api *API) authorize(req *http.Request, or objectReference) (bool, error) {
+	h := req.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return false, errors.New("no bearer token")
+	}
+	token := strings.TrimPrefix(h, "Bearer ")
+
+	tr, err := api.kclient.AuthenticationV1().TokenReviews().Create(context.TODO(), &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, errors.Wrap(err, "reviewing the token failed")
+	}
+	if !tr.Status.Authenticated {
+		return false, errors.Errorf("token not authenticated: %s", tr.Status.Error)
+	}
+
+	user := tr.Status.User
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	sar, err := api.kclient.AuthorizationV1().SubjectAccessReviews().Create(context.TODO(), &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: or.namespace,
+				Verb:      "get",
+				Group:     v1alpha1.TPRGroup,
+				Resource:  v1alpha1.TPRPersistenceActionName,
+				Name:      or.name,
+			},
+			User:   user.Username,
+			Groups: user.Groups,
+			Extra:  extra,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		// The caller is authenticated, failing to review its access denies
+		// the request.
+		glog.Errorf("Problem while reviewing the access to the action : %s", err)
+		return false, nil
+	}
+	return sar.Status.Allowed, nil
+}
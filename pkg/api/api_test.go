@@ -0,0 +1,135 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestAuthorization(t *testing.T) {
+	routes := []struct {
+		name    string
+		path    string
+		handler func(*API) http.HandlerFunc
+	}{
+		{name: "status", path: "/apis/persistence.mmerrill3.com/v1alpha1/namespaces/prod/persistence-actions/vacuum/status", handler: func(api *API) http.HandlerFunc { return api.status }},
+		{name: "plan", path: "/apis/persistence.mmerrill3.com/v1alpha1/namespaces/prod/persistence-actions/vacuum/plan", handler: func(api *API) http.HandlerFunc { return api.plan }},
+	}
+	tests := []struct {
+		name          string
+		header        string
+		authenticated bool
+		allowed       bool
+		code          int
+	}{
+		{name: "no token", header: "", code: 401},
+		{name: "basic auth", header: "Basic Zm9vOmJhcg==", code: 401},
+		{name: "unauthenticated", header: "Bearer token", code: 401},
+		{name: "denied", header: "Bearer token", authenticated: true, code: 403},
+	}
+
+	for _, route := range routes {
+		for _, test := range tests {
+			t.Run(route.name+"/"+test.name, func(t *testing.T) {
+				var sar *authorizationv1.SubjectAccessReview
+				kclient := fake.NewSimpleClientset()
+				kclient.PrependReactor("create", "tokenreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+					tr := action.(clienttesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+					if tr.Spec.Token != "token" {
+						t.Errorf("expected token %q to be reviewed, got %q", "token", tr.Spec.Token)
+					}
+					tr.Status.Authenticated = test.authenticated
+					tr.Status.User = authenticationv1.UserInfo{
+						Username: "jane",
+						Groups:   []string{"dba"},
+					}
+					return true, tr, nil
+				})
+				kclient.PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+					sar = action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+					sar.Status.Allowed = test.allowed
+					return true, sar, nil
+				})
+
+				api := &API{kclient: kclient}
+				req := httptest.NewRequest("GET", route.path, nil)
+				if test.header != "" {
+					req.Header.Set("Authorization", test.header)
+				}
+				w := httptest.NewRecorder()
+				route.handler(api)(w, req)
+
+				if w.Code != test.code {
+					t.Fatalf("expected status %d, got %d", test.code, w.Code)
+				}
+				if !test.authenticated {
+					if sar != nil {
+						t.Fatal("expected no access review of an unauthenticated request")
+					}
+					return
+				}
+				if sar == nil {
+					t.Fatal("expected the access to be reviewed")
+				}
+				expected := authorizationv1.ResourceAttributes{
+					Namespace: "prod",
+					Verb:      "get",
+					Group:     "persistence.mmerrill3.com",
+					Resource:  "persistenceactions",
+					Name:      "vacuum",
+				}
+				if *sar.Spec.ResourceAttributes != expected {
+					t.Errorf("expected resource attributes %+v, got %+v", expected, *sar.Spec.ResourceAttributes)
+				}
+				if sar.Spec.User != "jane" || len(sar.Spec.Groups) != 1 || sar.Spec.Groups[0] != "dba" {
+					t.Errorf("expected the access of jane in dba to be reviewed, got %s in %v", sar.Spec.User, sar.Spec.Groups)
+				}
+			})
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	tests := []struct {
+		path   string
+		status bool
+		plan   bool
+	}{
+		{path: "/apis/persistence.mmerrill3.com/v1alpha1/namespaces/prod/persistence-actions/vacuum/status", status: true},
+		{path: "/apis/persistence.mmerrill3.com/v1alpha1/namespaces/prod/persistence-actions/vacuum/plan", plan: true},
+		{path: "/proxy/apis/persistence.mmerrill3.com/v1alpha1/namespaces/prod/persistence-actions/vacuum/status"},
+		{path: "/apis/persistence.mmerrill3.com/v1alpha1/namespaces/prod/persistence-actions/vacuum/status/plan"},
+		{path: "/apis/persistence.mmerrill3.com/v1alpha1/namespaces/prod/persistence-actions/vacuum/plan/status"},
+		{path: "/apis/persistence.mmerrill3.com/v1alpha1/namespaces/prod/persistence-actions//status"},
+		{path: "/apis/persistence.mmerrill3.com/v1alpha1/namespaces/prod/x/persistence-actions/vacuum/status"},
+	}
+
+	for _, test := range tests {
+		if m := instanceRoute.MatchString(test.path); m != test.status {
+			t.Errorf("expected status route match of %s to be %t, got %t", test.path, test.status, m)
+		}
+		if m := planRoute.MatchString(test.path); m != test.plan {
+			t.Errorf("expected plan route match of %s to be %t, got %t", test.path, test.plan, m)
+		}
+	}
+}
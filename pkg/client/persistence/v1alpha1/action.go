@@ -15,11 +15,15 @@
 package v1alpha1
 
 import (
+	"context"
 	"encoding/json"
+	"net/http"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
@@ -38,28 +42,27 @@ type PersistenceActionInterface interface {
 	Create(*PersistenceAction) (*PersistenceAction, error)
 	Get(name string) (*PersistenceAction, error)
 	Update(*PersistenceAction) (*PersistenceAction, error)
+	UpdateStatus(*PersistenceAction) (*PersistenceAction, error)
 	Delete(name string, options *metav1.DeleteOptions) error
 	List(opts metav1.ListOptions) (runtime.Object, error)
 	Watch(opts metav1.ListOptions) (watch.Interface, error)
 }
 
+// +k8s:deepcopy-gen=false
 type persistenceactions struct {
 	restClient rest.Interface
-	client     *dynamic.ResourceClient
+	client     dynamic.ResourceInterface
 	ns         string
 }
 
-func newPersistenceActions(r rest.Interface, c *dynamic.Client, namespace string) *persistenceactions {
+func newPersistenceActions(r rest.Interface, c dynamic.Interface, namespace string) *persistenceactions {
 	return &persistenceactions{
 		r,
-		c.Resource(
-			&metav1.APIResource{
-				Kind:       TPRPersistenceActionsKind,
-				Name:       TPRPersistenceActionName,
-				Namespaced: true,
-			},
-			namespace,
-		),
+		c.Resource(schema.GroupVersionResource{
+			Group:    TPRGroup,
+			Version:  TPRVersion,
+			Resource: TPRPersistenceActionName,
+		}).Namespace(namespace),
 		namespace,
 	}
 }
@@ -70,7 +73,7 @@ func (s *persistenceactions) Create(o *PersistenceAction) (*PersistenceAction, e
 		return nil, err
 	}
 
-	us, err = s.client.Create(us)
+	us, err = s.client.Create(context.TODO(), us, metav1.CreateOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +82,7 @@ func (s *persistenceactions) Create(o *PersistenceAction) (*PersistenceAction, e
 }
 
 func (s *persistenceactions) Get(name string) (*PersistenceAction, error) {
-	obj, err := s.client.Get(name, metav1.GetOptions{})
+	obj, err := s.client.Get(context.TODO(), name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -92,7 +95,7 @@ func (s *persistenceactions) Update(o *PersistenceAction) (*PersistenceAction, e
 		return nil, err
 	}
 
-	us, err = s.client.Update(us)
+	us, err = s.client.Update(context.TODO(), us, metav1.UpdateOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -100,17 +103,44 @@ func (s *persistenceactions) Update(o *PersistenceAction) (*PersistenceAction, e
 	return PersistenceActionFromUnstructured(us)
 }
 
+// UpdateStatus replaces the status of o through the status subresource.
+// Updates of the object itself ignore its status.
+func (s *persistenceactions) UpdateStatus(o *PersistenceAction) (*PersistenceAction, error) {
+	o.TypeMeta.Kind = TPRPersistenceActionsKind
+	o.TypeMeta.APIVersion = TPRGroup + "/" + TPRVersion
+	body, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := s.restClient.Put().
+		Namespace(s.ns).
+		Resource(TPRPersistenceActionName).
+		Name(o.Name).
+		SubResource("status").
+		Body(body).
+		DoRaw(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	var res PersistenceAction
+	return &res, json.Unmarshal(b, &res)
+}
+
 func (s *persistenceactions) Delete(name string, options *metav1.DeleteOptions) error {
-	return s.client.Delete(name, options)
+	var opts metav1.DeleteOptions
+	if options != nil {
+		opts = *options
+	}
+	return s.client.Delete(context.TODO(), name, opts)
 }
 
 func (s *persistenceactions) List(opts metav1.ListOptions) (runtime.Object, error) {
-	req := s.restClient.Get().
+	b, err := s.restClient.Get().
 		Namespace(s.ns).
-		Resource("persistenceactions").
-		FieldsSelectorParam(nil)
-
-	b, err := req.DoRaw()
+		Resource(TPRPersistenceActionName).
+		VersionedParams(&opts, metav1.ParameterCodec).
+		DoRaw(context.TODO())
 	if err != nil {
 		return nil, err
 	}
@@ -119,19 +149,19 @@ func (s *persistenceactions) List(opts metav1.ListOptions) (runtime.Object, erro
 }
 
 func (s *persistenceactions) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	opts.Watch = true
 	r, err := s.restClient.Get().
-		Prefix("watch").
 		Namespace(s.ns).
-		Resource("persistenceactions").
-		FieldsSelectorParam(nil).
-		Stream()
+		Resource(TPRPersistenceActionName).
+		VersionedParams(&opts, metav1.ParameterCodec).
+		Stream(context.TODO())
 	if err != nil {
 		return nil, err
 	}
 	return watch.NewStreamWatcher(&persistenceActionDecoder{
 		dec:   json.NewDecoder(r),
 		close: r.Close,
-	}), nil
+	}, apierrors.NewClientErrorReporter(http.StatusInternalServerError, "GET", "ClientWatchDecoding")), nil
 }
 
 // PersistenceActionFromUnstructured unmarshals a PersistenceAction object from dynamic client's unstructured
@@ -164,6 +194,7 @@ func UnstructuredFromPersistenceAction(s *PersistenceAction) (*unstructured.Unst
 	return &r, nil
 }
 
+// +k8s:deepcopy-gen=false
 type persistenceActionDecoder struct {
 	dec   *json.Decoder
 	close func() error
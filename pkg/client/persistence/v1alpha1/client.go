@@ -16,9 +16,8 @@ package v1alpha1
 
 import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/pkg/api"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 )
 
@@ -27,9 +26,20 @@ const (
 	TPRVersion = "v1alpha1"
 )
 
+// PersistenceV1alpha1Interface is implemented by PersistenceV1alpha1Client.
+type PersistenceV1alpha1Interface interface {
+	PersistenceActionGetter
+	PersistenceInstanceGetter
+}
+
+// +k8s:deepcopy-gen=false
 type PersistenceV1alpha1Client struct {
 	restClient    rest.Interface
-	dynamicClient *dynamic.Client
+	dynamicClient dynamic.Interface
+}
+
+func (c *PersistenceV1alpha1Client) PersistenceInstances(namespace string) PersistenceInstanceInterface {
+	return newPersistenceInstances(c.restClient, c.dynamicClient, namespace)
 }
 
 func (c *PersistenceV1alpha1Client) PersistenceActions(namespace string) PersistenceActionInterface {
@@ -44,7 +54,7 @@ func NewForConfig(c *rest.Config) (*PersistenceV1alpha1Client, error) {
 		return nil, err
 	}
 
-	dynamicClient, err := dynamic.NewClient(&config)
+	dynamicClient, err := dynamic.NewForConfig(&config)
 	if err != nil {
 		return nil, err
 	}
@@ -58,6 +68,6 @@ func setConfigDefaults(config *rest.Config) {
 		Version: TPRVersion,
 	}
 	config.APIPath = "/apis"
-	config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: api.Codecs}
+	config.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
 	return
 }
@@ -15,11 +15,15 @@
 package v1alpha1
 
 import (
+	"context"
 	"encoding/json"
+	"net/http"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
@@ -38,28 +42,27 @@ type PersistenceInstanceInterface interface {
 	Create(*PersistenceInstance) (*PersistenceInstance, error)
 	Get(name string) (*PersistenceInstance, error)
 	Update(*PersistenceInstance) (*PersistenceInstance, error)
+	UpdateStatus(*PersistenceInstance) (*PersistenceInstance, error)
 	Delete(name string, options *metav1.DeleteOptions) error
 	List(opts metav1.ListOptions) (runtime.Object, error)
 	Watch(opts metav1.ListOptions) (watch.Interface, error)
 }
 
+// +k8s:deepcopy-gen=false
 type persistenceinstances struct {
 	restClient rest.Interface
-	client     *dynamic.ResourceClient
+	client     dynamic.ResourceInterface
 	ns         string
 }
 
-func newPersistenceInstances(r rest.Interface, c *dynamic.Client, namespace string) *persistenceinstances {
+func newPersistenceInstances(r rest.Interface, c dynamic.Interface, namespace string) *persistenceinstances {
 	return &persistenceinstances{
 		r,
-		c.Resource(
-			&metav1.APIResource{
-				Kind:       TPRPersistenceInstancesKind,
-				Name:       TPRPersistenceInstanceName,
-				Namespaced: true,
-			},
-			namespace,
-		),
+		c.Resource(schema.GroupVersionResource{
+			Group:    TPRGroup,
+			Version:  TPRVersion,
+			Resource: TPRPersistenceInstanceName,
+		}).Namespace(namespace),
 		namespace,
 	}
 }
@@ -70,7 +73,7 @@ func (s *persistenceinstances) Create(o *PersistenceInstance) (*PersistenceInsta
 		return nil, err
 	}
 
-	us, err = s.client.Create(us)
+	us, err = s.client.Create(context.TODO(), us, metav1.CreateOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +82,7 @@ func (s *persistenceinstances) Create(o *PersistenceInstance) (*PersistenceInsta
 }
 
 func (s *persistenceinstances) Get(name string) (*PersistenceInstance, error) {
-	obj, err := s.client.Get(name, metav1.GetOptions{})
+	obj, err := s.client.Get(context.TODO(), name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -92,7 +95,7 @@ func (s *persistenceinstances) Update(o *PersistenceInstance) (*PersistenceInsta
 		return nil, err
 	}
 
-	us, err = s.client.Update(us)
+	us, err = s.client.Update(context.TODO(), us, metav1.UpdateOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -100,17 +103,44 @@ func (s *persistenceinstances) Update(o *PersistenceInstance) (*PersistenceInsta
 	return PersistenceInstanceFromUnstructured(us)
 }
 
+// UpdateStatus replaces the status of o through the status subresource.
+// Updates of the object itself ignore its status.
+func (s *persistenceinstances) UpdateStatus(o *PersistenceInstance) (*PersistenceInstance, error) {
+	o.TypeMeta.Kind = TPRPersistenceInstancesKind
+	o.TypeMeta.APIVersion = TPRGroup + "/" + TPRVersion
+	body, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := s.restClient.Put().
+		Namespace(s.ns).
+		Resource(TPRPersistenceInstanceName).
+		Name(o.Name).
+		SubResource("status").
+		Body(body).
+		DoRaw(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	var res PersistenceInstance
+	return &res, json.Unmarshal(b, &res)
+}
+
 func (s *persistenceinstances) Delete(name string, options *metav1.DeleteOptions) error {
-	return s.client.Delete(name, options)
+	var opts metav1.DeleteOptions
+	if options != nil {
+		opts = *options
+	}
+	return s.client.Delete(context.TODO(), name, opts)
 }
 
 func (s *persistenceinstances) List(opts metav1.ListOptions) (runtime.Object, error) {
-	req := s.restClient.Get().
+	b, err := s.restClient.Get().
 		Namespace(s.ns).
-		Resource("persistenceinstances").
-		FieldsSelectorParam(nil)
-
-	b, err := req.DoRaw()
+		Resource(TPRPersistenceInstanceName).
+		VersionedParams(&opts, metav1.ParameterCodec).
+		DoRaw(context.TODO())
 	if err != nil {
 		return nil, err
 	}
@@ -119,19 +149,19 @@ func (s *persistenceinstances) List(opts metav1.ListOptions) (runtime.Object, er
 }
 
 func (s *persistenceinstances) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	opts.Watch = true
 	r, err := s.restClient.Get().
-		Prefix("watch").
 		Namespace(s.ns).
-		Resource("persistenceinstances").
-		FieldsSelectorParam(nil).
-		Stream()
+		Resource(TPRPersistenceInstanceName).
+		VersionedParams(&opts, metav1.ParameterCodec).
+		Stream(context.TODO())
 	if err != nil {
 		return nil, err
 	}
 	return watch.NewStreamWatcher(&persistenceInstanceDecoder{
 		dec:   json.NewDecoder(r),
 		close: r.Close,
-	}), nil
+	}, apierrors.NewClientErrorReporter(http.StatusInternalServerError, "GET", "ClientWatchDecoding")), nil
 }
 
 // PersistenceInstanceFromUnstructured unmarshals a PersistenceInstance object from dynamic client's unstructured
@@ -164,6 +194,7 @@ func UnstructuredFromPersistenceInstance(s *PersistenceInstance) (*unstructured.
 	return &r, nil
 }
 
+// +k8s:deepcopy-gen=false
 type persistenceInstanceDecoder struct {
 	dec   *json.Decoder
 	close func() error
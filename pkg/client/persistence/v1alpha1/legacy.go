@@ -0,0 +1,61 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha1
+
+import (
+	"encoding/json"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// The keys the credentials were read from when PersistenceInstances
+	// named the secrets holding them by usernameSecret and passwordSecret.
+	legacyUsernameKey = "username"
+	legacyPasswordKey = "password"
+)
+
+// UnmarshalJSON decodes a PersistenceInstanceSpec. Specs written before the
+// credentials were referenced by key name the secrets holding them by
+// usernameSecret and passwordSecret. They are decoded into references to the
+// username and password keys of these secrets, unless the new fields are set
+// as well.
+func (s *PersistenceInstanceSpec) UnmarshalJSON(b []byte) error {
+	// spec has the fields of PersistenceInstanceSpec without this method.
+	type spec PersistenceInstanceSpec
+	var in struct {
+		spec
+		UsernameSecret string `json:"usernameSecret"`
+		PasswordSecret string `json:"passwordSecret"`
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	*s = PersistenceInstanceSpec(in.spec)
+	if s.UsernameSecretRef == nil && in.UsernameSecret != "" {
+		s.UsernameSecretRef = &v1.SecretKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: in.UsernameSecret},
+			Key:                  legacyUsernameKey,
+		}
+	}
+	if s.PasswordSecretRef == nil && in.PasswordSecret != "" {
+		s.PasswordSecretRef = &v1.SecretKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: in.PasswordSecret},
+			Key:                  legacyPasswordKey,
+		}
+	}
+	return nil
+}
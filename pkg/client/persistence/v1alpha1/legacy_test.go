@@ -0,0 +1,70 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestUnmarshalLegacyCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		spec               string
+		username, password *v1.SecretKeySelector
+	}{
+		{
+			name: "legacy",
+			spec: `{"persistenceType": "Postgres", "usernameSecret": "db-user", "passwordSecret": "db-pass"}`,
+			username: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "db-user"},
+				Key:                  "username",
+			},
+			password: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "db-pass"},
+				Key:                  "password",
+			},
+		},
+		{
+			name: "references take precedence",
+			spec: `{"persistenceType": "Postgres", "usernameSecret": "db-user", "usernameSecretRef": {"name": "db", "key": "user"}}`,
+			username: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "db"},
+				Key:                  "user",
+			},
+		},
+		{
+			name: "no credentials",
+			spec: `{"persistenceType": "Postgres"}`,
+		},
+	} {
+		var s PersistenceInstanceSpec
+		if err := json.Unmarshal([]byte(tc.spec), &s); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if s.PersistenceType != "Postgres" {
+			t.Errorf("%s: expected the persistence type to be decoded, got %q", tc.name, s.PersistenceType)
+		}
+		if !reflect.DeepEqual(s.UsernameSecretRef, tc.username) {
+			t.Errorf("%s: expected username reference %v, got %v", tc.name, tc.username, s.UsernameSecretRef)
+		}
+		if !reflect.DeepEqual(s.PasswordSecretRef, tc.password) {
+			t.Errorf("%s: expected password reference %v, got %v", tc.name, tc.password, s.PasswordSecretRef)
+		}
+	}
+}
@@ -15,11 +15,12 @@
 package v1alpha1
 
 import (
+	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/pkg/api/v1"
 )
 
 // PersistenceInstanceList is a list of PersistenceInstances.
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type PersistenceInstanceList struct {
 	metav1.TypeMeta `json:",inline"`
 	// Standard list metadata
@@ -30,6 +31,7 @@ type PersistenceInstanceList struct {
 }
 
 // defines a Persistence Instance
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type PersistenceInstance struct {
 	metav1.TypeMeta `json:",inline"`
 	// Standard object’s metadata. More info:
@@ -38,6 +40,10 @@ type PersistenceInstance struct {
 	// Specification of the desired behavior of the PersistenceInstance. More info:
 	// http://releases.k8s.io/HEAD/docs/devel/api-conventions.md#spec-and-status
 	Spec PersistenceInstanceSpec `json:"spec"`
+	// Most recent observed status of the PersistenceInstance. Read-only.
+	// Maintained by the Persistence Operator. More info:
+	// http://releases.k8s.io/HEAD/docs/devel/api-conventions.md#spec-and-status
+	Status *PersistenceInstanceStatus `json:"status,omitempty"`
 }
 
 // Specification of the desired behavior of the PersistenceAction. More info:
@@ -45,19 +51,88 @@ type PersistenceInstance struct {
 type PersistenceInstanceSpec struct {
 	// One of Oracle, Postgres, MySQL, Mongo
 	PersistenceType string `json:"persistenceType"`
-	// The name of the secret containing the username, in the same namespace as the
-	// PersistenceInstance
-	UsernameSecret string `json:"usernameSecret,omitempty"`
-	// The name of the secret containing the password, in the same namespace as the
-	// PersistenceInstance
-	PasswordSecret string `json:"passwordSecret,omitempty"`
+	// The key of the secret containing the username, in the same namespace as the
+	// PersistenceInstance. The deprecated usernameSecret field names a secret
+	// whose username key is referenced.
+	UsernameSecretRef *v1.SecretKeySelector `json:"usernameSecretRef,omitempty"`
+	// The key of the secret containing the password, in the same namespace as the
+	// PersistenceInstance. The deprecated passwordSecret field names a secret
+	// whose password key is referenced.
+	PasswordSecretRef *v1.SecretKeySelector `json:"passwordSecretRef,omitempty"`
 	// The url of the persistence
 	URL string `json:"url"`
 	// The port of the persistence
 	Port int32 `json:"port"`
+	// The database to connect to, or the service name for Oracle
+	Database string `json:"database,omitempty"`
+	// The schema statements are executed in, where the persistence type
+	// distinguishes it from the database
+	Schema string `json:"schema,omitempty"`
+	// Further connection parameters, passed to the driver of the persistence
+	// type as they are
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// The TLS configuration of the connections to the persistence. Connections
+	// use the defaults of the persistence type if unset.
+	TLS *PersistenceInstanceTLS `json:"tls,omitempty"`
+	// Actions run on the instance before it is deleted, in literal order,
+	// e.g. revoking the users granted access to it. The instance is only
+	// deleted once they succeeded, or the
+	// persistence.mmerrill3.com/skip-teardown annotation is set.
+	OnDelete []string `json:"onDelete,omitempty"`
+}
+
+// TLS configuration of the connections to a PersistenceInstance.
+type PersistenceInstanceTLS struct {
+	// One of Disable, Require, VerifyCA, VerifyFull. Require encrypts the
+	// connection without verifying the server certificate, VerifyCA verifies
+	// the server certificate is issued by a trusted CA, VerifyFull also
+	// verifies it matches the server name. Defaults to VerifyFull.
+	Mode string `json:"mode,omitempty"`
+	// The key of the secret containing the PEM encoded CA certificates server
+	// certificates are verified against. Defaults to the system roots.
+	CASecretRef *v1.SecretKeySelector `json:"caSecretRef,omitempty"`
+	// The secret of type kubernetes.io/tls containing the client certificate
+	// and key presented to the server
+	ClientCertSecretRef *v1.LocalObjectReference `json:"clientCertSecretRef,omitempty"`
+	// The name server certificates are verified against. Defaults to the url
+	ServerName string `json:"serverName,omitempty"`
+}
+
+// Most recent observed status of a PersistenceInstance. Read-only.
+// Maintained by the Persistence Operator. More info:
+// http://releases.k8s.io/HEAD/docs/devel/api-conventions.md#spec-and-status
+type PersistenceInstanceStatus struct {
+	// The generation of the instance the status was computed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Represents whether the operator was able to connect to the instance on
+	// the last probe
+	Reachable bool `json:"reachable"`
+	// The version reported by the server of the instance
+	ServerVersion string `json:"serverVersion,omitempty"`
+	// The time the instance was last probed. Probes reporting the same as
+	// the previous one only update it every ten minutes.
+	LastProbeTime *metav1.Time `json:"lastProbeTime,omitempty"`
+	// The current conditions of the instance
+	Conditions []PersistenceCondition `json:"conditions,omitempty"`
+}
+
+// PersistenceCondition describes the state of a persistence resource at a
+// certain point.
+type PersistenceCondition struct {
+	// Type of the condition
+	Type string `json:"type"`
+	// Status of the condition, one of True, False, Unknown
+	Status v1.ConditionStatus `json:"status"`
+	// The last time the condition transitioned from one status to another
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// The reason for the condition's last transition, in CamelCase
+	Reason string `json:"reason,omitempty"`
+	// A human readable message indicating details about the transition
+	Message string `json:"message,omitempty"`
 }
 
 // PersistenceActionList is a list of PersistenceActions.
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type PersistenceActionList struct {
 	metav1.TypeMeta `json:",inline"`
 	// Standard list metadata
@@ -68,6 +143,7 @@ type PersistenceActionList struct {
 }
 
 // defines a Persistence Action
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type PersistenceAction struct {
 	metav1.TypeMeta `json:",inline"`
 	// Standard object’s metadata. More info:
@@ -76,9 +152,8 @@ type PersistenceAction struct {
 	// Specification of the desired behavior of the PersistenceAction. More info:
 	// http://releases.k8s.io/HEAD/docs/devel/api-conventions.md#spec-and-status
 	Spec PersistenceActionSpec `json:"spec"`
-	// Most recent observed status of the PersistenceAction. Read-only. Not
-	// included when requesting from the apiserver, only from the Persistence
-	// Operator API itself. More info:
+	// Most recent observed status of the PersistenceAction. Read-only.
+	// Maintained by the Persistence Operator. More info:
 	// http://releases.k8s.io/HEAD/docs/devel/api-conventions.md#spec-and-status
 	Status *PersistenceActionStatus `json:"status,omitempty"`
 }
@@ -86,9 +161,12 @@ type PersistenceAction struct {
 // Specification of the desired behavior of the PersistenceAction. More info:
 // http://releases.k8s.io/HEAD/docs/devel/api-conventions.md#spec-and-status
 type PersistenceActionSpec struct {
-	// ServiceMonitors to be selected for target discovery.
+	// PersistenceInstances the actions are executed against. The actions run
+	// once on every matching instance.
 	PersistenceInstanceSelector *metav1.LabelSelector `json:"persistenceInstanceSelector,omitempty"`
-	// Whether a persistence action is applied already.  Make it a no-operation
+	// Whether a persistence action is applied already.  Make it a no-operation.
+	// Actions are tracked in a history table within every instance, so this
+	// is only needed for actions applied before that.
 	Applied bool `json:"applied,omitempty"`
 	// Define resources requests and limits for Pods.
 	Resources v1.ResourceRequirements `json:"resources,omitempty"`
@@ -99,21 +177,197 @@ type PersistenceActionSpec struct {
 	ServiceAccountName string `json:"serviceAccountName,omitempty"`
 	// Define which tolerations are appicable for the pods
 	Tolerations []v1.Toleration `json:"tolerations,omitempty"`
-	// The time that the action will be ran
+	// The time that the action will be ran. Defaults to immediately. Mutually
+	// exclusive with Schedule.
 	ApplicationTime *metav1.Time `json:"applicationTime"`
-	// The actual actions to run.  Every value in the list will be executed in literal order
+	// The schedule in Cron format, see https://en.wikipedia.org/wiki/Cron.
+	// If set, the action is ran repeatedly on this schedule, in the time zone
+	// of the kube-controller-manager.
+	Schedule string `json:"schedule,omitempty"`
+	// Suspend subsequent executions of a scheduled action. Executions which
+	// already started are not affected.
+	Suspend bool `json:"suspend,omitempty"`
+	// How to treat concurrent executions of a scheduled action. One of Allow,
+	// Forbid or Replace. Defaults to Forbid.
+	ConcurrencyPolicy string `json:"concurrencyPolicy,omitempty"`
+	// The number of successful executions of a scheduled action to retain.
+	// Defaults to 3.
+	SuccessfulJobsHistoryLimit *int32 `json:"successfulJobsHistoryLimit,omitempty"`
+	// The number of failed executions of a scheduled action to retain.
+	// Defaults to 1.
+	FailedJobsHistoryLimit *int32 `json:"failedJobsHistoryLimit,omitempty"`
+	// The actual actions to run.  Every value in the list will be executed in literal order.
+	// Actions are Go templates, rendered for every instance with the fields
+	// .Action, .Instance and .Values. The function secret looks up the key
+	// of a Secret, e.g. {{ secret "credentials" "password" }}. It reads the
+	// Secrets of ValuesFrom, the credentials of the instance and Secrets
+	// labelled persistence.mmerrill3.com/template=true only.
 	Actions []string `json:"actions"`
+	// Sources of further actions, executed in literal order after Actions.
+	// Changes to the sources are treated like changes to Actions right away.
+	ActionsFrom []PersistenceActionSource `json:"actionsFrom,omitempty"`
+	// Values the actions are rendered with. They take precedence over
+	// ValuesFrom.
+	Values map[string]string `json:"values,omitempty"`
+	// Sources of values the actions are rendered with. Later sources take
+	// precedence over earlier ones. Changes to the sources are treated like
+	// changes to Values right away.
+	ValuesFrom []PersistenceActionValuesSource `json:"valuesFrom,omitempty"`
+	// How changes to actions which are applied already are treated. One of
+	// Fail, reporting the change by the ChecksumMismatch condition, Reapply,
+	// applying the changed actions again, or Ignore. Defaults to Fail.
+	ChecksumPolicy string `json:"checksumPolicy,omitempty"`
+	// The version of the actions, recorded along with them in the history
+	// table of every instance they are applied to.
+	Version string `json:"version,omitempty"`
+	// The actions reverting Actions, executed in literal order. They are run
+	// on the instances the action is applied to once the
+	// persistence.mmerrill3.com/rollback annotation is set on the action.
+	RollbackActions []string `json:"rollbackActions,omitempty"`
+	// Actions run on the selected instances the action is applied to before
+	// it is deleted, in literal order, e.g. dropping a tenant schema. They are
+	// rendered like Actions. The action is only deleted once they succeeded
+	// on every instance, or the persistence.mmerrill3.com/skip-teardown
+	// annotation is set.
+	OnDelete []string `json:"onDelete,omitempty"`
+	// Run RollbackActions when Actions fail part way. Only applies to
+	// persistence types which can't revert failed actions by rolling back a
+	// transaction.
+	AutoRollback bool `json:"autoRollback,omitempty"`
+	// PersistenceActions of the same namespace which have to be applied on an
+	// instance before this action is executed on it.
+	DependsOn []PersistenceActionDependency `json:"dependsOn,omitempty"`
+	// Only plan the actions instead of executing them. The plan is reported
+	// in the status of the action.
+	DryRun bool `json:"dryRun,omitempty"`
+	// How the actions are executed. One of Job, running them in a Job using
+	// the executor image of the persistence type, or InProcess, running them
+	// directly from the operator. Defaults to the executor configured for the
+	// operator.
+	Executor string `json:"executor,omitempty"`
+}
+
+// A source of actions. Exactly one of its fields must be set.
+type PersistenceActionSource struct {
+	// Selects a key of a ConfigMap holding an action
+	ConfigMapKeyRef *v1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+	// Selects a key of a Secret holding an action, e.g. for statements
+	// containing credentials. Such statements are redacted from the status.
+	SecretKeyRef *v1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+	// Selects the keys of a ConfigMap holding actions, in lexical order
+	ConfigMapKeysRef *PersistenceActionKeysSelector `json:"configMapKeysRef,omitempty"`
+	// Selects the keys of a Secret holding actions, in lexical order
+	SecretKeysRef *PersistenceActionKeysSelector `json:"secretKeysRef,omitempty"`
+}
+
+// Selects the keys of a ConfigMap or Secret.
+type PersistenceActionKeysSelector struct {
+	// The name of the ConfigMap or Secret
+	Name string `json:"name"`
+	// The glob keys have to match, e.g. "V*.sql". Defaults to all keys.
+	Pattern string `json:"pattern,omitempty"`
 }
 
-// Most recent observed status of a PersistenceAction. Read-only. Not
-// included when requesting from the apiserver, only from the Persistence
-// Operator API itself. More info:
+// A source of values. Every key of the referenced object becomes a value.
+// Exactly one of its fields must be set.
+type PersistenceActionValuesSource struct {
+	// The ConfigMap to read values from
+	ConfigMapRef *v1.LocalObjectReference `json:"configMapRef,omitempty"`
+	// The Secret to read values from. Rendered actions containing them are
+	// redacted from the status.
+	SecretRef *v1.LocalObjectReference `json:"secretRef,omitempty"`
+}
+
+// A reference to the PersistenceActions another one depends on.
+type PersistenceActionDependency struct {
+	// The name of the PersistenceAction
+	Name string `json:"name,omitempty"`
+	// Selects PersistenceActions by their labels
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// Most recent observed status of a PersistenceAction. Read-only.
+// Maintained by the Persistence Operator. More info:
 // http://releases.k8s.io/HEAD/docs/devel/api-conventions.md#spec-and-status
 type PersistenceActionStatus struct {
-	// Represents whether the action has been performed
-	Applied bool `json:"paused"`
+	// The generation of the action the status was computed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Represents whether the action has been performed on every selected
+	// instance
+	Applied bool `json:"applied"`
 	// The time that the action started exectuion
 	ExecutionTime *metav1.Time `json:"executionTime"`
 	// The time that the action completed
 	CompletionTime *metav1.Time `json:"completionTime"`
+	// The number of attempts made to perform the action
+	Attempts int32 `json:"attempts,omitempty"`
+	// A human readable message indicating why the action failed
+	Reason string `json:"reason,omitempty"`
+	// The current conditions of the action
+	Conditions []PersistenceCondition `json:"conditions,omitempty"`
+	// The progress of the action on every selected PersistenceInstance
+	Instances []PersistenceActionInstanceStatus `json:"instances,omitempty"`
+	// What the action would do. Only reported for dry runs.
+	Plan *PersistenceActionPlan `json:"plan,omitempty"`
+}
+
+// Most recent observed status of a PersistenceAction on a single
+// PersistenceInstance.
+type PersistenceActionInstanceStatus struct {
+	// The name of the PersistenceInstance
+	Instance string `json:"instance"`
+	// Represents whether the action has been performed on the instance
+	Applied bool `json:"applied"`
+	// The time that the action started exectuion on the instance
+	ExecutionTime *metav1.Time `json:"executionTime,omitempty"`
+	// The time that the action completed on the instance
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// The number of attempts made to perform the action on the instance
+	Attempts int32 `json:"attempts,omitempty"`
+	// A human readable message indicating why the action failed on the
+	// instance
+	Reason string `json:"reason,omitempty"`
+	// The checksum of the actions applied to the instance
+	Checksum string `json:"checksum,omitempty"`
+	// Represents whether the action has been rolled back on the instance
+	RolledBack bool `json:"rolledBack,omitempty"`
+	// The time that the rollback finished on the instance
+	RollbackTime *metav1.Time `json:"rollbackTime,omitempty"`
+	// The outcome of every executed statement, in order. Only recorded by
+	// the InProcess executor.
+	Statements []StatementStatus `json:"statements,omitempty"`
+}
+
+// The outcome of a single statement of an action.
+type StatementStatus struct {
+	// The statement, truncated if it is overly long
+	Statement string `json:"statement"`
+	// Represents whether the statement succeeded
+	Succeeded bool `json:"succeeded"`
+	// How long the statement took to execute
+	Duration metav1.Duration `json:"duration"`
+	// The error returned by the database if the statement failed
+	Error string `json:"error,omitempty"`
+}
+
+// What a PersistenceAction would do if it was executed.
+type PersistenceActionPlan struct {
+	// The plan for every selected PersistenceInstance
+	Instances []PersistenceActionInstancePlan `json:"instances"`
+	// Potential problems with the actions
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// What a PersistenceAction would do on a single PersistenceInstance.
+type PersistenceActionInstancePlan struct {
+	// The name of the PersistenceInstance
+	Instance string `json:"instance"`
+	// The statements which would be executed, in order
+	Statements []string `json:"statements,omitempty"`
+	// Whether the history table of the instance records the action as
+	// applied already, in which case nothing would be executed
+	Applied bool `json:"applied"`
+	// A human readable message indicating why the plan is incomplete, e.g.
+	// because the history table of the instance could not be read
+	Reason string `json:"reason,omitempty"`
 }
@@ -0,0 +1,353 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1beta1
+
+import (
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+)
+
+// Every field of v1alpha1 has a counterpart in v1beta1 and vice versa, so
+// objects convert back and forth without loss. The converted objects share
+// maps, slices and pointers with the objects they were converted from, so
+// neither may be modified while the other is in use. Objects from an
+// informer cache have to be deep copied before they are converted.
+
+// PersistenceInstanceFromV1alpha1 converts a v1alpha1 PersistenceInstance.
+// The result shares memory with in.
+func PersistenceInstanceFromV1alpha1(in *v1alpha1.PersistenceInstance) *PersistenceInstance {
+	out := &PersistenceInstance{
+		ObjectMeta: in.ObjectMeta,
+		Spec: PersistenceInstanceSpec{
+			Type:       PersistenceType(in.Spec.PersistenceType),
+			Host:       in.Spec.URL,
+			Port:       in.Spec.Port,
+			Database:   in.Spec.Database,
+			Schema:     in.Spec.Schema,
+			Parameters: in.Spec.Parameters,
+			OnDelete:   in.Spec.OnDelete,
+			Credentials: Credentials{
+				UsernameSecretRef: in.Spec.UsernameSecretRef,
+				PasswordSecretRef: in.Spec.PasswordSecretRef,
+			},
+		},
+	}
+	out.Kind = PersistenceInstanceKind
+	out.APIVersion = Group + "/" + Version
+	if t := in.Spec.TLS; t != nil {
+		out.Spec.TLS = &TLS{
+			Mode:                TLSMode(t.Mode),
+			CASecretRef:         t.CASecretRef,
+			ClientCertSecretRef: t.ClientCertSecretRef,
+			ServerName:          t.ServerName,
+		}
+	}
+	if s := in.Status; s != nil {
+		out.Status = &PersistenceInstanceStatus{
+			ObservedGeneration: s.ObservedGeneration,
+			Reachable:          s.Reachable,
+			ServerVersion:      s.ServerVersion,
+			LastProbeTime:      s.LastProbeTime,
+			Conditions:         conditionsFromV1alpha1(s.Conditions),
+		}
+	}
+	return out
+}
+
+// PersistenceInstanceToV1alpha1 converts a PersistenceInstance to v1alpha1.
+// The result shares memory with in.
+func PersistenceInstanceToV1alpha1(in *PersistenceInstance) *v1alpha1.PersistenceInstance {
+	out := &v1alpha1.PersistenceInstance{
+		ObjectMeta: in.ObjectMeta,
+		Spec: v1alpha1.PersistenceInstanceSpec{
+			PersistenceType:   string(in.Spec.Type),
+			UsernameSecretRef: in.Spec.Credentials.UsernameSecretRef,
+			PasswordSecretRef: in.Spec.Credentials.PasswordSecretRef,
+			URL:               in.Spec.Host,
+			Port:              in.Spec.Port,
+			Database:          in.Spec.Database,
+			Schema:            in.Spec.Schema,
+			Parameters:        in.Spec.Parameters,
+			OnDelete:          in.Spec.OnDelete,
+		},
+	}
+	out.Kind = v1alpha1.TPRPersistenceInstancesKind
+	out.APIVersion = v1alpha1.TPRGroup + "/" + v1alpha1.TPRVersion
+	if t := in.Spec.TLS; t != nil {
+		out.Spec.TLS = &v1alpha1.PersistenceInstanceTLS{
+			Mode:                string(t.Mode),
+			CASecretRef:         t.CASecretRef,
+			ClientCertSecretRef: t.ClientCertSecretRef,
+			ServerName:          t.ServerName,
+		}
+	}
+	if s := in.Status; s != nil {
+		out.Status = &v1alpha1.PersistenceInstanceStatus{
+			ObservedGeneration: s.ObservedGeneration,
+			Reachable:          s.Reachable,
+			ServerVersion:      s.ServerVersion,
+			LastProbeTime:      s.LastProbeTime,
+			Conditions:         conditionsToV1alpha1(s.Conditions),
+		}
+	}
+	return out
+}
+
+// PersistenceActionFromV1alpha1 converts a v1alpha1 PersistenceAction. The
+// result shares memory with in.
+func PersistenceActionFromV1alpha1(in *v1alpha1.PersistenceAction) *PersistenceAction {
+	s := &in.Spec
+	out := &PersistenceAction{
+		ObjectMeta: in.ObjectMeta,
+		Spec: PersistenceActionSpec{
+			InstanceSelector: s.PersistenceInstanceSelector,
+			Applied:          s.Applied,
+			Executor:         Executor(s.Executor),
+			DryRun:           s.DryRun,
+			Actions:          s.Actions,
+			Values:           s.Values,
+			Version:          s.Version,
+			ChecksumPolicy:   ChecksumPolicy(s.ChecksumPolicy),
+			RollbackActions:  s.RollbackActions,
+			OnDelete:         s.OnDelete,
+			AutoRollback:     s.AutoRollback,
+			ApplicationTime:  s.ApplicationTime,
+			Schedule: Schedule{
+				Cron:                       s.Schedule,
+				Suspend:                    s.Suspend,
+				ConcurrencyPolicy:          ConcurrencyPolicy(s.ConcurrencyPolicy),
+				SuccessfulJobsHistoryLimit: s.SuccessfulJobsHistoryLimit,
+				FailedJobsHistoryLimit:     s.FailedJobsHistoryLimit,
+			},
+			Pod: PodSettings{
+				Resources:          s.Resources,
+				NodeSelector:       s.NodeSelector,
+				ServiceAccountName: s.ServiceAccountName,
+				Tolerations:        s.Tolerations,
+			},
+		},
+	}
+	out.Kind = PersistenceActionKind
+	out.APIVersion = Group + "/" + Version
+	if s.ActionsFrom != nil {
+		out.Spec.ActionsFrom = make([]ActionSource, len(s.ActionsFrom))
+		for i, src := range s.ActionsFrom {
+			out.Spec.ActionsFrom[i] = ActionSource{
+				ConfigMapKeyRef:  src.ConfigMapKeyRef,
+				SecretKeyRef:     src.SecretKeyRef,
+				ConfigMapKeysRef: (*KeysSelector)(src.ConfigMapKeysRef),
+				SecretKeysRef:    (*KeysSelector)(src.SecretKeysRef),
+			}
+		}
+	}
+	if s.ValuesFrom != nil {
+		out.Spec.ValuesFrom = make([]ValuesSource, len(s.ValuesFrom))
+		for i, src := range s.ValuesFrom {
+			out.Spec.ValuesFrom[i] = ValuesSource(src)
+		}
+	}
+	if s.DependsOn != nil {
+		out.Spec.DependsOn = make([]Dependency, len(s.DependsOn))
+		for i, d := range s.DependsOn {
+			out.Spec.DependsOn[i] = Dependency(d)
+		}
+	}
+	if st := in.Status; st != nil {
+		out.Status = &PersistenceActionStatus{
+			ObservedGeneration: st.ObservedGeneration,
+			Applied:            st.Applied,
+			ExecutionTime:      st.ExecutionTime,
+			CompletionTime:     st.CompletionTime,
+			Attempts:           st.Attempts,
+			Reason:             st.Reason,
+			Conditions:         conditionsFromV1alpha1(st.Conditions),
+		}
+		if st.Instances != nil {
+			out.Status.Instances = make([]InstanceStatus, len(st.Instances))
+			for i, is := range st.Instances {
+				out.Status.Instances[i] = instanceStatusFromV1alpha1(is)
+			}
+		}
+		if p := st.Plan; p != nil {
+			out.Status.Plan = &Plan{Warnings: p.Warnings}
+			if p.Instances != nil {
+				out.Status.Plan.Instances = make([]InstancePlan, len(p.Instances))
+				for i, ip := range p.Instances {
+					out.Status.Plan.Instances[i] = InstancePlan(ip)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// PersistenceActionToV1alpha1 converts a PersistenceAction to v1alpha1. The
+// result shares memory with in.
+func PersistenceActionToV1alpha1(in *PersistenceAction) *v1alpha1.PersistenceAction {
+	s := &in.Spec
+	out := &v1alpha1.PersistenceAction{
+		ObjectMeta: in.ObjectMeta,
+		Spec: v1alpha1.PersistenceActionSpec{
+			PersistenceInstanceSelector: s.InstanceSelector,
+			Applied:                     s.Applied,
+			Resources:                   s.Pod.Resources,
+			NodeSelector:                s.Pod.NodeSelector,
+			ServiceAccountName:          s.Pod.ServiceAccountName,
+			Tolerations:                 s.Pod.Tolerations,
+			ApplicationTime:             s.ApplicationTime,
+			Schedule:                    s.Schedule.Cron,
+			Suspend:                     s.Schedule.Suspend,
+			ConcurrencyPolicy:           string(s.Schedule.ConcurrencyPolicy),
+			SuccessfulJobsHistoryLimit:  s.Schedule.SuccessfulJobsHistoryLimit,
+			FailedJobsHistoryLimit:      s.Schedule.FailedJobsHistoryLimit,
+			Actions:                     s.Actions,
+			Values:                      s.Values,
+			ChecksumPolicy:              string(s.ChecksumPolicy),
+			Version:                     s.Version,
+			RollbackActions:             s.RollbackActions,
+			OnDelete:                    s.OnDelete,
+			AutoRollback:                s.AutoRollback,
+			DryRun:                      s.DryRun,
+			Executor:                    string(s.Executor),
+		},
+	}
+	out.Kind = v1alpha1.TPRPersistenceActionsKind
+	out.APIVersion = v1alpha1.TPRGroup + "/" + v1alpha1.TPRVersion
+	if s.ActionsFrom != nil {
+		out.Spec.ActionsFrom = make([]v1alpha1.PersistenceActionSource, len(s.ActionsFrom))
+		for i, src := range s.ActionsFrom {
+			out.Spec.ActionsFrom[i] = v1alpha1.PersistenceActionSource{
+				ConfigMapKeyRef:  src.ConfigMapKeyRef,
+				SecretKeyRef:     src.SecretKeyRef,
+				ConfigMapKeysRef: (*v1alpha1.PersistenceActionKeysSelector)(src.ConfigMapKeysRef),
+				SecretKeysRef:    (*v1alpha1.PersistenceActionKeysSelector)(src.SecretKeysRef),
+			}
+		}
+	}
+	if s.ValuesFrom != nil {
+		out.Spec.ValuesFrom = make([]v1alpha1.PersistenceActionValuesSource, len(s.ValuesFrom))
+		for i, src := range s.ValuesFrom {
+			out.Spec.ValuesFrom[i] = v1alpha1.PersistenceActionValuesSource(src)
+		}
+	}
+	if s.DependsOn != nil {
+		out.Spec.DependsOn = make([]v1alpha1.PersistenceActionDependency, len(s.DependsOn))
+		for i, d := range s.DependsOn {
+			out.Spec.DependsOn[i] = v1alpha1.PersistenceActionDependency(d)
+		}
+	}
+	if st := in.Status; st != nil {
+		out.Status = &v1alpha1.PersistenceActionStatus{
+			ObservedGeneration: st.ObservedGeneration,
+			Applied:            st.Applied,
+			ExecutionTime:      st.ExecutionTime,
+			CompletionTime:     st.CompletionTime,
+			Attempts:           st.Attempts,
+			Reason:             st.Reason,
+			Conditions:         conditionsToV1alpha1(st.Conditions),
+		}
+		if st.Instances != nil {
+			out.Status.Instances = make([]v1alpha1.PersistenceActionInstanceStatus, len(st.Instances))
+			for i, is := range st.Instances {
+				out.Status.Instances[i] = instanceStatusToV1alpha1(is)
+			}
+		}
+		if p := st.Plan; p != nil {
+			out.Status.Plan = &v1alpha1.PersistenceActionPlan{Warnings: p.Warnings}
+			if p.Instances != nil {
+				out.Status.Plan.Instances = make([]v1alpha1.PersistenceActionInstancePlan, len(p.Instances))
+				for i, ip := range p.Instances {
+					out.Status.Plan.Instances[i] = v1alpha1.PersistenceActionInstancePlan(ip)
+				}
+			}
+		}
+	}
+	return out
+}
+
+func conditionsFromV1alpha1(in []v1alpha1.PersistenceCondition) []Condition {
+	if in == nil {
+		return nil
+	}
+	out := make([]Condition, len(in))
+	for i, c := range in {
+		out[i] = Condition{
+			Type:               ConditionType(c.Type),
+			Status:             c.Status,
+			LastTransitionTime: c.LastTransitionTime,
+			Reason:             c.Reason,
+			Message:            c.Message,
+		}
+	}
+	return out
+}
+
+func conditionsToV1alpha1(in []Condition) []v1alpha1.PersistenceCondition {
+	if in == nil {
+		return nil
+	}
+	out := make([]v1alpha1.PersistenceCondition, len(in))
+	for i, c := range in {
+		out[i] = v1alpha1.PersistenceCondition{
+			Type:               string(c.Type),
+			Status:             c.Status,
+			LastTransitionTime: c.LastTransitionTime,
+			Reason:             c.Reason,
+			Message:            c.Message,
+		}
+	}
+	return out
+}
+
+func instanceStatusFromV1alpha1(in v1alpha1.PersistenceActionInstanceStatus) InstanceStatus {
+	out := InstanceStatus{
+		Instance:       in.Instance,
+		Applied:        in.Applied,
+		ExecutionTime:  in.ExecutionTime,
+		CompletionTime: in.CompletionTime,
+		Attempts:       in.Attempts,
+		Reason:         in.Reason,
+		Checksum:       in.Checksum,
+		RolledBack:     in.RolledBack,
+		RollbackTime:   in.RollbackTime,
+	}
+	if in.Statements != nil {
+		out.Statements = make([]StatementStatus, len(in.Statements))
+		for i, s := range in.Statements {
+			out.Statements[i] = StatementStatus(s)
+		}
+	}
+	return out
+}
+
+func instanceStatusToV1alpha1(in InstanceStatus) v1alpha1.PersistenceActionInstanceStatus {
+	out := v1alpha1.PersistenceActionInstanceStatus{
+		Instance:       in.Instance,
+		Applied:        in.Applied,
+		ExecutionTime:  in.ExecutionTime,
+		CompletionTime: in.CompletionTime,
+		Attempts:       in.Attempts,
+		Reason:         in.Reason,
+		Checksum:       in.Checksum,
+		RolledBack:     in.RolledBack,
+		RollbackTime:   in.RollbackTime,
+	}
+	if in.Statements != nil {
+		out.Statements = make([]v1alpha1.StatementStatus, len(in.Statements))
+		for i, s := range in.Statements {
+			out.Statements[i] = v1alpha1.StatementStatus(s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1beta1
+
+import (
+	"reflect"
+	"testing"
+
+	fuzz "github.com/google/gofuzz"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+)
+
+const fuzzIterations = 200
+
+// newFuzzer returns a fuzzer filling every field, so that all of them have to
+// survive the round trip.
+func newFuzzer() *fuzz.Fuzzer {
+	return fuzz.NewWithSeed(1).NilChance(0)
+}
+
+func TestPersistenceInstanceRoundTrip(t *testing.T) {
+	f := newFuzzer()
+	for i := 0; i < fuzzIterations; i++ {
+		var alpha v1alpha1.PersistenceInstance
+		f.Fuzz(&alpha)
+		alpha.Kind = v1alpha1.TPRPersistenceInstancesKind
+		alpha.APIVersion = v1alpha1.TPRGroup + "/" + v1alpha1.TPRVersion
+		if got := PersistenceInstanceToV1alpha1(PersistenceInstanceFromV1alpha1(&alpha)); !reflect.DeepEqual(got, &alpha) {
+			t.Fatalf("v1alpha1 PersistenceInstance changed in the round trip:\n%+v\nbecame\n%+v", alpha, *got)
+		}
+
+		var beta PersistenceInstance
+		f.Fuzz(&beta)
+		beta.Kind = PersistenceInstanceKind
+		beta.APIVersion = Group + "/" + Version
+		if got := PersistenceInstanceFromV1alpha1(PersistenceInstanceToV1alpha1(&beta)); !reflect.DeepEqual(got, &beta) {
+			t.Fatalf("v1beta1 PersistenceInstance changed in the round trip:\n%+v\nbecame\n%+v", beta, *got)
+		}
+	}
+}
+
+func TestPersistenceActionRoundTrip(t *testing.T) {
+	f := newFuzzer()
+	for i := 0; i < fuzzIterations; i++ {
+		var alpha v1alpha1.PersistenceAction
+		f.Fuzz(&alpha)
+		alpha.Kind = v1alpha1.TPRPersistenceActionsKind
+		alpha.APIVersion = v1alpha1.TPRGroup + "/" + v1alpha1.TPRVersion
+		if got := PersistenceActionToV1alpha1(PersistenceActionFromV1alpha1(&alpha)); !reflect.DeepEqual(got, &alpha) {
+			t.Fatalf("v1alpha1 PersistenceAction changed in the round trip:\n%+v\nbecame\n%+v", alpha, *got)
+		}
+
+		var beta PersistenceAction
+		f.Fuzz(&beta)
+		beta.Kind = PersistenceActionKind
+		beta.APIVersion = Group + "/" + Version
+		if got := PersistenceActionFromV1alpha1(PersistenceActionToV1alpha1(&beta)); !reflect.DeepEqual(got, &beta) {
+			t.Fatalf("v1beta1 PersistenceAction changed in the round trip:\n%+v\nbecame\n%+v", beta, *got)
+		}
+	}
+}
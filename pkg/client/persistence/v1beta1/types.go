@@ -0,0 +1,371 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package v1beta1 contains the v1beta1 API of the persistence operator. It
+// cleans up the v1alpha1 types, which are converted to and from it without
+// loss, see conversion.go.
+package v1beta1
+
+import (
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	Group   = "persistence.mmerrill3.com"
+	Version = "v1beta1"
+
+	PersistenceInstanceKind = "PersistenceInstance"
+	PersistenceActionKind   = "PersistenceAction"
+)
+
+// PersistenceType is the kind of database a PersistenceInstance is.
+type PersistenceType string
+
+// The persistence types supported by the operator. They are matched
+// case-insensitively.
+const (
+	PersistenceTypeOracle   PersistenceType = "Oracle"
+	PersistenceTypePostgres PersistenceType = "Postgres"
+	PersistenceTypeMySQL    PersistenceType = "MySQL"
+	PersistenceTypeMongo    PersistenceType = "Mongo"
+	PersistenceTypeSQLite   PersistenceType = "SQLite"
+)
+
+// TLSMode is how the connections to a PersistenceInstance are secured.
+type TLSMode string
+
+const (
+	// TLSModeDisable connects without TLS.
+	TLSModeDisable TLSMode = "Disable"
+	// TLSModeRequire encrypts the connection without verifying the server
+	// certificate.
+	TLSModeRequire TLSMode = "Require"
+	// TLSModeVerifyCA verifies the server certificate is issued by a trusted
+	// CA.
+	TLSModeVerifyCA TLSMode = "VerifyCA"
+	// TLSModeVerifyFull verifies the server certificate is issued by a
+	// trusted CA and matches the server name.
+	TLSModeVerifyFull TLSMode = "VerifyFull"
+)
+
+// ConditionType is the type of a Condition.
+type ConditionType string
+
+const (
+	// ConditionReachable is true if the operator could connect to an
+	// instance on the last probe.
+	ConditionReachable ConditionType = "Reachable"
+	// ConditionValid is true if an instance is configured correctly.
+	ConditionValid ConditionType = "Valid"
+	// ConditionChecksumMismatch is true if an action changed after it was
+	// applied.
+	ConditionChecksumMismatch ConditionType = "ChecksumMismatch"
+	// ConditionDependencyCycle is true if an action depends on itself.
+	ConditionDependencyCycle ConditionType = "DependencyCycle"
+)
+
+// Executor runs the actions of a PersistenceAction.
+type Executor string
+
+const (
+	// ExecutorJob runs actions in a Job per instance.
+	ExecutorJob Executor = "Job"
+	// ExecutorInProcess runs actions from within the operator.
+	ExecutorInProcess Executor = "InProcess"
+)
+
+// ChecksumPolicy is how changes to actions which are applied already are
+// handled.
+type ChecksumPolicy string
+
+const (
+	// ChecksumPolicyFail reports changed actions without applying them.
+	ChecksumPolicyFail ChecksumPolicy = "Fail"
+	// ChecksumPolicyReapply applies changed actions again.
+	ChecksumPolicyReapply ChecksumPolicy = "Reapply"
+	// ChecksumPolicyIgnore ignores changes to actions.
+	ChecksumPolicyIgnore ChecksumPolicy = "Ignore"
+)
+
+// ConcurrencyPolicy is how concurrent executions of a scheduled action are
+// handled.
+type ConcurrencyPolicy string
+
+const (
+	// ConcurrencyPolicyAllow allows executions to run concurrently.
+	ConcurrencyPolicyAllow ConcurrencyPolicy = "Allow"
+	// ConcurrencyPolicyForbid skips an execution while the previous one is
+	// still running.
+	ConcurrencyPolicyForbid ConcurrencyPolicy = "Forbid"
+	// ConcurrencyPolicyReplace cancels the running execution in favour of
+	// the new one.
+	ConcurrencyPolicyReplace ConcurrencyPolicy = "Replace"
+)
+
+// PersistenceInstanceList is a list of PersistenceInstances.
+type PersistenceInstanceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PersistenceInstance `json:"items"`
+}
+
+// PersistenceInstance is a database actions are applied to.
+type PersistenceInstance struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              PersistenceInstanceSpec    `json:"spec"`
+	Status            *PersistenceInstanceStatus `json:"status,omitempty"`
+}
+
+// PersistenceInstanceSpec is the desired state of a PersistenceInstance.
+type PersistenceInstanceSpec struct {
+	// The kind of database
+	Type PersistenceType `json:"type"`
+	// The host name of the database, or the path of the database file for
+	// SQLite
+	Host string `json:"host"`
+	// The port of the database
+	Port int32 `json:"port,omitempty"`
+	// The database to connect to, or the service name for Oracle
+	Database string `json:"database,omitempty"`
+	// The schema statements are executed in, where the persistence type
+	// distinguishes it from the database
+	Schema string `json:"schema,omitempty"`
+	// Further connection parameters, passed to the driver as they are
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// The credentials to connect with
+	Credentials Credentials `json:"credentials,omitempty"`
+	// The TLS configuration of the connections. Connections use the defaults
+	// of the persistence type if unset.
+	TLS *TLS `json:"tls,omitempty"`
+	// The actions run on the instance before it is deleted
+	OnDelete []string `json:"onDelete,omitempty"`
+}
+
+// Credentials reference the secret keys containing the username and
+// password, in the namespace of the PersistenceInstance.
+type Credentials struct {
+	UsernameSecretRef *v1.SecretKeySelector `json:"usernameSecretRef,omitempty"`
+	PasswordSecretRef *v1.SecretKeySelector `json:"passwordSecretRef,omitempty"`
+}
+
+// TLS is the TLS configuration of the connections to a PersistenceInstance.
+type TLS struct {
+	// Defaults to VerifyFull
+	Mode TLSMode `json:"mode,omitempty"`
+	// The key of the secret containing the PEM encoded CA certificates.
+	// Defaults to the system roots.
+	CASecretRef *v1.SecretKeySelector `json:"caSecretRef,omitempty"`
+	// The secret of type kubernetes.io/tls containing the client certificate
+	// and key
+	ClientCertSecretRef *v1.LocalObjectReference `json:"clientCertSecretRef,omitempty"`
+	// The name server certificates are verified against. Defaults to the
+	// host.
+	ServerName string `json:"serverName,omitempty"`
+}
+
+// PersistenceInstanceStatus is the observed state of a PersistenceInstance.
+type PersistenceInstanceStatus struct {
+	// The generation of the instance the status was computed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Whether the operator could connect to the instance on the last probe
+	Reachable bool `json:"reachable"`
+	// The version reported by the server
+	ServerVersion string `json:"serverVersion,omitempty"`
+	// The time the instance was last probed. Probes reporting the same as
+	// the previous one only update it every ten minutes.
+	LastProbeTime *metav1.Time `json:"lastProbeTime,omitempty"`
+	Conditions    []Condition  `json:"conditions,omitempty"`
+}
+
+// Condition describes the state of a persistence resource at a certain point.
+type Condition struct {
+	Type               ConditionType      `json:"type"`
+	Status             v1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time        `json:"lastTransitionTime,omitempty"`
+	// A machine readable explanation of the last transition
+	Reason string `json:"reason,omitempty"`
+	// A human readable explanation of the last transition
+	Message string `json:"message,omitempty"`
+}
+
+// PersistenceActionList is a list of PersistenceActions.
+type PersistenceActionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PersistenceAction `json:"items"`
+}
+
+// PersistenceAction is a set of actions applied to the selected
+// PersistenceInstances.
+type PersistenceAction struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              PersistenceActionSpec    `json:"spec"`
+	Status            *PersistenceActionStatus `json:"status,omitempty"`
+}
+
+// PersistenceActionSpec is the desired state of a PersistenceAction.
+type PersistenceActionSpec struct {
+	// Selects the instances the actions are applied to
+	InstanceSelector *metav1.LabelSelector `json:"instanceSelector,omitempty"`
+	// Marks the action as applied, it is not executed anymore
+	Applied bool `json:"applied,omitempty"`
+	// Defaults to the executor the operator is configured with
+	Executor Executor `json:"executor,omitempty"`
+	// Only plan the execution, see the plan in the status
+	DryRun bool `json:"dryRun,omitempty"`
+	// The actions, executed in literal order. Actions are Go templates,
+	// rendered for every instance with the fields .Action, .Instance and
+	// .Values. The function secret reads the Secrets of ValuesFrom, the
+	// credentials of the instance and Secrets labelled
+	// persistence.mmerrill3.com/template=true.
+	Actions []string `json:"actions,omitempty"`
+	// Actions read from ConfigMaps and Secrets, appended to Actions. Changes
+	// to the sources are applied right away
+	ActionsFrom []ActionSource `json:"actionsFrom,omitempty"`
+	// Values passed to the templates
+	Values map[string]string `json:"values,omitempty"`
+	// Values read from ConfigMaps and Secrets, overridden by Values. Changes
+	// to the sources are applied right away
+	ValuesFrom []ValuesSource `json:"valuesFrom,omitempty"`
+	// The version of the actions, recorded in the history table
+	Version string `json:"version,omitempty"`
+	// Defaults to Fail
+	ChecksumPolicy ChecksumPolicy `json:"checksumPolicy,omitempty"`
+	// The actions reverting Actions
+	RollbackActions []string `json:"rollbackActions,omitempty"`
+	// The actions run on the instances the action is applied to before it
+	// is deleted
+	OnDelete []string `json:"onDelete,omitempty"`
+	// Whether to run RollbackActions when Actions fail part way on a
+	// non-transactional persistence type
+	AutoRollback bool `json:"autoRollback,omitempty"`
+	// The actions which have to be applied first
+	DependsOn []Dependency `json:"dependsOn,omitempty"`
+	// The time the actions are applied at. Defaults to immediately.
+	ApplicationTime *metav1.Time `json:"applicationTime,omitempty"`
+	// Repeats the actions on a schedule
+	Schedule Schedule `json:"schedule,omitempty"`
+	// The pods executing the actions with the Job executor
+	Pod PodSettings `json:"pod,omitempty"`
+}
+
+// Schedule repeats a PersistenceAction.
+type Schedule struct {
+	// The schedule in cron format, in the time zone of the controller
+	// manager. The actions are applied once if empty.
+	Cron string `json:"cron,omitempty"`
+	// Suspends subsequent executions
+	Suspend bool `json:"suspend,omitempty"`
+	// Defaults to Forbid
+	ConcurrencyPolicy ConcurrencyPolicy `json:"concurrencyPolicy,omitempty"`
+	// The number of successful executions to keep. Defaults to 3.
+	SuccessfulJobsHistoryLimit *int32 `json:"successfulJobsHistoryLimit,omitempty"`
+	// The number of failed executions to keep. Defaults to 1.
+	FailedJobsHistoryLimit *int32 `json:"failedJobsHistoryLimit,omitempty"`
+}
+
+// PodSettings configure the pods executing a PersistenceAction.
+type PodSettings struct {
+	Resources          v1.ResourceRequirements `json:"resources,omitempty"`
+	NodeSelector       map[string]string       `json:"nodeSelector,omitempty"`
+	ServiceAccountName string                  `json:"serviceAccountName,omitempty"`
+	Tolerations        []v1.Toleration         `json:"tolerations,omitempty"`
+}
+
+// ActionSource is a source of actions. Exactly one of its fields must be set.
+type ActionSource struct {
+	ConfigMapKeyRef  *v1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+	SecretKeyRef     *v1.SecretKeySelector    `json:"secretKeyRef,omitempty"`
+	ConfigMapKeysRef *KeysSelector            `json:"configMapKeysRef,omitempty"`
+	SecretKeysRef    *KeysSelector            `json:"secretKeysRef,omitempty"`
+}
+
+// KeysSelector selects the keys of a ConfigMap or Secret, in lexical order.
+type KeysSelector struct {
+	Name string `json:"name"`
+	// The glob keys have to match. Defaults to all keys.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// ValuesSource is a source of values. Exactly one of its fields must be set.
+type ValuesSource struct {
+	ConfigMapRef *v1.LocalObjectReference `json:"configMapRef,omitempty"`
+	SecretRef    *v1.LocalObjectReference `json:"secretRef,omitempty"`
+}
+
+// Dependency selects PersistenceActions in the same namespace, either by name
+// or by label.
+type Dependency struct {
+	Name     string                `json:"name,omitempty"`
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// PersistenceActionStatus is the observed state of a PersistenceAction.
+type PersistenceActionStatus struct {
+	// The generation of the action the status was computed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Whether the actions are applied to every selected instance
+	Applied        bool         `json:"applied"`
+	ExecutionTime  *metav1.Time `json:"executionTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	Attempts       int32        `json:"attempts,omitempty"`
+	// Why the actions are not applied
+	Reason     string           `json:"reason,omitempty"`
+	Conditions []Condition      `json:"conditions,omitempty"`
+	Instances  []InstanceStatus `json:"instances,omitempty"`
+	// The plan of a dry run
+	Plan *Plan `json:"plan,omitempty"`
+}
+
+// InstanceStatus is the status of a PersistenceAction on a single instance.
+type InstanceStatus struct {
+	Instance       string       `json:"instance"`
+	Applied        bool         `json:"applied"`
+	ExecutionTime  *metav1.Time `json:"executionTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	Attempts       int32        `json:"attempts,omitempty"`
+	Reason         string       `json:"reason,omitempty"`
+	// The checksum of the actions applied
+	Checksum     string       `json:"checksum,omitempty"`
+	RolledBack   bool         `json:"rolledBack,omitempty"`
+	RollbackTime *metav1.Time `json:"rollbackTime,omitempty"`
+	// The statements executed by the InProcess executor
+	Statements []StatementStatus `json:"statements,omitempty"`
+}
+
+// StatementStatus is the outcome of a single statement.
+type StatementStatus struct {
+	Statement string          `json:"statement"`
+	Succeeded bool            `json:"succeeded"`
+	Duration  metav1.Duration `json:"duration"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// Plan is what a PersistenceAction would execute.
+type Plan struct {
+	Instances []InstancePlan `json:"instances"`
+	Warnings  []string       `json:"warnings,omitempty"`
+}
+
+// InstancePlan is what a PersistenceAction would execute on a single
+// instance.
+type InstancePlan struct {
+	Instance   string   `json:"instance"`
+	Statements []string `json:"statements,omitempty"`
+	Applied    bool     `json:"applied"`
+	Reason     string   `json:"reason,omitempty"`
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conversion implements the webhook converting PersistenceInstances
+// and PersistenceActions between the API versions on behalf of the API
+// server.
+package conversion
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1beta1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Path is the path the webhook is served at.
+const Path = "/convert"
+
+var (
+	v1alpha1APIVersion = v1alpha1.TPRGroup + "/" + v1alpha1.TPRVersion
+	v1beta1APIVersion  = v1beta1.Group + "/" + v1beta1.Version
+)
+
+// Webhook serves ConversionReviews.
+type Webhook struct{}
+
+// New creates a conversion webhook.
+func New() *Webhook {
+	return &Webhook{}
+}
+
+// Register serves the webhook at Path on mux.
+func (wh *Webhook) Register(mux *http.ServeMux) {
+	mux.HandleFunc(Path, wh.serve)
+}
+
+func (wh *Webhook) serve(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		glog.Errorf("Problem while reading the conversion review : %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var review apiextensionsv1beta1.ConversionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		glog.Errorf("Problem while decoding the conversion review : %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	review.Response = Review(review.Request)
+	review.Request = nil
+	b, err := json.Marshal(review)
+	if err != nil {
+		glog.Errorf("Problem while marshalling the conversion review : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// Review converts the objects of req. The conversion fails as a whole if any
+// object can't be converted.
+func Review(req *apiextensionsv1beta1.ConversionRequest) *apiextensionsv1beta1.ConversionResponse {
+	res := &apiextensionsv1beta1.ConversionResponse{
+		UID:              req.UID,
+		ConvertedObjects: make([]runtime.RawExtension, 0, len(req.Objects)),
+		Result:           metav1.Status{Status: metav1.StatusSuccess},
+	}
+	for _, obj := range req.Objects {
+		converted, err := Convert(obj.Raw, req.DesiredAPIVersion)
+		if err != nil {
+			return &apiextensionsv1beta1.ConversionResponse{
+				UID: req.UID,
+				Result: metav1.Status{
+					Status:  metav1.StatusFailure,
+					Message: err.Error(),
+				},
+			}
+		}
+		res.ConvertedObjects = append(res.ConvertedObjects, runtime.RawExtension{Raw: converted})
+	}
+	return res
+}
+
+// Convert converts the JSON encoded object raw to apiVersion.
+func Convert(raw []byte, apiVersion string) ([]byte, error) {
+	var tm metav1.TypeMeta
+	if err := json.Unmarshal(raw, &tm); err != nil {
+		return nil, err
+	}
+	if tm.APIVersion == apiVersion {
+		return raw, nil
+	}
+
+	// The converted object shares memory with the decoded one, which is
+	// safe as both are discarded once out is encoded.
+	var out interface{}
+	switch {
+	case tm.APIVersion == v1alpha1APIVersion && apiVersion == v1beta1APIVersion:
+		switch tm.Kind {
+		case v1alpha1.TPRPersistenceInstancesKind:
+			var in v1alpha1.PersistenceInstance
+			if err := json.Unmarshal(raw, &in); err != nil {
+				return nil, err
+			}
+			out = v1beta1.PersistenceInstanceFromV1alpha1(&in)
+		case v1alpha1.TPRPersistenceActionsKind:
+			var in v1alpha1.PersistenceAction
+			if err := json.Unmarshal(raw, &in); err != nil {
+				return nil, err
+			}
+			out = v1beta1.PersistenceActionFromV1alpha1(&in)
+		}
+	case tm.APIVersion == v1beta1APIVersion && apiVersion == v1alpha1APIVersion:
+		switch tm.Kind {
+		case v1beta1.PersistenceInstanceKind:
+			var in v1beta1.PersistenceInstance
+			if err := json.Unmarshal(raw, &in); err != nil {
+				return nil, err
+			}
+			out = v1beta1.PersistenceInstanceToV1alpha1(&in)
+		case v1beta1.PersistenceActionKind:
+			var in v1beta1.PersistenceAction
+			if err := json.Unmarshal(raw, &in); err != nil {
+				return nil, err
+			}
+			out = v1beta1.PersistenceActionToV1alpha1(&in)
+		}
+	}
+	if out == nil {
+		return nil, fmt.Errorf("converting %s %s to %s is not supported", tm.APIVersion, tm.Kind, apiVersion)
+	}
+	return json.Marshal(out)
+}
@@ -0,0 +1,202 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conversion
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1beta1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// post sends body to the webhook and returns the recorded response.
+func post(method, body string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	New().Register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(method, Path, strings.NewReader(body)))
+	return rec
+}
+
+// convert posts a ConversionReview of objects to desiredAPIVersion and
+// returns the response.
+func convert(t *testing.T, desiredAPIVersion string, objects ...interface{}) *apiextensionsv1beta1.ConversionResponse {
+	req := &apiextensionsv1beta1.ConversionRequest{
+		UID:               types.UID("4e7f0c2a"),
+		DesiredAPIVersion: desiredAPIVersion,
+	}
+	for _, obj := range objects {
+		b, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Objects = append(req.Objects, runtime.RawExtension{Raw: b})
+	}
+	body, err := json.Marshal(apiextensionsv1beta1.ConversionReview{Request: req})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := post(http.MethodPost, string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	var review apiextensionsv1beta1.ConversionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	if review.Request != nil {
+		t.Error("expected the request to be omitted from the response")
+	}
+	if review.Response == nil || review.Response.UID != req.UID {
+		t.Fatalf("expected a response to request %s, got %+v", req.UID, review.Response)
+	}
+	return review.Response
+}
+
+func testInstance() *v1alpha1.PersistenceInstance {
+	return &v1alpha1.PersistenceInstance{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1APIVersion, Kind: v1alpha1.TPRPersistenceInstancesKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "prod"},
+		Spec: v1alpha1.PersistenceInstanceSpec{
+			PersistenceType: "Postgres",
+			URL:             "orders.prod",
+			Port:            5432,
+		},
+	}
+}
+
+func testAction() *v1alpha1.PersistenceAction {
+	return &v1alpha1.PersistenceAction{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1APIVersion, Kind: v1alpha1.TPRPersistenceActionsKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "vacuum", Namespace: "prod"},
+		Spec: v1alpha1.PersistenceActionSpec{
+			Actions: []string{"VACUUM"},
+		},
+	}
+}
+
+func TestConvert(t *testing.T) {
+	res := convert(t, v1beta1APIVersion, testInstance(), testAction())
+	if res.Result.Status != metav1.StatusSuccess {
+		t.Fatalf("expected the conversion to succeed, got %+v", res.Result)
+	}
+	if len(res.ConvertedObjects) != 2 {
+		t.Fatalf("expected 2 converted objects, got %d", len(res.ConvertedObjects))
+	}
+	var i v1beta1.PersistenceInstance
+	if err := json.Unmarshal(res.ConvertedObjects[0].Raw, &i); err != nil {
+		t.Fatal(err)
+	}
+	if i.APIVersion != v1beta1APIVersion || i.Kind != v1beta1.PersistenceInstanceKind || i.Name != "orders" {
+		t.Errorf("expected v1beta1 instance orders, got %s %s %s", i.APIVersion, i.Kind, i.Name)
+	}
+	var p v1beta1.PersistenceAction
+	if err := json.Unmarshal(res.ConvertedObjects[1].Raw, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.APIVersion != v1beta1APIVersion || p.Kind != v1beta1.PersistenceActionKind || p.Name != "vacuum" {
+		t.Errorf("expected v1beta1 action vacuum, got %s %s %s", p.APIVersion, p.Kind, p.Name)
+	}
+
+	// Converting back yields the original objects.
+	var objects []interface{}
+	for _, obj := range res.ConvertedObjects {
+		objects = append(objects, json.RawMessage(obj.Raw))
+	}
+	res = convert(t, v1alpha1APIVersion, objects...)
+	if res.Result.Status != metav1.StatusSuccess || len(res.ConvertedObjects) != 2 {
+		t.Fatalf("expected the conversion back to succeed, got %+v", res.Result)
+	}
+	var action v1alpha1.PersistenceAction
+	if err := json.Unmarshal(res.ConvertedObjects[1].Raw, &action); err != nil {
+		t.Fatal(err)
+	}
+	if action.APIVersion != v1alpha1APIVersion || len(action.Spec.Actions) != 1 || action.Spec.Actions[0] != "VACUUM" {
+		t.Errorf("expected the v1alpha1 action to be restored, got %+v", action)
+	}
+}
+
+func TestConvertSameVersion(t *testing.T) {
+	b, err := json.Marshal(testAction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := convert(t, v1alpha1APIVersion, json.RawMessage(b))
+	if res.Result.Status != metav1.StatusSuccess || len(res.ConvertedObjects) != 1 {
+		t.Fatalf("expected the conversion to succeed, got %+v", res.Result)
+	}
+	if !bytes.Equal(res.ConvertedObjects[0].Raw, b) {
+		t.Errorf("expected the object to be returned unchanged, got %s", res.ConvertedObjects[0].Raw)
+	}
+}
+
+func TestConvertUnsupported(t *testing.T) {
+	unknownKind := testAction()
+	unknownKind.Kind = "PersistenceBackup"
+
+	for _, tc := range []struct {
+		name       string
+		apiVersion string
+		object     interface{}
+	}{
+		{name: "unknown desired version", apiVersion: v1alpha1.TPRGroup + "/v2", object: testAction()},
+		{name: "unknown source version", apiVersion: v1beta1APIVersion, object: map[string]string{"apiVersion": v1alpha1.TPRGroup + "/v0", "kind": v1alpha1.TPRPersistenceActionsKind}},
+		{name: "unknown kind", apiVersion: v1beta1APIVersion, object: unknownKind},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The valid instance doesn't make the conversion succeed
+			// partially.
+			res := convert(t, tc.apiVersion, testInstance(), tc.object)
+			if res.Result.Status != metav1.StatusFailure {
+				t.Fatalf("expected the conversion to fail, got %+v", res.Result)
+			}
+			if !strings.Contains(res.Result.Message, "not supported") {
+				t.Errorf("expected the message to name the unsupported conversion, got %q", res.Result.Message)
+			}
+			if len(res.ConvertedObjects) != 0 {
+				t.Errorf("expected no converted objects, got %d", len(res.ConvertedObjects))
+			}
+		})
+	}
+}
+
+func TestServeInvalidRequests(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		body   string
+		code   int
+	}{
+		{name: "method", method: http.MethodGet, code: http.StatusMethodNotAllowed},
+		{name: "malformed", method: http.MethodPost, body: `{"request": `, code: http.StatusBadRequest},
+		{name: "no request", method: http.MethodPost, body: `{"kind": "ConversionReview"}`, code: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if rec := post(tc.method, tc.body); rec.Code != tc.code {
+				t.Errorf("expected status %d, got %d", tc.code, rec.Code)
+			}
+		})
+	}
+}
@@ -15,45 +15,47 @@
 package k8sutil
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/pkg/errors"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/api/core/v1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsclientv1beta1 "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/typed/apiextensions/v1beta1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
-	clientv2alpha1 "k8s.io/client-go/kubernetes/typed/batch/v2alpha1"
-	"k8s.io/client-go/pkg/api/v1"
-	"k8s.io/client-go/pkg/apis/batch/v2alpha1"
+	clientv1 "k8s.io/client-go/kubernetes/typed/batch/v1"
+	clientv1beta1 "k8s.io/client-go/kubernetes/typed/batch/v1beta1"
+	clientcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 )
 
-// WaitForTPRReady waits for a third party resource to be available
-// for use.
-func WaitForTPRReady(restClient rest.Interface, tprGroup, tprVersion, tprName string) error {
+// WaitForCRDEstablished waits for a custom resource definition to be
+// established, i.e. served by the API server.
+func WaitForCRDEstablished(crdClient apiextensionsclientv1beta1.CustomResourceDefinitionInterface, name string) error {
 	return wait.Poll(3*time.Second, 30*time.Second, func() (bool, error) {
-		res := restClient.Get().AbsPath("apis", tprGroup, tprVersion, tprName).Do()
-		err := res.Error()
+		crd, err := crdClient.Get(context.TODO(), name, metav1.GetOptions{})
 		if err != nil {
-			// RESTClient returns *apierrors.StatusError for any status codes < 200 or > 206
-			// and http.Client.Do errors are returned directly.
-			if se, ok := err.(*apierrors.StatusError); ok {
-				if se.Status().Code == http.StatusNotFound {
-					return false, nil
-				}
-			}
 			return false, err
 		}
-
-		var statusCode int
-		res.StatusCode(&statusCode)
-		if statusCode != http.StatusOK {
-			return false, fmt.Errorf("invalid status code: %d", statusCode)
+		for _, cond := range crd.Status.Conditions {
+			switch cond.Type {
+			case apiextensionsv1beta1.Established:
+				if cond.Status == apiextensionsv1beta1.ConditionTrue {
+					return true, nil
+				}
+			case apiextensionsv1beta1.NamesAccepted:
+				if cond.Status == apiextensionsv1beta1.ConditionFalse {
+					return false, fmt.Errorf("names not accepted: %s", cond.Message)
+				}
+			}
 		}
-
-		return true, nil
+		return false, nil
 	})
 }
 
@@ -113,20 +115,20 @@ func IsResourceNotFoundError(err error) bool {
 	return false
 }
 
-func CreateOrUpdateCronJob(jclient clientv2alpha1.CronJobInterface, job *v2alpha1.CronJob) error {
-	existingJob, err := jclient.Get(job.Name, metav1.GetOptions{})
+func CreateOrUpdateCronJob(jclient clientv1beta1.CronJobInterface, job *batchv1beta1.CronJob) error {
+	existingJob, err := jclient.Get(context.TODO(), job.Name, metav1.GetOptions{})
 	if err != nil && !apierrors.IsNotFound(err) {
 		return errors.Wrap(err, "retrieving job object failed")
 	}
 
 	if apierrors.IsNotFound(err) {
-		_, err = jclient.Create(job)
+		_, err = jclient.Create(context.TODO(), job, metav1.CreateOptions{})
 		if err != nil {
 			return errors.Wrap(err, "creating job object failed")
 		}
 	} else {
 		job.ResourceVersion = existingJob.ResourceVersion
-		_, err := jclient.Update(job)
+		_, err := jclient.Update(context.TODO(), job, metav1.UpdateOptions{})
 		if err != nil && !apierrors.IsNotFound(err) {
 			return errors.Wrap(err, "updating job object failed")
 		}
@@ -134,14 +136,56 @@ func CreateOrUpdateCronJob(jclient clientv2alpha1.CronJobInterface, job *v2alpha
 	return nil
 }
 
-func DeleteCronJob(jclient clientv2alpha1.CronJobInterface, name string) error {
-	_, err := jclient.Get(name, metav1.GetOptions{})
+// DeleteCronJob deletes the cronjob with the given name along with its jobs.
+func DeleteCronJob(jclient clientv1beta1.CronJobInterface, name string) error {
+	_, err := jclient.Get(context.TODO(), name, metav1.GetOptions{})
 	if err != nil && !apierrors.IsNotFound(err) {
 		return errors.Wrap(err, "retrieving cronjob failed ")
 	}
-	err = jclient.Delete(name, &metav1.DeleteOptions{})
+	propagation := metav1.DeletePropagationBackground
+	err = jclient.Delete(context.TODO(), name, metav1.DeleteOptions{PropagationPolicy: &propagation})
 	if err != nil {
 		return errors.Wrap(err, "Deleting cronjob failed")
 	}
 	return nil
 }
+
+// DeleteJob deletes the job with the given name along with its pods.
+func DeleteJob(jclient clientv1.JobInterface, name string) error {
+	propagation := metav1.DeletePropagationBackground
+	err := jclient.Delete(context.TODO(), name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "Deleting job failed")
+	}
+	return nil
+}
+
+// CreateOrUpdateSecret creates the secret, or replaces its data if it exists
+// already.
+func CreateOrUpdateSecret(sclient clientcorev1.SecretInterface, secret *v1.Secret) error {
+	existing, err := sclient.Get(context.TODO(), secret.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "retrieving secret failed")
+	}
+
+	if apierrors.IsNotFound(err) {
+		if _, err := sclient.Create(context.TODO(), secret, metav1.CreateOptions{}); err != nil {
+			return errors.Wrap(err, "creating secret failed")
+		}
+		return nil
+	}
+	secret.ResourceVersion = existing.ResourceVersion
+	if _, err := sclient.Update(context.TODO(), secret, metav1.UpdateOptions{}); err != nil {
+		return errors.Wrap(err, "updating secret failed")
+	}
+	return nil
+}
+
+// DeleteSecret deletes the secret with the given name, if it exists.
+func DeleteSecret(sclient clientcorev1.SecretInterface, name string) error {
+	err := sclient.Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "deleting secret failed")
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/pkg/k8sutil"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// actionsMountPath is where the executor finds the actions it runs, one
+	// file per action in lexical order.
+	actionsMountPath  = "/etc/persistence/actions"
+	actionsVolumeName = "actions"
+
+	// redacted replaces values from Secrets.
+	redacted = "<redacted>"
+	// minSecretLength is the length below which values from Secrets are only
+	// redacted where they occur as whole token. Shorter values, e.g. "1" or
+	// "ON", occur within unrelated words too often to hide them there.
+	minSecretLength = 4
+
+	// sourceIndex indexes the PersistenceActions by the ConfigMaps and
+	// Secrets they read actions or values from.
+	sourceIndex = "source"
+)
+
+// redactor hides values originating from Secrets in text recorded in the
+// status of an action. A nil redactor hides nothing.
+type redactor struct {
+	// values are hidden wherever they occur.
+	values []string
+	// actions read from Secrets are hidden along with their statements.
+	actions []string
+}
+
+// add registers the value v read from a Secret.
+func (r *redactor) add(v string) {
+	if strings.TrimSpace(v) != "" {
+		r.values = append(r.values, v)
+	}
+}
+
+// addAction registers the action a read from a Secret.
+func (r *redactor) addAction(a string) {
+	if strings.TrimSpace(a) != "" {
+		r.actions = append(r.actions, a)
+		r.add(a)
+	}
+}
+
+// isAction returns whether a was registered as action read from a Secret.
+func (r *redactor) isAction(a string) bool {
+	if r == nil {
+		return false
+	}
+	for _, v := range r.actions {
+		if v == a {
+			return true
+		}
+	}
+	return false
+}
+
+// redact hides the secrets contained in s. If s is part of an action read
+// from a Secret, e.g. a single statement of it, it is hidden entirely.
+func (r *redactor) redact(s string) string {
+	if r == nil {
+		return s
+	}
+	if trimmed := strings.TrimSpace(s); trimmed != "" {
+		for _, a := range r.actions {
+			if strings.Contains(a, trimmed) {
+				return redacted
+			}
+		}
+	}
+	// Short values are hidden last, so they can't break up the longer ones.
+	values := append([]string(nil), r.values...)
+	sort.SliceStable(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, v := range values {
+		if len(strings.TrimSpace(v)) < minSecretLength {
+			s = replaceToken(s, v, redacted)
+			continue
+		}
+		s = strings.Replace(s, v, redacted, -1)
+	}
+	return s
+}
+
+// replaceToken replaces the occurrences of old in s which aren't part of a
+// longer word by new.
+func replaceToken(s, old, new string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, old)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		j := i + len(old)
+		before, _ := utf8.DecodeLastRuneInString(s[:i])
+		after, _ := utf8.DecodeRuneInString(s[j:])
+		first, _ := utf8.DecodeRuneInString(old)
+		last, _ := utf8.DecodeLastRuneInString(old)
+		if (isWordRune(first) && isWordRune(before)) || (isWordRune(last) && isWordRune(after)) {
+			// Part of a longer word, keep the first rune and look further.
+			_, n := utf8.DecodeRuneInString(s[i:])
+			b.WriteString(s[:i+n])
+			s = s[i+n:]
+			continue
+		}
+		b.WriteString(s[:i])
+		b.WriteString(new)
+		s = s[j:]
+	}
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// resolveActions returns a copy of p whose Actions are followed by the
+// actions read from its ActionsFrom sources and whose Values include the ones
+// read from its ValuesFrom sources, along with a redactor hiding everything
+// read from Secrets.
+func resolveActions(kclient kubernetes.Interface, p *v1alpha1.PersistenceAction) (*v1alpha1.PersistenceAction, *redactor, error) {
+	r := &redactor{}
+	actions := append([]string{}, p.Spec.Actions...)
+	for n, src := range p.Spec.ActionsFrom {
+		var (
+			data    map[string]string
+			keys    []string
+			secret  bool
+			kind    string
+			name    string
+			pattern string
+		)
+		switch {
+		case src.ConfigMapKeyRef != nil:
+			kind, name, keys = "configmap", src.ConfigMapKeyRef.Name, []string{src.ConfigMapKeyRef.Key}
+		case src.SecretKeyRef != nil:
+			kind, name, keys, secret = "secret", src.SecretKeyRef.Name, []string{src.SecretKeyRef.Key}, true
+		case src.ConfigMapKeysRef != nil:
+			kind, name, pattern = "configmap", src.ConfigMapKeysRef.Name, src.ConfigMapKeysRef.Pattern
+		case src.SecretKeysRef != nil:
+			kind, name, pattern, secret = "secret", src.SecretKeysRef.Name, src.SecretKeysRef.Pattern, true
+		default:
+			return nil, nil, fmt.Errorf("actionsFrom[%d] has no source", n)
+		}
+
+		if secret {
+			s, err := kclient.CoreV1().Secrets(p.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "retrieving secret %s failed", name)
+			}
+			data = make(map[string]string, len(s.Data))
+			for k, v := range s.Data {
+				data[k] = string(v)
+			}
+		} else {
+			cm, err := kclient.CoreV1().ConfigMaps(p.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "retrieving configmap %s failed", name)
+			}
+			data = cm.Data
+		}
+
+		if keys == nil {
+			if pattern == "" {
+				pattern = "*"
+			}
+			for k := range data {
+				ok, err := path.Match(pattern, k)
+				if err != nil {
+					return nil, nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+				}
+				if ok {
+					keys = append(keys, k)
+				}
+			}
+			if len(keys) == 0 {
+				return nil, nil, fmt.Errorf("no key of %s %s matches %q", kind, name, pattern)
+			}
+			sort.Strings(keys)
+		}
+		for _, k := range keys {
+			v, ok := data[k]
+			if !ok {
+				return nil, nil, fmt.Errorf("%s %s has no key %s", kind, name, k)
+			}
+			if secret {
+				r.addAction(v)
+			}
+			actions = append(actions, v)
+		}
+	}
+
+	values := map[string]string{}
+	for n, src := range p.Spec.ValuesFrom {
+		switch {
+		case src.ConfigMapRef != nil:
+			cm, err := kclient.CoreV1().ConfigMaps(p.Namespace).Get(context.TODO(), src.ConfigMapRef.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "retrieving configmap %s failed", src.ConfigMapRef.Name)
+			}
+			for k, v := range cm.Data {
+				values[k] = v
+			}
+		case src.SecretRef != nil:
+			s, err := kclient.CoreV1().Secrets(p.Namespace).Get(context.TODO(), src.SecretRef.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "retrieving secret %s failed", src.SecretRef.Name)
+			}
+			for k, v := range s.Data {
+				values[k] = string(v)
+				r.add(string(v))
+			}
+		default:
+			return nil, nil, fmt.Errorf("valuesFrom[%d] has no source", n)
+		}
+	}
+	for k, v := range p.Spec.Values {
+		values[k] = v
+	}
+
+	res := *p
+	res.Spec.Actions = actions
+	res.Spec.Values = values
+	return &res, r, nil
+}
+
+// actionsSecretName returns the name of the Secret holding the actions for
+// the execution with the given name.
+func actionsSecretName(execution string) string {
+	return execution + "-actions"
+}
+
+// actionKey returns the key of the nth action in the Secret holding the
+// actions. Keys sort in the order of the actions.
+func actionKey(n int) string {
+	return fmt.Sprintf("action-%04d", n)
+}
+
+// rollbackActionKey returns the key of the nth rollback action in the Secret
+// holding the actions. Keys sort in the order of the rollback actions.
+func rollbackActionKey(n int) string {
+	return fmt.Sprintf("rollback-%04d", n)
+}
+
+// syncActionsSecret stores the rendered actions and rollback actions of the
+// execution with the given name of p in the Secret its executor reads them
+// from.
+func (c *Operator) syncActionsSecret(execution string, p *v1alpha1.PersistenceAction, actions, rollbackActions []string) error {
+	data := make(map[string][]byte, len(actions)+len(rollbackActions))
+	for n, a := range actions {
+		data[actionKey(n)] = []byte(a)
+	}
+	for n, a := range rollbackActions {
+		data[rollbackActionKey(n)] = []byte(a)
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: actionsSecretName(execution),
+			Labels: map[string]string{
+				actionLabel:    p.Name,
+				managedByLabel: managedBy,
+			},
+			OwnerReferences: ownerReferences(*p),
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: data,
+	}
+	return k8sutil.CreateOrUpdateSecret(c.kclient.CoreV1().Secrets(p.Namespace), secret)
+}
+
+// destroyActionsSecrets deletes the Secrets holding the actions for the
+// executions of the PersistenceAction name.
+func (c *Operator) destroyActionsSecrets(ns, name string) error {
+	secretClient := c.kclient.CoreV1().Secrets(ns)
+	secrets, err := secretClient.List(context.TODO(), metav1.ListOptions{LabelSelector: actionSelector(name)})
+	if err != nil {
+		return errors.Wrap(err, "listing secrets failed")
+	}
+	for _, s := range secrets.Items {
+		if err := k8sutil.DeleteSecret(secretClient, s.Name); err != nil {
+			return errors.Wrapf(err, "deleting secret %s failed", s.Name)
+		}
+	}
+	return nil
+}
+
+// sourceKey returns the key of the ConfigMap, or Secret if secret is set,
+// with the given namespace and name in the source index.
+func sourceKey(secret bool, ns, name string) string {
+	kind := "configmap"
+	if secret {
+		kind = "secret"
+	}
+	return kind + "/" + ns + "/" + name
+}
+
+// actionSourceIndexFunc returns the keys of the ConfigMaps and Secrets a
+// PersistenceAction reads actions or values from. Secrets looked up by the
+// actions themselves are not taken into account.
+func actionSourceIndexFunc(obj interface{}) ([]string, error) {
+	p, ok := obj.(*v1alpha1.PersistenceAction)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+	var res []string
+	for _, src := range p.Spec.ValuesFrom {
+		switch {
+		case src.ConfigMapRef != nil:
+			res = append(res, sourceKey(false, p.Namespace, src.ConfigMapRef.Name))
+		case src.SecretRef != nil:
+			res = append(res, sourceKey(true, p.Namespace, src.SecretRef.Name))
+		}
+	}
+	for _, src := range p.Spec.ActionsFrom {
+		switch {
+		case src.ConfigMapKeyRef != nil:
+			res = append(res, sourceKey(false, p.Namespace, src.ConfigMapKeyRef.Name))
+		case src.ConfigMapKeysRef != nil:
+			res = append(res, sourceKey(false, p.Namespace, src.ConfigMapKeysRef.Name))
+		case src.SecretKeyRef != nil:
+			res = append(res, sourceKey(true, p.Namespace, src.SecretKeyRef.Name))
+		case src.SecretKeysRef != nil:
+			res = append(res, sourceKey(true, p.Namespace, src.SecretKeysRef.Name))
+		}
+	}
+	return res, nil
+}
+
+// enqueueReferencingActions enqueues the PersistenceActions reading actions
+// or values from the changed ConfigMap, or Secret if secret is set.
+func (c *Operator) enqueueReferencingActions(secret bool, obj interface{}) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	o, ok := obj.(metav1.Object)
+	if !ok {
+		return
+	}
+	key := sourceKey(secret, o.GetNamespace(), o.GetName())
+
+	objs, err := c.persistenceActionInf.GetIndexer().ByIndex(sourceIndex, key)
+	if err != nil {
+		glog.Errorf("looking up persistence actions reading %s failed: %s", key, err)
+		return
+	}
+	for _, o := range objs {
+		c.enqueue(o)
+	}
+}
+
+// sourceHandler handles the events of the ConfigMaps, or Secrets if secret is
+// set, which actions may be read from.
+func (c *Operator) sourceHandler(secret bool) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.enqueueReferencingActions(secret, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.enqueueReferencingActions(secret, obj)
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			// Periodic resyncs don't change the content.
+			if old.(metav1.Object).GetResourceVersion() == cur.(metav1.Object).GetResourceVersion() {
+				return
+			}
+			c.enqueueReferencingActions(secret, cur)
+		},
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/third_party/workqueue"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestRedactValues(t *testing.T) {
+	r := &redactor{}
+	r.add("s3cr3t-password")
+	r.add("ON")
+	r.add("1")
+	r.add(" ")
+	r.add("key-1-abcdef")
+
+	for _, tc := range []struct {
+		text, expected string
+	}{
+		// Values are hidden wherever they occur.
+		{"ALTER ROLE app PASSWORD 's3cr3t-password';", "ALTER ROLE app PASSWORD '<redacted>';"},
+		{"s3cr3t-password", redacted},
+		// Short values don't break up longer ones containing them.
+		{"PASSWORD 'key-1-abcdef'", "PASSWORD '<redacted>'"},
+		// Text contained in a value is not a secret by itself.
+		{"password", "password"},
+		{"OK", "OK"},
+		// Short values are hidden where they occur as whole token.
+		{"SET autocommit = ON;", "SET autocommit = <redacted>;"},
+		{"ON", redacted},
+		{"statement 1 failed", "statement <redacted> failed"},
+		{"LIMIT 1,1", "LIMIT <redacted>,<redacted>"},
+		// They are not hidden within longer words.
+		{"ALTER TABLE ONLINE_ORDERS ADD COLUMN id1 INT;", "ALTER TABLE ONLINE_ORDERS ADD COLUMN id1 INT;"},
+		{"statement 10 failed", "statement 10 failed"},
+		// Blank values are not hidden.
+		{"a b", "a b"},
+	} {
+		if got := r.redact(tc.text); got != tc.expected {
+			t.Errorf("expected %q to be redacted to %q, got %q", tc.text, tc.expected, got)
+		}
+	}
+}
+
+func TestRedactActions(t *testing.T) {
+	r := &redactor{}
+	action := "CREATE ROLE reporting;\nGRANT SELECT ON ALL TABLES IN SCHEMA shop TO reporting;"
+	r.addAction(action)
+	r.addAction("CREATE SCHEMA orders;")
+
+	for _, tc := range []struct {
+		text, expected string
+	}{
+		// Actions read from Secrets and their statements are hidden
+		// entirely.
+		{action, redacted},
+		{"CREATE ROLE reporting;", redacted},
+		{"GRANT SELECT ON ALL TABLES IN SCHEMA shop TO reporting;", redacted},
+		{"rendering actions[1] failed: " + action, "rendering actions[1] failed: " + redacted},
+		// Other statements are not.
+		{"CREATE TABLE users (id int);", "CREATE TABLE users (id int);"},
+	} {
+		if got := r.redact(tc.text); got != tc.expected {
+			t.Errorf("expected %q to be redacted to %q, got %q", tc.text, tc.expected, got)
+		}
+	}
+
+	if !r.isAction("CREATE SCHEMA orders;") {
+		t.Error("expected the action read from a Secret to be registered")
+	}
+	if r.isAction("CREATE ROLE reporting;") {
+		t.Error("expected a statement not to be registered as action")
+	}
+}
+
+func TestRedactRenderedActions(t *testing.T) {
+	p, inst := testAction(), testInstance()
+	p.Spec.Actions = []string{"CREATE SCHEMA {{ .Instance.Database }};", "CREATE TABLE {{ .Instance.Database }}.users (id INT);"}
+	r := &redactor{}
+	// Only the first action is read from a Secret.
+	r.addAction(p.Spec.Actions[0])
+
+	if _, err := renderActions(fake.NewSimpleClientset(), &p, &inst, r); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.redact("CREATE SCHEMA orders;"); got != redacted {
+		t.Errorf("expected the rendered action read from a Secret to be redacted, got %q", got)
+	}
+	if got := r.redact("CREATE TABLE orders.users (id INT);"); got == redacted {
+		t.Error("expected the rendered inline action not to be redacted")
+	}
+}
+
+func TestSourceHandler(t *testing.T) {
+	p := testAction()
+	p.Spec.ActionsFrom = []v1alpha1.PersistenceActionSource{{
+		ConfigMapKeysRef: &v1alpha1.PersistenceActionKeysSelector{Name: "migrations"},
+	}}
+	p.Spec.ValuesFrom = []v1alpha1.PersistenceActionValuesSource{{
+		SecretRef: &v1.LocalObjectReference{Name: "credentials"},
+	}}
+	meta := func(ns, name, rv string) *metav1.PartialObjectMetadata {
+		return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, ResourceVersion: rv}}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		secret   bool
+		event    func(h cache.ResourceEventHandlerFuncs)
+		enqueued bool
+	}{
+		{
+			name:     "unlabelled config map added",
+			event:    func(h cache.ResourceEventHandlerFuncs) { h.OnAdd(meta("shop", "migrations", "1")) },
+			enqueued: true,
+		},
+		{
+			name:   "secret updated",
+			secret: true,
+			event: func(h cache.ResourceEventHandlerFuncs) {
+				h.OnUpdate(meta("shop", "credentials", "1"), meta("shop", "credentials", "2"))
+			},
+			enqueued: true,
+		},
+		{
+			name:   "secret resynced",
+			secret: true,
+			event: func(h cache.ResourceEventHandlerFuncs) {
+				h.OnUpdate(meta("shop", "credentials", "1"), meta("shop", "credentials", "1"))
+			},
+		},
+		{
+			name:   "secret deleted",
+			secret: true,
+			event: func(h cache.ResourceEventHandlerFuncs) {
+				h.OnDelete(cache.DeletedFinalStateUnknown{Key: "shop/credentials", Obj: meta("shop", "credentials", "1")})
+			},
+			enqueued: true,
+		},
+		{
+			name:  "secret named like a config map",
+			event: func(h cache.ResourceEventHandlerFuncs) { h.OnAdd(meta("shop", "credentials", "1")) },
+		},
+		{
+			name:  "config map of another namespace",
+			event: func(h cache.ResourceEventHandlerFuncs) { h.OnAdd(meta("billing", "migrations", "1")) },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Operator{
+				persistenceActionInf: cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceAction{}, 0, cache.Indexers{
+					sourceIndex: actionSourceIndexFunc,
+				}),
+				queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence"),
+			}
+			defer c.queue.ShutDown()
+			c.persistenceActionInf.GetIndexer().Add(&p)
+
+			tc.event(c.sourceHandler(tc.secret))
+
+			want := 0
+			if tc.enqueued {
+				want = 1
+			}
+			if n := c.queue.Len(); n != want {
+				t.Fatalf("expected %d enqueued actions, got %d", want, n)
+			}
+			if tc.enqueued {
+				if key, _ := c.queue.Get(); key != "shop/create-users" {
+					t.Fatalf("expected shop/create-users to be enqueued, got %v", key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// conditionReachable reports whether a PersistenceInstance could be
+	// connected to on the last probe.
+	conditionReachable = "Reachable"
+	// conditionValid reports whether the spec of a PersistenceInstance is
+	// valid.
+	conditionValid = "Valid"
+	// conditionChecksumMismatch reports whether a PersistenceAction was
+	// changed after it was applied.
+	conditionChecksumMismatch = "ChecksumMismatch"
+	// conditionDependencyCycle reports whether the dependencies of a
+	// PersistenceAction lead back to the action itself.
+	conditionDependencyCycle = "DependencyCycle"
+	// conditionTornDown reports whether the OnDelete actions of a deleted
+	// PersistenceAction or PersistenceInstance succeeded.
+	conditionTornDown = "TornDown"
+)
+
+// setCondition adds c to conds or replaces the condition of the same type.
+// The transition time is only updated if the status of the condition changed.
+func setCondition(conds []v1alpha1.PersistenceCondition, c v1alpha1.PersistenceCondition) []v1alpha1.PersistenceCondition {
+	c.LastTransitionTime = metav1.Now()
+	for i, cur := range conds {
+		if cur.Type != c.Type {
+			continue
+		}
+		if cur.Status == c.Status {
+			c.LastTransitionTime = cur.LastTransitionTime
+		}
+		res := append([]v1alpha1.PersistenceCondition{}, conds...)
+		res[i] = c
+		return res
+	}
+	return append(append([]v1alpha1.PersistenceCondition{}, conds...), c)
+}
+
+// findCondition returns the condition of the given type, or nil if there is
+// none.
+func findCondition(conds []v1alpha1.PersistenceCondition, t string) *v1alpha1.PersistenceCondition {
+	for i := range conds {
+		if conds[i].Type == t {
+			return &conds[i]
+		}
+	}
+	return nil
+}
+
+// conditionStatus converts b into the status of a condition.
+func conditionStatus(b bool) v1.ConditionStatus {
+	if b {
+		return v1.ConditionTrue
+	}
+	return v1.ConditionFalse
+}
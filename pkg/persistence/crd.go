@@ -0,0 +1,565 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1beta1"
+	"github.com/mmerrill3/persistence-operator/pkg/conversion"
+	"github.com/mmerrill3/persistence-operator/pkg/k8sutil"
+	"github.com/pkg/errors"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+const (
+	crdPersistenceInstance = v1alpha1.TPRPersistenceInstanceName + "." + v1alpha1.TPRGroup
+	crdPersistenceAction   = v1alpha1.TPRPersistenceActionName + "." + v1alpha1.TPRGroup
+)
+
+// createCRDs registers the CustomResourceDefinitions of PersistenceInstances
+// and PersistenceActions, or updates them to the current schema, and waits
+// for the API server to serve them.
+func (c *Operator) createCRDs() error {
+	conv, err := c.crdConversion()
+	if err != nil {
+		return err
+	}
+
+	crdClient := c.crdclient.ApiextensionsV1beta1().CustomResourceDefinitions()
+	for _, crd := range []*apiextensionsv1beta1.CustomResourceDefinition{
+		persistenceInstanceCRD(conv),
+		persistenceActionCRD(conv),
+	} {
+		existing, err := crdClient.Get(context.TODO(), crd.Name, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			if _, err := crdClient.Create(context.TODO(), crd, metav1.CreateOptions{}); err != nil {
+				return errors.Wrapf(err, "creating CRD %s failed", crd.Name)
+			}
+			glog.Infof("CRD created : %s ", crd.Name)
+		case err != nil:
+			return errors.Wrapf(err, "retrieving CRD %s failed", crd.Name)
+		default:
+			crd.ResourceVersion = existing.ResourceVersion
+			if _, err := crdClient.Update(context.TODO(), crd, metav1.UpdateOptions{}); err != nil {
+				return errors.Wrapf(err, "updating CRD %s failed", crd.Name)
+			}
+			glog.Infof("CRD updated : %s ", crd.Name)
+		}
+	}
+
+	// We have to wait for the CRDs to be established. Otherwise the initial
+	// watch may fail.
+	for _, name := range []string{crdPersistenceInstance, crdPersistenceAction} {
+		if err := k8sutil.WaitForCRDEstablished(crdClient, name); err != nil {
+			return errors.Wrapf(err, "waiting for CRD %s failed", name)
+		}
+	}
+
+	if c.config.RestoreTPRBackups {
+		if err := restoreTPRBackups(c.kclient, c.mclient, c.config.Namespace); err != nil {
+			return errors.Wrap(err, "restoring TPR backups failed")
+		}
+	}
+	return nil
+}
+
+// crdConversion returns the conversion webhook the API server calls to
+// convert between the API versions, or nil if none is configured. Only
+// v1alpha1 is served without it.
+func (c *Operator) crdConversion() (*apiextensionsv1beta1.CustomResourceConversion, error) {
+	if c.config.ConversionWebhookService == "" {
+		return nil, nil
+	}
+	parts := strings.Split(c.config.ConversionWebhookService, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("conversion webhook service %q is not of the form namespace/name", c.config.ConversionWebhookService)
+	}
+	var caBundle []byte
+	if c.config.ConversionWebhookCAFile != "" {
+		b, err := ioutil.ReadFile(c.config.ConversionWebhookCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading conversion webhook CA failed")
+		}
+		caBundle = b
+	}
+	path := conversion.Path
+	return &apiextensionsv1beta1.CustomResourceConversion{
+		Strategy: apiextensionsv1beta1.WebhookConverter,
+		WebhookClientConfig: &apiextensionsv1beta1.WebhookClientConfig{
+			Service: &apiextensionsv1beta1.ServiceReference{
+				Namespace: parts[0],
+				Name:      parts[1],
+				Path:      &path,
+			},
+			CABundle: caBundle,
+		},
+		ConversionReviewVersions: []string{"v1beta1"},
+	}, nil
+}
+
+// persistenceInstanceCRD defines PersistenceInstances. The v1beta1 API is
+// served along with v1alpha1 given a conversion webhook, v1alpha1 remains the
+// storage version.
+func persistenceInstanceCRD(conv *apiextensionsv1beta1.CustomResourceConversion) *apiextensionsv1beta1.CustomResourceDefinition {
+	status := schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"observedGeneration": schemaInt64(),
+		"reachable":          schemaBool(),
+		"serverVersion":      schemaString(),
+		"lastProbeTime":      schemaTime(),
+		"conditions":         schemaArray(schemaCondition()),
+	})
+	columns := func(url string) []apiextensionsv1beta1.CustomResourceColumnDefinition {
+		return []apiextensionsv1beta1.CustomResourceColumnDefinition{
+			{Name: "Type", Type: "string", JSONPath: ".spec.persistenceType"},
+			{Name: "URL", Type: "string", JSONPath: url},
+			{Name: "Reachable", Type: "boolean", JSONPath: ".status.reachable"},
+			{Name: "Version", Type: "string", JSONPath: ".status.serverVersion", Priority: 1},
+			{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+		}
+	}
+
+	versions := []apiextensionsv1beta1.CustomResourceDefinitionVersion{{
+		Name:    v1alpha1.TPRVersion,
+		Served:  true,
+		Storage: true,
+		Schema: &apiextensionsv1beta1.CustomResourceValidation{
+			OpenAPIV3Schema: schemaResource(schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+				"persistenceType":   schemaString(),
+				"usernameSecretRef": schemaSecretKeySelector(),
+				"passwordSecretRef": schemaSecretKeySelector(),
+				"url":               schemaString(),
+				"port":              schemaPort(),
+				"database":          schemaString(),
+				"schema":            schemaString(),
+				"parameters":        schemaStringMap(),
+				"tls":               schemaTLS(),
+				"onDelete":          schemaArray(schemaString()),
+				// Deprecated in favour of the secret references.
+				"usernameSecret": schemaString(),
+				"passwordSecret": schemaString(),
+			}, "persistenceType", "url"), status),
+		},
+		Subresources:             statusSubresource(),
+		AdditionalPrinterColumns: columns(".spec.url"),
+	}}
+	if conv != nil {
+		beta := columns(".spec.host")
+		beta[0].JSONPath = ".spec.type"
+		versions = append(versions, apiextensionsv1beta1.CustomResourceDefinitionVersion{
+			Name:   v1beta1.Version,
+			Served: true,
+			Schema: &apiextensionsv1beta1.CustomResourceValidation{
+				OpenAPIV3Schema: schemaResource(schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+					"type":       schemaString(),
+					"host":       schemaString(),
+					"port":       schemaPort(),
+					"database":   schemaString(),
+					"schema":     schemaString(),
+					"parameters": schemaStringMap(),
+					"credentials": schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+						"usernameSecretRef": schemaSecretKeySelector(),
+						"passwordSecretRef": schemaSecretKeySelector(),
+					}),
+					"tls":      schemaTLS(),
+					"onDelete": schemaArray(schemaString()),
+				}, "type", "host"), status),
+			},
+			Subresources:             statusSubresource(),
+			AdditionalPrinterColumns: beta,
+		})
+	}
+
+	return &apiextensionsv1beta1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: crdPersistenceInstance},
+		Spec: crdSpec(apiextensionsv1beta1.CustomResourceDefinitionSpec{
+			Group:    v1alpha1.TPRGroup,
+			Version:  v1alpha1.TPRVersion,
+			Versions: versions,
+			Scope:    apiextensionsv1beta1.NamespaceScoped,
+			Names: apiextensionsv1beta1.CustomResourceDefinitionNames{
+				Plural:     v1alpha1.TPRPersistenceInstanceName,
+				Singular:   "persistenceinstance",
+				Kind:       v1alpha1.TPRPersistenceInstancesKind,
+				ListKind:   v1alpha1.TPRPersistenceInstancesKind + "List",
+				ShortNames: []string{"pi"},
+				Categories: []string{"persistence"},
+			},
+			Conversion: conv,
+		}),
+	}
+}
+
+// persistenceActionCRD defines PersistenceActions, served in the same
+// versions as PersistenceInstances.
+func persistenceActionCRD(conv *apiextensionsv1beta1.CustomResourceConversion) *apiextensionsv1beta1.CustomResourceDefinition {
+	instanceStatusSchema := schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"instance":       schemaString(),
+		"applied":        schemaBool(),
+		"executionTime":  schemaTime(),
+		"completionTime": schemaTime(),
+		"attempts":       schemaInt(),
+		"reason":         schemaString(),
+		"checksum":       schemaString(),
+		"rolledBack":     schemaBool(),
+		"rollbackTime":   schemaTime(),
+		"statements": schemaArray(schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+			"statement": schemaString(),
+			"succeeded": schemaBool(),
+			"duration":  schemaString(),
+			"error":     schemaString(),
+		})),
+	})
+	plan := schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"instances": schemaNullable(schemaArray(schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+			"instance":   schemaString(),
+			"statements": schemaArray(schemaString()),
+			"applied":    schemaBool(),
+			"reason":     schemaString(),
+		}))),
+		"warnings": schemaArray(schemaString()),
+	})
+	status := schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"observedGeneration": schemaInt64(),
+		"applied":            schemaBool(),
+		"executionTime":      schemaNullable(schemaTime()),
+		"completionTime":     schemaNullable(schemaTime()),
+		"attempts":           schemaInt(),
+		"reason":             schemaString(),
+		"conditions":         schemaArray(schemaCondition()),
+		"instances":          schemaArray(instanceStatusSchema),
+		"plan":               plan,
+	})
+
+	// The fields both versions have in common.
+	spec := func(fields map[string]apiextensionsv1beta1.JSONSchemaProps) apiextensionsv1beta1.JSONSchemaProps {
+		common := map[string]apiextensionsv1beta1.JSONSchemaProps{
+			"applied":         schemaBool(),
+			"applicationTime": schemaNullable(schemaTime()),
+			"actions":         schemaNullable(schemaArray(schemaString())),
+			"actionsFrom":     schemaArray(schemaActionSource()),
+			"values":          schemaStringMap(),
+			"valuesFrom":      schemaArray(schemaValuesSource()),
+			"checksumPolicy":  schemaEnum(checksumPolicyFail, checksumPolicyReapply, checksumPolicyIgnore),
+			"version":         schemaString(),
+			"rollbackActions": schemaArray(schemaString()),
+			"onDelete":        schemaArray(schemaString()),
+			"autoRollback":    schemaBool(),
+			"dependsOn":       schemaArray(schemaDependency()),
+			"dryRun":          schemaBool(),
+			"executor":        schemaEnum(ExecutorJob, ExecutorInProcess),
+		}
+		for k, v := range fields {
+			common[k] = v
+		}
+		return schemaObject(common)
+	}
+	schedule := map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"suspend":                    schemaBool(),
+		"concurrencyPolicy":          schemaEnum("Allow", "Forbid", "Replace"),
+		"successfulJobsHistoryLimit": schemaInt(),
+		"failedJobsHistoryLimit":     schemaInt(),
+	}
+	pod := map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"resources":          schemaPreserved(),
+		"nodeSelector":       schemaStringMap(),
+		"serviceAccountName": schemaString(),
+		"tolerations":        schemaArray(schemaPreserved()),
+	}
+
+	alpha := map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"persistenceInstanceSelector": schemaLabelSelector(),
+		"schedule":                    schemaString(),
+	}
+	for _, fields := range []map[string]apiextensionsv1beta1.JSONSchemaProps{schedule, pod} {
+		for k, v := range fields {
+			alpha[k] = v
+		}
+	}
+	columns := func(schedule string) []apiextensionsv1beta1.CustomResourceColumnDefinition {
+		return []apiextensionsv1beta1.CustomResourceColumnDefinition{
+			{Name: "Applied", Type: "boolean", JSONPath: ".status.applied"},
+			{Name: "Schedule", Type: "string", JSONPath: schedule},
+			{Name: "Attempts", Type: "integer", JSONPath: ".status.attempts", Priority: 1},
+			{Name: "Reason", Type: "string", JSONPath: ".status.reason", Priority: 1},
+			{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+		}
+	}
+
+	versions := []apiextensionsv1beta1.CustomResourceDefinitionVersion{{
+		Name:    v1alpha1.TPRVersion,
+		Served:  true,
+		Storage: true,
+		Schema: &apiextensionsv1beta1.CustomResourceValidation{
+			OpenAPIV3Schema: schemaResource(spec(alpha), status),
+		},
+		Subresources:             statusSubresource(),
+		AdditionalPrinterColumns: columns(".spec.schedule"),
+	}}
+	if conv != nil {
+		schedule["cron"] = schemaString()
+		beta := map[string]apiextensionsv1beta1.JSONSchemaProps{
+			"instanceSelector": schemaLabelSelector(),
+			"schedule":         schemaObject(schedule),
+			"pod":              schemaObject(pod),
+		}
+		versions = append(versions, apiextensionsv1beta1.CustomResourceDefinitionVersion{
+			Name:   v1beta1.Version,
+			Served: true,
+			Schema: &apiextensionsv1beta1.CustomResourceValidation{
+				OpenAPIV3Schema: schemaResource(spec(beta), status),
+			},
+			Subresources:             statusSubresource(),
+			AdditionalPrinterColumns: columns(".spec.schedule.cron"),
+		})
+	}
+
+	return &apiextensionsv1beta1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: crdPersistenceAction},
+		Spec: crdSpec(apiextensionsv1beta1.CustomResourceDefinitionSpec{
+			Group:    v1alpha1.TPRGroup,
+			Version:  v1alpha1.TPRVersion,
+			Versions: versions,
+			Scope:    apiextensionsv1beta1.NamespaceScoped,
+			Names: apiextensionsv1beta1.CustomResourceDefinitionNames{
+				Plural:     v1alpha1.TPRPersistenceActionName,
+				Singular:   "persistenceaction",
+				Kind:       v1alpha1.TPRPersistenceActionsKind,
+				ListKind:   v1alpha1.TPRPersistenceActionsKind + "List",
+				ShortNames: []string{"pa"},
+				Categories: []string{"persistence"},
+			},
+			Conversion: conv,
+		}),
+	}
+}
+
+// crdSpec completes spec, whose versions each define their schema,
+// subresources and printer columns, as the API server expects it. Fields
+// which are the same for every version are only accepted at the top level,
+// and conversion webhooks require unknown fields to be pruned.
+func crdSpec(spec apiextensionsv1beta1.CustomResourceDefinitionSpec) apiextensionsv1beta1.CustomResourceDefinitionSpec {
+	versions := spec.Versions
+	schemas, subresources, columns := true, true, true
+	for _, v := range versions[1:] {
+		schemas = schemas && apiequality.Semantic.DeepEqual(v.Schema, versions[0].Schema)
+		subresources = subresources && apiequality.Semantic.DeepEqual(v.Subresources, versions[0].Subresources)
+		columns = columns && apiequality.Semantic.DeepEqual(v.AdditionalPrinterColumns, versions[0].AdditionalPrinterColumns)
+	}
+	if schemas {
+		spec.Validation = versions[0].Schema
+	}
+	if subresources {
+		spec.Subresources = versions[0].Subresources
+	}
+	if columns {
+		spec.AdditionalPrinterColumns = versions[0].AdditionalPrinterColumns
+	}
+	for i := range versions {
+		if schemas {
+			versions[i].Schema = nil
+		}
+		if subresources {
+			versions[i].Subresources = nil
+		}
+		if columns {
+			versions[i].AdditionalPrinterColumns = nil
+		}
+	}
+
+	if spec.Conversion != nil && spec.Conversion.Strategy == apiextensionsv1beta1.WebhookConverter {
+		spec.PreserveUnknownFields = pointer.BoolPtr(false)
+	}
+	return spec
+}
+
+func statusSubresource() *apiextensionsv1beta1.CustomResourceSubresources {
+	return &apiextensionsv1beta1.CustomResourceSubresources{
+		Status: &apiextensionsv1beta1.CustomResourceSubresourceStatus{},
+	}
+}
+
+// The helpers below build the structural OpenAPI schemas of the resources.
+
+// schemaResource is the schema of a resource with the given spec and status.
+func schemaResource(spec, status apiextensionsv1beta1.JSONSchemaProps) *apiextensionsv1beta1.JSONSchemaProps {
+	res := schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"apiVersion": schemaString(),
+		"kind":       schemaString(),
+		"metadata":   {Type: "object"},
+		"spec":       spec,
+		"status":     schemaNullable(status),
+	}, "spec")
+	return &res
+}
+
+func schemaString() apiextensionsv1beta1.JSONSchemaProps {
+	return apiextensionsv1beta1.JSONSchemaProps{Type: "string"}
+}
+
+func schemaBool() apiextensionsv1beta1.JSONSchemaProps {
+	return apiextensionsv1beta1.JSONSchemaProps{Type: "boolean"}
+}
+
+func schemaInt() apiextensionsv1beta1.JSONSchemaProps {
+	return apiextensionsv1beta1.JSONSchemaProps{Type: "integer", Format: "int32"}
+}
+
+func schemaPort() apiextensionsv1beta1.JSONSchemaProps {
+	res := schemaInt()
+	min, max := float64(0), float64(65535)
+	res.Minimum, res.Maximum = &min, &max
+	return res
+}
+
+func schemaInt64() apiextensionsv1beta1.JSONSchemaProps {
+	return apiextensionsv1beta1.JSONSchemaProps{Type: "integer", Format: "int64"}
+}
+
+func schemaTime() apiextensionsv1beta1.JSONSchemaProps {
+	return apiextensionsv1beta1.JSONSchemaProps{Type: "string", Format: "date-time"}
+}
+
+// schemaEnum is a string which is either empty, for the default, or one of
+// values.
+func schemaEnum(values ...string) apiextensionsv1beta1.JSONSchemaProps {
+	res := schemaString()
+	res.Enum = []apiextensionsv1beta1.JSON{{Raw: []byte(`""`)}}
+	for _, v := range values {
+		res.Enum = append(res.Enum, apiextensionsv1beta1.JSON{Raw: []byte(`"` + v + `"`)})
+	}
+	return res
+}
+
+func schemaNullable(s apiextensionsv1beta1.JSONSchemaProps) apiextensionsv1beta1.JSONSchemaProps {
+	s.Nullable = true
+	return s
+}
+
+func schemaObject(properties map[string]apiextensionsv1beta1.JSONSchemaProps, required ...string) apiextensionsv1beta1.JSONSchemaProps {
+	return apiextensionsv1beta1.JSONSchemaProps{
+		Type:       "object",
+		Properties: properties,
+		Required:   required,
+	}
+}
+
+func schemaArray(items apiextensionsv1beta1.JSONSchemaProps) apiextensionsv1beta1.JSONSchemaProps {
+	return apiextensionsv1beta1.JSONSchemaProps{
+		Type:  "array",
+		Items: &apiextensionsv1beta1.JSONSchemaPropsOrArray{Schema: &items},
+	}
+}
+
+func schemaStringMap() apiextensionsv1beta1.JSONSchemaProps {
+	s := schemaString()
+	return apiextensionsv1beta1.JSONSchemaProps{
+		Type:                 "object",
+		AdditionalProperties: &apiextensionsv1beta1.JSONSchemaPropsOrBool{Allows: true, Schema: &s},
+	}
+}
+
+// schemaPreserved is an object validated by the API server's core types
+// rather than the CRD, e.g. resource requirements.
+func schemaPreserved() apiextensionsv1beta1.JSONSchemaProps {
+	preserve := true
+	return apiextensionsv1beta1.JSONSchemaProps{
+		Type:                   "object",
+		XPreserveUnknownFields: &preserve,
+	}
+}
+
+func schemaLocalObjectReference() apiextensionsv1beta1.JSONSchemaProps {
+	return schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{"name": schemaString()}, "name")
+}
+
+func schemaSecretKeySelector() apiextensionsv1beta1.JSONSchemaProps {
+	return schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"name":     schemaString(),
+		"key":      schemaString(),
+		"optional": schemaBool(),
+	}, "name", "key")
+}
+
+func schemaConfigMapKeySelector() apiextensionsv1beta1.JSONSchemaProps {
+	return schemaSecretKeySelector()
+}
+
+func schemaLabelSelector() apiextensionsv1beta1.JSONSchemaProps {
+	return schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"matchLabels": schemaStringMap(),
+		"matchExpressions": schemaArray(schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+			"key":      schemaString(),
+			"operator": schemaString(),
+			"values":   schemaArray(schemaString()),
+		}, "key", "operator")),
+	})
+}
+
+func schemaTLS() apiextensionsv1beta1.JSONSchemaProps {
+	return schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"mode":                schemaEnum(TLSModeDisable, TLSModeRequire, TLSModeVerifyCA, TLSModeVerifyFull),
+		"caSecretRef":         schemaSecretKeySelector(),
+		"clientCertSecretRef": schemaLocalObjectReference(),
+		"serverName":          schemaString(),
+	})
+}
+
+func schemaActionSource() apiextensionsv1beta1.JSONSchemaProps {
+	keysSelector := schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"name":    schemaString(),
+		"pattern": schemaString(),
+	}, "name")
+	return schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"configMapKeyRef":  schemaConfigMapKeySelector(),
+		"secretKeyRef":     schemaSecretKeySelector(),
+		"configMapKeysRef": keysSelector,
+		"secretKeysRef":    keysSelector,
+	})
+}
+
+func schemaValuesSource() apiextensionsv1beta1.JSONSchemaProps {
+	return schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"configMapRef": schemaLocalObjectReference(),
+		"secretRef":    schemaLocalObjectReference(),
+	})
+}
+
+func schemaDependency() apiextensionsv1beta1.JSONSchemaProps {
+	return schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"name":     schemaString(),
+		"selector": schemaLabelSelector(),
+	})
+}
+
+func schemaCondition() apiextensionsv1beta1.JSONSchemaProps {
+	return schemaObject(map[string]apiextensionsv1beta1.JSONSchemaProps{
+		"type":               schemaString(),
+		"status":             schemaString(),
+		"lastTransitionTime": schemaNullable(schemaTime()),
+		"reason":             schemaString(),
+		"message":            schemaString(),
+	}, "type", "status")
+}
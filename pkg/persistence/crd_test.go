@@ -0,0 +1,57 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"testing"
+
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/validation"
+)
+
+func TestCRDsValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+	}{
+		{name: "without conversion"},
+		{name: "with conversion", service: "persistence/persistence-operator"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Operator{config: Config{ConversionWebhookService: test.service}}
+			conv, err := c.crdConversion()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, crd := range []*apiextensionsv1beta1.CustomResourceDefinition{
+				persistenceInstanceCRD(conv),
+				persistenceActionCRD(conv),
+			} {
+				// The API server defaults the CRD before validating it.
+				apiextensionsv1beta1.SetObjectDefaults_CustomResourceDefinition(crd)
+				var internal apiextensions.CustomResourceDefinition
+				if err := apiextensionsv1beta1.Convert_v1beta1_CustomResourceDefinition_To_apiextensions_CustomResourceDefinition(crd, &internal, nil); err != nil {
+					t.Fatal(err)
+				}
+				if errs := validation.ValidateCustomResourceDefinition(&internal, apiextensionsv1beta1.SchemeGroupVersion); len(errs) > 0 {
+					t.Errorf("expected CRD %s to be valid, got %v", crd.Name, errs.ToAggregate())
+				}
+			}
+		})
+	}
+}
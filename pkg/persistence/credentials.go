@@ -0,0 +1,111 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Credentials are the username, password and TLS configuration used to
+// connect to a PersistenceInstance.
+type Credentials struct {
+	Username string
+	Password string
+	// Nil if the instance has no TLS configuration.
+	TLS *TLS
+}
+
+// instanceCredentials reads the credentials of i from the secrets it
+// references.
+func instanceCredentials(kclient kubernetes.Interface, i *v1alpha1.PersistenceInstance) (Credentials, error) {
+	var res Credentials
+	for _, c := range []struct {
+		ref   *v1.SecretKeySelector
+		value *string
+	}{
+		{ref: i.Spec.UsernameSecretRef, value: &res.Username},
+		{ref: i.Spec.PasswordSecretRef, value: &res.Password},
+	} {
+		if c.ref == nil {
+			continue
+		}
+		v, err := secretKey(kclient, i.Namespace, c.ref)
+		if err != nil {
+			return res, err
+		}
+		*c.value = v
+	}
+	t, err := instanceTLS(kclient, i)
+	if err != nil {
+		return res, errors.Wrap(err, "tls")
+	}
+	res.TLS = t
+	return res, nil
+}
+
+// secretKey reads the value of the secret key ref from the given namespace.
+func secretKey(kclient kubernetes.Interface, ns string, ref *v1.SecretKeySelector) (string, error) {
+	if ref.Name == "" || ref.Key == "" {
+		return "", fmt.Errorf("secret reference needs a name and a key")
+	}
+	s, err := kclient.CoreV1().Secrets(ns).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "retrieving secret %s failed", ref.Name)
+	}
+	v, ok := s.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %s", ref.Name, ref.Key)
+	}
+	return string(v), nil
+}
+
+// validateInstance checks the secret keys referenced by i exist and its TLS
+// configuration is valid.
+func validateInstance(kclient kubernetes.Interface, i *v1alpha1.PersistenceInstance) error {
+	// The references are checked in order, so the same error is reported
+	// on every probe.
+	type secretRef struct {
+		field string
+		ref   *v1.SecretKeySelector
+	}
+	for _, r := range []secretRef{
+		{field: "usernameSecretRef", ref: i.Spec.UsernameSecretRef},
+		{field: "passwordSecretRef", ref: i.Spec.PasswordSecretRef},
+	} {
+		if r.ref == nil {
+			continue
+		}
+		if _, err := secretKey(kclient, i.Namespace, r.ref); err != nil {
+			return errors.Wrap(err, r.field)
+		}
+	}
+	t, err := instanceTLS(kclient, i)
+	if err != nil {
+		return errors.Wrap(err, "tls")
+	}
+	if t != nil {
+		if _, err := t.Config(); err != nil {
+			return errors.Wrap(err, "tls")
+		}
+	}
+	return nil
+}
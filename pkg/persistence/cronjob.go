@@ -15,29 +15,128 @@
 package persistence
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
 	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
 	"github.com/pkg/errors"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/pkg/apis/batch/v2alpha1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
-	oracleBaseImage   = ""
-	postgresBaseImage = ""
-	mysqlBaseImage    = ""
-	mongoBaseImage    = ""
+	executorContainerName = "persistence-action"
+	credentialsMountPath  = "/etc/persistence"
+	clientCertVolumeName  = "client-cert"
+
+	// Labels identifying the PersistenceAction and PersistenceInstance an
+	// execution belongs to.
+	actionLabel   = "persistence.mmerrill3.com/action"
+	instanceLabel = "persistence.mmerrill3.com/instance"
+	// kindLabel marks executions rolling an action back. Executions without
+	// it apply the action.
+	kindLabel = "persistence.mmerrill3.com/kind"
+	// managedByLabel marks the workloads generated by the operator, so they
+	// can be swept once their action is gone.
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedBy      = "persistence-operator"
+
+	defaultSuccessfulJobsHistoryLimit = 3
+	defaultFailedJobsHistoryLimit     = 1
+
+	// maxExecutionNameLength is the longest name of a CronJob, whose Jobs are
+	// named after it with a suffix. It leaves room for the suffix of rollback
+	// Jobs as well.
+	maxExecutionNameLength = 52
+	// executionHashLength is the length of the hash making execution names
+	// unique.
+	executionHashLength = 8
 )
 
-func makeCronJob(p v1alpha1.PersistenceAction) (*v2alpha1.CronJob, error) {
-	spec, err := makeCronJobSpec(p)
+// executionName returns the name of the workload running the actions of p
+// against the PersistenceInstance i. The names of p and i are truncated to
+// fit the length limits of CronJobs and Jobs, and followed by a hash of both,
+// so names stay unique if they are truncated or contain dashes.
+func executionName(p v1alpha1.PersistenceAction, i v1alpha1.PersistenceInstance) string {
+	sum := sha256.Sum256([]byte(p.Name + "/" + i.Name))
+	hash := hex.EncodeToString(sum[:])[:executionHashLength]
+
+	name := p.Name + "-" + i.Name
+	if max := maxExecutionNameLength - executionHashLength - 1; len(name) > max {
+		name = name[:max]
+	}
+	// Names have to end with an alphanumeric character before the hash is
+	// appended.
+	name = strings.TrimRight(name, "-.")
+	return name + "-" + hash
+}
+
+// executorImage returns the image executing actions against instances of the
+// given persistence type in Jobs, as configured by conf or else by the driver
+// of the type.
+func executorImage(conf Config, persistenceType string) (string, error) {
+	if image := conf.ExecutorImages[strings.ToLower(persistenceType)]; image != "" {
+		return image, nil
+	}
+	if d, err := LookupDriver(persistenceType); err == nil && d.ExecutorImage() != "" {
+		return d.ExecutorImage(), nil
+	}
+	return "", fmt.Errorf("no executor image configured for persistence type %s, configure one or use the %s executor", persistenceType, ExecutorInProcess)
+}
+
+// executionLabels returns the labels of p extended by the labels identifying
+// the execution against the PersistenceInstance i.
+func executionLabels(p v1alpha1.PersistenceAction, i v1alpha1.PersistenceInstance) map[string]string {
+	res := make(map[string]string, len(p.Labels)+3)
+	for k, v := range p.Labels {
+		res[k] = v
+	}
+	res[actionLabel] = p.Name
+	res[instanceLabel] = i.Name
+	res[managedByLabel] = managedBy
+	return res
+}
+
+// ownerReferences makes p the controller of the workloads generated for it,
+// so they are garbage collected along with it.
+func ownerReferences(p v1alpha1.PersistenceAction) []metav1.OwnerReference {
+	controller := true
+	blockOwnerDeletion := true
+	return []metav1.OwnerReference{{
+		APIVersion:         v1alpha1.TPRGroup + "/" + v1alpha1.TPRVersion,
+		Kind:               v1alpha1.TPRPersistenceActionsKind,
+		Name:               p.Name,
+		UID:                p.UID,
+		Controller:         &controller,
+		BlockOwnerDeletion: &blockOwnerDeletion,
+	}}
+}
+
+// actionSelector selects all executions belonging to the PersistenceAction
+// with the given name.
+func actionSelector(name string) string {
+	return labels.SelectorFromSet(labels.Set{actionLabel: name}).String()
+}
+
+// makeCronJob creates the CronJob running the actions of p against the
+// PersistenceInstance i on schedule, in the given executor image.
+func makeCronJob(p v1alpha1.PersistenceAction, i v1alpha1.PersistenceInstance, image string) (*batchv1beta1.CronJob, error) {
+	spec, err := makeCronJobSpec(p, i, image)
 	if err != nil {
 		return nil, errors.Wrap(err, "make CronJob spec")
 	}
-	cronjob := &v2alpha1.CronJob{
+	cronjob := &batchv1beta1.CronJob{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        p.Name,
-			Labels:      p.ObjectMeta.Labels,
-			Annotations: p.ObjectMeta.Annotations,
+			Name:            executionName(p, i),
+			Labels:          executionLabels(p, i),
+			Annotations:     p.ObjectMeta.Annotations,
+			OwnerReferences: ownerReferences(p),
 		},
 		Spec: *spec,
 	}
@@ -45,6 +144,218 @@ func makeCronJob(p v1alpha1.PersistenceAction) (*v2alpha1.CronJob, error) {
 	return cronjob, nil
 }
 
-func makeCronJobSpec(p v1alpha1.PersistenceAction) (*v2alpha1.CronJobSpec, error) {
-	return &v2alpha1.CronJobSpec{}, nil
+func makeCronJobSpec(p v1alpha1.PersistenceAction, i v1alpha1.PersistenceInstance, image string) (*batchv1beta1.CronJobSpec, error) {
+	schedule, err := cronSchedule(p)
+	if err != nil {
+		return nil, err
+	}
+	concurrencyPolicy, err := cronConcurrencyPolicy(p)
+	if err != nil {
+		return nil, err
+	}
+	jobSpec, err := makeJobSpec(p, i, image)
+	if err != nil {
+		return nil, err
+	}
+
+	suspend := p.Spec.Suspend
+	successfulJobsHistoryLimit := int32(defaultSuccessfulJobsHistoryLimit)
+	if p.Spec.SuccessfulJobsHistoryLimit != nil {
+		successfulJobsHistoryLimit = *p.Spec.SuccessfulJobsHistoryLimit
+	}
+	failedJobsHistoryLimit := int32(defaultFailedJobsHistoryLimit)
+	if p.Spec.FailedJobsHistoryLimit != nil {
+		failedJobsHistoryLimit = *p.Spec.FailedJobsHistoryLimit
+	}
+
+	return &batchv1beta1.CronJobSpec{
+		Schedule:                   schedule,
+		ConcurrencyPolicy:          concurrencyPolicy,
+		Suspend:                    &suspend,
+		SuccessfulJobsHistoryLimit: &successfulJobsHistoryLimit,
+		FailedJobsHistoryLimit:     &failedJobsHistoryLimit,
+		JobTemplate: batchv1beta1.JobTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: executionLabels(p, i),
+			},
+			Spec: *jobSpec,
+		},
+	}, nil
+}
+
+// errTimeZoneUnsupported rejects schedules with a time zone. The CronJob
+// controller interprets schedules in its own time zone and doesn't understand
+// the CRON_TZ prefix.
+var errTimeZoneUnsupported = errors.New("time zones are not supported by the CronJob controller, schedules are interpreted in the time zone of the kube-controller-manager")
+
+// cronSchedule validates the Schedule of p and returns it in the format
+// understood by the CronJob controller.
+func cronSchedule(p v1alpha1.PersistenceAction) (string, error) {
+	schedule := strings.TrimSpace(p.Spec.Schedule)
+	if strings.HasPrefix(schedule, "CRON_TZ=") || strings.HasPrefix(schedule, "TZ=") {
+		return "", errTimeZoneUnsupported
+	}
+	if !strings.HasPrefix(schedule, "@") && len(strings.Fields(schedule)) != 5 {
+		return "", fmt.Errorf("invalid schedule %q: expected five fields", p.Spec.Schedule)
+	}
+	return schedule, nil
+}
+
+// cronConcurrencyPolicy returns the ConcurrencyPolicy of p. Concurrent
+// executions are forbidden by default, as actions are generally not safe to
+// run in parallel.
+func cronConcurrencyPolicy(p v1alpha1.PersistenceAction) (batchv1beta1.ConcurrencyPolicy, error) {
+	switch batchv1beta1.ConcurrencyPolicy(p.Spec.ConcurrencyPolicy) {
+	case "", batchv1beta1.ForbidConcurrent:
+		return batchv1beta1.ForbidConcurrent, nil
+	case batchv1beta1.AllowConcurrent:
+		return batchv1beta1.AllowConcurrent, nil
+	case batchv1beta1.ReplaceConcurrent:
+		return batchv1beta1.ReplaceConcurrent, nil
+	}
+	return "", fmt.Errorf("unknown concurrency policy %q", p.Spec.ConcurrencyPolicy)
+}
+
+// makePodSpec builds the pod running the actions of p against the
+// PersistenceInstance i in the given executor image, which implements the
+// executor contract documented in the README. The actions are rendered for
+// the instance, so they may contain secrets. They are mounted from the Secret
+// generated for the execution, one file per action in lexical order, instead
+// of being passed as arguments. The credentials and TLS certificates are
+// mounted from the secrets referenced by the instance.
+func makePodSpec(p v1alpha1.PersistenceAction, i v1alpha1.PersistenceInstance, image string) (*v1.PodSpec, error) {
+	if _, err := LookupDriver(i.Spec.PersistenceType); err != nil {
+		return nil, err
+	}
+	if len(p.Spec.Actions) == 0 {
+		return nil, fmt.Errorf("no actions defined")
+	}
+
+	// The executor records the action in the history table of the instance
+	// and skips it if it is recorded already. Scheduled actions are meant to
+	// be repeated and never skipped. With auto rollback enabled the executor
+	// runs the rollback actions, mounted along with the actions, if the
+	// actions fail part way.
+	env := []v1.EnvVar{
+		{Name: "PERSISTENCE_TYPE", Value: i.Spec.PersistenceType},
+		{Name: "PERSISTENCE_URL", Value: i.Spec.URL},
+		{Name: "PERSISTENCE_PORT", Value: strconv.Itoa(int(i.Spec.Port))},
+		{Name: "PERSISTENCE_DATABASE", Value: i.Spec.Database},
+		{Name: "PERSISTENCE_SCHEMA", Value: i.Spec.Schema},
+		{Name: "PERSISTENCE_PARAMETERS", Value: encodeParameters(i.Spec.Parameters)},
+		{Name: "PERSISTENCE_ACTION", Value: historyAction(&p)},
+		{Name: "PERSISTENCE_ACTION_VERSION", Value: p.Spec.Version},
+		{Name: "PERSISTENCE_ACTION_CHECKSUM", Value: checksumOf(&p)},
+		{Name: "PERSISTENCE_ACTION_REPEATABLE", Value: strconv.FormatBool(p.Spec.Schedule != "")},
+		{Name: "PERSISTENCE_CHECKSUM_POLICY", Value: p.Spec.ChecksumPolicy},
+		{Name: "PERSISTENCE_ACTION_KIND", Value: historyKindApply},
+		{Name: "PERSISTENCE_AUTO_ROLLBACK", Value: strconv.FormatBool(p.Spec.AutoRollback)},
+	}
+	var (
+		volumes []v1.Volume
+		mounts  []v1.VolumeMount
+	)
+	type secretRef struct {
+		name string
+		env  string
+		ref  *v1.SecretKeySelector
+	}
+	secretRefs := []secretRef{
+		{name: "username", env: "PERSISTENCE_USERNAME_FILE", ref: i.Spec.UsernameSecretRef},
+		{name: "password", env: "PERSISTENCE_PASSWORD_FILE", ref: i.Spec.PasswordSecretRef},
+	}
+	if t := i.Spec.TLS; t != nil {
+		mode, err := tlsMode(t)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env,
+			v1.EnvVar{Name: "PERSISTENCE_TLS_MODE", Value: mode},
+			v1.EnvVar{Name: "PERSISTENCE_TLS_SERVER_NAME", Value: t.ServerName},
+		)
+		secretRefs = append(secretRefs, secretRef{name: "ca", env: "PERSISTENCE_TLS_CA_FILE", ref: t.CASecretRef})
+
+		if t.ClientCertSecretRef != nil {
+			mountPath := path.Join(credentialsMountPath, clientCertVolumeName)
+			volumes = append(volumes, v1.Volume{
+				Name: clientCertVolumeName,
+				VolumeSource: v1.VolumeSource{
+					Secret: &v1.SecretVolumeSource{
+						SecretName: t.ClientCertSecretRef.Name,
+						Items: []v1.KeyToPath{
+							{Key: v1.TLSCertKey, Path: v1.TLSCertKey},
+							{Key: v1.TLSPrivateKeyKey, Path: v1.TLSPrivateKeyKey},
+						},
+					},
+				},
+			})
+			mounts = append(mounts, v1.VolumeMount{
+				Name:      clientCertVolumeName,
+				MountPath: mountPath,
+				ReadOnly:  true,
+			})
+			env = append(env,
+				v1.EnvVar{Name: "PERSISTENCE_TLS_CERT_FILE", Value: path.Join(mountPath, v1.TLSCertKey)},
+				v1.EnvVar{Name: "PERSISTENCE_TLS_KEY_FILE", Value: path.Join(mountPath, v1.TLSPrivateKeyKey)},
+			)
+		}
+	}
+	for _, c := range secretRefs {
+		if c.ref == nil {
+			continue
+		}
+		mountPath := path.Join(credentialsMountPath, c.name)
+		volumes = append(volumes, v1.Volume{
+			Name: c.name,
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{
+					SecretName: c.ref.Name,
+					Items: []v1.KeyToPath{
+						{Key: c.ref.Key, Path: c.name},
+					},
+				},
+			},
+		})
+		mounts = append(mounts, v1.VolumeMount{
+			Name:      c.name,
+			MountPath: mountPath,
+			ReadOnly:  true,
+		})
+		env = append(env, v1.EnvVar{
+			Name:  c.env,
+			Value: path.Join(mountPath, c.name),
+		})
+	}
+
+	volumes = append(volumes, v1.Volume{
+		Name: actionsVolumeName,
+		VolumeSource: v1.VolumeSource{
+			Secret: &v1.SecretVolumeSource{SecretName: actionsSecretName(executionName(p, i))},
+		},
+	})
+	mounts = append(mounts, v1.VolumeMount{
+		Name:      actionsVolumeName,
+		MountPath: actionsMountPath,
+		ReadOnly:  true,
+	})
+	env = append(env, v1.EnvVar{Name: "PERSISTENCE_ACTIONS_DIR", Value: actionsMountPath})
+
+	return &v1.PodSpec{
+		Containers: []v1.Container{
+			{
+				Name:         executorContainerName,
+				Image:        image,
+				Env:          env,
+				Resources:    p.Spec.Resources,
+				VolumeMounts: mounts,
+			},
+		},
+		// Actions are not idempotent, a failed container must not be restarted
+		// in place.
+		RestartPolicy:      v1.RestartPolicyNever,
+		NodeSelector:       p.Spec.NodeSelector,
+		ServiceAccountName: p.Spec.ServiceAccountName,
+		Tolerations:        p.Spec.Tolerations,
+		Volumes:            volumes,
+	}, nil
 }
@@ -0,0 +1,284 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+const testExecutorImage = "registry.example.com/persistence-executor:v1"
+
+func testAction() v1alpha1.PersistenceAction {
+	return v1alpha1.PersistenceAction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "create-users",
+			Namespace: "shop",
+			UID:       "8b1e3f4c-5a6d-11e7-907b-a6006ad3dba0",
+			Labels:    map[string]string{"app": "shop"},
+		},
+		Spec: v1alpha1.PersistenceActionSpec{
+			PersistenceInstanceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "shop"},
+			},
+			Version:         "1",
+			Actions:         []string{"CREATE TABLE users (id INT PRIMARY KEY);"},
+			RollbackActions: []string{"DROP TABLE users;"},
+			ChecksumPolicy:  checksumPolicyFail,
+			AutoRollback:    true,
+		},
+	}
+}
+
+func testInstance() v1alpha1.PersistenceInstance {
+	return v1alpha1.PersistenceInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "orders-db",
+			Namespace: "shop",
+			Labels:    map[string]string{"app": "shop"},
+		},
+		Spec: v1alpha1.PersistenceInstanceSpec{
+			PersistenceType: "Postgres",
+			URL:             "orders-db.shop.svc",
+			Port:            5432,
+			Database:        "orders",
+			Schema:          "public",
+			Parameters:      map[string]string{"connect_timeout": "10"},
+			UsernameSecretRef: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "orders-db"},
+				Key:                  "username",
+			},
+			PasswordSecretRef: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "orders-db"},
+				Key:                  "password",
+			},
+			TLS: &v1alpha1.PersistenceInstanceTLS{
+				Mode: TLSModeVerifyFull,
+				CASecretRef: &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{Name: "orders-db-ca"},
+					Key:                  "ca.crt",
+				},
+				ClientCertSecretRef: &v1.LocalObjectReference{Name: "orders-db-client"},
+				ServerName:          "orders-db",
+			},
+		},
+	}
+}
+
+// checkGolden compares obj, serialized as indented JSON, to the golden file
+// testdata/name. The golden file is rewritten instead if -update is given.
+func checkGolden(t *testing.T, name string, obj interface{}) {
+	got, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the generated object, rerun with -update if the change is intended. Got:\n%s", path, got)
+	}
+}
+
+func TestMakeJobGolden(t *testing.T) {
+	job, err := makeJob(testAction(), testInstance(), testExecutorImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "job.golden", job)
+
+	if job.Spec.BackoffLimit == nil || *job.Spec.BackoffLimit != 0 {
+		t.Errorf("expected failed executions not to be retried, got backoff limit %v", job.Spec.BackoffLimit)
+	}
+}
+
+func TestMakeRollbackJobGolden(t *testing.T) {
+	job, err := makeRollbackJob(testAction(), testInstance(), testExecutorImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "rollback-job.golden", job)
+
+	for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+		if e.Name == "PERSISTENCE_AUTO_ROLLBACK" && e.Value != "false" {
+			t.Errorf("rollback job passes auto rollback %s, expected false", e.Value)
+		}
+		if e.Name == "PERSISTENCE_ACTION_KIND" && e.Value != historyKindRollback {
+			t.Errorf("rollback job passes action kind %s, expected %s", e.Value, historyKindRollback)
+		}
+	}
+}
+
+func TestJobChecksum(t *testing.T) {
+	p := testAction()
+	want := actionChecksum(p.Spec.Actions, p.Spec.Values)
+	// Annotations are set by users and must not override the checksum.
+	p.Annotations = map[string]string{checksumAnnotation: "forged"}
+
+	for _, build := range []func(v1alpha1.PersistenceAction, v1alpha1.PersistenceInstance, string) (*batchv1.Job, error){makeJob, makeRollbackJob} {
+		job, err := build(p, testInstance(), testExecutorImage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := job.Annotations[checksumAnnotation]; got != want {
+			t.Errorf("job %s is annotated with checksum %s, expected %s", job.Name, got, want)
+		}
+		for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+			if e.Name == "PERSISTENCE_ACTION_CHECKSUM" && e.Value != want {
+				t.Errorf("job %s passes checksum %s, expected %s", job.Name, e.Value, want)
+			}
+		}
+	}
+}
+
+func TestMakeCronJobGolden(t *testing.T) {
+	p := testAction()
+	p.Spec.Schedule = "0 3 * * *"
+	p.Spec.RollbackActions = nil
+	p.Spec.AutoRollback = false
+	cronJob, err := makeCronJob(p, testInstance(), testExecutorImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "cronjob.golden", cronJob)
+}
+
+func TestCronSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		schedule string
+		expected string
+		err      error
+	}{
+		{schedule: "0 3 * * *", expected: "0 3 * * *"},
+		{schedule: " @daily ", expected: "@daily"},
+		{schedule: "0 3 * *", err: errors.New(`invalid schedule "0 3 * *": expected five fields`)},
+		{schedule: "CRON_TZ=Europe/Berlin 0 3 * * *", err: errTimeZoneUnsupported},
+		{schedule: "TZ=Europe/Berlin 0 3 * * *", err: errTimeZoneUnsupported},
+	} {
+		p := testAction()
+		p.Spec.Schedule = tc.schedule
+		schedule, err := cronSchedule(p)
+		if fmt.Sprint(err) != fmt.Sprint(tc.err) {
+			t.Errorf("%q: expected error %v, got %v", tc.schedule, tc.err, err)
+		}
+		if schedule != tc.expected {
+			t.Errorf("%q: expected schedule %q, got %q", tc.schedule, tc.expected, schedule)
+		}
+	}
+}
+
+func TestExecutionName(t *testing.T) {
+	long := strings.Repeat("a", 253)
+	for _, tc := range []struct {
+		action, instance string
+	}{
+		{"create-users", "orders-db"},
+		{"a-b", "c"},
+		{"a", "b-c"},
+		{long, "orders-db"},
+		{long, long},
+		{strings.Repeat("a", 42) + "-", "db"},
+		{strings.Repeat("a", 40) + ".b", "db"},
+	} {
+		p, i := testAction(), testInstance()
+		p.Name, i.Name = tc.action, tc.instance
+		name := executionName(p, i)
+
+		if len(name) > maxExecutionNameLength {
+			t.Errorf("execution name of %s on %s is %d characters long, expected at most %d", tc.action, tc.instance, len(name), maxExecutionNameLength)
+		}
+		if len(rollbackName(p, i)) > 63 {
+			t.Errorf("rollback name of %s on %s exceeds 63 characters", tc.action, tc.instance)
+		}
+		prefix := name[:len(name)-executionHashLength-1]
+		if last := prefix[len(prefix)-1]; last == '-' || last == '.' {
+			t.Errorf("execution name %q of %s on %s is malformed", name, tc.action, tc.instance)
+		}
+	}
+
+	p, i := testAction(), testInstance()
+	p.Name, i.Name = "a-b", "c"
+	collides := executionName(p, i)
+	p.Name, i.Name = "a", "b-c"
+	if name := executionName(p, i); name == collides {
+		t.Errorf("execution names of a-b on c and a on b-c collide: %s", name)
+	}
+}
+
+// registerImageDriver registers a copy of the Postgres driver with a default
+// executor image as persistence type ImagePostgres.
+var registerImageDriver sync.Once
+
+func TestExecutorImage(t *testing.T) {
+	registerImageDriver.Do(func() {
+		d, err := LookupDriver("Postgres")
+		if err != nil {
+			t.Fatal(err)
+		}
+		withImage := *d.(*sqlDriver)
+		withImage.executorImage = "registry.example.com/executor-postgres:v1"
+		RegisterDriver("ImagePostgres", &withImage)
+	})
+
+	conf := Config{ExecutorImages: map[string]string{"postgres": testExecutorImage, "imagepostgres": testExecutorImage}}
+	for _, tc := range []struct {
+		conf            Config
+		persistenceType string
+		expected        string
+	}{
+		{conf: conf, persistenceType: "Postgres", expected: testExecutorImage},
+		{persistenceType: "Postgres"},
+		{conf: conf, persistenceType: "MySQL"},
+		{persistenceType: "ImagePostgres", expected: "registry.example.com/executor-postgres:v1"},
+		{conf: conf, persistenceType: "ImagePostgres", expected: testExecutorImage},
+		{persistenceType: "Cassandra"},
+	} {
+		image, err := executorImage(tc.conf, tc.persistenceType)
+		if tc.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error without an executor image, got %s", tc.persistenceType, image)
+			}
+			continue
+		}
+		if err != nil || image != tc.expected {
+			t.Errorf("%s: expected %s, got %q, %v", tc.persistenceType, tc.expected, image, err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceActions returns the PersistenceActions of the given namespace by
+// name.
+func (c *Operator) namespaceActions(ns string) (map[string]*v1alpha1.PersistenceAction, error) {
+	objs, err := c.persistenceActionInf.GetIndexer().ByIndex(cache.NamespaceIndex, ns)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing persistence actions failed")
+	}
+	res := make(map[string]*v1alpha1.PersistenceAction, len(objs))
+	for _, obj := range objs {
+		p := obj.(*v1alpha1.PersistenceAction)
+		res[p.Name] = p
+	}
+	return res, nil
+}
+
+// resolveDependencies returns the actions p depends on, ordered by name, and
+// the names of the dependencies which don't exist.
+func resolveDependencies(p *v1alpha1.PersistenceAction, actions map[string]*v1alpha1.PersistenceAction) ([]*v1alpha1.PersistenceAction, []string, error) {
+	var (
+		res     []*v1alpha1.PersistenceAction
+		missing []string
+	)
+	seen := map[string]bool{}
+	add := func(d *v1alpha1.PersistenceAction) {
+		if !seen[d.Name] {
+			seen[d.Name] = true
+			res = append(res, d)
+		}
+	}
+	for _, dep := range p.Spec.DependsOn {
+		if dep.Name != "" {
+			d, ok := actions[dep.Name]
+			if !ok {
+				missing = append(missing, dep.Name)
+				continue
+			}
+			add(d)
+		}
+		if dep.Selector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(dep.Selector)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "invalid dependency selector")
+			}
+			for _, d := range actions {
+				// An action never depends on itself through a selector.
+				if d.Name != p.Name && selector.Matches(labels.Set(d.Labels)) {
+					add(d)
+				}
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, missing, nil
+}
+
+// dependencyCycle returns a cycle of dependencies leading from p back to p,
+// starting and ending with p, or nil if there is none.
+func dependencyCycle(p *v1alpha1.PersistenceAction, actions map[string]*v1alpha1.PersistenceAction) []string {
+	visited := map[string]bool{}
+	var path []string
+	var visit func(a *v1alpha1.PersistenceAction) bool
+	visit = func(a *v1alpha1.PersistenceAction) bool {
+		// Invalid dependencies are reported by the actions declaring them.
+		deps, _, _ := resolveDependencies(a, actions)
+		for _, d := range deps {
+			found := d.Name == p.Name
+			if !found && !visited[d.Name] {
+				visited[d.Name] = true
+				found = visit(d)
+			}
+			if found {
+				path = append(path, a.Name)
+				return true
+			}
+		}
+		return false
+	}
+	if !visit(p) {
+		return nil
+	}
+
+	// The path was collected while unwinding.
+	res := make([]string, 0, len(path)+1)
+	for i := len(path) - 1; i >= 0; i-- {
+		res = append(res, path[i])
+	}
+	return append(res, p.Name)
+}
+
+// dependencyApplied returns whether the action d is applied on the named
+// instance.
+func dependencyApplied(d *v1alpha1.PersistenceAction, instance string) bool {
+	if d.Spec.Applied {
+		return true
+	}
+	if is := previousInstanceStatus(d, instance); is != nil {
+		return is.Applied
+	}
+	return false
+}
+
+// holdForDependencies holds p back on every instance on which one of its
+// dependencies is not applied yet. Cycles hold p back on all instances and
+// are reported by the returned condition.
+func (c *Operator) holdForDependencies(p *v1alpha1.PersistenceAction, instances []*v1alpha1.PersistenceInstance, held map[string]string) (v1alpha1.PersistenceCondition, error) {
+	cond := v1alpha1.PersistenceCondition{
+		Type:   conditionDependencyCycle,
+		Status: conditionStatus(false),
+		Reason: "NoCycle",
+	}
+	// Rollbacks don't wait for the dependencies.
+	if len(p.Spec.DependsOn) == 0 || rollbackRequested(p) {
+		return cond, nil
+	}
+
+	actions, err := c.namespaceActions(p.Namespace)
+	if err != nil {
+		return cond, err
+	}
+	holdAll := func(reason string) {
+		for _, inst := range instances {
+			if _, ok := held[inst.Name]; !ok {
+				held[inst.Name] = reason
+			}
+		}
+	}
+
+	if cycle := dependencyCycle(p, actions); cycle != nil {
+		cond.Status = conditionStatus(true)
+		cond.Reason = "CycleDetected"
+		cond.Message = strings.Join(cycle, " -> ")
+		holdAll("dependency cycle " + cond.Message)
+		return cond, nil
+	}
+
+	deps, missing, err := resolveDependencies(p, actions)
+	if err != nil {
+		holdAll(err.Error())
+		return cond, nil
+	}
+	if len(missing) > 0 {
+		holdAll(fmt.Sprintf("dependencies %v not found", missing))
+		return cond, nil
+	}
+	for _, inst := range instances {
+		if _, ok := held[inst.Name]; ok {
+			continue
+		}
+		for _, d := range deps {
+			if !dependencyApplied(d, inst.Name) {
+				held[inst.Name] = fmt.Sprintf("waiting for persistence action %s", d.Name)
+				break
+			}
+		}
+	}
+	return cond, nil
+}
+
+// enqueueDependents enqueues the PersistenceActions depending on p, as they
+// may be waiting for it.
+func (c *Operator) enqueueDependents(p *v1alpha1.PersistenceAction) {
+	actions, err := c.namespaceActions(p.Namespace)
+	if err != nil {
+		glog.Errorf("listing persistence actions failed: %s", err)
+		return
+	}
+	for _, a := range actions {
+		deps, missing, err := resolveDependencies(a, actions)
+		if err != nil {
+			continue
+		}
+		for _, d := range deps {
+			if d.Name == p.Name {
+				c.enqueue(a)
+			}
+		}
+		for _, name := range missing {
+			if name == p.Name {
+				c.enqueue(a)
+			}
+		}
+	}
+}
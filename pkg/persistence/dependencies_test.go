@@ -0,0 +1,355 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/third_party/workqueue"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// dependentAction returns an action of the shop namespace depending on the
+// actions with the given names.
+func dependentAction(name string, labels map[string]string, deps ...string) *v1alpha1.PersistenceAction {
+	p := testAction()
+	p.Name = name
+	p.Labels = labels
+	for _, d := range deps {
+		p.Spec.DependsOn = append(p.Spec.DependsOn, v1alpha1.PersistenceActionDependency{Name: d})
+	}
+	return &p
+}
+
+// selectingAction returns an action of the shop namespace depending on the
+// actions selected by matchLabels.
+func selectingAction(name string, matchLabels map[string]string) *v1alpha1.PersistenceAction {
+	p := dependentAction(name, nil)
+	p.Spec.DependsOn = []v1alpha1.PersistenceActionDependency{{
+		Selector: &metav1.LabelSelector{MatchLabels: matchLabels},
+	}}
+	return p
+}
+
+func actionsByName(actions ...*v1alpha1.PersistenceAction) map[string]*v1alpha1.PersistenceAction {
+	res := make(map[string]*v1alpha1.PersistenceAction, len(actions))
+	for _, p := range actions {
+		res[p.Name] = p
+	}
+	return res
+}
+
+// dependencyOperator returns an operator knowing the given actions.
+func dependencyOperator(actions ...*v1alpha1.PersistenceAction) *Operator {
+	c := &Operator{
+		persistenceActionInf: cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceAction{}, 0, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		}),
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence"),
+	}
+	for _, p := range actions {
+		c.persistenceActionInf.GetIndexer().Add(p)
+	}
+	return c
+}
+
+// drainQueue returns the keys in q in lexical order.
+func drainQueue(q workqueue.RateLimitingInterface) []string {
+	var res []string
+	for q.Len() > 0 {
+		key, _ := q.Get()
+		res = append(res, key.(string))
+		q.Done(key)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestResolveDependencies(t *testing.T) {
+	schema := dependentAction("schema", map[string]string{"stage": "schema"})
+	users := dependentAction("users", map[string]string{"stage": "schema"})
+	actions := actionsByName(schema, users)
+
+	for _, tc := range []struct {
+		name    string
+		p       *v1alpha1.PersistenceAction
+		deps    []string
+		missing []string
+		err     bool
+	}{
+		{name: "none", p: dependentAction("data", nil)},
+		{name: "by name", p: dependentAction("data", nil, "users", "schema"), deps: []string{"schema", "users"}},
+		{name: "duplicate", p: dependentAction("data", nil, "users", "users"), deps: []string{"users"}},
+		{name: "missing", p: dependentAction("data", nil, "schema", "indexes"), deps: []string{"schema"}, missing: []string{"indexes"}},
+		{name: "by selector", p: selectingAction("data", map[string]string{"stage": "schema"}), deps: []string{"schema", "users"}},
+		// A selector matching the action itself doesn't make it depend on
+		// itself.
+		{name: "selector matching itself", p: selectingAction("users", map[string]string{"stage": "schema"}), deps: []string{"schema"}},
+		{
+			name: "invalid selector",
+			p: func() *v1alpha1.PersistenceAction {
+				p := selectingAction("data", nil)
+				p.Spec.DependsOn[0].Selector.MatchExpressions = []metav1.LabelSelectorRequirement{{Key: "stage", Operator: "Near"}}
+				return p
+			}(),
+			err: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			deps, missing, err := resolveDependencies(tc.p, actions)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error to be %t, got %v", tc.err, err)
+			}
+			var names []string
+			for _, d := range deps {
+				names = append(names, d.Name)
+			}
+			if !reflect.DeepEqual(names, tc.deps) {
+				t.Errorf("expected dependencies %v, got %v", tc.deps, names)
+			}
+			if !reflect.DeepEqual(missing, tc.missing) {
+				t.Errorf("expected missing dependencies %v, got %v", tc.missing, missing)
+			}
+		})
+	}
+}
+
+func TestDependencyCycle(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		actions []*v1alpha1.PersistenceAction
+		cycle   []string
+	}{
+		{
+			name:    "none",
+			actions: []*v1alpha1.PersistenceAction{dependentAction("a", nil, "b"), dependentAction("b", nil)},
+		},
+		{
+			name:    "self",
+			actions: []*v1alpha1.PersistenceAction{dependentAction("a", nil, "a")},
+			cycle:   []string{"a", "a"},
+		},
+		{
+			name: "indirect",
+			actions: []*v1alpha1.PersistenceAction{
+				dependentAction("a", nil, "b"),
+				dependentAction("b", nil, "c"),
+				dependentAction("c", nil, "a"),
+			},
+			cycle: []string{"a", "b", "c", "a"},
+		},
+		{
+			name: "through a selector",
+			actions: []*v1alpha1.PersistenceAction{
+				dependentAction("a", nil, "b"),
+				selectingAction("b", map[string]string{"stage": "data"}),
+				dependentAction("c", map[string]string{"stage": "data"}, "a"),
+			},
+			cycle: []string{"a", "b", "c", "a"},
+		},
+		// Cycles among the dependencies are reported by the actions
+		// forming them.
+		{
+			name: "among the dependencies",
+			actions: []*v1alpha1.PersistenceAction{
+				dependentAction("a", nil, "b"),
+				dependentAction("b", nil, "c"),
+				dependentAction("c", nil, "b"),
+			},
+		},
+		{
+			name:    "missing dependency",
+			actions: []*v1alpha1.PersistenceAction{dependentAction("a", nil, "b")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cycle := dependencyCycle(tc.actions[0], actionsByName(tc.actions...))
+			if !reflect.DeepEqual(cycle, tc.cycle) {
+				t.Fatalf("expected cycle %v, got %v", tc.cycle, cycle)
+			}
+		})
+	}
+}
+
+func TestHoldForDependencies(t *testing.T) {
+	orders, billing := testInstance(), testInstance()
+	billing.Name = "billing-db"
+	instances := []*v1alpha1.PersistenceInstance{&orders, &billing}
+
+	// schema is applied on the orders database only.
+	schema := dependentAction("schema", nil)
+	schema.Status = &v1alpha1.PersistenceActionStatus{Instances: []v1alpha1.PersistenceActionInstanceStatus{
+		{Instance: orders.Name, Applied: true},
+		{Instance: billing.Name},
+	}}
+	// indexes is marked as applied.
+	indexes := dependentAction("indexes", nil)
+	indexes.Spec.Applied = true
+
+	for _, tc := range []struct {
+		name    string
+		p       *v1alpha1.PersistenceAction
+		actions []*v1alpha1.PersistenceAction
+		held    map[string]string
+		cycle   string
+	}{
+		{
+			name: "no dependencies",
+			p:    dependentAction("data", nil),
+			held: map[string]string{},
+		},
+		{
+			name: "applied",
+			p:    dependentAction("data", nil, "indexes"),
+			held: map[string]string{},
+		},
+		{
+			name: "not applied yet",
+			p:    dependentAction("data", nil, "schema", "indexes"),
+			held: map[string]string{billing.Name: "waiting for persistence action schema"},
+		},
+		{
+			name: "missing",
+			p:    dependentAction("data", nil, "seeds"),
+			held: map[string]string{orders.Name: "dependencies [seeds] not found", billing.Name: "dependencies [seeds] not found"},
+		},
+		{
+			name:  "self-cycle",
+			p:     dependentAction("data", nil, "data"),
+			held:  map[string]string{orders.Name: "dependency cycle data -> data", billing.Name: "dependency cycle data -> data"},
+			cycle: "data -> data",
+		},
+		{
+			name:    "indirect cycle",
+			p:       dependentAction("data", nil, "views"),
+			actions: []*v1alpha1.PersistenceAction{dependentAction("views", nil, "data")},
+			held:    map[string]string{orders.Name: "dependency cycle data -> views -> data", billing.Name: "dependency cycle data -> views -> data"},
+			cycle:   "data -> views -> data",
+		},
+		{
+			name: "rollback",
+			p: func() *v1alpha1.PersistenceAction {
+				p := dependentAction("data", nil, "seeds")
+				p.Annotations = map[string]string{rollbackAnnotation: ""}
+				return p
+			}(),
+			held: map[string]string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dependencyOperator(append([]*v1alpha1.PersistenceAction{tc.p, schema, indexes}, tc.actions...)...)
+			defer c.queue.ShutDown()
+
+			held := map[string]string{}
+			cond, err := c.holdForDependencies(tc.p, instances, held)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(held, tc.held) {
+				t.Errorf("expected held instances %v, got %v", tc.held, held)
+			}
+			if cycle := cond.Status == conditionStatus(true); cycle != (tc.cycle != "") || cond.Message != tc.cycle {
+				t.Errorf("expected cycle %q, got %s %q", tc.cycle, cond.Status, cond.Message)
+			}
+		})
+	}
+}
+
+func TestEnqueueDependents(t *testing.T) {
+	schema := dependentAction("schema", map[string]string{"stage": "schema"})
+	for _, tc := range []struct {
+		name     string
+		actions  []*v1alpha1.PersistenceAction
+		deleted  bool
+		enqueued []string
+	}{
+		{
+			name:     "by name",
+			actions:  []*v1alpha1.PersistenceAction{dependentAction("data", nil, "schema")},
+			enqueued: []string{"shop/data"},
+		},
+		{
+			name:     "by selector",
+			actions:  []*v1alpha1.PersistenceAction{selectingAction("data", map[string]string{"stage": "schema"})},
+			enqueued: []string{"shop/data"},
+		},
+		{
+			name: "several",
+			actions: []*v1alpha1.PersistenceAction{
+				dependentAction("data", nil, "schema"),
+				dependentAction("views", nil, "indexes", "schema"),
+			},
+			enqueued: []string{"shop/data", "shop/views"},
+		},
+		// Dependents of a deleted action are held back again.
+		{
+			name:     "deleted",
+			actions:  []*v1alpha1.PersistenceAction{dependentAction("data", nil, "schema")},
+			deleted:  true,
+			enqueued: []string{"shop/data"},
+		},
+		{
+			name:    "unrelated",
+			actions: []*v1alpha1.PersistenceAction{dependentAction("data", nil, "indexes")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			actions := tc.actions
+			if !tc.deleted {
+				actions = append(actions, schema)
+			}
+			c := dependencyOperator(actions...)
+			defer c.queue.ShutDown()
+
+			// schema completed, or was deleted.
+			applied := schema.DeepCopy()
+			applied.Status = &v1alpha1.PersistenceActionStatus{Applied: true}
+			c.enqueueDependents(applied)
+
+			enqueued := drainQueue(c.queue)
+			if !reflect.DeepEqual(enqueued, tc.enqueued) {
+				t.Fatalf("expected %v to be enqueued, got %v", tc.enqueued, enqueued)
+			}
+		})
+	}
+}
+
+func TestHandlePersistenceActionDelete(t *testing.T) {
+	schema := dependentAction("schema", nil)
+	for _, tc := range []struct {
+		name string
+		obj  interface{}
+	}{
+		{name: "deleted", obj: schema},
+		{name: "deletion missed", obj: cache.DeletedFinalStateUnknown{Key: "shop/schema", Obj: schema}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dependencyOperator(dependentAction("data", nil, "schema"))
+			c.metrics = newOperatorMetrics()
+			defer c.queue.ShutDown()
+
+			c.handlePersistenceActionDelete(tc.obj)
+
+			enqueued := drainQueue(c.queue)
+			if expected := []string{"shop/data", "shop/schema"}; !reflect.DeepEqual(enqueued, expected) {
+				t.Fatalf("expected %v to be enqueued, got %v", expected, enqueued)
+			}
+		})
+	}
+}
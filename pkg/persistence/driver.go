@@ -0,0 +1,413 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+)
+
+const healthCheckTimeout = 10 * time.Second
+
+// The images executing actions in Jobs by persistence type, unless
+// --executor-image overrides them. They are empty unless set at build time,
+// e.g. with -ldflags "-X github.com/mmerrill3/persistence-operator/pkg/persistence.postgresBaseImage=image".
+var (
+	oracleBaseImage   = ""
+	postgresBaseImage = ""
+	mysqlBaseImage    = ""
+	mongoBaseImage    = ""
+)
+
+// Driver implements the behaviour specific to a persistence type.
+type Driver interface {
+	// DSN builds the connection string to the PersistenceInstance i.
+	DSN(i *v1alpha1.PersistenceInstance, c Credentials) (string, error)
+	// SplitStatements splits an action into the statements it consists of.
+	SplitStatements(action string) []string
+	// Transactional returns whether statements, including schema changes, are
+	// run atomically within a transaction.
+	Transactional() bool
+	// ExecutorImage returns the image executing actions in Jobs, or an empty
+	// string if there is none.
+	ExecutorImage() string
+	// Open connects to the database identified by dsn.
+	Open(ctx context.Context, dsn string) (Session, error)
+	// HealthCheck connects to the database identified by dsn and returns the
+	// version reported by its server.
+	HealthCheck(ctx context.Context, dsn string) (string, error)
+}
+
+// Session is a connection to a database, obtained from a Driver.
+type Session interface {
+	// Version returns the version reported by the server.
+	Version(ctx context.Context) (string, error)
+	// Begin starts a transaction. It is only supported by transactional
+	// drivers.
+	Begin(ctx context.Context) error
+	// Commit commits the current transaction.
+	Commit() error
+	// Rollback aborts the current transaction.
+	Rollback() error
+	// Exec executes a single statement, within the current transaction if
+	// there is one.
+	Exec(ctx context.Context, stmt string) error
+	// EnsureHistory creates the history table if it doesn't exist yet.
+	EnsureHistory(ctx context.Context) error
+	// HasHistory returns whether the history table exists, without creating
+	// it.
+	HasHistory(ctx context.Context) (bool, error)
+	// History returns the most recent entry of the named action in the
+	// history table, or nil if there is none.
+	History(ctx context.Context, action string) (*HistoryEntry, error)
+	// RecordHistory appends e to the history table, within the current
+	// transaction if there is one.
+	RecordHistory(ctx context.Context, e HistoryEntry) error
+	// Close releases the connection.
+	Close() error
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]Driver{}
+)
+
+// RegisterDriver makes a Driver available for the given persistence type.
+// Persistence types are matched case-insensitively. It panics if a driver is
+// registered twice for the same type.
+func RegisterDriver(persistenceType string, d Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	t := strings.ToLower(persistenceType)
+	if _, ok := drivers[t]; ok {
+		panic(fmt.Sprintf("persistence: driver registered twice for %s", persistenceType))
+	}
+	drivers[t] = d
+}
+
+// LookupDriver returns the Driver of the given persistence type.
+func LookupDriver(persistenceType string) (Driver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	d, ok := drivers[strings.ToLower(persistenceType)]
+	if !ok {
+		return nil, fmt.Errorf("unknown persistence type %q, expected one of %s", persistenceType, strings.Join(driverNames(), ", "))
+	}
+	return d, nil
+}
+
+// driverNames returns the sorted persistence types of all registered
+// drivers. The caller has to hold driversMu.
+func driverNames() []string {
+	res := make([]string, 0, len(drivers))
+	for t := range drivers {
+		res = append(res, t)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// address returns the host and port of the PersistenceInstance i.
+func address(i *v1alpha1.PersistenceInstance) string {
+	return net.JoinHostPort(i.Spec.URL, strconv.Itoa(int(i.Spec.Port)))
+}
+
+// encodeParameters encodes the connection parameters of an instance as URL
+// query, sorted by key.
+func encodeParameters(params map[string]string) string {
+	q := url.Values{}
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	return q.Encode()
+}
+
+// sqlDriver is the base of the drivers built on database/sql.
+type sqlDriver struct {
+	// The name the database/sql driver is registered with.
+	driverName    string
+	versionQuery  string
+	transactional bool
+	executorImage string
+	dsn           func(i *v1alpha1.PersistenceInstance, c Credentials) (string, error)
+	split         func(action string) []string
+	// The statement creating the history table unless it exists.
+	historyDDL string
+	// The query counting the tables named like the history table, visible
+	// to the session.
+	historyExistsQuery string
+	// placeholder returns the placeholder of the n-th parameter, counting
+	// from 1.
+	placeholder func(n int) string
+}
+
+func (d *sqlDriver) DSN(i *v1alpha1.PersistenceInstance, c Credentials) (string, error) {
+	return d.dsn(i, c)
+}
+
+func (d *sqlDriver) SplitStatements(action string) []string {
+	return d.split(action)
+}
+
+func (d *sqlDriver) Transactional() bool {
+	return d.transactional
+}
+
+func (d *sqlDriver) ExecutorImage() string {
+	return d.executorImage
+}
+
+func (d *sqlDriver) Open(ctx context.Context, dsn string) (Session, error) {
+	db, err := sql.Open(d.driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Statements may depend on session state set by previous statements, so
+	// all of them have to run on the same connection.
+	db.SetMaxOpenConns(1)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlSession{db: db, driver: d}, nil
+}
+
+func (d *sqlDriver) HealthCheck(ctx context.Context, dsn string) (string, error) {
+	s, err := d.Open(ctx, dsn)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+	return s.Version(ctx)
+}
+
+// sqlSession is a Session on top of database/sql.
+type sqlSession struct {
+	db     *sql.DB
+	tx     *sql.Tx
+	driver *sqlDriver
+}
+
+func (s *sqlSession) Version(ctx context.Context) (string, error) {
+	var version string
+	if err := s.db.QueryRowContext(ctx, s.driver.versionQuery).Scan(&version); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+func (s *sqlSession) Begin(ctx context.Context) error {
+	if s.tx != nil {
+		return fmt.Errorf("transaction already in progress")
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	s.tx = tx
+	return nil
+}
+
+func (s *sqlSession) Commit() error {
+	if s.tx == nil {
+		return fmt.Errorf("no transaction in progress")
+	}
+	err := s.tx.Commit()
+	s.tx = nil
+	return err
+}
+
+func (s *sqlSession) Rollback() error {
+	if s.tx == nil {
+		return fmt.Errorf("no transaction in progress")
+	}
+	err := s.tx.Rollback()
+	s.tx = nil
+	return err
+}
+
+func (s *sqlSession) Exec(ctx context.Context, stmt string) error {
+	return s.exec(ctx, stmt)
+}
+
+func (s *sqlSession) exec(ctx context.Context, stmt string, args ...interface{}) error {
+	var err error
+	if s.tx != nil {
+		_, err = s.tx.ExecContext(ctx, stmt, args...)
+	} else {
+		_, err = s.db.ExecContext(ctx, stmt, args...)
+	}
+	return err
+}
+
+func (s *sqlSession) EnsureHistory(ctx context.Context) error {
+	return s.exec(ctx, s.driver.historyDDL)
+}
+
+func (s *sqlSession) HasHistory(ctx context.Context) (bool, error) {
+	var n int
+	if err := s.db.QueryRowContext(ctx, s.driver.historyExistsQuery).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *sqlSession) History(ctx context.Context, action string) (*HistoryEntry, error) {
+	q := fmt.Sprintf("SELECT version, checksum, kind, applied_by, applied_at FROM %s WHERE action = %s ORDER BY id DESC",
+		historyTable, s.driver.placeholder(1))
+	e := &HistoryEntry{Action: action}
+	err := s.db.QueryRowContext(ctx, q, action).Scan(&e.Version, &e.Checksum, &e.Kind, &e.AppliedBy, &e.AppliedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (s *sqlSession) RecordHistory(ctx context.Context, e HistoryEntry) error {
+	ph := make([]string, 6)
+	for i := range ph {
+		ph[i] = s.driver.placeholder(i + 1)
+	}
+	q := fmt.Sprintf("INSERT INTO %s (action, version, checksum, kind, applied_by, applied_at) VALUES (%s)",
+		historyTable, strings.Join(ph, ", "))
+	return s.exec(ctx, q, e.Action, e.Version, e.Checksum, e.Kind, e.AppliedBy, e.AppliedAt.UTC())
+}
+
+func (s *sqlSession) Close() error {
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.tx = nil
+	}
+	return s.db.Close()
+}
+
+// questionMark is the placeholder style of MySQL and SQLite.
+func questionMark(n int) string {
+	return "?"
+}
+
+// splitOptions configures the dialect specific quoting understood by
+// splitSQL.
+type splitOptions struct {
+	// Whether backticks quote identifiers, as in MySQL.
+	backticks bool
+	// Whether $tag$ delimits string constants, as in Postgres.
+	dollarQuotes bool
+	// Whether backslashes escape the character following them in quoted
+	// strings, as in MySQL.
+	backslashEscapes bool
+}
+
+// splitSQL splits s into statements separated by semicolons. Semicolons
+// within quotes and comments are ignored. The separators are not part of the
+// returned statements and empty statements are dropped.
+func splitSQL(s string, opts splitOptions) []string {
+	var (
+		res   []string
+		start int
+	)
+	emit := func(end int) {
+		if stmt := strings.TrimSpace(s[start:end]); stmt != "" {
+			res = append(res, stmt)
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'' || c == '"' || (c == '`' && opts.backticks):
+			// Quotes are escaped by doubling them, which is covered by
+			// leaving and reentering the quoted section.
+			i = closingQuote(s, i, opts.backslashEscapes && c != '`')
+		case c == '-' && strings.HasPrefix(s[i:], "--"):
+			if j := strings.IndexByte(s[i:], '\n'); j >= 0 {
+				i += j
+			} else {
+				i = len(s)
+			}
+		case c == '/' && strings.HasPrefix(s[i:], "/*"):
+			if j := strings.Index(s[i+2:], "*/"); j >= 0 {
+				i += j + 3
+			} else {
+				i = len(s)
+			}
+		case c == '$' && opts.dollarQuotes:
+			tag := dollarQuoteTag(s[i:])
+			if tag == "" {
+				continue
+			}
+			if j := strings.Index(s[i+len(tag):], tag); j >= 0 {
+				i += len(tag) + j + len(tag) - 1
+			} else {
+				i = len(s)
+			}
+		case c == ';':
+			emit(i)
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		emit(len(s))
+	}
+	return res
+}
+
+// closingQuote returns the index of the quote closing the quoted section
+// starting at the quote s[start], or len(s) if it isn't closed. Quotes
+// preceded by a backslash are skipped if backslashEscapes is set.
+func closingQuote(s string, start int, backslashEscapes bool) int {
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case s[start]:
+			return i
+		case '\\':
+			if backslashEscapes {
+				i++
+			}
+		}
+	}
+	return len(s)
+}
+
+// dollarQuoteTag returns the dollar quote tag s starts with, e.g. "$$" or
+// "$body$", or an empty string if s does not start with one.
+func dollarQuoteTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '$':
+			return s[:i+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 1:
+		default:
+			return ""
+		}
+	}
+	return ""
+}
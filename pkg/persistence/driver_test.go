@@ -0,0 +1,233 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitSQL(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		action   string
+		opts     splitOptions
+		expected []string
+	}{
+		{
+			name:     "statements",
+			action:   "CREATE TABLE users (id INT);\n INSERT INTO users VALUES (1) ;",
+			expected: []string{"CREATE TABLE users (id INT)", "INSERT INTO users VALUES (1)"},
+		},
+		{
+			name:     "empty statements",
+			action:   " ; ;\n;",
+			expected: nil,
+		},
+		{
+			name:     "unterminated",
+			action:   "DROP TABLE users",
+			expected: []string{"DROP TABLE users"},
+		},
+		{
+			name:     "single quotes",
+			action:   "INSERT INTO t VALUES ('a;b'); SELECT 1",
+			expected: []string{"INSERT INTO t VALUES ('a;b')", "SELECT 1"},
+		},
+		{
+			name:     "doubled quotes",
+			action:   "INSERT INTO t VALUES ('it''s;here'); SELECT 1",
+			expected: []string{"INSERT INTO t VALUES ('it''s;here')", "SELECT 1"},
+		},
+		{
+			name:     "double quotes",
+			action:   `CREATE TABLE "a;b" (id INT); SELECT 1`,
+			expected: []string{`CREATE TABLE "a;b" (id INT)`, "SELECT 1"},
+		},
+		{
+			name:     "unterminated quote",
+			action:   "SELECT 'a;b",
+			expected: []string{"SELECT 'a;b"},
+		},
+		{
+			name:     "backticks",
+			action:   "CREATE TABLE `a;b` (id INT); SELECT 1",
+			opts:     splitOptions{backticks: true},
+			expected: []string{"CREATE TABLE `a;b` (id INT)", "SELECT 1"},
+		},
+		{
+			name:     "backticks not quoting",
+			action:   "SELECT `a;b`",
+			expected: []string{"SELECT `a", "b`"},
+		},
+		{
+			name:     "backslash escapes",
+			action:   `INSERT INTO t VALUES ('a\';b', "c\";d", 'e\\'); SELECT 1`,
+			opts:     splitOptions{backticks: true, backslashEscapes: true},
+			expected: []string{`INSERT INTO t VALUES ('a\';b', "c\";d", 'e\\')`, "SELECT 1"},
+		},
+		{
+			name:     "backslashes not escaping",
+			action:   `INSERT INTO t VALUES ('a\'); SELECT 1`,
+			expected: []string{`INSERT INTO t VALUES ('a\')`, "SELECT 1"},
+		},
+		{
+			name:     "backslashes not escaping backticks",
+			action:   "SELECT `a\\`; SELECT 1",
+			opts:     splitOptions{backticks: true, backslashEscapes: true},
+			expected: []string{"SELECT `a\\`", "SELECT 1"},
+		},
+		{
+			name:     "line comments",
+			action:   "SELECT 1; -- no; split\nSELECT 2",
+			expected: []string{"SELECT 1", "-- no; split\nSELECT 2"},
+		},
+		{
+			name:     "block comments",
+			action:   "SELECT /* a;b */ 1; SELECT 2 /* c;",
+			expected: []string{"SELECT /* a;b */ 1", "SELECT 2 /* c;"},
+		},
+		{
+			name:     "quotes in comments",
+			action:   "SELECT 1; -- it's\nSELECT 2",
+			expected: []string{"SELECT 1", "-- it's\nSELECT 2"},
+		},
+		{
+			name: "dollar quotes",
+			action: "CREATE FUNCTION f() RETURNS INT AS $$ BEGIN RETURN 1; END; $$ LANGUAGE plpgsql;" +
+				"CREATE FUNCTION g() RETURNS INT AS $body$ SELECT 1; $$ $body$ LANGUAGE sql; SELECT $1",
+			opts: splitOptions{dollarQuotes: true},
+			expected: []string{
+				"CREATE FUNCTION f() RETURNS INT AS $$ BEGIN RETURN 1; END; $$ LANGUAGE plpgsql",
+				"CREATE FUNCTION g() RETURNS INT AS $body$ SELECT 1; $$ $body$ LANGUAGE sql",
+				"SELECT $1",
+			},
+		},
+		{
+			name:     "dollar quotes not quoting",
+			action:   "SELECT $$a;b$$",
+			expected: []string{"SELECT $$a", "b$$"},
+		},
+	} {
+		if got := splitSQL(tc.action, tc.opts); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestDollarQuoteTag(t *testing.T) {
+	for s, expected := range map[string]string{
+		"$$ body":    "$$",
+		"$body$ x":   "$body$",
+		"$b_1$ x":    "$b_1$",
+		"$1":         "",
+		"$1$":        "",
+		"$a-b$":      "",
+		"$unclosed":  "",
+		"$":          "",
+		"$Body$body": "$Body$",
+	} {
+		if got := dollarQuoteTag(s); got != expected {
+			t.Errorf("%q: expected tag %q, got %q", s, expected, got)
+		}
+	}
+}
+
+func TestSplitOracle(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		action   string
+		expected []string
+	}{
+		{
+			name:     "statements",
+			action:   "CREATE TABLE users (id NUMBER);\nINSERT INTO users VALUES (1);",
+			expected: []string{"CREATE TABLE users (id NUMBER)", "INSERT INTO users VALUES (1)"},
+		},
+		{
+			name:     "block",
+			action:   "BEGIN\n  INSERT INTO users VALUES (1);\n  COMMIT;\nEND;\n/\nSELECT 1 FROM dual;",
+			expected: []string{"BEGIN\n  INSERT INTO users VALUES (1);\n  COMMIT;\nEND;", "SELECT 1 FROM dual"},
+		},
+		{
+			name: "procedure and declare",
+			action: "create or replace procedure p as begin null; end;\n /  \n" +
+				"DECLARE n NUMBER; BEGIN n := 1; END;\n/",
+			expected: []string{
+				"create or replace procedure p as begin null; end;",
+				"DECLARE n NUMBER; BEGIN n := 1; END;",
+			},
+		},
+		{
+			name:     "division",
+			action:   "SELECT 4 / 2 FROM dual;",
+			expected: []string{"SELECT 4 / 2 FROM dual"},
+		},
+		{
+			name:     "quotes",
+			action:   "INSERT INTO t VALUES ('a;b');",
+			expected: []string{"INSERT INTO t VALUES ('a;b')"},
+		},
+	} {
+		if got := splitOracle(tc.action); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestLookupDriver(t *testing.T) {
+	for _, tc := range []struct {
+		persistenceType string
+		err             bool
+	}{
+		{persistenceType: "Postgres"},
+		{persistenceType: "postgres"},
+		{persistenceType: "MYSQL"},
+		{persistenceType: "Oracle"},
+		{persistenceType: "Mongo"},
+		{persistenceType: "Cassandra", err: true},
+		{persistenceType: "", err: true},
+	} {
+		d, err := LookupDriver(tc.persistenceType)
+		if tc.err {
+			if err == nil || !strings.Contains(err.Error(), "unknown persistence type") || !strings.Contains(err.Error(), "postgres") {
+				t.Errorf("%q: expected an error listing the known types, got %v", tc.persistenceType, err)
+			}
+			continue
+		}
+		if err != nil || d == nil {
+			t.Errorf("%q: expected a driver, got %v", tc.persistenceType, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		persistenceType string
+		action          string
+		expected        []string
+	}{
+		{persistenceType: "MySQL", action: `INSERT INTO t VALUES ('a\';b');`, expected: []string{`INSERT INTO t VALUES ('a\';b')`}},
+		{persistenceType: "Postgres", action: `INSERT INTO t VALUES ('a\'); SELECT 1`, expected: []string{`INSERT INTO t VALUES ('a\')`, "SELECT 1"}},
+		{persistenceType: "Postgres", action: "DO $$ BEGIN NULL; END $$;", expected: []string{"DO $$ BEGIN NULL; END $$"}},
+	} {
+		d, err := LookupDriver(tc.persistenceType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.SplitStatements(tc.action); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %q, got %q", tc.persistenceType, tc.expected, got)
+		}
+	}
+}
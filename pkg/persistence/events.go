@@ -0,0 +1,140 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// The reasons of the events recorded on PersistenceActions and
+// PersistenceInstances.
+const (
+	eventReasonScheduled           = "Scheduled"
+	eventReasonJobCreated          = "JobCreated"
+	eventReasonStatementFailed     = "StatementFailed"
+	eventReasonApplied             = "Applied"
+	eventReasonRolledBack          = "RolledBack"
+	eventReasonInstanceUnreachable = "InstanceUnreachable"
+	eventReasonChecksumMismatch    = "ChecksumMismatch"
+	eventReasonTornDown            = "TornDown"
+	eventReasonTeardownFailed      = "TeardownFailed"
+)
+
+// eventComponent is the source events are recorded by.
+const eventComponent = "persistence-operator"
+
+// newEventRecorder returns a recorder publishing events through kclient.
+func newEventRecorder(kclient kubernetes.Interface) record.EventRecorder {
+	b := record.NewBroadcaster()
+	b.StartLogging(glog.V(4).Infof)
+	b.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kclient.CoreV1().Events("")})
+	return b.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent})
+}
+
+// actionRef returns p with its kind set, which events are recorded on. The
+// kinds of custom resources are unknown to the scheme of the recorder.
+func actionRef(p *v1alpha1.PersistenceAction) runtime.Object {
+	ref := *p
+	ref.Kind = v1alpha1.TPRPersistenceActionsKind
+	ref.APIVersion = v1alpha1.TPRGroup + "/" + v1alpha1.TPRVersion
+	return &ref
+}
+
+// instanceRef returns i with its kind set, which events are recorded on.
+func instanceRef(i *v1alpha1.PersistenceInstance) runtime.Object {
+	ref := *i
+	ref.Kind = v1alpha1.TPRPersistenceInstancesKind
+	ref.APIVersion = v1alpha1.TPRGroup + "/" + v1alpha1.TPRVersion
+	return &ref
+}
+
+// actionEvent records an event concerning p on the instance inst, both on p
+// and on inst.
+func (c *Operator) actionEvent(p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance, eventtype, reason, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	c.recorder.Eventf(actionRef(p), eventtype, reason, "Instance %s: %s", inst.Name, msg)
+	c.recorder.Eventf(instanceRef(inst), eventtype, reason, "Action %s: %s", p.Name, msg)
+}
+
+// recordTransitions records events and metrics for the transitions between
+// the status persisted on p and status, which is about to replace it.
+func (c *Operator) recordTransitions(p *v1alpha1.PersistenceAction, instances []*v1alpha1.PersistenceInstance, status *v1alpha1.PersistenceActionStatus) {
+	// Changes to the spec are observed once.
+	if !p.Spec.DryRun && (p.Status == nil || p.Status.ObservedGeneration != p.Generation) {
+		switch {
+		case p.Spec.Schedule != "":
+			c.recorder.Eventf(actionRef(p), v1.EventTypeNormal, eventReasonScheduled, "Scheduled %q", p.Spec.Schedule)
+		case p.Spec.ApplicationTime != nil && p.Spec.ApplicationTime.After(time.Now()):
+			c.recorder.Eventf(actionRef(p), v1.EventTypeNormal, eventReasonScheduled, "Scheduled for %s", applicationTime(*p))
+		}
+	}
+
+	byName := make(map[string]*v1alpha1.PersistenceInstance, len(instances))
+	for _, inst := range instances {
+		byName[inst.Name] = inst
+	}
+	for _, is := range status.Instances {
+		inst, ok := byName[is.Instance]
+		if !ok {
+			continue
+		}
+		var prev v1alpha1.PersistenceActionInstanceStatus
+		if s := previousInstanceStatus(p, is.Instance); s != nil {
+			prev = *s
+		}
+		switch {
+		case is.RolledBack && !prev.RolledBack:
+			c.actionEvent(p, inst, v1.EventTypeNormal, eventReasonRolledBack, "Rolled back")
+			c.metrics.rolledBack(p)
+		case is.Applied && (!prev.Applied || prev.Checksum != is.Checksum):
+			c.actionEvent(p, inst, v1.EventTypeNormal, eventReasonApplied, "Applied")
+			c.metrics.applied(p, inst, is)
+		case is.Applied || is.Reason == "" || is.Reason == prev.Reason:
+			// Nothing failed, or the failure was reported already.
+		case !instanceReachable(inst):
+			c.actionEvent(p, inst, v1.EventTypeWarning, eventReasonInstanceUnreachable, "%s", is.Reason)
+		case !strings.HasPrefix(is.Reason, "held back: "):
+			c.actionEvent(p, inst, v1.EventTypeWarning, eventReasonStatementFailed, "%s", is.Reason)
+			c.metrics.failed(p)
+		}
+	}
+
+	cond := findCondition(status.Conditions, conditionChecksumMismatch)
+	if cond == nil || cond.Reason != "ChecksumMismatch" {
+		return
+	}
+	if p.Status != nil {
+		if prev := findCondition(p.Status.Conditions, conditionChecksumMismatch); prev != nil && prev.Reason == cond.Reason {
+			return
+		}
+	}
+	sum := checksumOf(p)
+	for _, is := range status.Instances {
+		if inst, ok := byName[is.Instance]; ok && is.Checksum != "" && is.Checksum != sum {
+			c.actionEvent(p, inst, v1.EventTypeWarning, eventReasonChecksumMismatch, "Applied with checksum %s, now %s", is.Checksum, sum)
+		}
+	}
+}
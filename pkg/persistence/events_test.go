@@ -0,0 +1,129 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// recordedEvents drains the events recorded by r.
+func recordedEvents(r *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case e := <-r.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestRecordTransitions(t *testing.T) {
+	action := testAction()
+	sum := checksumOf(&action)
+	reachable := testInstance()
+	reachable.Status = &v1alpha1.PersistenceInstanceStatus{Reachable: true}
+	unreachable := testInstance()
+
+	for _, tc := range []struct {
+		name      string
+		instance  v1alpha1.PersistenceInstance
+		prev, cur *v1alpha1.PersistenceActionInstanceStatus
+		eventtype string
+		reason    string
+	}{
+		{
+			name:      "applied",
+			instance:  reachable,
+			cur:       &v1alpha1.PersistenceActionInstanceStatus{Applied: true, Checksum: sum},
+			eventtype: v1.EventTypeNormal,
+			reason:    eventReasonApplied,
+		},
+		{
+			name:      "rolled back",
+			instance:  reachable,
+			prev:      &v1alpha1.PersistenceActionInstanceStatus{Applied: true, Checksum: sum},
+			cur:       &v1alpha1.PersistenceActionInstanceStatus{RolledBack: true, Reason: "statement 2 failed"},
+			eventtype: v1.EventTypeNormal,
+			reason:    eventReasonRolledBack,
+		},
+		{
+			name:      "statement failed",
+			instance:  reachable,
+			cur:       &v1alpha1.PersistenceActionInstanceStatus{Reason: "statement 1 failed: syntax error"},
+			eventtype: v1.EventTypeWarning,
+			reason:    eventReasonStatementFailed,
+		},
+		{
+			name:      "instance unreachable",
+			instance:  unreachable,
+			cur:       &v1alpha1.PersistenceActionInstanceStatus{Reason: "connecting failed: connection refused"},
+			eventtype: v1.EventTypeWarning,
+			reason:    eventReasonInstanceUnreachable,
+		},
+		{
+			name:      "checksum mismatch",
+			instance:  reachable,
+			prev:      &v1alpha1.PersistenceActionInstanceStatus{Applied: true, Checksum: "0123456789abcdef"},
+			cur:       &v1alpha1.PersistenceActionInstanceStatus{Applied: true, Checksum: "0123456789abcdef"},
+			eventtype: v1.EventTypeWarning,
+			reason:    eventReasonChecksumMismatch,
+		},
+	} {
+		recorder := record.NewFakeRecorder(10)
+		c := &Operator{recorder: recorder, metrics: newOperatorMetrics()}
+		inst := tc.instance
+		instances := []*v1alpha1.PersistenceInstance{&inst}
+
+		p := testAction()
+		if tc.prev != nil {
+			prev := *tc.prev
+			prev.Instance = inst.Name
+			p.Status = &v1alpha1.PersistenceActionStatus{Instances: []v1alpha1.PersistenceActionInstanceStatus{prev}}
+		}
+		status := func() *v1alpha1.PersistenceActionStatus {
+			cur := *tc.cur
+			cur.Instance = inst.Name
+			status := &v1alpha1.PersistenceActionStatus{Instances: []v1alpha1.PersistenceActionInstanceStatus{cur}}
+			status.Conditions = setCondition(nil, checksumCondition(&p, status))
+			return status
+		}
+
+		c.recordTransitions(&p, instances, status())
+		events := recordedEvents(recorder)
+		// The event is recorded on both the action and the instance.
+		if len(events) != 2 {
+			t.Errorf("%s: expected 2 events, got %q", tc.name, events)
+		}
+		for _, e := range events {
+			if !strings.HasPrefix(e, tc.eventtype+" "+tc.reason+" ") {
+				t.Errorf("%s: expected a %s event with reason %s, got %q", tc.name, tc.eventtype, tc.reason, e)
+			}
+		}
+
+		// Resyncs don't record the transition again once it is persisted.
+		p.Status = status()
+		c.recordTransitions(&p, instances, status())
+		if events := recordedEvents(recorder); len(events) > 0 {
+			t.Errorf("%s: expected no events on resync, got %q", tc.name, events)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ExecutorJob runs actions in Jobs and CronJobs using the executor image
+	// configured for the persistence type.
+	ExecutorJob = "Job"
+	// ExecutorInProcess runs actions directly from the operator.
+	ExecutorInProcess = "InProcess"
+
+	// maxStatementLength limits the length of statements recorded in the
+	// status of an action.
+	maxStatementLength = 256
+)
+
+// executorMode returns the executor running p, which defaults to the one
+// configured for the operator.
+func executorMode(p *v1alpha1.PersistenceAction, conf Config) (string, error) {
+	mode := p.Spec.Executor
+	if mode == "" {
+		mode = conf.ExecutorMode
+	}
+	switch mode {
+	case "", ExecutorJob:
+		return ExecutorJob, nil
+	case ExecutorInProcess:
+		return ExecutorInProcess, nil
+	}
+	return "", fmt.Errorf("unknown executor %q, expected one of %s, %s", mode, ExecutorJob, ExecutorInProcess)
+}
+
+// syncInProcess runs p on every selected instance which is not held back and
+// on which it didn't run yet, once its ApplicationTime has come. If the
+// rollback of p was requested, it is rolled back instead. Statements are
+// recorded in the status as redacted by r. Executions are cancelled along with
+// ctx. It returns the resulting status of the action.
+func (c *Operator) syncInProcess(ctx context.Context, key string, p *v1alpha1.PersistenceAction, instances []*v1alpha1.PersistenceInstance, held map[string]string, r *redactor) (*v1alpha1.PersistenceActionStatus, error) {
+	prev := map[string]v1alpha1.PersistenceActionInstanceStatus{}
+	if p.Status != nil {
+		for _, is := range p.Status.Instances {
+			prev[is.Instance] = is
+		}
+	}
+	statuses := make([]v1alpha1.PersistenceActionInstanceStatus, 0, len(instances))
+	for _, inst := range instances {
+		is, ok := prev[inst.Name]
+		if !ok || (is.ExecutionTime == nil && !(is.RolledBack && rollbackRequested(p))) || reapply(p, is.Checksum) {
+			// Only the outcome of executions is carried over. Rolled back
+			// actions are applied again once the rollback is not requested
+			// anymore, changed ones depending on the checksum policy.
+			is = v1alpha1.PersistenceActionInstanceStatus{Instance: inst.Name}
+		}
+		statuses = append(statuses, is)
+	}
+
+	// Workloads of a previous executor are not needed anymore.
+	if err := c.destroyPersistenceActionJob(p.Namespace, p.Name); err != nil {
+		return aggregateStatus(statuses), err
+	}
+	if p.Spec.Schedule != "" {
+		return aggregateStatus(statuses), fmt.Errorf("schedules are not supported by the %s executor", ExecutorInProcess)
+	}
+	if rollbackRequested(p) {
+		return c.syncRollbacks(ctx, key, p, instances, held, statuses, r)
+	}
+	if p.Spec.ApplicationTime != nil {
+		if d := p.Spec.ApplicationTime.Sub(time.Now()); d > 0 {
+			glog.V(4).Infof("PersistenceAction %s scheduled for %s", key, applicationTime(*p))
+			c.queue.AddAfter(key, d)
+			return aggregateStatus(statuses), nil
+		}
+	}
+
+	var errs []error
+	for n, inst := range instances {
+		is := statuses[n]
+		// Executions which failed part way are not retried, as they may have
+		// left the instance in an intermediate state.
+		if is.Applied || is.ExecutionTime != nil {
+			continue
+		}
+		if _, ok := held[inst.Name]; ok {
+			continue
+		}
+
+		glog.Infof("PersistenceAction %s started on instance %s", key, inst.Name)
+		res, err := c.executor.Execute(ctx, p, inst, r)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "executing on instance %s failed", inst.Name))
+			continue
+		}
+		statuses[n] = *res
+	}
+
+	if len(errs) > 0 {
+		return aggregateStatus(statuses), fmt.Errorf("%v", errs)
+	}
+	return aggregateStatus(statuses), nil
+}
+
+// syncRollbacks rolls p back on every selected instance which is not held
+// back and on which it is applied. Like executions, failed rollbacks are not
+// retried.
+func (c *Operator) syncRollbacks(ctx context.Context, key string, p *v1alpha1.PersistenceAction, instances []*v1alpha1.PersistenceInstance, held map[string]string, statuses []v1alpha1.PersistenceActionInstanceStatus, r *redactor) (*v1alpha1.PersistenceActionStatus, error) {
+	if len(p.Spec.RollbackActions) == 0 {
+		return aggregateStatus(statuses), fmt.Errorf("rollback requested, but no rollback actions defined")
+	}
+
+	var errs []error
+	for n, inst := range instances {
+		is := statuses[n]
+		if !is.Applied || is.RollbackTime != nil {
+			continue
+		}
+		if _, ok := held[inst.Name]; ok {
+			continue
+		}
+
+		glog.Infof("PersistenceAction %s rolling back on instance %s", key, inst.Name)
+		res, err := c.executor.Rollback(ctx, p, inst, is, r)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "rolling back on instance %s failed", inst.Name))
+			continue
+		}
+		statuses[n] = *res
+	}
+
+	if len(errs) > 0 {
+		return aggregateStatus(statuses), fmt.Errorf("%v", errs)
+	}
+	return aggregateStatus(statuses), nil
+}
+
+// openSession connects to the PersistenceInstance inst with the driver of its
+// persistence type. Connecting is given up after timeout, unless it is zero.
+func openSession(ctx context.Context, kclient kubernetes.Interface, inst *v1alpha1.PersistenceInstance, timeout time.Duration) (Session, Driver, error) {
+	d, err := LookupDriver(inst.Spec.PersistenceType)
+	if err != nil {
+		return nil, nil, err
+	}
+	creds, err := instanceCredentials(kclient, inst)
+	if err != nil {
+		return nil, nil, err
+	}
+	dsn, err := d.DSN(inst, creds)
+	if err != nil {
+		return nil, nil, err
+	}
+	octx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	s, err := d.Open(octx, dsn)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "connecting failed")
+	}
+	return s, d, nil
+}
+
+// withTimeout returns a copy of ctx which is cancelled after timeout, unless
+// it is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// actionExecutor runs actions against PersistenceInstances in-process. The
+// operator syncs actions through it, so it can be replaced, e.g. in tests.
+// Executions are cancelled along with ctx, e.g. once the operator lost its
+// leader election lease. Cancelled executions return an error rather than a
+// status, so they are retried by the next leader.
+type actionExecutor interface {
+	// Execute applies the actions of the resolved action p to inst.
+	Execute(ctx context.Context, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance, r *redactor) (*v1alpha1.PersistenceActionInstanceStatus, error)
+	// Rollback reverts the actions of the resolved action p, applied to
+	// inst with the status applied.
+	Rollback(ctx context.Context, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance, applied v1alpha1.PersistenceActionInstanceStatus, r *redactor) (*v1alpha1.PersistenceActionInstanceStatus, error)
+}
+
+// sessionExecutor runs actions in sessions opened by the driver of the
+// persistence type. The executions are recorded in the history table of the
+// instances as performed by identity. Connecting and every single statement
+// are given up after the respective timeout, unless it is zero.
+type sessionExecutor struct {
+	kclient          kubernetes.Interface
+	identity         string
+	connectTimeout   time.Duration
+	statementTimeout time.Duration
+}
+
+// Execute renders the actions of the resolved action p for the
+// PersistenceInstance inst and runs them against it, unless its history table
+// records them as applied already. Errors occurring before any statement was
+// executed are returned, failing statements are recorded in the returned
+// status instead. Without a transaction, failed executions are recorded in the
+// history table as well, so they are not repeated even if the status is lost.
+func (se *sessionExecutor) Execute(ctx context.Context, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance, r *redactor) (*v1alpha1.PersistenceActionInstanceStatus, error) {
+	rp, err := renderActions(se.kclient, p, inst, r)
+	if err != nil {
+		return nil, errors.Wrap(err, "rendering actions failed")
+	}
+	// The checksum is taken from the actions before they are rendered, so it
+	// is the same on every instance.
+	sum := checksumOf(p)
+
+	s, d, err := openSession(ctx, se.kclient, inst, se.connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	if err := s.EnsureHistory(ctx); err != nil {
+		return nil, errors.Wrap(err, "creating history table failed")
+	}
+	e, err := s.History(ctx, historyAction(p))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading history table failed")
+	}
+	if e != nil && e.Kind == historyKindApply && !reapply(p, e.Checksum) {
+		glog.Infof("PersistenceAction %s already applied to instance %s at %s", historyAction(p), inst.Name, e.AppliedAt)
+		return historyStatus(inst.Name, e), nil
+	}
+	if e != nil && e.Kind == historyKindFailed && e.Checksum == sum {
+		glog.Infof("PersistenceAction %s failed part way on instance %s at %s", historyAction(p), inst.Name, e.AppliedAt)
+		return failedHistoryStatus(inst.Name, e), nil
+	}
+
+	if d.Transactional() {
+		if err := s.Begin(ctx); err != nil {
+			return nil, errors.Wrap(err, "starting transaction failed")
+		}
+	}
+
+	start := metav1.Now()
+	res := &v1alpha1.PersistenceActionInstanceStatus{
+		Instance:      inst.Name,
+		ExecutionTime: &start,
+		Attempts:      1,
+	}
+	fail := func(reason string) (*v1alpha1.PersistenceActionInstanceStatus, error) {
+		res.Reason = reason
+		if d.Transactional() {
+			if err := s.Rollback(); err != nil {
+				glog.Errorf("rolling back transaction on instance %s failed: %s", inst.Name, err)
+			}
+			if ctx.Err() != nil {
+				return nil, errors.Wrap(ctx.Err(), "execution cancelled")
+			}
+			return res, nil
+		}
+		// Without a transaction the statements executed so far can only be
+		// reverted by the rollback actions. The failure is recorded first, so
+		// the execution isn't repeated on an instance in an intermediate
+		// state. This happens even if the execution was cancelled, as the
+		// replica taking over relies on it.
+		hctx, cancel := withTimeout(context.Background(), se.statementTimeout)
+		defer cancel()
+		err := s.RecordHistory(hctx, HistoryEntry{
+			Action:    historyAction(p),
+			Version:   p.Spec.Version,
+			Checksum:  sum,
+			Kind:      historyKindFailed,
+			AppliedBy: se.identity,
+			AppliedAt: time.Now(),
+		})
+		if err != nil {
+			res.Reason += fmt.Sprintf(", recording failure failed: %s", err)
+		}
+		if ctx.Err() != nil {
+			return nil, errors.Wrapf(ctx.Err(), "execution cancelled part way (%s)", res.Reason)
+		}
+		if p.Spec.AutoRollback && len(p.Spec.RollbackActions) > 0 {
+			glog.Infof("PersistenceAction %s rolling back on instance %s", historyAction(p), inst.Name)
+			if err := se.revert(ctx, s, d, p, rp.Spec.RollbackActions, res, r); err != nil {
+				res.Reason += fmt.Sprintf(", rollback failed: %s", err)
+			}
+		}
+		return res, nil
+	}
+
+	if err := execStatements(ctx, s, statements(d, rp.Spec.Actions), res, r, se.statementTimeout); err != nil {
+		return fail(err.Error())
+	}
+
+	// The history is recorded within the transaction of transactional
+	// drivers, so it can't diverge from the actual state of the database.
+	err = s.RecordHistory(ctx, HistoryEntry{
+		Action:    historyAction(p),
+		Version:   p.Spec.Version,
+		Checksum:  sum,
+		Kind:      historyKindApply,
+		AppliedBy: se.identity,
+		AppliedAt: time.Now(),
+	})
+	if err != nil {
+		return fail(fmt.Sprintf("recording history failed: %s", err))
+	}
+
+	if d.Transactional() {
+		if err := s.Commit(); err != nil {
+			// Whether the transaction was committed is looked up in the
+			// history table when the execution is retried.
+			if ctx.Err() != nil {
+				return nil, errors.Wrap(ctx.Err(), "execution cancelled")
+			}
+			res.Reason = fmt.Sprintf("committing transaction failed: %s", err)
+			return res, nil
+		}
+	}
+
+	end := metav1.Now()
+	res.Applied = true
+	res.CompletionTime = &end
+	res.Checksum = sum
+	return res, nil
+}
+
+// Rollback renders the rollback actions of the resolved action p for the
+// PersistenceInstance inst, on which p is applied with the status applied, and
+// runs them against it. Errors occurring before any statement was executed are
+// returned, failing statements are recorded in the returned status instead.
+func (se *sessionExecutor) Rollback(ctx context.Context, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance, applied v1alpha1.PersistenceActionInstanceStatus, r *redactor) (*v1alpha1.PersistenceActionInstanceStatus, error) {
+	rp, err := renderActions(se.kclient, p, inst, r)
+	if err != nil {
+		return nil, errors.Wrap(err, "rendering actions failed")
+	}
+
+	s, d, err := openSession(ctx, se.kclient, inst, se.connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	if err := s.EnsureHistory(ctx); err != nil {
+		return nil, errors.Wrap(err, "creating history table failed")
+	}
+
+	// The status of the reverted execution is discarded, so the action is
+	// applied again once the rollback is not requested anymore.
+	res := &v1alpha1.PersistenceActionInstanceStatus{Instance: inst.Name}
+	if err := se.revert(ctx, s, d, p, rp.Spec.RollbackActions, res, r); err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.Wrapf(ctx.Err(), "rollback cancelled (%s)", err)
+		}
+		now := metav1.Now()
+		applied.Reason = fmt.Sprintf("rollback failed: %s", err)
+		applied.RollbackTime = &now
+		applied.Statements = res.Statements
+		return &applied, nil
+	}
+	return res, nil
+}
+
+// revert runs the rendered rollback actions of the resolved action p in the
+// session s and records the rollback in the history table. The outcome is
+// recorded in res.
+func (se *sessionExecutor) revert(ctx context.Context, s Session, d Driver, p *v1alpha1.PersistenceAction, rollbackActions []string, res *v1alpha1.PersistenceActionInstanceStatus, r *redactor) error {
+	if d.Transactional() {
+		if err := s.Begin(ctx); err != nil {
+			return errors.Wrap(err, "starting transaction failed")
+		}
+	}
+	abort := func(err error) error {
+		if d.Transactional() {
+			if rerr := s.Rollback(); rerr != nil {
+				glog.Errorf("rolling back transaction of %s failed: %s", historyAction(p), rerr)
+			}
+		}
+		return err
+	}
+
+	if err := execStatements(ctx, s, statements(d, rollbackActions), res, r, se.statementTimeout); err != nil {
+		return abort(err)
+	}
+	err := s.RecordHistory(ctx, HistoryEntry{
+		Action:    historyAction(p),
+		Version:   p.Spec.Version,
+		Checksum:  checksumOf(p),
+		Kind:      historyKindRollback,
+		AppliedBy: se.identity,
+		AppliedAt: time.Now(),
+	})
+	if err != nil {
+		return abort(errors.Wrap(err, "recording history failed"))
+	}
+	if d.Transactional() {
+		if err := s.Commit(); err != nil {
+			return errors.Wrap(err, "committing transaction failed")
+		}
+	}
+
+	now := metav1.Now()
+	res.Applied = false
+	res.RolledBack = true
+	res.RollbackTime = &now
+	return nil
+}
+
+// execStatements executes stmts in order and records their outcome, redacted
+// by r, in res. It stops at the first failing statement. Every statement is
+// cancelled after timeout, unless it is zero.
+func execStatements(ctx context.Context, s Session, stmts []string, res *v1alpha1.PersistenceActionInstanceStatus, r *redactor, timeout time.Duration) error {
+	for _, stmt := range stmts {
+		t := time.Now()
+		sctx, cancel := withTimeout(ctx, timeout)
+		err := s.Exec(sctx, stmt)
+		cancel()
+		ss := v1alpha1.StatementStatus{
+			Statement: truncate(r.redact(stmt), maxStatementLength),
+			Succeeded: err == nil,
+			Duration:  metav1.Duration{Duration: time.Since(t)},
+		}
+		if err != nil {
+			ss.Error = r.redact(err.Error())
+		}
+		res.Statements = append(res.Statements, ss)
+
+		if err != nil {
+			return fmt.Errorf("statement %d failed: %s", len(res.Statements), ss.Error)
+		}
+	}
+	return nil
+}
+
+// statements splits actions into the statements they consist of, in order.
+func statements(d Driver, actions []string) []string {
+	var res []string
+	for _, a := range actions {
+		res = append(res, d.SplitStatements(a)...)
+	}
+	return res
+}
+
+// truncate shortens s to at most n bytes followed by an ellipsis. It doesn't
+// cut a UTF-8 encoded character in half, so the status remains valid UTF-8.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
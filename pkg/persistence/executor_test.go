@@ -0,0 +1,306 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/third_party/workqueue"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestMain(m *testing.M) {
+	// SQLite is only supported on request, which the tests rely on.
+	if _, err := LookupDriver("SQLite"); err == nil {
+		fmt.Fprintln(os.Stderr, "SQLite is registered without being enabled")
+		os.Exit(1)
+	}
+	EnableSQLite()
+	os.Exit(m.Run())
+}
+
+// sqliteOperator returns an operator executing actions in-process, and a
+// PersistenceInstance backed by a new SQLite database file.
+func sqliteOperator(t *testing.T) (*Operator, *v1alpha1.PersistenceInstance) {
+	kclient := fake.NewSimpleClientset()
+	c := &Operator{
+		kclient:  kclient,
+		identity: "persistence-operator-0",
+		executor: &sessionExecutor{kclient: kclient, identity: "persistence-operator-0"},
+		config:   Config{ExecutorMode: ExecutorInProcess},
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence"),
+		recorder: &record.FakeRecorder{},
+		metrics:  newOperatorMetrics(),
+	}
+	inst := testInstance()
+	inst.Spec = v1alpha1.PersistenceInstanceSpec{
+		PersistenceType: "SQLite",
+		URL:             filepath.Join(t.TempDir(), "shop.db"),
+	}
+	return c, &inst
+}
+
+// historyKinds returns the kinds of the history entries recorded in the
+// database of inst, in order.
+func historyKinds(t *testing.T, inst *v1alpha1.PersistenceInstance, action string) []string {
+	db, err := sql.Open("sqlite", inst.Spec.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT kind, applied_by FROM `+historyTable+` WHERE action = ? ORDER BY id`, action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var kinds []string
+	for rows.Next() {
+		var kind, appliedBy string
+		if err := rows.Scan(&kind, &appliedBy); err != nil {
+			t.Fatal(err)
+		}
+		if appliedBy != "persistence-operator-0" {
+			t.Errorf("expected the entry to be recorded as applied by persistence-operator-0, got %s", appliedBy)
+		}
+		kinds = append(kinds, kind)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return kinds
+}
+
+// tableExists returns whether the database of inst has the table name.
+func tableExists(t *testing.T, inst *v1alpha1.PersistenceInstance, name string) bool {
+	db, err := sql.Open("sqlite", inst.Spec.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestSyncInProcessSQLite(t *testing.T) {
+	c, inst := sqliteOperator(t)
+	p := testAction()
+	p.Spec.Actions = []string{"CREATE TABLE users (id INT PRIMARY KEY); INSERT INTO users VALUES (1);"}
+
+	status, err := c.syncInProcess(context.Background(), "shop/create-users", &p, []*v1alpha1.PersistenceInstance{inst}, nil, &redactor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Instances) != 1 {
+		t.Fatalf("expected the status of 1 instance, got %d", len(status.Instances))
+	}
+	is := status.Instances[0]
+	if !is.Applied || is.CompletionTime == nil || is.Checksum != checksumOf(&p) {
+		t.Fatalf("expected the action to be applied, got %+v", is)
+	}
+	if len(is.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %+v", is.Statements)
+	}
+	for _, ss := range is.Statements {
+		if !ss.Succeeded || ss.Error != "" {
+			t.Errorf("expected statement %q to succeed, got %+v", ss.Statement, ss)
+		}
+	}
+	if kinds := historyKinds(t, inst, historyAction(&p)); len(kinds) != 1 || kinds[0] != historyKindApply {
+		t.Fatalf("expected the application to be recorded in the history table, got %v", kinds)
+	}
+
+	// With the status lost, the history table prevents applying the action
+	// twice.
+	p.Status = nil
+	status, err = c.syncInProcess(context.Background(), "shop/create-users", &p, []*v1alpha1.PersistenceInstance{inst}, nil, &redactor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Instances[0].Applied || len(status.Instances[0].Statements) != 0 {
+		t.Errorf("expected the action to be taken as applied from the history table, got %+v", status.Instances[0])
+	}
+	if kinds := historyKinds(t, inst, historyAction(&p)); len(kinds) != 1 {
+		t.Errorf("expected no further history entry, got %v", kinds)
+	}
+
+	// The rollback actions revert the action once requested.
+	p.Status = status
+	p.Annotations = map[string]string{rollbackAnnotation: "true"}
+	status, err = c.syncInProcess(context.Background(), "shop/create-users", &p, []*v1alpha1.PersistenceInstance{inst}, nil, &redactor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	is = status.Instances[0]
+	if is.Applied || !is.RolledBack || is.RollbackTime == nil {
+		t.Fatalf("expected the action to be rolled back, got %+v", is)
+	}
+	if tableExists(t, inst, "users") {
+		t.Error("expected the rollback actions to drop the table")
+	}
+	if kinds := historyKinds(t, inst, historyAction(&p)); len(kinds) != 2 || kinds[1] != historyKindRollback {
+		t.Errorf("expected the rollback to be recorded in the history table, got %v", kinds)
+	}
+}
+
+func TestSyncInProcessSQLiteFailure(t *testing.T) {
+	c, inst := sqliteOperator(t)
+	p := testAction()
+	p.Spec.Actions = []string{"CREATE TABLE users (id INT PRIMARY KEY);", "INSERT INTO orders VALUES (1);"}
+
+	status, err := c.syncInProcess(context.Background(), "shop/create-users", &p, []*v1alpha1.PersistenceInstance{inst}, nil, &redactor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := status.Instances[0]
+	if is.Applied || is.ExecutionTime == nil || is.Reason == "" {
+		t.Fatalf("expected the execution to fail, got %+v", is)
+	}
+	if !strings.Contains(is.Reason, "statement 2 failed") {
+		t.Errorf("expected the reason to name the failing statement, got %q", is.Reason)
+	}
+	if len(is.Statements) != 2 || !is.Statements[0].Succeeded || is.Statements[1].Succeeded || is.Statements[1].Error == "" {
+		t.Fatalf("expected the first statement to succeed and the second to fail, got %+v", is.Statements)
+	}
+
+	// The transaction is rolled back as a whole, without a trace in the
+	// history table.
+	if tableExists(t, inst, "users") {
+		t.Error("expected the table created by the failed execution to be rolled back")
+	}
+	if kinds := historyKinds(t, inst, historyAction(&p)); len(kinds) != 0 {
+		t.Errorf("expected no history entry of the failed execution, got %v", kinds)
+	}
+
+	// Failed executions are not retried.
+	p.Status = status
+	status, err = c.syncInProcess(context.Background(), "shop/create-users", &p, []*v1alpha1.PersistenceInstance{inst}, nil, &redactor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Instances[0].Reason != is.Reason || len(status.Instances[0].Statements) != 2 {
+		t.Errorf("expected the failed execution to be kept, got %+v", status.Instances[0])
+	}
+}
+
+// registerAutocommitSQLite registers SQLite as driver without transactions,
+// as persistence type SQLiteAutocommit, so failing actions can only be
+// reverted by their rollback actions.
+var registerAutocommitSQLite sync.Once
+
+func TestAutoRollbackSQLite(t *testing.T) {
+	registerAutocommitSQLite.Do(func() {
+		d, err := LookupDriver("SQLite")
+		if err != nil {
+			t.Fatal(err)
+		}
+		autocommit := *d.(*sqlDriver)
+		autocommit.transactional = false
+		RegisterDriver("SQLiteAutocommit", &autocommit)
+	})
+
+	for _, tc := range []struct {
+		name            string
+		autoRollback    bool
+		rollbackActions []string
+		rolledBack      bool
+		reason          string
+		kinds           []string
+	}{
+		{
+			name:            "rolled back",
+			autoRollback:    true,
+			rollbackActions: []string{"DROP TABLE users;"},
+			rolledBack:      true,
+			reason:          "statement 2 failed",
+			kinds:           []string{historyKindFailed, historyKindRollback},
+		},
+		{
+			name:            "auto rollback disabled",
+			rollbackActions: []string{"DROP TABLE users;"},
+			reason:          "statement 2 failed",
+			kinds:           []string{historyKindFailed},
+		},
+		{
+			name:            "rollback failed",
+			autoRollback:    true,
+			rollbackActions: []string{"DROP TABLE customers;"},
+			reason:          "rollback failed",
+			kinds:           []string{historyKindFailed},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, inst := sqliteOperator(t)
+			inst.Spec.PersistenceType = "SQLiteAutocommit"
+			p := testAction()
+			p.Spec.Actions = []string{"CREATE TABLE users (id INT PRIMARY KEY);", "INSERT INTO orders VALUES (1);"}
+			p.Spec.RollbackActions = tc.rollbackActions
+			p.Spec.AutoRollback = tc.autoRollback
+
+			status, err := c.syncInProcess(context.Background(), "shop/create-users", &p, []*v1alpha1.PersistenceInstance{inst}, nil, &redactor{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			is := status.Instances[0]
+			if is.Applied || is.RolledBack != tc.rolledBack || !strings.Contains(is.Reason, tc.reason) {
+				t.Fatalf("expected the action to fail with %q and rolled back to be %t, got %+v", tc.reason, tc.rolledBack, is)
+			}
+			if exists := tableExists(t, inst, "users"); exists == tc.rolledBack {
+				t.Errorf("expected the table created before the failure to exist to be %t", !tc.rolledBack)
+			}
+			if kinds := historyKinds(t, inst, historyAction(&p)); !reflect.DeepEqual(kinds, tc.kinds) {
+				t.Errorf("expected the history entries %v, got %v", tc.kinds, kinds)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		n        int
+		expected string
+	}{
+		{s: "SELECT 1", n: 8, expected: "SELECT 1"},
+		{s: "SELECT 1", n: 6, expected: "SELECT..."},
+		// "ü" is encoded in two bytes, "€" in three.
+		{s: "SELECT 'Müller'", n: 9, expected: "SELECT 'M..."},
+		{s: "SELECT 'Müller'", n: 10, expected: "SELECT 'M..."},
+		{s: "SELECT 'Müller'", n: 11, expected: "SELECT 'Mü..."},
+		{s: "€€", n: 5, expected: "€..."},
+		{s: "€€", n: 2, expected: "..."},
+	} {
+		res := truncate(tc.s, tc.n)
+		if res != tc.expected {
+			t.Errorf("expected %q truncated to %d bytes to be %q, got %q", tc.s, tc.n, tc.expected, res)
+		}
+		if !utf8.ValidString(res) {
+			t.Errorf("expected %q truncated to %d bytes to be valid UTF-8, got %q", tc.s, tc.n, res)
+		}
+	}
+}
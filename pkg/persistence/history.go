@@ -0,0 +1,225 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// historyTable is the table, or collection, tracking the actions applied
+	// to a database.
+	historyTable = "persistence_operator_history"
+
+	// historyKindApply marks an entry recording the application of an action.
+	historyKindApply = "apply"
+	// historyKindRollback marks an entry recording the rollback of an action.
+	historyKindRollback = "rollback"
+	// historyKindTeardown marks an entry recording the OnDelete actions of a
+	// deleted action.
+	historyKindTeardown = "teardown"
+	// historyKindFailed marks an entry recording an action which failed part
+	// way without a transaction, leaving the database in an intermediate
+	// state.
+	historyKindFailed = "failed"
+
+	// The checksum policies, see PersistenceActionSpec.ChecksumPolicy.
+	checksumPolicyFail    = "Fail"
+	checksumPolicyReapply = "Reapply"
+	checksumPolicyIgnore  = "Ignore"
+
+	// rollbackAnnotation requests the rollback of an action on the instances
+	// it is applied to. The action is not applied again while it is set.
+	rollbackAnnotation = "persistence.mmerrill3.com/rollback"
+)
+
+// HistoryEntry records an action applied to a database.
+type HistoryEntry struct {
+	// The namespace and name of the PersistenceAction
+	Action string `bson:"action"`
+	// The version of the PersistenceAction
+	Version string `bson:"version"`
+	// The checksum of the statements of the PersistenceAction
+	Checksum string `bson:"checksum"`
+	// What happened to the database, e.g. the action was applied
+	Kind string `bson:"kind"`
+	// The identity of the operator which applied the action
+	AppliedBy string `bson:"appliedBy"`
+	// When the action was applied
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// historyAction identifies p in the history table. Actions of different
+// namespaces may target the same database.
+func historyAction(p *v1alpha1.PersistenceAction) string {
+	return p.Namespace + "/" + p.Name
+}
+
+// actionChecksum returns the checksum of the given actions and the values
+// they are rendered with. Every action is terminated, so moving statements
+// between actions changes the checksum.
+func actionChecksum(actions []string, values map[string]string) string {
+	h := sha256.New()
+	for _, a := range actions {
+		h.Write([]byte(a))
+		h.Write([]byte{0})
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Write([]byte(k + "=" + values[k]))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checksumOf returns the checksum of the actions of p, which has to be
+// resolved but not rendered yet, so the checksum is the same on every
+// instance.
+func checksumOf(p *v1alpha1.PersistenceAction) string {
+	return actionChecksum(p.Spec.Actions, p.Spec.Values)
+}
+
+// rollbackRequested returns whether the rollback of p was requested.
+func rollbackRequested(p *v1alpha1.PersistenceAction) bool {
+	_, ok := p.Annotations[rollbackAnnotation]
+	return ok
+}
+
+// checksumPolicy returns the checksum policy of p.
+func checksumPolicy(p *v1alpha1.PersistenceAction) (string, error) {
+	switch p.Spec.ChecksumPolicy {
+	case "", checksumPolicyFail:
+		return checksumPolicyFail, nil
+	case checksumPolicyReapply, checksumPolicyIgnore:
+		return p.Spec.ChecksumPolicy, nil
+	}
+	return "", fmt.Errorf("unknown checksum policy %q, expected one of %s, %s, %s", p.Spec.ChecksumPolicy, checksumPolicyFail, checksumPolicyReapply, checksumPolicyIgnore)
+}
+
+// reapply returns whether p has to be applied again on an instance on which
+// it was applied with the given checksum.
+func reapply(p *v1alpha1.PersistenceAction, checksum string) bool {
+	policy, _ := checksumPolicy(p)
+	return policy == checksumPolicyReapply && checksum != "" && checksum != checksumOf(p)
+}
+
+// historyStatus is the status of an action on an instance whose history
+// table records it as applied already.
+func historyStatus(instance string, e *HistoryEntry) *v1alpha1.PersistenceActionInstanceStatus {
+	at := metav1.NewTime(e.AppliedAt)
+	return &v1alpha1.PersistenceActionInstanceStatus{
+		Instance:       instance,
+		Applied:        true,
+		ExecutionTime:  &at,
+		CompletionTime: &at,
+		Checksum:       e.Checksum,
+	}
+}
+
+// failedHistoryStatus is the status of an action on an instance whose history
+// table records it as failed part way.
+func failedHistoryStatus(instance string, e *HistoryEntry) *v1alpha1.PersistenceActionInstanceStatus {
+	at := metav1.NewTime(e.AppliedAt)
+	return &v1alpha1.PersistenceActionInstanceStatus{
+		Instance:      instance,
+		ExecutionTime: &at,
+		Reason:        fmt.Sprintf("failed part way on %s by %s, the instance has to be repaired manually", e.AppliedAt.UTC().Format(time.RFC3339), e.AppliedBy),
+	}
+}
+
+// recordedHistory looks p up in the history table of the PersistenceInstance
+// inst. It returns nil if p was not applied to the instance yet. The instance
+// is not modified, a missing history table means nothing was applied. The
+// lookup is cancelled along with ctx, or once it took healthCheckTimeout.
+func recordedHistory(ctx context.Context, kclient kubernetes.Interface, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance) (*HistoryEntry, error) {
+	ctx, cancel := withTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	s, _, err := openSession(ctx, kclient, inst, healthCheckTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	ok, err := s.HasHistory(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "looking up history table failed")
+	}
+	if !ok {
+		return nil, nil
+	}
+	e, err := s.History(ctx, historyAction(p))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading history table failed")
+	}
+	if e != nil && (e.Kind != historyKindApply || reapply(p, e.Checksum)) {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// checksumCondition reports the instances on which p was applied with
+// different statements than it consists of now. Depending on the checksum
+// policy of p, they are reported as failed.
+func checksumCondition(p *v1alpha1.PersistenceAction, status *v1alpha1.PersistenceActionStatus) v1alpha1.PersistenceCondition {
+	policy, _ := checksumPolicy(p)
+	if policy == checksumPolicyIgnore {
+		return v1alpha1.PersistenceCondition{
+			Type:   conditionChecksumMismatch,
+			Status: conditionStatus(false),
+			Reason: "Ignored",
+		}
+	}
+
+	sum := checksumOf(p)
+	var mismatched []string
+	for i := range status.Instances {
+		is := &status.Instances[i]
+		if is.Checksum == "" || is.Checksum == sum {
+			continue
+		}
+		mismatched = append(mismatched, is.Instance)
+		if policy == checksumPolicyFail {
+			is.Reason = fmt.Sprintf("checksum mismatch: applied %s, now %s", is.Checksum, sum)
+		}
+	}
+
+	cond := v1alpha1.PersistenceCondition{
+		Type:   conditionChecksumMismatch,
+		Status: conditionStatus(len(mismatched) > 0),
+		Reason: "ChecksumsMatch",
+	}
+	if len(mismatched) > 0 {
+		cond.Reason = "ChecksumMismatch"
+		cond.Message = fmt.Sprintf("actions changed after they were applied to %v", mismatched)
+		if policy == checksumPolicyReapply {
+			cond.Reason = "Reapplying"
+		}
+	}
+	return cond
+}
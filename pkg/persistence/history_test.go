@@ -0,0 +1,137 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+)
+
+func TestActionChecksum(t *testing.T) {
+	base := actionChecksum([]string{"CREATE TABLE a (id INT);", "CREATE TABLE b (id INT);"}, map[string]string{"owner": "shop", "schema": "public"})
+	for _, tc := range []struct {
+		name    string
+		actions []string
+		values  map[string]string
+		same    bool
+	}{
+		{
+			name:    "unchanged",
+			actions: []string{"CREATE TABLE a (id INT);", "CREATE TABLE b (id INT);"},
+			values:  map[string]string{"schema": "public", "owner": "shop"},
+			same:    true,
+		},
+		{
+			name:    "statement changed",
+			actions: []string{"CREATE TABLE a (id BIGINT);", "CREATE TABLE b (id INT);"},
+			values:  map[string]string{"owner": "shop", "schema": "public"},
+		},
+		{
+			name:    "statement moved to another action",
+			actions: []string{"CREATE TABLE a (id INT);CREATE TABLE b (id INT);", ""},
+			values:  map[string]string{"owner": "shop", "schema": "public"},
+		},
+		{
+			name:    "actions reordered",
+			actions: []string{"CREATE TABLE b (id INT);", "CREATE TABLE a (id INT);"},
+			values:  map[string]string{"owner": "shop", "schema": "public"},
+		},
+		{
+			name:    "value changed",
+			actions: []string{"CREATE TABLE a (id INT);", "CREATE TABLE b (id INT);"},
+			values:  map[string]string{"owner": "billing", "schema": "public"},
+		},
+	} {
+		if same := actionChecksum(tc.actions, tc.values) == base; same != tc.same {
+			t.Errorf("%s: expected the checksum to be the same to be %t", tc.name, tc.same)
+		}
+	}
+}
+
+func TestChecksumCondition(t *testing.T) {
+	p := testAction()
+	for _, tc := range []struct {
+		policy   string
+		checksum string
+		status   bool
+		reason   string
+		failed   bool
+	}{
+		{policy: checksumPolicyFail, checksum: checksumOf(&p), reason: "ChecksumsMatch"},
+		// Instances without a recorded checksum are not compared.
+		{policy: checksumPolicyFail, reason: "ChecksumsMatch"},
+		{policy: checksumPolicyFail, checksum: "0123", status: true, reason: "ChecksumMismatch", failed: true},
+		{policy: checksumPolicyReapply, checksum: "0123", status: true, reason: "Reapplying"},
+		{policy: checksumPolicyIgnore, checksum: "0123", reason: "Ignored"},
+	} {
+		p.Spec.ChecksumPolicy = tc.policy
+		status := &v1alpha1.PersistenceActionStatus{Instances: []v1alpha1.PersistenceActionInstanceStatus{
+			{Instance: "orders-db", Applied: true, Checksum: tc.checksum},
+		}}
+		cond := checksumCondition(&p, status)
+		if cond.Type != conditionChecksumMismatch || cond.Status != conditionStatus(tc.status) || cond.Reason != tc.reason {
+			t.Errorf("%s %q: expected the condition to be %s with reason %s, got %+v", tc.policy, tc.checksum, conditionStatus(tc.status), tc.reason, cond)
+		}
+		if failed := status.Instances[0].Reason != ""; failed != tc.failed {
+			t.Errorf("%s %q: expected the instance to be failed to be %t, got %q", tc.policy, tc.checksum, tc.failed, status.Instances[0].Reason)
+		}
+	}
+}
+
+func TestRecordedHistory(t *testing.T) {
+	c, inst := sqliteOperator(t)
+	p := testAction()
+
+	// Nothing is recorded before the history table exists.
+	if e, err := recordedHistory(context.Background(), c.kclient, &p, inst); err != nil || e != nil {
+		t.Fatalf("expected no history entry, got %+v, %v", e, err)
+	}
+	if _, err := c.syncInProcess(context.Background(), "shop/create-users", &p, []*v1alpha1.PersistenceInstance{inst}, nil, &redactor{}); err != nil {
+		t.Fatal(err)
+	}
+	applied := checksumOf(&p)
+
+	for _, tc := range []struct {
+		name     string
+		actions  []string
+		policy   string
+		recorded bool
+	}{
+		{name: "applied", actions: p.Spec.Actions, recorded: true},
+		// Changed actions stay applied, the mismatch is reported by the
+		// checksum condition.
+		{name: "changed", actions: []string{"CREATE TABLE users (id BIGINT PRIMARY KEY);"}, recorded: true},
+		{name: "changed and reapplied", actions: []string{"CREATE TABLE users (id BIGINT PRIMARY KEY);"}, policy: checksumPolicyReapply},
+	} {
+		cur := p
+		cur.Spec.Actions = tc.actions
+		cur.Spec.ChecksumPolicy = tc.policy
+		e, err := recordedHistory(context.Background(), c.kclient, &cur, inst)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if recorded := e != nil; recorded != tc.recorded {
+			t.Fatalf("%s: expected the action to be recorded to be %t, got %+v", tc.name, tc.recorded, e)
+		}
+		if e == nil {
+			continue
+		}
+		if e.Action != "shop/create-users" || e.Version != p.Spec.Version || e.Checksum != applied || e.Kind != historyKindApply || e.AppliedBy != "persistence-operator-0" || e.AppliedAt.IsZero() {
+			t.Errorf("%s: expected the application of version %s with checksum %s, got %+v", tc.name, p.Spec.Version, applied, e)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+// instanceStatusRefreshInterval is how often the status of a
+// PersistenceInstance is written when its probes keep reporting the same, to
+// refresh its LastProbeTime.
+const instanceStatusRefreshInterval = 10 * time.Minute
+
+// instanceWorker runs a worker thread probing the PersistenceInstances.
+func (c *Operator) instanceWorker(ctx context.Context) {
+	for c.processNextInstanceWorkItem(ctx) {
+	}
+}
+
+func (c *Operator) processNextInstanceWorkItem(ctx context.Context) bool {
+	key, quit := c.instanceQueue.Get()
+	if quit {
+		return false
+	}
+	defer c.instanceQueue.Done(key)
+
+	err := c.syncInstance(ctx, key.(string))
+	if err == nil {
+		c.instanceQueue.Forget(key)
+		return true
+	}
+
+	utilruntime.HandleError(errors.Wrap(err, fmt.Sprintf("Sync instance %q failed", key)))
+	c.instanceQueue.AddRateLimited(key)
+
+	return true
+}
+
+// syncInstance probes the PersistenceInstance and publishes the result in
+// its status. The instance is probed again after the probe interval.
+func (c *Operator) syncInstance(ctx context.Context, key string) error {
+	obj, exists, err := c.persistenceInstanceInf.GetIndexer().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	i := obj.(*v1alpha1.PersistenceInstance)
+	if i.DeletionTimestamp != nil {
+		return c.teardownInstance(ctx, key, i)
+	}
+	if i, err = c.syncInstanceFinalizer(i); err != nil {
+		return err
+	}
+	glog.V(4).Infof("probing PersistenceInstance %s", key)
+
+	status := &v1alpha1.PersistenceInstanceStatus{}
+	if i.Status != nil {
+		status.ServerVersion = i.Status.ServerVersion
+		status.Conditions = i.Status.Conditions
+	}
+	now := metav1.Now()
+	status.LastProbeTime = &now
+
+	valid := v1alpha1.PersistenceCondition{Type: conditionValid, Status: v1.ConditionTrue}
+	cond := v1alpha1.PersistenceCondition{Type: conditionReachable}
+	d, err := LookupDriver(i.Spec.PersistenceType)
+	if err != nil {
+		valid.Status = v1.ConditionFalse
+		valid.Reason = "UnknownPersistenceType"
+		valid.Message = err.Error()
+		cond.Reason = valid.Reason
+		cond.Message = valid.Message
+	} else if err := validateInstance(c.kclient, i); err != nil {
+		valid.Status = v1.ConditionFalse
+		valid.Reason = "InvalidSecretReference"
+		valid.Message = err.Error()
+		cond.Reason = valid.Reason
+		cond.Message = valid.Message
+	} else if version, err := c.healthCheck(ctx, d, i); err != nil {
+		// Probes cancelled by the shutdown of the operator or the loss of
+		// its leadership say nothing about the instance.
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		cond.Reason = "ProbeFailed"
+		cond.Message = err.Error()
+	} else {
+		status.Reachable = true
+		status.ServerVersion = version
+		cond.Reason = "ProbeSucceeded"
+	}
+	cond.Status = conditionStatus(status.Reachable)
+	status.Conditions = setCondition(status.Conditions, valid)
+	status.Conditions = setCondition(status.Conditions, cond)
+
+	if !status.Reachable {
+		glog.Infof("PersistenceInstance %s unreachable: %s", key, cond.Message)
+		if i.Status == nil || i.Status.Reachable {
+			c.recorder.Eventf(instanceRef(i), v1.EventTypeWarning, eventReasonInstanceUnreachable, "%s: %s", cond.Reason, cond.Message)
+		}
+	}
+
+	if instanceStatusChanged(i, status) {
+		if err := c.updateInstanceStatus(i, status); err != nil {
+			return err
+		}
+	}
+	if i.Status == nil || instanceReachable(i) != status.Reachable {
+		c.enqueueInstanceActions(i)
+	}
+
+	c.instanceQueue.AddAfter(key, c.config.ProbeInterval)
+	return nil
+}
+
+// healthCheck connects to i with the driver d and returns the version
+// reported by its server. The probe is cancelled along with ctx.
+func (c *Operator) healthCheck(ctx context.Context, d Driver, i *v1alpha1.PersistenceInstance) (string, error) {
+	creds, err := instanceCredentials(c.kclient, i)
+	if err != nil {
+		return "", err
+	}
+	dsn, err := d.DSN(i, creds)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	return d.HealthCheck(ctx, dsn)
+}
+
+// updateInstanceStatus persists status onto i, observed for its current
+// generation.
+func (c *Operator) updateInstanceStatus(i *v1alpha1.PersistenceInstance, status *v1alpha1.PersistenceInstanceStatus) error {
+	status.ObservedGeneration = i.Generation
+	// Objects from the informer cache must not be modified.
+	update := *i
+	update.Status = status
+	if _, err := c.mclient.PersistenceInstances(i.Namespace).UpdateStatus(&update); err != nil {
+		return errors.Wrap(err, "updating persistence instance status failed")
+	}
+	return nil
+}
+
+// instanceStatusChanged returns whether status differs from the one of i in
+// more than its LastProbeTime, or the LastProbeTime of i is older than
+// instanceStatusRefreshInterval. Writing every probe would update every
+// instance once per probe interval for nothing.
+func instanceStatusChanged(i *v1alpha1.PersistenceInstance, status *v1alpha1.PersistenceInstanceStatus) bool {
+	if i.Status == nil || i.Status.LastProbeTime == nil || i.Status.ObservedGeneration != i.Generation {
+		return true
+	}
+	if status.LastProbeTime.Sub(i.Status.LastProbeTime.Time) >= instanceStatusRefreshInterval {
+		return true
+	}
+	cur := *status
+	cur.ObservedGeneration = i.Generation
+	cur.LastProbeTime = i.Status.LastProbeTime
+	return !reflect.DeepEqual(&cur, i.Status)
+}
+
+// instanceReachable returns whether the last probe of i succeeded.
+func instanceReachable(i *v1alpha1.PersistenceInstance) bool {
+	return i.Status != nil && i.Status.Reachable
+}
+
+// instanceUnreachableReason explains why actions targeting i are held back.
+func instanceUnreachableReason(i *v1alpha1.PersistenceInstance) string {
+	if i.Status == nil {
+		return "instance has not been probed yet"
+	}
+	if c := findCondition(i.Status.Conditions, conditionReachable); c != nil && c.Message != "" {
+		return fmt.Sprintf("instance unreachable: %s: %s", c.Reason, c.Message)
+	}
+	return "instance unreachable"
+}
+
+// enqueueInstanceActions enqueues every PersistenceAction selecting i.
+func (c *Operator) enqueueInstanceActions(i *v1alpha1.PersistenceInstance) {
+	objs, err := c.persistenceActionInf.GetIndexer().ByIndex(cache.NamespaceIndex, i.Namespace)
+	if err != nil {
+		glog.Errorf("listing persistence actions failed: %s", err)
+		return
+	}
+	for _, obj := range objs {
+		p := obj.(*v1alpha1.PersistenceAction)
+		selector, err := metav1.LabelSelectorAsSelector(p.Spec.PersistenceInstanceSelector)
+		if err != nil || !selector.Matches(labels.Set(i.Labels)) {
+			continue
+		}
+		c.enqueue(p)
+	}
+}
+
+func (c *Operator) handlePersistenceInstanceAdd(obj interface{}) {
+	key, ok := c.keyFunc(obj)
+	if !ok {
+		return
+	}
+	glog.Infof("PersistenceInstance added : %s", key)
+	c.instanceQueue.Add(key)
+}
+
+func (c *Operator) handlePersistenceInstanceDelete(obj interface{}) {
+	key, ok := c.keyFunc(obj)
+	if !ok {
+		return
+	}
+	glog.Infof("PersistenceInstance deleted : %s", key)
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	if i, ok := obj.(*v1alpha1.PersistenceInstance); ok {
+		c.enqueueInstanceActions(i)
+	}
+}
+
+func (c *Operator) handlePersistenceInstanceUpdate(old, cur interface{}) {
+	o := old.(*v1alpha1.PersistenceInstance)
+	i := cur.(*v1alpha1.PersistenceInstance)
+	// Status updates are written by the operator itself and must not trigger
+	// another probe, the instance is probed periodically anyway. Deletions
+	// and annotations skipping the teardown are acted on right away.
+	if specEqual(o.Spec, i.Spec) && reflect.DeepEqual(o.Labels, i.Labels) &&
+		reflect.DeepEqual(o.Annotations, i.Annotations) && (o.DeletionTimestamp == nil) == (i.DeletionTimestamp == nil) {
+		return
+	}
+
+	key, ok := c.keyFunc(cur)
+	if !ok {
+		return
+	}
+	glog.Infof("PersistenceInstance updated : %s", key)
+	c.instanceQueue.Add(key)
+	c.enqueueInstanceActions(o)
+	c.enqueueInstanceActions(i)
+}
+
+// specEqual compares two specs by their serialized form.
+func specEqual(a, b interface{}) bool {
+	ab, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ab, bb)
+}
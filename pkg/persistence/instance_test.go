@@ -0,0 +1,297 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/third_party/workqueue"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeInstances accepts updates of PersistenceInstances and their status
+// and records them.
+type fakeInstances struct {
+	v1alpha1.PersistenceActionGetter
+	v1alpha1.PersistenceInstanceInterface
+	updated []*v1alpha1.PersistenceInstance
+}
+
+func (f *fakeInstances) PersistenceInstances(string) v1alpha1.PersistenceInstanceInterface {
+	return f
+}
+
+func (f *fakeInstances) Update(i *v1alpha1.PersistenceInstance) (*v1alpha1.PersistenceInstance, error) {
+	return f.UpdateStatus(i)
+}
+
+func (f *fakeInstances) UpdateStatus(i *v1alpha1.PersistenceInstance) (*v1alpha1.PersistenceInstance, error) {
+	f.updated = append(f.updated, i)
+	return i, nil
+}
+
+func TestSyncInstance(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		spec func(t *testing.T, spec *v1alpha1.PersistenceInstanceSpec)
+		// The reasons of the Valid and Reachable conditions.
+		valid, reachable string
+	}{
+		{
+			name:      "reachable",
+			spec:      func(t *testing.T, spec *v1alpha1.PersistenceInstanceSpec) {},
+			reachable: "ProbeSucceeded",
+		},
+		{
+			name:      "unknown persistence type",
+			spec:      func(t *testing.T, spec *v1alpha1.PersistenceInstanceSpec) { spec.PersistenceType = "Cassandra" },
+			valid:     "UnknownPersistenceType",
+			reachable: "UnknownPersistenceType",
+		},
+		{
+			name: "missing secret",
+			spec: func(t *testing.T, spec *v1alpha1.PersistenceInstanceSpec) {
+				spec.PasswordSecretRef = &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{Name: "orders-db"},
+					Key:                  "password",
+				}
+			},
+			valid:     "InvalidSecretReference",
+			reachable: "InvalidSecretReference",
+		},
+		{
+			name: "probe failed",
+			spec: func(t *testing.T, spec *v1alpha1.PersistenceInstanceSpec) {
+				spec.URL = filepath.Join(t.TempDir(), "missing", "shop.db")
+			},
+			reachable: "ProbeFailed",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			i := testInstance()
+			i.Spec = v1alpha1.PersistenceInstanceSpec{
+				PersistenceType: "SQLite",
+				URL:             filepath.Join(t.TempDir(), "shop.db"),
+			}
+			tc.spec(t, &i.Spec)
+			p := testAction()
+
+			mclient := &fakeInstances{}
+			recorder := record.NewFakeRecorder(10)
+			c := &Operator{
+				kclient: fake.NewSimpleClientset(),
+				mclient: mclient,
+				persistenceActionInf: cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceAction{}, 0, cache.Indexers{
+					cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+				}),
+				persistenceInstanceInf: cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceInstance{}, 0, cache.Indexers{}),
+				config:                 Config{ProbeInterval: time.Hour},
+				queue:                  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence"),
+				instanceQueue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence-instance"),
+				recorder:               recorder,
+			}
+			defer c.queue.ShutDown()
+			defer c.instanceQueue.ShutDown()
+			c.persistenceInstanceInf.GetIndexer().Add(&i)
+			c.persistenceActionInf.GetIndexer().Add(&p)
+
+			if err := c.syncInstance(context.Background(), "shop/orders-db"); err != nil {
+				t.Fatal(err)
+			}
+			if len(mclient.updated) != 1 {
+				t.Fatalf("expected the status to be updated once, got %d updates", len(mclient.updated))
+			}
+			status := mclient.updated[0].Status
+			if status.LastProbeTime == nil {
+				t.Error("expected the probe time to be recorded")
+			}
+			if reachable := tc.reachable == "ProbeSucceeded"; status.Reachable != reachable {
+				t.Errorf("expected reachable to be %t, got %t", reachable, status.Reachable)
+			} else if reachable && status.ServerVersion == "" {
+				t.Error("expected the server version to be recorded")
+			}
+
+			valid := findCondition(status.Conditions, conditionValid)
+			if want := conditionStatus(tc.valid == ""); valid == nil || valid.Status != want || valid.Reason != tc.valid {
+				t.Errorf("expected the Valid condition to be %s with reason %q, got %+v", want, tc.valid, valid)
+			}
+			cond := findCondition(status.Conditions, conditionReachable)
+			if cond == nil || cond.Reason != tc.reachable {
+				t.Errorf("expected the Reachable condition to have reason %q, got %+v", tc.reachable, cond)
+			}
+
+			events := recordedEvents(recorder)
+			if unreachable := !status.Reachable; unreachable != (len(events) == 1 && strings.Contains(events[0], eventReasonInstanceUnreachable)) {
+				t.Errorf("expected an unreachable event to be recorded to be %t, got %v", unreachable, events)
+			}
+			// The first probe releases or holds back the actions selecting
+			// the instance.
+			if n := c.queue.Len(); n != 1 {
+				t.Errorf("expected the action selecting the instance to be enqueued, got %d actions", n)
+			}
+			// The instance is probed again after the probe interval.
+			if n := c.instanceQueue.Len(); n != 0 {
+				t.Errorf("expected the instance to be probed again later, got %d instances enqueued", n)
+			}
+		})
+	}
+}
+
+func TestSyncInstanceSkipsUnchangedStatus(t *testing.T) {
+	i := testInstance()
+	i.Spec = v1alpha1.PersistenceInstanceSpec{
+		PersistenceType: "SQLite",
+		URL:             filepath.Join(t.TempDir(), "shop.db"),
+	}
+	mclient := &fakeInstances{}
+	c := &Operator{
+		kclient: fake.NewSimpleClientset(),
+		mclient: mclient,
+		persistenceActionInf: cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceAction{}, 0, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		}),
+		persistenceInstanceInf: cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceInstance{}, 0, cache.Indexers{}),
+		config:                 Config{ProbeInterval: time.Hour},
+		queue:                  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence"),
+		instanceQueue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence-instance"),
+		recorder:               record.NewFakeRecorder(10),
+	}
+	defer c.queue.ShutDown()
+	defer c.instanceQueue.ShutDown()
+	c.persistenceInstanceInf.GetIndexer().Add(&i)
+
+	// probe probes the instance and feeds the written status back into the
+	// informer cache, like the watch would.
+	probe := func() {
+		t.Helper()
+		if err := c.syncInstance(context.Background(), "shop/orders-db"); err != nil {
+			t.Fatal(err)
+		}
+		c.persistenceInstanceInf.GetIndexer().Update(mclient.updated[len(mclient.updated)-1])
+	}
+
+	probe()
+	probe()
+	if n := len(mclient.updated); n != 1 {
+		t.Fatalf("expected a probe reporting the same not to update the status, got %d updates", n)
+	}
+
+	// The probe time is refreshed eventually.
+	last := *mclient.updated[0]
+	status := *last.Status
+	old := metav1.NewTime(status.LastProbeTime.Add(-instanceStatusRefreshInterval))
+	status.LastProbeTime = &old
+	last.Status = &status
+	c.persistenceInstanceInf.GetIndexer().Update(&last)
+	probe()
+	if n := len(mclient.updated); n != 2 {
+		t.Fatalf("expected a stale probe time to be refreshed, got %d updates", n)
+	}
+
+	// Changes of the reachability are written right away.
+	unreachable := *mclient.updated[1]
+	unreachable.Spec.URL = filepath.Join(t.TempDir(), "missing", "shop.db")
+	c.persistenceInstanceInf.GetIndexer().Update(&unreachable)
+	probe()
+	if n := len(mclient.updated); n != 3 || mclient.updated[2].Status.Reachable {
+		t.Fatalf("expected the instance to be reported unreachable, got %d updates", n)
+	}
+}
+
+func TestInstanceUnreachableReason(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		status   *v1alpha1.PersistenceInstanceStatus
+		expected string
+	}{
+		{name: "not probed", expected: "instance has not been probed yet"},
+		{
+			name: "probe failed",
+			status: &v1alpha1.PersistenceInstanceStatus{Conditions: []v1alpha1.PersistenceCondition{{
+				Type:    conditionReachable,
+				Status:  v1.ConditionFalse,
+				Reason:  "ProbeFailed",
+				Message: "connection refused",
+			}}},
+			expected: "instance unreachable: ProbeFailed: connection refused",
+		},
+		{name: "no condition", status: &v1alpha1.PersistenceInstanceStatus{}, expected: "instance unreachable"},
+	} {
+		i := testInstance()
+		i.Status = tc.status
+		if got := instanceUnreachableReason(&i); got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestSyncHoldsActionsOnUnreachableInstances(t *testing.T) {
+	inst := testInstance()
+	inst.Status = &v1alpha1.PersistenceInstanceStatus{Conditions: []v1alpha1.PersistenceCondition{{
+		Type:    conditionReachable,
+		Status:  v1.ConditionFalse,
+		Reason:  "ProbeFailed",
+		Message: "connection refused",
+	}}}
+	p := testAction()
+
+	e := &blockingExecutor{started: make(chan string, 1), release: make(chan struct{})}
+	close(e.release)
+	mclient := &fakeActions{}
+	c := &Operator{
+		kclient: fake.NewSimpleClientset(),
+		mclient: mclient,
+		persistenceActionInf: cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceAction{}, 0, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		}),
+		persistenceInstanceInf: cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceInstance{}, 0, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		}),
+		executor: e,
+		config:   Config{ExecutorMode: ExecutorInProcess},
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence"),
+		recorder: &record.FakeRecorder{},
+		metrics:  newOperatorMetrics(),
+	}
+	defer c.queue.ShutDown()
+	c.persistenceInstanceInf.GetIndexer().Add(&inst)
+	c.persistenceActionInf.GetIndexer().Add(&p)
+
+	if err := c.sync(context.Background(), "shop/create-users"); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.started) != 0 {
+		t.Fatal("expected the action not to run on the unreachable instance")
+	}
+	if len(mclient.updated) == 0 {
+		t.Fatal("expected the status to be updated")
+	}
+	status := mclient.updated[len(mclient.updated)-1].Status
+	if len(status.Instances) != 1 || status.Instances[0].Applied {
+		t.Fatalf("expected the action not to be applied on the instance, got %+v", status.Instances)
+	}
+	if want := "instance unreachable: ProbeFailed: connection refused"; !strings.Contains(status.Instances[0].Reason, want) {
+		t.Errorf("expected the instance status to report %q, got %q", want, status.Instances[0].Reason)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// applicationTimeAnnotation records the ApplicationTime a one-shot Job
+	// was created for, so a rescheduled action can be detected.
+	applicationTimeAnnotation = "persistence.mmerrill3.com/application-time"
+	// checksumAnnotation records the checksum of the actions a one-shot Job
+	// applies.
+	checksumAnnotation = "persistence.mmerrill3.com/checksum"
+)
+
+// makeJob creates the one-shot Job running the actions of the resolved action
+// p against the PersistenceInstance i in the given executor image. The Job
+// reads the actions rendered for i from the Secret synced along with it.
+func makeJob(p v1alpha1.PersistenceAction, i v1alpha1.PersistenceInstance, image string) (*batchv1.Job, error) {
+	spec, err := makeJobSpec(p, i, image)
+	if err != nil {
+		return nil, errors.Wrap(err, "make Job spec")
+	}
+
+	annotations := make(map[string]string, len(p.Annotations)+1)
+	for k, v := range p.Annotations {
+		annotations[k] = v
+	}
+	annotations[applicationTimeAnnotation] = applicationTime(p)
+	annotations[checksumAnnotation] = checksumOf(&p)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            executionName(p, i),
+			Labels:          executionLabels(p, i),
+			Annotations:     annotations,
+			OwnerReferences: ownerReferences(p),
+		},
+		Spec: *spec,
+	}
+
+	return job, nil
+}
+
+// makeRollbackJob creates the one-shot Job running the rollback actions of p
+// against the PersistenceInstance i in the given executor image.
+func makeRollbackJob(p v1alpha1.PersistenceAction, i v1alpha1.PersistenceInstance, image string) (*batchv1.Job, error) {
+	if len(p.Spec.RollbackActions) == 0 {
+		return nil, fmt.Errorf("no rollback actions defined")
+	}
+	rp := p
+	rp.Spec.Actions = p.Spec.RollbackActions
+	rp.Spec.ActionsFrom = nil
+	// A failing rollback is not rolled back by running it once more.
+	rp.Spec.RollbackActions = nil
+	rp.Spec.AutoRollback = false
+	job, err := makeJob(rp, i, image)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Name = rollbackName(p, i)
+	// The history records the checksum of the reverted actions.
+	job.Annotations[checksumAnnotation] = checksumOf(&p)
+	job.Labels[kindLabel] = historyKindRollback
+	job.Spec.Template.Labels[kindLabel] = historyKindRollback
+
+	for n, v := range job.Spec.Template.Spec.Volumes {
+		if v.Name == actionsVolumeName {
+			job.Spec.Template.Spec.Volumes[n].Secret.SecretName = actionsSecretName(job.Name)
+		}
+	}
+	c := &job.Spec.Template.Spec.Containers[0]
+	for n := range c.Env {
+		switch c.Env[n].Name {
+		case "PERSISTENCE_ACTION_KIND":
+			c.Env[n].Value = historyKindRollback
+		case "PERSISTENCE_ACTION_CHECKSUM":
+			c.Env[n].Value = checksumOf(&p)
+		}
+	}
+	return job, nil
+}
+
+// rollbackName returns the name of the Job rolling p back on the
+// PersistenceInstance i.
+func rollbackName(p v1alpha1.PersistenceAction, i v1alpha1.PersistenceInstance) string {
+	return executionName(p, i) + "-rollback"
+}
+
+func makeJobSpec(p v1alpha1.PersistenceAction, i v1alpha1.PersistenceInstance, image string) (*batchv1.JobSpec, error) {
+	podSpec, err := makePodSpec(p, i, image)
+	if err != nil {
+		return nil, err
+	}
+
+	// Executions failing part way may leave the instance in an intermediate
+	// state, so a failed pod is never retried.
+	backoffLimit := int32(0)
+	return &batchv1.JobSpec{
+		BackoffLimit: &backoffLimit,
+		Template: v1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: executionLabels(p, i),
+			},
+			Spec: *podSpec,
+		},
+	}, nil
+}
+
+// applicationTime returns the ApplicationTime of p in its serialized form,
+// or an empty string if the action is not scheduled.
+func applicationTime(p v1alpha1.PersistenceAction) string {
+	if p.Spec.ApplicationTime == nil {
+		return ""
+	}
+	return p.Spec.ApplicationTime.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/third_party/workqueue"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// jobOperator returns an operator running actions in Jobs on a fake cluster
+// holding the given Jobs.
+func jobOperator(objs ...runtime.Object) *Operator {
+	return &Operator{
+		kclient:  fake.NewSimpleClientset(objs...),
+		config:   Config{ExecutorImages: map[string]string{"postgres": testExecutorImage}},
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence"),
+		recorder: record.NewFakeRecorder(10),
+	}
+}
+
+func TestSyncJobsApplicationTime(t *testing.T) {
+	past := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	future := metav1.NewTime(time.Now().Add(time.Hour).Truncate(time.Second))
+	previous := metav1.NewTime(time.Now().Add(2 * time.Hour).Truncate(time.Second))
+
+	for _, tc := range []struct {
+		name string
+		at   *metav1.Time
+		// The application time of an existing Job, if any.
+		existing *metav1.Time
+		// Whether a Job for the current application time is expected.
+		created bool
+	}{
+		{name: "unscheduled", created: true},
+		{name: "due", at: &past, created: true},
+		{name: "pending", at: &future},
+		{name: "postponed", at: &future, existing: &past},
+		{name: "brought forward", at: &past, existing: &previous, created: true},
+		{name: "started", at: &past, existing: &past, created: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, inst := testAction(), testInstance()
+			var objs []runtime.Object
+			if tc.existing != nil {
+				old := p
+				old.Spec.ApplicationTime = tc.existing
+				j, err := makeJob(old, inst, testExecutorImage)
+				if err != nil {
+					t.Fatal(err)
+				}
+				objs = append(objs, j)
+			}
+			c := jobOperator(objs...)
+			defer c.queue.ShutDown()
+
+			p.Spec.ApplicationTime = tc.at
+			if err := c.syncJobs("shop/create-users", &p, []*v1alpha1.PersistenceInstance{&inst}, map[string]string{}, &redactor{}); err != nil {
+				t.Fatal(err)
+			}
+
+			jobs, err := c.kclient.BatchV1().Jobs(p.Namespace).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.created {
+				if len(jobs.Items) != 0 {
+					t.Fatalf("expected no job before the application time, got %d", len(jobs.Items))
+				}
+				return
+			}
+			if len(jobs.Items) != 1 {
+				t.Fatalf("expected one job, got %d", len(jobs.Items))
+			}
+			want := applicationTime(p)
+			if got := jobs.Items[0].Annotations[applicationTimeAnnotation]; got != want {
+				t.Errorf("expected the job to be created for %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestSyncJobsRequeuesAtApplicationTime(t *testing.T) {
+	c := jobOperator()
+	defer c.queue.ShutDown()
+	p, inst := testAction(), testInstance()
+	at := metav1.NewTime(time.Now().Add(100 * time.Millisecond))
+	p.Spec.ApplicationTime = &at
+
+	if err := c.syncJobs("shop/create-users", &p, []*v1alpha1.PersistenceInstance{&inst}, map[string]string{}, &redactor{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.queue.Len(); n != 0 {
+		t.Fatalf("expected the action not to be enqueued before its application time, got %d", n)
+	}
+
+	keys := make(chan interface{})
+	go func() {
+		key, _ := c.queue.Get()
+		keys <- key
+	}()
+	select {
+	case key := <-keys:
+		if key != "shop/create-users" {
+			t.Fatalf("expected shop/create-users to be enqueued, got %v", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the action to be enqueued at its application time")
+	}
+}
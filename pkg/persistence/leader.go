@@ -0,0 +1,216 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// errLeaseLost is returned once another replica took over the lease.
+var errLeaseLost = errors.New("leader election lease lost")
+
+// LeaderElectionConfig configures the election of the replica of the
+// operator executing actions. Only the leader runs the workers.
+type LeaderElectionConfig struct {
+	// Whether to elect a leader. The operator runs unconditionally if unset.
+	Enabled bool
+	// The namespace and name of the ConfigMap and Lease holding the lease.
+	Namespace string
+	Name      string
+	// The identity of the replica. Defaults to the hostname.
+	Identity string
+	// How long replicas wait before taking over a lease which is not renewed.
+	LeaseDuration time.Duration
+	// How long the leader retries renewing the lease before giving it up.
+	RenewDeadline time.Duration
+	// How long replicas wait between attempts to acquire or renew the lease.
+	RetryPeriod time.Duration
+}
+
+// leaderState tracks the current leader as observed by this replica, and
+// whether this replica lost its lease.
+type leaderState struct {
+	mtx     sync.Mutex
+	leader  string
+	leading bool
+	lost    bool
+}
+
+func (s *leaderState) set(leader string, leading bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.leader = leader
+	s.leading = leading
+}
+
+func (s *leaderState) get() (string, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.leader, s.leading
+}
+
+func (s *leaderState) lose() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lost = true
+}
+
+func (s *leaderState) leaseLost() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.lost
+}
+
+// RunWithLeaderElection runs the controller once this replica is elected as
+// leader. The workers are stopped once the lease is lost, in which case
+// errLeaseLost is returned, so the replica can restart as candidate. Actions
+// and teardowns being executed are cancelled right away then, as another
+// replica may take over once the lease expired.
+func (c *Operator) RunWithLeaderElection(stopc <-chan struct{}) error {
+	conf := c.config.LeaderElection
+	if !conf.Enabled {
+		c.setLeading(true)
+		return c.Run(stopc)
+	}
+
+	// The lease is held in a Lease and, for replicas of previous versions
+	// which only know the ConfigMap lock, in a ConfigMap.
+	lock, err := resourcelock.New(
+		resourcelock.ConfigMapsLeasesResourceLock,
+		conf.Namespace,
+		conf.Name,
+		c.kclient.CoreV1(),
+		c.kclient.CoordinationV1(),
+		resourcelock.ResourceLockConfig{
+			Identity:      c.electionID,
+			EventRecorder: c.recorder,
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "creating leader election lock failed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopc:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	started := make(chan struct{})
+	runErr := make(chan error, 1)
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: conf.LeaseDuration,
+		RenewDeadline: conf.RenewDeadline,
+		RetryPeriod:   conf.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			// ctx is cancelled once the lease is lost or the operator
+			// stops.
+			OnStartedLeading: func(ctx context.Context) {
+				glog.Infof("elected as leader %s", c.electionID)
+				c.setLeading(true)
+				close(started)
+
+				err := c.run(ctx, ctx.Done())
+				select {
+				case <-stopc:
+				default:
+					if err == nil {
+						err = errLeaseLost
+					}
+				}
+				runErr <- err
+			},
+			OnStoppedLeading: func() {
+				c.stoppedLeading(stopc)
+			},
+			OnNewLeader: func(id string) {
+				if id != c.electionID {
+					glog.Infof("new leader elected: %s", id)
+					c.leader.set(id, false)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "creating leader elector failed")
+	}
+	c.setLeading(false)
+	go le.Run(ctx)
+
+	// Candidates simply stop, the leader waits for the workers to finish.
+	select {
+	case <-started:
+	case <-stopc:
+		return nil
+	}
+	return <-runErr
+}
+
+// setLeading records whether this replica is the leader.
+func (c *Operator) setLeading(leading bool) {
+	leader, _ := c.leader.get()
+	v := 0.0
+	if leading {
+		leader = c.electionID
+		v = 1
+	}
+	c.leader.set(leader, leading)
+	c.metrics.leader.WithLabelValues(c.electionID).Set(v)
+}
+
+// stoppedLeading records that this replica stopped leading, or gave up as
+// candidate. Unless the operator stops, a leader lost its lease then.
+func (c *Operator) stoppedLeading(stopc <-chan struct{}) {
+	_, leading := c.leader.get()
+	c.setLeading(false)
+	if !leading {
+		return
+	}
+	select {
+	case <-stopc:
+		glog.Infof("stopped leading as %s", c.electionID)
+	default:
+		glog.Infof("lost leadership as %s", c.electionID)
+		c.leader.lose()
+	}
+}
+
+// ServeHealthz reports the health of the replica along with the current
+// leader. A replica which lost its lease is unhealthy, as it stops the
+// workers and exits.
+func (c *Operator) ServeHealthz(w http.ResponseWriter, req *http.Request) {
+	leader, leading := c.leader.get()
+	status := "ok"
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if c.leader.leaseLost() {
+		status = "leader election lease lost"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, "%s\nidentity: %s\nleader: %s\nleading: %t\n", status, c.electionID, leader, leading)
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeHealthz(t *testing.T) {
+	tests := []struct {
+		name     string
+		leading  bool
+		stopped  bool
+		stopping bool
+		code     int
+		body     string
+	}{
+		{name: "leading", leading: true, code: 200, body: "ok\n"},
+		{name: "candidate", code: 200, body: "ok\n"},
+		{name: "candidate stopped", stopped: true, code: 200, body: "ok\n"},
+		{name: "leader stopping", leading: true, stopped: true, stopping: true, code: 200, body: "ok\n"},
+		{name: "lease lost", leading: true, stopped: true, code: 503, body: "leader election lease lost\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Operator{electionID: "persistence-operator-0", metrics: newOperatorMetrics()}
+			c.setLeading(test.leading)
+			stopc := make(chan struct{})
+			if test.stopping {
+				close(stopc)
+			}
+			if test.stopped {
+				c.stoppedLeading(stopc)
+			}
+
+			w := httptest.NewRecorder()
+			c.ServeHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+			if w.Code != test.code {
+				t.Errorf("expected status %d, got %d", test.code, w.Code)
+			}
+			if !strings.HasPrefix(w.Body.String(), test.body) {
+				t.Errorf("expected body to start with %q, got %q", test.body, w.Body.String())
+			}
+			if strings.Contains(w.Body.String(), "leading: true") != (test.leading && !test.stopped) {
+				t.Errorf("expected leading to be %t, got %q", test.leading && !test.stopped, w.Body.String())
+			}
+		})
+	}
+}
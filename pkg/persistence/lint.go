@@ -0,0 +1,70 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// lintRule flags statements matching pattern, unless they match unless as
+// well.
+type lintRule struct {
+	pattern *regexp.Regexp
+	unless  *regexp.Regexp
+	message string
+}
+
+var lintRules = []lintRule{
+	{
+		pattern: regexp.MustCompile(`(?is)^\s*DELETE\b`),
+		unless:  regexp.MustCompile(`(?is)\bWHERE\b`),
+		message: "DELETE without WHERE clause deletes every row",
+	},
+	{
+		pattern: regexp.MustCompile(`(?is)^\s*UPDATE\b`),
+		unless:  regexp.MustCompile(`(?is)\bWHERE\b`),
+		message: "UPDATE without WHERE clause updates every row",
+	},
+	{
+		pattern: regexp.MustCompile(`(?is)^\s*TRUNCATE\b`),
+		message: "TRUNCATE deletes every row",
+	},
+	{
+		pattern: regexp.MustCompile(`(?is)^\s*DROP\s+(TABLE|DATABASE|SCHEMA|VIEW|INDEX)\b`),
+		unless:  regexp.MustCompile(`(?is)\bIF\s+EXISTS\b`),
+		message: "DROP without IF EXISTS fails if the object does not exist",
+	},
+}
+
+// lintStatements returns warnings about the statements of an action run by
+// the driver d of the given persistence type.
+func lintStatements(persistenceType string, d Driver, stmts []string) []string {
+	var res []string
+	if len(stmts) == 0 {
+		res = append(res, "actions contain no statements")
+	}
+	if len(stmts) > 1 && !d.Transactional() {
+		res = append(res, fmt.Sprintf("%s does not apply the statements atomically, a failing statement leaves the preceding ones applied", persistenceType))
+	}
+	for n, stmt := range stmts {
+		for _, r := range lintRules {
+			if r.pattern.MatchString(stmt) && (r.unless == nil || !r.unless.MatchString(stmt)) {
+				res = append(res, fmt.Sprintf("statement %d: %s", n+1, r.message))
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// lockRetryInterval is how long an action waits for the instances it targets
+// to be released by the actions syncing them.
+const lockRetryInterval = 5 * time.Second
+
+// lockReservationTTL is how long owners keep their place in line for keys
+// without trying to lock them again, e.g. because the action was deleted.
+const lockReservationTTL = 3 * lockRetryInterval
+
+// instanceLocks keeps the workers from syncing actions targeting the same
+// PersistenceInstances concurrently. Instances are identified by their key.
+// The locks only cover the sync itself, including in-process executions. Jobs
+// and CronJobs keep running once the sync created them and released the
+// locks, they are serialized by holding back actions on instances on which
+// Jobs of other actions are running instead, see runningExecution.
+type instanceLocks struct {
+	mtx  sync.Mutex
+	held map[string]bool
+	// The owners which failed to lock their keys, in the order they tried
+	// first.
+	waiting []*lockReservation
+}
+
+// lockReservation holds back keys for an owner waiting to lock them.
+type lockReservation struct {
+	owner string
+	keys  []string
+	tried time.Time
+}
+
+// tryLock locks all keys for owner, or none of them if any is locked already
+// or reserved by an owner waiting for longer. Owners failing to lock the keys
+// reserve them, so owners locking many keys are not starved by ones locking
+// few of them. Reservations expire unless the owner tries again within
+// lockReservationTTL. Workers never wait for a lock, so they can't deadlock
+// and unrelated instances progress in the meantime.
+func (l *instanceLocks) tryLock(owner string, keys []string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+
+	free := true
+	for _, k := range keys {
+		if l.held[k] {
+			free = false
+		}
+	}
+	var (
+		waiting []*lockReservation
+		own     *lockReservation
+	)
+	for _, w := range l.waiting {
+		if now.Sub(w.tried) > lockReservationTTL {
+			continue
+		}
+		if w.owner == owner {
+			own = w
+		} else if own == nil && overlaps(w.keys, keys) {
+			// Reserved by an owner waiting for longer.
+			free = false
+		}
+		waiting = append(waiting, w)
+	}
+
+	if !free {
+		if own == nil {
+			own = &lockReservation{owner: owner}
+			waiting = append(waiting, own)
+		}
+		own.keys, own.tried = keys, now
+		l.waiting = waiting
+		return false
+	}
+	l.waiting = waiting[:0]
+	for _, w := range waiting {
+		if w != own {
+			l.waiting = append(l.waiting, w)
+		}
+	}
+	if l.held == nil {
+		l.held = map[string]bool{}
+	}
+	for _, k := range keys {
+		l.held[k] = true
+	}
+	return true
+}
+
+// unlock releases keys locked by tryLock.
+func (l *instanceLocks) unlock(keys []string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for _, k := range keys {
+		delete(l.held, k)
+	}
+}
+
+// overlaps returns whether a and b have a key in common.
+func overlaps(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// instanceKeys returns the keys of instances.
+func instanceKeys(instances []*v1alpha1.PersistenceInstance) []string {
+	res := make([]string, 0, len(instances))
+	for _, inst := range instances {
+		res = append(res, inst.Namespace+"/"+inst.Name)
+	}
+	return res
+}
+
+// jobFinished returns whether j completed or failed for good.
+func jobFinished(j *batchv1.Job) bool {
+	for _, c := range j.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// runningExecution returns the name of another action than p with a Job
+// running on the PersistenceInstance inst, or an empty string if there is
+// none. The Jobs are listed from the API rather than the informer cache, as
+// the cache may not contain Jobs created by the last sync yet. Jobs spawned by
+// the CronJobs of scheduled actions are taken into account. The CronJobs
+// themselves are suspended while Jobs of other actions run on the instance,
+// see syncCronJobs, though they may fire before the suspension took effect.
+func (c *Operator) runningExecution(p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance) (string, error) {
+	jobs, err := c.kclient.BatchV1().Jobs(inst.Namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", instanceLabel, inst.Name),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "listing jobs failed")
+	}
+	for i := range jobs.Items {
+		j := &jobs.Items[i]
+		if name := j.Labels[actionLabel]; name != p.Name && !jobFinished(j) {
+			return name, nil
+		}
+	}
+	return "", nil
+}
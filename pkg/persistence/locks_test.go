@@ -0,0 +1,172 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/third_party/workqueue"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestInstanceLocksFairness(t *testing.T) {
+	var l instanceLocks
+	if !l.tryLock("x", []string{"a"}) {
+		t.Fatal("expected x to lock a")
+	}
+	if l.tryLock("w1", []string{"a", "b"}) {
+		t.Fatal("expected w1 to fail locking a and b while x holds a")
+	}
+	// b is free, but reserved by w1 which waits for longer.
+	if l.tryLock("w2", []string{"b"}) {
+		t.Fatal("expected w2 to fail locking b reserved by w1")
+	}
+	l.unlock([]string{"a"})
+	if l.tryLock("w2", []string{"b"}) {
+		t.Fatal("expected w2 to fail locking b before w1 got it")
+	}
+	if !l.tryLock("w1", []string{"a", "b"}) {
+		t.Fatal("expected w1 to lock a and b once x released a")
+	}
+	l.unlock([]string{"a", "b"})
+	if !l.tryLock("w2", []string{"b"}) {
+		t.Fatal("expected w2 to lock b once w1 released it")
+	}
+}
+
+func TestInstanceLocksReservationExpiry(t *testing.T) {
+	var l instanceLocks
+	l.tryLock("x", []string{"a"})
+	if l.tryLock("w1", []string{"a", "b"}) {
+		t.Fatal("expected w1 to fail locking a and b while x holds a")
+	}
+	// w1 gave up, e.g. because its action was deleted.
+	l.waiting[0].tried = time.Now().Add(-2 * lockReservationTTL)
+	if !l.tryLock("w2", []string{"b"}) {
+		t.Fatal("expected w2 to lock b once the reservation of w1 expired")
+	}
+}
+
+// blockingExecutor reports the actions it starts executing and applies them
+// once release is closed.
+type blockingExecutor struct {
+	started chan string
+	release chan struct{}
+}
+
+func (e *blockingExecutor) Execute(ctx context.Context, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance, r *redactor) (*v1alpha1.PersistenceActionInstanceStatus, error) {
+	e.started <- p.Name
+	<-e.release
+	return &v1alpha1.PersistenceActionInstanceStatus{Instance: inst.Name, Applied: true, Checksum: checksumOf(p)}, nil
+}
+
+func (e *blockingExecutor) Rollback(ctx context.Context, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance, applied v1alpha1.PersistenceActionInstanceStatus, r *redactor) (*v1alpha1.PersistenceActionInstanceStatus, error) {
+	return nil, fmt.Errorf("unexpected rollback of %s", p.Name)
+}
+
+// fakeActions accepts updates of PersistenceActions and their status and
+// records them.
+type fakeActions struct {
+	v1alpha1.PersistenceActionInterface
+	v1alpha1.PersistenceInstanceGetter
+
+	mu      sync.Mutex
+	updated []*v1alpha1.PersistenceAction
+}
+
+func (f *fakeActions) PersistenceActions(string) v1alpha1.PersistenceActionInterface {
+	return f
+}
+
+func (f *fakeActions) Update(p *v1alpha1.PersistenceAction) (*v1alpha1.PersistenceAction, error) {
+	return f.UpdateStatus(p)
+}
+
+func (f *fakeActions) UpdateStatus(p *v1alpha1.PersistenceAction) (*v1alpha1.PersistenceAction, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updated = append(f.updated, p)
+	return p, nil
+}
+
+func TestSyncSerializesExecutionsOnInstances(t *testing.T) {
+	inst := testInstance()
+	inst.Status = &v1alpha1.PersistenceInstanceStatus{Reachable: true}
+	users := testAction()
+	orders := testAction()
+	orders.Name = "create-orders"
+	orders.UID = "2f0c6a2e-5a6e-11e7-907b-a6006ad3dba0"
+
+	e := &blockingExecutor{started: make(chan string, 2), release: make(chan struct{})}
+	c := &Operator{
+		kclient: fake.NewSimpleClientset(),
+		mclient: &fakeActions{},
+		persistenceActionInf: cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceAction{}, 0, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+			sourceIndex:          actionSourceIndexFunc,
+		}),
+		persistenceInstanceInf: cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceInstance{}, 0, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		}),
+		executor: e,
+		config:   Config{ExecutorMode: ExecutorInProcess},
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence"),
+		recorder: &record.FakeRecorder{},
+		metrics:  newOperatorMetrics(),
+	}
+	defer c.queue.ShutDown()
+	c.persistenceInstanceInf.GetIndexer().Add(&inst)
+	c.persistenceActionInf.GetIndexer().Add(&users)
+	c.persistenceActionInf.GetIndexer().Add(&orders)
+
+	done := make(chan error)
+	go func() { done <- c.sync(context.Background(), "shop/create-users") }()
+	if name := <-e.started; name != users.Name {
+		t.Fatalf("expected %s to start, got %s", users.Name, name)
+	}
+
+	// The instance is locked until the execution of create-users finished.
+	if err := c.sync(context.Background(), "shop/create-orders"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-e.started:
+		t.Fatalf("expected %s to wait for the instance, but it started", name)
+	default:
+	}
+
+	close(e.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := c.sync(context.Background(), "shop/create-orders"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-e.started:
+		if name != orders.Name {
+			t.Fatalf("expected %s to start, got %s", orders.Name, name)
+		}
+	default:
+		t.Fatalf("expected %s to start once the instance was released", orders.Name)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/third_party/workqueue"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+const metricsNamespace = "persistence_operator"
+
+// operatorMetrics are updated as the operator executes actions.
+type operatorMetrics struct {
+	executions *prometheus.CounterVec
+	failures   *prometheus.CounterVec
+	rollbacks  *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	leader     *prometheus.GaugeVec
+}
+
+func newOperatorMetrics() *operatorMetrics {
+	actionLabels := []string{"namespace", "action"}
+	return &operatorMetrics{
+		executions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "action_executions_total",
+			Help:      "Number of executions of persistence actions on persistence instances.",
+		}, actionLabels),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "action_failures_total",
+			Help:      "Number of failed executions of persistence actions on persistence instances.",
+		}, actionLabels),
+		rollbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "action_rollbacks_total",
+			Help:      "Number of rollbacks of persistence actions on persistence instances.",
+		}, actionLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "action_execution_duration_seconds",
+			Help:      "Duration of successful executions of persistence actions by persistence type.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+		}, []string{"persistence_type"}),
+		leader: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "leader",
+			Help:      "Whether the replica with the given identity is the elected leader running the workers.",
+		}, []string{"identity"}),
+	}
+}
+
+// applied records the successful execution of p on inst.
+func (m *operatorMetrics) applied(p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance, is v1alpha1.PersistenceActionInstanceStatus) {
+	m.executions.WithLabelValues(p.Namespace, p.Name).Inc()
+	if is.ExecutionTime != nil && is.CompletionTime != nil {
+		d := is.CompletionTime.Sub(is.ExecutionTime.Time)
+		m.duration.WithLabelValues(inst.Spec.PersistenceType).Observe(d.Seconds())
+	}
+}
+
+// failed records the failed execution of p.
+func (m *operatorMetrics) failed(p *v1alpha1.PersistenceAction) {
+	m.executions.WithLabelValues(p.Namespace, p.Name).Inc()
+	m.failures.WithLabelValues(p.Namespace, p.Name).Inc()
+}
+
+// rolledBack records the rollback of p.
+func (m *operatorMetrics) rolledBack(p *v1alpha1.PersistenceAction) {
+	m.rollbacks.WithLabelValues(p.Namespace, p.Name).Inc()
+}
+
+// forget drops the series of the deleted action name in namespace, so that
+// they don't accumulate as actions come and go.
+func (m *operatorMetrics) forget(namespace, name string) {
+	m.executions.DeleteLabelValues(namespace, name)
+	m.failures.DeleteLabelValues(namespace, name)
+	m.rollbacks.DeleteLabelValues(namespace, name)
+}
+
+var (
+	descPendingActions = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "instance_pending_actions"),
+		"Number of persistence actions selecting a persistence instance which are not applied on it yet.",
+		[]string{"namespace", "instance"}, nil,
+	)
+	descInstanceReachable = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "instance_reachable"),
+		"Whether the last probe of a persistence instance succeeded.",
+		[]string{"namespace", "instance"}, nil,
+	)
+)
+
+// instanceCollector reports the state of the PersistenceInstances from the
+// informer caches when scraped.
+type instanceCollector struct {
+	actions   cache.Indexer
+	instances cache.Indexer
+}
+
+// Describe implements prometheus.Collector.
+func (ic *instanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descPendingActions
+	ch <- descInstanceReachable
+}
+
+// Collect implements prometheus.Collector.
+func (ic *instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, obj := range ic.instances.List() {
+		inst := obj.(*v1alpha1.PersistenceInstance)
+		reachable := 0.0
+		if instanceReachable(inst) {
+			reachable = 1
+		}
+		ch <- prometheus.MustNewConstMetric(descInstanceReachable, prometheus.GaugeValue, reachable, inst.Namespace, inst.Name)
+		ch <- prometheus.MustNewConstMetric(descPendingActions, prometheus.GaugeValue, ic.pendingActions(inst), inst.Namespace, inst.Name)
+	}
+}
+
+// pendingActions counts the actions selecting inst which are not applied on
+// it yet.
+func (ic *instanceCollector) pendingActions(inst *v1alpha1.PersistenceInstance) float64 {
+	objs, err := ic.actions.ByIndex(cache.NamespaceIndex, inst.Namespace)
+	if err != nil {
+		return 0
+	}
+	var n float64
+	for _, obj := range objs {
+		p := obj.(*v1alpha1.PersistenceAction)
+		if p.Spec.Applied || p.Spec.DryRun || p.DeletionTimestamp != nil {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(p.Spec.PersistenceInstanceSelector)
+		if err != nil || !selector.Matches(labels.Set(inst.Labels)) {
+			continue
+		}
+		if is := previousInstanceStatus(p, inst.Name); is == nil || !is.Applied {
+			n++
+		}
+	}
+	return n
+}
+
+// RegisterMetrics registers the metrics of the operator with r.
+func (c *Operator) RegisterMetrics(r prometheus.Registerer) {
+	r.MustRegister(
+		c.metrics.executions,
+		c.metrics.failures,
+		c.metrics.rollbacks,
+		c.metrics.duration,
+		c.metrics.leader,
+		&instanceCollector{
+			actions:   c.persistenceActionInf.GetIndexer(),
+			instances: c.persistenceInstanceInf.GetIndexer(),
+		},
+	)
+}
+
+// RegisterWorkqueueMetrics exports the metrics of the work queues of the
+// operator through r. It has to be called before the operator is created.
+func RegisterWorkqueueMetrics(r prometheus.Registerer) {
+	p := &workqueueMetricsProvider{
+		depth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "workqueue",
+			Name:      "depth",
+			Help:      "Current depth of the work queue.",
+		}, []string{"name"}),
+		adds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "workqueue",
+			Name:      "adds_total",
+			Help:      "Number of adds handled by the work queue.",
+		}, []string{"name"}),
+		latency: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "workqueue",
+			Name:      "queue_latency_microseconds",
+			Help:      "How long an item stays in the work queue before being requested.",
+		}, []string{"name"}),
+		workDuration: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "workqueue",
+			Name:      "work_duration_microseconds",
+			Help:      "How long processing an item from the work queue takes.",
+		}, []string{"name"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "workqueue",
+			Name:      "retries_total",
+			Help:      "Number of retries handled by the work queue.",
+		}, []string{"name"}),
+	}
+	r.MustRegister(p.depth, p.adds, p.latency, p.workDuration, p.retries)
+	workqueue.SetProvider(p)
+}
+
+// workqueueMetricsProvider provides the metrics of the work queues, labeled
+// by the name of the queue.
+type workqueueMetricsProvider struct {
+	depth        *prometheus.GaugeVec
+	adds         *prometheus.CounterVec
+	latency      *prometheus.SummaryVec
+	workDuration *prometheus.SummaryVec
+	retries      *prometheus.CounterVec
+}
+
+func (p *workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return p.depth.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return p.adds.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.SummaryMetric {
+	return p.latency.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.SummaryMetric {
+	return p.workDuration.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return p.retries.WithLabelValues(name)
+}
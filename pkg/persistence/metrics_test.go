@@ -0,0 +1,249 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/third_party/workqueue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestTransitionMetrics(t *testing.T) {
+	started := metav1.NewTime(time.Now().Add(-3 * time.Second))
+	completed := metav1.Now()
+	reachable := testInstance()
+	reachable.Status = &v1alpha1.PersistenceInstanceStatus{Reachable: true}
+
+	for _, tc := range []struct {
+		name     string
+		instance v1alpha1.PersistenceInstance
+		cur      v1alpha1.PersistenceActionInstanceStatus
+		// The expected executions, failures and rollbacks of the action and
+		// observed durations.
+		executions, failures, rollbacks, durations int
+	}{
+		{
+			name:       "applied",
+			instance:   reachable,
+			cur:        v1alpha1.PersistenceActionInstanceStatus{Applied: true, ExecutionTime: &started, CompletionTime: &completed},
+			executions: 1,
+			durations:  1,
+		},
+		{
+			name:       "applied without timing",
+			instance:   reachable,
+			cur:        v1alpha1.PersistenceActionInstanceStatus{Applied: true},
+			executions: 1,
+		},
+		{
+			name:       "statement failed",
+			instance:   reachable,
+			cur:        v1alpha1.PersistenceActionInstanceStatus{Reason: "statement 1 failed: syntax error"},
+			executions: 1,
+			failures:   1,
+		},
+		{
+			name:      "rolled back",
+			instance:  reachable,
+			cur:       v1alpha1.PersistenceActionInstanceStatus{RolledBack: true, Reason: "statement 2 failed"},
+			rollbacks: 1,
+		},
+		{
+			name:     "held back",
+			instance: reachable,
+			cur:      v1alpha1.PersistenceActionInstanceStatus{Reason: "held back: instance orders-db is busy"},
+		},
+		{
+			name:     "instance unreachable",
+			instance: testInstance(),
+			cur:      v1alpha1.PersistenceActionInstanceStatus{Reason: "connecting failed: connection refused"},
+		},
+	} {
+		c := &Operator{recorder: record.NewFakeRecorder(10), metrics: newOperatorMetrics()}
+		inst := tc.instance
+		p := testAction()
+		cur := tc.cur
+		cur.Instance = inst.Name
+		c.recordTransitions(&p, []*v1alpha1.PersistenceInstance{&inst}, &v1alpha1.PersistenceActionStatus{
+			Instances: []v1alpha1.PersistenceActionInstanceStatus{cur},
+		})
+
+		for _, m := range []struct {
+			name     string
+			counter  *prometheus.CounterVec
+			expected int
+		}{
+			{name: "executions", counter: c.metrics.executions, expected: tc.executions},
+			{name: "failures", counter: c.metrics.failures, expected: tc.failures},
+			{name: "rollbacks", counter: c.metrics.rollbacks, expected: tc.rollbacks},
+		} {
+			if got := testutil.ToFloat64(m.counter.WithLabelValues(p.Namespace, p.Name)); got != float64(m.expected) {
+				t.Errorf("%s: expected %d %s, got %v", tc.name, m.expected, m.name, got)
+			}
+		}
+		if got := testutil.CollectAndCount(c.metrics.duration); got != tc.durations {
+			t.Errorf("%s: expected durations observed for %d persistence types, got %d", tc.name, tc.durations, got)
+		}
+	}
+}
+
+func TestForgetMetrics(t *testing.T) {
+	m := newOperatorMetrics()
+	users, orders := testAction(), testAction()
+	orders.Name = "create-orders"
+	for _, p := range []*v1alpha1.PersistenceAction{&users, &orders} {
+		m.failed(p)
+		m.rolledBack(p)
+	}
+
+	m.forget(users.Namespace, users.Name)
+	for name, vec := range map[string]*prometheus.CounterVec{"executions": m.executions, "failures": m.failures, "rollbacks": m.rollbacks} {
+		if got := testutil.CollectAndCount(vec); got != 1 {
+			t.Errorf("expected only the %s of %s to be left, got %d series", name, orders.Name, got)
+		}
+		if got := testutil.ToFloat64(vec.WithLabelValues(orders.Namespace, orders.Name)); got != 1 {
+			t.Errorf("expected the %s of %s to be kept, got %v", name, orders.Name, got)
+		}
+	}
+}
+
+func TestInstanceCollector(t *testing.T) {
+	reachable := testInstance()
+	reachable.Status = &v1alpha1.PersistenceInstanceStatus{Reachable: true}
+	unreachable := testInstance()
+	unreachable.Name = "billing-db"
+
+	pending := testAction()
+	applied := testAction()
+	applied.Name = "create-orders"
+	applied.Status = &v1alpha1.PersistenceActionStatus{Instances: []v1alpha1.PersistenceActionInstanceStatus{
+		{Instance: reachable.Name, Applied: true},
+	}}
+	marked := testAction()
+	marked.Name = "create-customers"
+	marked.Spec.Applied = true
+	dryRun := testAction()
+	dryRun.Name = "drop-users"
+	dryRun.Spec.DryRun = true
+	deleting := testAction()
+	deleting.Name = "create-invoices"
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	unselecting := testAction()
+	unselecting.Name = "create-audit"
+	unselecting.Spec.PersistenceInstanceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "audit"}}
+
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	ic := &instanceCollector{
+		actions:   cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers),
+		instances: cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers),
+	}
+	for _, p := range []*v1alpha1.PersistenceAction{&pending, &applied, &marked, &dryRun, &deleting, &unselecting} {
+		ic.actions.Add(p)
+	}
+	ic.instances.Add(&reachable)
+	ic.instances.Add(&unreachable)
+
+	// Only create-users is pending on orders-db, create-orders is also
+	// pending on billing-db.
+	expected := `
+# HELP persistence_operator_instance_pending_actions Number of persistence actions selecting a persistence instance which are not applied on it yet.
+# TYPE persistence_operator_instance_pending_actions gauge
+persistence_operator_instance_pending_actions{instance="billing-db",namespace="shop"} 2
+persistence_operator_instance_pending_actions{instance="orders-db",namespace="shop"} 1
+# HELP persistence_operator_instance_reachable Whether the last probe of a persistence instance succeeded.
+# TYPE persistence_operator_instance_reachable gauge
+persistence_operator_instance_reachable{instance="billing-db",namespace="shop"} 0
+persistence_operator_instance_reachable{instance="orders-db",namespace="shop"} 1
+`
+	if err := testutil.CollectAndCompare(ic, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+// The work queue metrics provider can only be set once, so it is registered
+// with workqueueRegistry by the first test using it.
+var (
+	registerWorkqueueMetrics sync.Once
+	workqueueRegistry        = prometheus.NewRegistry()
+	workqueueRuns            int
+)
+
+func TestWorkqueueMetrics(t *testing.T) {
+	registerWorkqueueMetrics.Do(func() { RegisterWorkqueueMetrics(workqueueRegistry) })
+	// Runs repeated with -count use queues of their own.
+	workqueueRuns++
+	name := fmt.Sprintf("metrics-test-%d", workqueueRuns)
+
+	q := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), name)
+	defer q.ShutDown()
+	q.Add("shop/create-users")
+	q.Add("shop/create-orders")
+	item, _ := q.Get()
+	q.Done(item)
+	// Retries are delayed beyond the end of the test, so they are counted
+	// without being added yet.
+	q.AddAfter("shop/create-users", time.Hour)
+
+	families, err := workqueueRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The value of each metric of the queue, the sample count for summaries.
+	values := map[string]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			if len(m.GetLabel()) != 1 || m.GetLabel()[0].GetValue() != name {
+				continue
+			}
+			switch {
+			case m.Counter != nil:
+				values[f.GetName()] = m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				values[f.GetName()] = m.GetGauge().GetValue()
+			case m.Summary != nil:
+				values[f.GetName()] = float64(m.GetSummary().GetSampleCount())
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		metric   string
+		expected float64
+	}{
+		{metric: "persistence_operator_workqueue_depth", expected: 1},
+		{metric: "persistence_operator_workqueue_adds_total", expected: 2},
+		{metric: "persistence_operator_workqueue_queue_latency_microseconds", expected: 1},
+		{metric: "persistence_operator_workqueue_work_duration_microseconds", expected: 1},
+		{metric: "persistence_operator_workqueue_retries_total", expected: 1},
+	} {
+		got, ok := values[tc.metric]
+		if !ok {
+			t.Errorf("expected %s to be reported for queue %s", tc.metric, name)
+		} else if got != tc.expected {
+			t.Errorf("expected %s %v for queue %s, got %v", tc.metric, tc.expected, name, got)
+		}
+	}
+}
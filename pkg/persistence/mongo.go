@@ -0,0 +1,367 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoTLSOption is the connection option naming the registered TLS
+// configuration.
+const mongoTLSOption = "tls"
+
+func init() {
+	RegisterDriver("Mongo", &mongoDriver{executorImage: mongoBaseImage})
+}
+
+// mongoDriver runs actions against MongoDB. Every action is a single
+// database command in extended JSON, e.g. {"create": "users"}.
+type mongoDriver struct {
+	executorImage string
+}
+
+// DSN connects to the database of the instance, which commands are run
+// against, passing its parameters as connection options. MongoDB has no
+// schemas. The TLS configuration is registered under the name of the
+// instance, which the tls option refers to.
+func (d *mongoDriver) DSN(i *v1alpha1.PersistenceInstance, c Credentials) (string, error) {
+	if i.Spec.Schema != "" {
+		return "", fmt.Errorf("schemas are not supported by Mongo")
+	}
+	params := make(map[string]string, len(i.Spec.Parameters)+1)
+	for k, v := range i.Spec.Parameters {
+		params[k] = v
+	}
+	if t := c.TLS; t != nil && t.Mode != TLSModeDisable {
+		tc, err := t.Config()
+		if err != nil {
+			return "", err
+		}
+		name := tlsConfigName(i)
+		registerTLSConfig(name, tc)
+		params[mongoTLSOption] = name
+	}
+	u := url.URL{
+		Scheme:   "mongodb",
+		Host:     address(i),
+		Path:     "/" + i.Spec.Database,
+		RawQuery: encodeParameters(params),
+	}
+	if c.Username != "" {
+		u.User = url.UserPassword(c.Username, c.Password)
+	}
+	return u.String(), nil
+}
+
+func (d *mongoDriver) SplitStatements(action string) []string {
+	if stmt := strings.TrimSpace(action); stmt != "" {
+		return []string{stmt}
+	}
+	return nil
+}
+
+func (d *mongoDriver) Transactional() bool {
+	return false
+}
+
+func (d *mongoDriver) ExecutorImage() string {
+	return d.executorImage
+}
+
+func (d *mongoDriver) Open(ctx context.Context, dsn string) (Session, error) {
+	// mgo rejects options it doesn't know, so the tls option is removed
+	// before parsing the DSN.
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	var tc *tls.Config
+	if name := q.Get(mongoTLSOption); name != "" {
+		if tc, err = lookupTLSConfig(name); err != nil {
+			return nil, err
+		}
+		q.Del(mongoTLSOption)
+		u.RawQuery = q.Encode()
+	}
+	info, err := mgo.ParseURL(u.String())
+	if err != nil {
+		return nil, err
+	}
+	info.Timeout = healthCheckTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		info.Timeout = time.Until(deadline)
+	}
+	if tc != nil {
+		dialer := &net.Dialer{Timeout: info.Timeout}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return tls.DialWithDialer(dialer, "tcp", addr.String(), tc)
+		}
+	}
+	s, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoSession{info: info, session: s, database: info.Database}, nil
+}
+
+func (d *mongoDriver) HealthCheck(ctx context.Context, dsn string) (string, error) {
+	s, err := d.Open(ctx, dsn)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+	return s.Version(ctx)
+}
+
+type mongoSession struct {
+	info *mgo.DialInfo
+	// session is nil once it was closed to abort a command.
+	session  *mgo.Session
+	database string
+}
+
+// db returns the database of the session, with the deadline of ctx applied
+// to its next operations. mgo has no notion of contexts, so operations without
+// a deadline are not bounded, like the statements of the SQL drivers. The
+// server is dialed again if the session was closed to abort a command, e.g.
+// to record the failure of the aborted action.
+func (s *mongoSession) db(ctx context.Context) (*mgo.Database, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	if s.session == nil {
+		session, err := mgo.DialWithInfo(s.info)
+		if err != nil {
+			return nil, errors.Wrap(err, "reconnecting failed")
+		}
+		s.session = session
+	}
+	s.session.SetSyncTimeout(timeout)
+	s.session.SetSocketTimeout(timeout)
+	return s.session.DB(s.database), nil
+}
+
+func (s *mongoSession) Version(ctx context.Context) (string, error) {
+	db, err := s.db(ctx)
+	if err != nil {
+		return "", err
+	}
+	info, err := db.Session.BuildInfo()
+	if err != nil {
+		return "", err
+	}
+	return info.Version, nil
+}
+
+func (s *mongoSession) Begin(ctx context.Context) error {
+	return fmt.Errorf("transactions are not supported by mongo")
+}
+
+func (s *mongoSession) Commit() error {
+	return fmt.Errorf("transactions are not supported by mongo")
+}
+
+func (s *mongoSession) Rollback() error {
+	return fmt.Errorf("transactions are not supported by mongo")
+}
+
+func (s *mongoSession) Exec(ctx context.Context, stmt string) error {
+	cmd, err := parseMongoCommand(stmt)
+	if err != nil {
+		return errors.Wrap(err, "parsing command failed")
+	}
+	db, err := s.db(ctx)
+	if err != nil {
+		return err
+	}
+
+	// mgo can't cancel commands, they are aborted by closing the session.
+	done := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			db.Session.Close()
+			aborted <- true
+		case <-done:
+			aborted <- false
+		}
+	}()
+	var res bson.M
+	err = db.Run(cmd, &res)
+	close(done)
+	if <-aborted {
+		s.session = nil
+		if err != nil {
+			return errors.Wrap(ctx.Err(), "command aborted")
+		}
+	}
+	return err
+}
+
+func (s *mongoSession) EnsureHistory(ctx context.Context) error {
+	db, err := s.db(ctx)
+	if err != nil {
+		return err
+	}
+	return db.C(historyTable).EnsureIndexKey("action", "-appliedAt")
+}
+
+func (s *mongoSession) HasHistory(ctx context.Context) (bool, error) {
+	db, err := s.db(ctx)
+	if err != nil {
+		return false, err
+	}
+	names, err := db.CollectionNames()
+	if err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if n == historyTable {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *mongoSession) History(ctx context.Context, action string) (*HistoryEntry, error) {
+	db, err := s.db(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var e HistoryEntry
+	err = db.C(historyTable).Find(bson.M{"action": action}).Sort("-appliedAt").One(&e)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *mongoSession) RecordHistory(ctx context.Context, e HistoryEntry) error {
+	db, err := s.db(ctx)
+	if err != nil {
+		return err
+	}
+	return db.C(historyTable).Insert(e)
+}
+
+func (s *mongoSession) Close() error {
+	if s.session != nil {
+		s.session.Close()
+	}
+	return nil
+}
+
+// parseMongoCommand parses a command in extended JSON. The order of the fields
+// of a document is significant to MongoDB, e.g. the command name comes first,
+// but the extended JSON decoder only decodes documents into maps.
+func parseMongoCommand(stmt string) (bson.D, error) {
+	v, err := parseExtendedJSON([]byte(stmt))
+	if err != nil {
+		return nil, err
+	}
+	cmd, ok := v.(bson.D)
+	if !ok || len(cmd) == 0 {
+		return nil, fmt.Errorf("command is not a document")
+	}
+	return cmd, nil
+}
+
+// parseExtendedJSON decodes documents field by field into bson.D, and leaves
+// every other value to the extended JSON decoder.
+func parseExtendedJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('['):
+		var raws []json.RawMessage
+		if err := json.Unmarshal(data, &raws); err != nil {
+			return nil, err
+		}
+		res := make([]interface{}, 0, len(raws))
+		for _, raw := range raws {
+			v, err := parseExtendedJSON(raw)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, v)
+		}
+		return res, nil
+	case json.Delim('{'):
+		doc := bson.D{}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			name := tok.(string)
+			// Extended JSON represents values like ObjectIds and dates as
+			// documents of fields starting with $.
+			if len(doc) == 0 && strings.HasPrefix(name, "$") {
+				return unmarshalExtendedJSON(data)
+			}
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, err
+			}
+			v, err := parseExtendedJSON(raw)
+			if err != nil {
+				return nil, err
+			}
+			doc = append(doc, bson.DocElem{Name: name, Value: v})
+		}
+		// The closing brace.
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+	return unmarshalExtendedJSON(data)
+}
+
+func unmarshalExtendedJSON(data []byte) (interface{}, error) {
+	var v interface{}
+	if err := bson.UnmarshalJSON(data, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseMongoCommand(t *testing.T) {
+	tests := []struct {
+		stmt     string
+		expected bson.D
+	}{
+		{
+			stmt:     `{"create": "users", "capped": true, "size": 1024}`,
+			expected: bson.D{{Name: "create", Value: "users"}, {Name: "capped", Value: true}, {Name: "size", Value: float64(1024)}},
+		},
+		{
+			stmt: `{"createIndexes": "orders", "indexes": [{"key": {"customer": 1, "createdAt": -1}, "name": "customer_createdAt"}]}`,
+			expected: bson.D{
+				{Name: "createIndexes", Value: "orders"},
+				{Name: "indexes", Value: []interface{}{
+					bson.D{
+						{Name: "key", Value: bson.D{{Name: "customer", Value: float64(1)}, {Name: "createdAt", Value: float64(-1)}}},
+						{Name: "name", Value: "customer_createdAt"},
+					},
+				}},
+			},
+		},
+		{
+			stmt: `{"delete": "sessions", "deletes": [{"q": {"_id": {"$oid": "5964e8d5a6006ad3dba0907b"}}, "limit": 1}]}`,
+			expected: bson.D{
+				{Name: "delete", Value: "sessions"},
+				{Name: "deletes", Value: []interface{}{
+					bson.D{
+						{Name: "q", Value: bson.D{{Name: "_id", Value: bson.ObjectIdHex("5964e8d5a6006ad3dba0907b")}}},
+						{Name: "limit", Value: float64(1)},
+					},
+				}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		cmd, err := parseMongoCommand(test.stmt)
+		if err != nil {
+			t.Fatalf("parsing %s failed: %s", test.stmt, err)
+		}
+		if !reflect.DeepEqual(cmd, test.expected) {
+			t.Errorf("expected %s to be parsed to %#v, got %#v", test.stmt, test.expected, cmd)
+		}
+	}
+
+	for _, stmt := range []string{`[{"create": "users"}]`, `{}`, `"users"`, `{"create": "users"`} {
+		if _, err := parseMongoCommand(stmt); err == nil {
+			t.Errorf("expected parsing %s to fail", stmt)
+		}
+	}
+}
+
+const (
+	mongoOpReply = 1
+	mongoOpQuery = 2004
+)
+
+// blockingMongo is a MongoDB server answering the commands mgo connects with
+// and buildinfo. Every other command blocks until its connection is closed.
+type blockingMongo struct {
+	l       net.Listener
+	blocked chan string
+}
+
+func newBlockingMongo(t *testing.T) *blockingMongo {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &blockingMongo{l: l, blocked: make(chan string, 1)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *blockingMongo) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.LittleEndian.Uint32(header)-16)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		if binary.LittleEndian.Uint32(header[12:]) != mongoOpQuery {
+			continue
+		}
+
+		// The flags and the collection name are followed by the number of
+		// documents to skip and to return, and the query.
+		collection := body[4:]
+		query := collection[bytes.IndexByte(collection, 0)+1+8:]
+		var cmd bson.D
+		if err := bson.Unmarshal(query[:binary.LittleEndian.Uint32(query)], &cmd); err != nil || len(cmd) == 0 {
+			return
+		}
+
+		var res bson.M
+		switch strings.ToLower(cmd[0].Name) {
+		case "ismaster":
+			res = bson.M{"ismaster": true, "maxWireVersion": 2, "ok": 1}
+		case "getnonce":
+			res = bson.M{"nonce": "2375531c32080ae8", "ok": 1}
+		case "ping":
+			res = bson.M{"ok": 1}
+		case "buildinfo":
+			res = bson.M{"version": "3.4.0", "ok": 1}
+		default:
+			select {
+			case m.blocked <- cmd[0].Name:
+			default:
+			}
+			continue
+		}
+		if err := mongoReply(conn, binary.LittleEndian.Uint32(header[4:]), res); err != nil {
+			return
+		}
+	}
+}
+
+// mongoReply answers the request with the given ID with the document doc.
+func mongoReply(w io.Writer, requestID uint32, doc interface{}) error {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	// The header is followed by the response flags, the cursor ID, the
+	// starting position and the number of documents returned.
+	msg := make([]byte, 36, 36+len(b))
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)+len(b)))
+	binary.LittleEndian.PutUint32(msg[8:], requestID)
+	binary.LittleEndian.PutUint32(msg[12:], mongoOpReply)
+	binary.LittleEndian.PutUint32(msg[32:], 1)
+	_, err = w.Write(append(msg, b...))
+	return err
+}
+
+func TestMongoExecCancelled(t *testing.T) {
+	m := newBlockingMongo(t)
+	defer m.l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := (&mongoDriver{}).Open(ctx, "mongodb://"+m.l.Addr().String()+"/shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ectx, ecancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Exec(ectx, `{"compact": "orders"}`) }()
+	select {
+	case name := <-m.blocked:
+		if name != "compact" {
+			t.Fatalf("expected compact to block, got %s", name)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the command to reach the server")
+	}
+
+	ecancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the cancelled command to fail")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the command to be aborted once its context was cancelled")
+	}
+
+	// The session is usable after the command was aborted, e.g. to record
+	// the failure of the action.
+	v, err := s.Version(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "3.4.0" {
+		t.Fatalf("expected version 3.4.0, got %s", v)
+	}
+}
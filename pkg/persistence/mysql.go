@@ -0,0 +1,88 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	// MySQL commits implicitly before and after schema changes, so
+	// transactions can't guard them.
+	RegisterDriver("MySQL", &sqlDriver{
+		driverName:    "mysql",
+		versionQuery:  "SELECT VERSION()",
+		transactional: false,
+		executorImage: mysqlBaseImage,
+		dsn:           mysqlDSN,
+		split: func(action string) []string {
+			return splitSQL(action, splitOptions{backticks: true, backslashEscapes: true})
+		},
+		historyDDL: `CREATE TABLE IF NOT EXISTS ` + historyTable + ` (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	action VARCHAR(253) NOT NULL,
+	version VARCHAR(63) NOT NULL,
+	checksum CHAR(64) NOT NULL,
+	kind VARCHAR(16) NOT NULL,
+	applied_by VARCHAR(253) NOT NULL,
+	applied_at DATETIME(6) NOT NULL
+)`,
+		historyExistsQuery: `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = '` + historyTable + `'`,
+		placeholder:        questionMark,
+	})
+}
+
+// mysqlDSN passes the parameters of the instance as system variables. MySQL
+// doesn't distinguish schemas from databases, so the schema may be given
+// instead of the database. The TLS configuration is registered with the
+// driver under the name of the instance.
+func mysqlDSN(i *v1alpha1.PersistenceInstance, c Credentials) (string, error) {
+	if i.Spec.Database != "" && i.Spec.Schema != "" && i.Spec.Database != i.Spec.Schema {
+		return "", fmt.Errorf("database and schema differ, MySQL only supports either")
+	}
+	cfg := &mysql.Config{
+		User:                 c.Username,
+		Passwd:               c.Password,
+		Net:                  "tcp",
+		Addr:                 address(i),
+		DBName:               i.Spec.Database,
+		Params:               i.Spec.Parameters,
+		AllowNativePasswords: true,
+		ParseTime:            true,
+	}
+	if cfg.DBName == "" {
+		cfg.DBName = i.Spec.Schema
+	}
+	if t := c.TLS; t != nil {
+		if t.Mode == TLSModeDisable {
+			cfg.TLSConfig = "false"
+		} else {
+			tc, err := t.Config()
+			if err != nil {
+				return "", err
+			}
+			name := tlsConfigName(i)
+			if err := mysql.RegisterTLSConfig(name, tc); err != nil {
+				return "", errors.Wrap(err, "registering TLS configuration failed")
+			}
+			cfg.TLSConfig = name
+		}
+	}
+	return cfg.FormatDSN(), nil
+}
@@ -15,38 +15,60 @@
 package persistence
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
 	"github.com/mmerrill3/persistence-operator/pkg/k8sutil"
 	"github.com/mmerrill3/persistence-operator/third_party/workqueue"
 	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/pkg/api"
-	extensionsobj "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"os"
+	"sort"
+	"sync"
 	"time"
 )
 
 const (
-	tprPersistenceInstance = "persistence-instance." + v1alpha1.TPRGroup
-	tprPersistenceAction   = "persistence-action." + v1alpha1.TPRGroup
-	configFilename         = "persistence.yaml"
-	resyncPeriod           = 5 * time.Minute
+	configFilename = "persistence.yaml"
+	resyncPeriod   = 5 * time.Minute
 )
 
 // Operator manages persistence actions
 type Operator struct {
-	kclient              *kubernetes.Clientset
-	mclient              *v1alpha1.PersistenceV1alpha1Client
-	persistenceActionInf cache.SharedIndexInformer
-	host                 string
-	config               Config
-	queue                workqueue.RateLimitingInterface
+	kclient                kubernetes.Interface
+	mclient                v1alpha1.PersistenceV1alpha1Interface
+	crdclient              apiextensionsclient.Interface
+	persistenceActionInf   cache.SharedIndexInformer
+	persistenceInstanceInf cache.SharedIndexInformer
+	jobInf                 cache.SharedIndexInformer
+	configMapInf           cache.SharedIndexInformer
+	secretInf              cache.SharedIndexInformer
+	host                   string
+	identity               string
+	electionID             string
+	leader                 leaderState
+	locks                  instanceLocks
+	executor               actionExecutor
+	config                 Config
+	queue                  workqueue.RateLimitingInterface
+	instanceQueue          workqueue.RateLimitingInterface
+	recorder               record.EventRecorder
+	metrics                *operatorMetrics
 }
 
 // Config defines configuration parameters for the Operator.
@@ -57,24 +79,42 @@ type Config struct {
 	TLSConfig                 rest.TLSClientConfig
 	ConfigReloaderImage       string
 	PersistenceConfigReloader string
-}
-
-// PersistenceActionStatus evaluates the current status of a PersistenceAction deployment.  It return the status
-func PersistenceActionStatus(kclient kubernetes.Interface, p *v1alpha1.PersistenceAction) (*v1alpha1.PersistenceActionStatus, error) {
-	res := &v1alpha1.PersistenceActionStatus{}
-
-	if p.Spec.Applied == true {
-		res.Applied = true
-	} else {
-		_, err := kclient.BatchV2alpha1().CronJobs(p.Namespace).Get(p.Name, metav1.GetOptions{})
-
-		//TODO need to lookup the job for the cronjob
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return res, nil
+	// The interval in which the connectivity to PersistenceInstances is
+	// probed.
+	ProbeInterval time.Duration
+	// The executor running actions which don't specify one, either
+	// ExecutorJob or ExecutorInProcess.
+	ExecutorMode string
+	// How long connecting to a PersistenceInstance and executing a single
+	// statement on it may take when running actions in-process. Unlimited if
+	// zero.
+	ConnectTimeout   time.Duration
+	StatementTimeout time.Duration
+	// The images implementing the executor contract documented in the README,
+	// by lower-case persistence type. Actions on instances of types without
+	// an image can only run in-process.
+	ExecutorImages map[string]string
+	// Whether to restore the PersistenceInstances and PersistenceActions
+	// which were stored as ThirdPartyResources from the backups written by
+	// BackupTPRs on startup.
+	RestoreTPRBackups bool
+	// The namespace the operator runs in, which holds the TPR backups.
+	Namespace string
+	// The service serving the conversion webhook, as namespace/name. The
+	// v1beta1 API is only served if set.
+	ConversionWebhookService string
+	// The file containing the CA bundle the API server verifies the
+	// certificate of the conversion webhook with.
+	ConversionWebhookCAFile string
+	// The interval in which workloads generated for deleted
+	// PersistenceActions are swept. Sweeping is disabled if zero.
+	SweepInterval time.Duration
+	// The election of the replica running the workers.
+	LeaderElection LeaderElectionConfig
+	// The number of workers syncing PersistenceActions concurrently, and of
+	// the ones probing PersistenceInstances. Actions targeting the same
+	// PersistenceInstance are never synced concurrently.
+	Workers int
 }
 
 // New creates a new controller.
@@ -93,20 +133,52 @@ func New(conf Config) (*Operator, error) {
 		return nil, err
 	}
 
+	crdclient, err := apiextensionsclient.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The identity is recorded in the history table of the instances.
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	electionID := conf.LeaderElection.Identity
+	if electionID == "" {
+		electionID = hostname
+	}
+
+	identity := "persistence-operator@" + hostname
 	c := &Operator{
-		kclient: client,
-		mclient: mclient,
-		host:    cfg.Host,
-		config:  conf,
-		queue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence"),
+		kclient:    client,
+		mclient:    mclient,
+		crdclient:  crdclient,
+		host:       cfg.Host,
+		identity:   identity,
+		electionID: electionID,
+		executor: &sessionExecutor{
+			kclient:          client,
+			identity:         identity,
+			connectTimeout:   conf.ConnectTimeout,
+			statementTimeout: conf.StatementTimeout,
+		},
+		config:        conf,
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence"),
+		instanceQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence-instance"),
+		recorder:      newEventRecorder(client),
+		metrics:       newOperatorMetrics(),
 	}
 
 	c.persistenceActionInf = cache.NewSharedIndexInformer(
 		&cache.ListWatch{
-			ListFunc:  mclient.PersistenceActions(api.NamespaceAll).List,
-			WatchFunc: mclient.PersistenceActions(api.NamespaceAll).Watch,
+			ListFunc:  mclient.PersistenceActions(metav1.NamespaceAll).List,
+			WatchFunc: mclient.PersistenceActions(metav1.NamespaceAll).Watch,
+		},
+		&v1alpha1.PersistenceAction{}, resyncPeriod, cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+			sourceIndex:          actionSourceIndexFunc,
 		},
-		&v1alpha1.PersistenceAction{}, resyncPeriod, cache.Indexers{},
 	)
 	c.persistenceActionInf.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    c.handlePersistenceActionAdd,
@@ -114,12 +186,86 @@ func New(conf Config) (*Operator, error) {
 		UpdateFunc: c.handlePersistenceActionUpdate,
 	})
 
+	c.persistenceInstanceInf = cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc:  mclient.PersistenceInstances(metav1.NamespaceAll).List,
+			WatchFunc: mclient.PersistenceInstances(metav1.NamespaceAll).Watch,
+		},
+		&v1alpha1.PersistenceInstance{}, resyncPeriod, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+	c.persistenceInstanceInf.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.handlePersistenceInstanceAdd,
+		DeleteFunc: c.handlePersistenceInstanceDelete,
+		UpdateFunc: c.handlePersistenceInstanceUpdate,
+	})
+
+	// Watch the Jobs executing the actions to keep their status up to date.
+	c.jobInf = cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = actionLabel
+				return client.BatchV1().Jobs(metav1.NamespaceAll).List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = actionLabel
+				return client.BatchV1().Jobs(metav1.NamespaceAll).Watch(context.TODO(), options)
+			},
+		},
+		&batchv1.Job{}, resyncPeriod, cache.Indexers{actionIndex: jobActionIndexFunc},
+	)
+	c.jobInf.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.handleJobAdd,
+		DeleteFunc: c.handleJobDelete,
+		UpdateFunc: c.handleJobUpdate,
+	})
+
+	// Watch the ConfigMaps and Secrets actions are read from. Only their
+	// metadata is cached rather than every Secret of the cluster, the content
+	// is read when the actions are synced.
+	metaclient, err := metadata.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sourceInf := func(resource string) cache.SharedIndexInformer {
+		sources := metaclient.Resource(v1.SchemeGroupVersion.WithResource(resource)).Namespace(metav1.NamespaceAll)
+		return cache.NewSharedIndexInformer(
+			&cache.ListWatch{
+				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+					return sources.List(context.TODO(), options)
+				},
+				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+					return sources.Watch(context.TODO(), options)
+				},
+			},
+			&metav1.PartialObjectMetadata{}, resyncPeriod, cache.Indexers{},
+		)
+	}
+	c.configMapInf = sourceInf("configmaps")
+	c.configMapInf.AddEventHandler(c.sourceHandler(false))
+	c.secretInf = sourceInf("secrets")
+	c.secretInf.AddEventHandler(c.sourceHandler(true))
+
 	return c, nil
 }
 
 // Run the controller.
 func (c *Operator) Run(stopc <-chan struct{}) error {
-	defer c.queue.ShutDown()
+	return c.run(context.Background(), stopc)
+}
+
+// run runs the controller until stopc is closed. Actions and teardowns being
+// executed are cancelled along with ctx.
+func (c *Operator) run(ctx context.Context, stopc <-chan struct{}) error {
+	// The queues may only be shut down once, either before waiting for the
+	// workers or when returning early.
+	var shutdown sync.Once
+	shutDownQueues := func() {
+		shutdown.Do(func() {
+			c.queue.ShutDown()
+			c.instanceQueue.ShutDown()
+		})
+	}
+	defer shutDownQueues()
 
 	errChan := make(chan error)
 	go func() {
@@ -130,8 +276,8 @@ func (c *Operator) Run(stopc <-chan struct{}) error {
 		}
 		glog.Infof("connection established, server version is %s", v)
 
-		if err := c.createTPRs(); err != nil {
-			errChan <- errors.Wrap(err, "creating TPRs failed")
+		if err := c.createCRDs(); err != nil {
+			errChan <- errors.Wrap(err, "creating CRDs failed")
 			return
 		}
 		errChan <- nil
@@ -142,33 +288,64 @@ func (c *Operator) Run(stopc <-chan struct{}) error {
 		if err != nil {
 			return err
 		}
-		glog.Info("TPR API endpoints ready")
+		glog.Info("CRD API endpoints ready")
 	case <-stopc:
 		return nil
 	}
 
-	go c.worker()
 	go c.persistenceActionInf.Run(stopc)
+	go c.persistenceInstanceInf.Run(stopc)
+	go c.jobInf.Run(stopc)
+	go c.configMapInf.Run(stopc)
+	go c.secretInf.Run(stopc)
+	if !cache.WaitForCacheSync(stopc, c.persistenceActionInf.HasSynced, c.persistenceInstanceInf.HasSynced, c.jobInf.HasSynced, c.configMapInf.HasSynced, c.secretInf.HasSynced) {
+		return nil
+	}
+	n := c.config.Workers
+	if n < 1 {
+		n = 1
+	}
+	// Probes of unreachable instances and their teardowns take a while, so
+	// instances are probed by as many workers as actions are synced by.
+	var workers []func(context.Context)
+	for i := 0; i < n; i++ {
+		workers = append(workers, c.worker, c.instanceWorker)
+	}
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w func(context.Context)) {
+			defer wg.Done()
+			w(ctx)
+		}(w)
+	}
+	if c.config.SweepInterval > 0 {
+		go wait.Until(c.sweep, c.config.SweepInterval, stopc)
+	}
 
 	<-stopc
+	// Actions being executed are completed before the workers stop, unless
+	// ctx is cancelled.
+	shutDownQueues()
+	wg.Wait()
 	return nil
 }
 
 // worker runs a worker thread that just dequeues items, processes them, and marks them done.
 // It enforces that the syncHandler is never invoked concurrently with the same key.
-func (c *Operator) worker() {
-	for c.processNextWorkItem() {
+func (c *Operator) worker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
 	}
 }
 
-func (c *Operator) processNextWorkItem() bool {
+func (c *Operator) processNextWorkItem(ctx context.Context) bool {
 	key, quit := c.queue.Get()
 	if quit {
 		return false
 	}
 	defer c.queue.Done(key)
 
-	err := c.sync(key.(string))
+	err := c.sync(ctx, key.(string))
 	if err == nil {
 		c.queue.Forget(key)
 		return true
@@ -180,7 +357,7 @@ func (c *Operator) processNextWorkItem() bool {
 	return true
 }
 
-func (c *Operator) sync(key string) error {
+func (c *Operator) sync(ctx context.Context, key string) error {
 	obj, exists, err := c.persistenceActionInf.GetIndexer().GetByKey(key)
 	if err != nil {
 		return err
@@ -193,32 +370,412 @@ func (c *Operator) sync(key string) error {
 		return c.destroyPersistenceActionJob(ns, name)
 	}
 
-	p := obj.(*v1alpha1.PersistenceAction)
-	if p.Spec.Applied {
+	orig := obj.(*v1alpha1.PersistenceAction)
+	if orig.DeletionTimestamp != nil {
+		// The workloads of the action are garbage collected once it is gone.
+		return c.teardownAction(ctx, key, orig)
+	}
+	if orig, err = c.syncActionFinalizer(orig); err != nil {
+		return err
+	}
+	if orig.Spec.Applied {
 		glog.V(7).Infof("PersistenceAction already applied: %s", key)
+		return c.updateActionStatus(orig, actionStatus(orig, nil, nil))
+	}
+
+	glog.Infof("sync PersistenceAction : %s", key)
+
+	// Actions read from other objects are treated like inline ones from here
+	// on. The status is persisted onto the original object.
+	p, r, err := resolveActions(c.kclient, orig)
+	if err == nil {
+		_, err = checksumPolicy(p)
+	}
+	if err != nil {
+		status := &v1alpha1.PersistenceActionStatus{}
+		if orig.Status != nil {
+			*status = *orig.Status
+		}
+		status.Reason = err.Error()
+		if uerr := c.updateActionStatus(orig, status); uerr != nil {
+			return uerr
+		}
+		return err
+	}
+
+	instances, err := c.persistenceInstances(p)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		glog.Infof("PersistenceAction %s selects no persistence instances", key)
+	}
+
+	// Actions targeting the same instances are synced one at a time, the
+	// others are retried once the instances are released.
+	locked := instanceKeys(instances)
+	if !c.locks.tryLock(v1alpha1.TPRPersistenceActionsKind+"/"+key, locked) {
+		glog.V(4).Infof("PersistenceAction %s waits for its instances to be released", key)
+		c.queue.AddAfter(key, lockRetryInterval)
 		return nil
 	}
+	defer c.locks.unlock(locked)
+
+	// Actions are held back on instances which are not reachable, on which
+	// another action is running, or on which their dependencies are not
+	// applied yet.
+	held := map[string]string{}
+	for _, inst := range instances {
+		if !instanceReachable(inst) {
+			held[inst.Name] = instanceUnreachableReason(inst)
+			continue
+		}
+		if p.Spec.DryRun {
+			continue
+		}
+		// The CronJobs of scheduled actions keep firing once they are
+		// applied, so they are held back as well.
+		if is := previousInstanceStatus(p, inst.Name); p.Spec.Schedule == "" && is != nil && is.Applied && !reapply(p, is.Checksum) && !rollbackRequested(p) {
+			continue
+		}
+		other, err := c.runningExecution(p, inst)
+		if err != nil {
+			return err
+		}
+		if other != "" {
+			held[inst.Name] = fmt.Sprintf("action %s is running on the instance", other)
+		}
+	}
+	cycleCond, err := c.holdForDependencies(p, instances, held)
+	if err != nil {
+		return err
+	}
+
+	var (
+		status  *v1alpha1.PersistenceActionStatus
+		syncErr error
+	)
+	mode, err := executorMode(p, c.config)
+	switch {
+	case p.Spec.DryRun:
+		// Nothing is executed, the plan shows what would be.
+		status = actionStatus(p, instances, nil)
+		status.Plan = planAction(ctx, c.kclient, p, instances, r)
+	case err != nil:
+		syncErr = err
+		status = actionStatus(p, instances, nil)
+	case mode == ExecutorInProcess:
+		status, syncErr = c.syncInProcess(ctx, key, p, instances, held, r)
+	default:
+		syncErr = c.syncExecutions(key, p, instances, held, r)
+		if status, err = c.jobStatus(key, p, instances); err != nil {
+			return err
+		}
+	}
+	for i := range status.Instances {
+		is := &status.Instances[i]
+		if reason, ok := held[is.Instance]; ok && !is.Applied && is.Reason == "" {
+			is.Reason = "held back: " + reason
+			if status.Reason == "" {
+				status.Reason = fmt.Sprintf("instance %s: %s", is.Instance, is.Reason)
+			}
+		}
+	}
+	var conds []v1alpha1.PersistenceCondition
+	if p.Status != nil {
+		conds = p.Status.Conditions
+	}
+	cond := checksumCondition(p, status)
+	status.Conditions = setCondition(conds, cond)
+	status.Conditions = setCondition(status.Conditions, cycleCond)
+	if cond.Reason == "ChecksumMismatch" && status.Reason == "" {
+		status.Reason = cond.Message
+	}
+	if syncErr != nil {
+		status.Reason = r.redact(syncErr.Error())
+	}
+	c.recordTransitions(p, instances, status)
+	if err := c.updateActionStatus(orig, status); err != nil {
+		return err
+	}
+	return syncErr
+}
+
+// syncExecutions creates the workloads executing p on the selected instances,
+// except for the held back ones. Secrets looked up while rendering the
+// actions are registered with r.
+func (c *Operator) syncExecutions(key string, p *v1alpha1.PersistenceAction, instances []*v1alpha1.PersistenceInstance, held map[string]string, r *redactor) error {
+	// Scheduled actions are left to a CronJob, all others run once.
+	if p.Spec.Schedule == "" {
+		if err := c.destroyCronJobs(p.Namespace, p.Name, nil); err != nil {
+			return err
+		}
+		return c.syncJobs(key, p, instances, held, r)
+	}
+	if p.Spec.ApplicationTime != nil {
+		return fmt.Errorf("applicationTime and schedule are mutually exclusive")
+	}
+	if rollbackRequested(p) {
+		return fmt.Errorf("scheduled actions can't be rolled back")
+	}
+	// Jobs spawned by the CronJobs don't carry an application time.
+	err := c.destroyJobs(p.Namespace, p.Name, func(j batchv1.Job) bool {
+		_, ok := j.Annotations[applicationTimeAnnotation]
+		return !ok
+	})
+	if err != nil {
+		return err
+	}
+	return c.syncCronJobs(p, instances, held, r)
+}
+
+// syncCronJobs creates a CronJob for every selected instance and removes the
+// CronJobs of instances which are no longer selected. The CronJobs of held
+// back instances are suspended.
+func (c *Operator) syncCronJobs(p *v1alpha1.PersistenceAction, instances []*v1alpha1.PersistenceInstance, held map[string]string, r *redactor) error {
+	cronJobClient := c.kclient.BatchV1beta1().CronJobs(p.Namespace)
+	selected := make(map[string]bool, len(instances))
+	for _, inst := range instances {
+		rp, err := renderActions(c.kclient, p, inst, r)
+		if err != nil {
+			return errors.Wrapf(err, "rendering actions for instance %s failed", inst.Name)
+		}
+		image, err := executorImage(c.config, inst.Spec.PersistenceType)
+		if err != nil {
+			return errors.Wrapf(err, "generating cron job for instance %s failed", inst.Name)
+		}
+		newCronJob, err := makeCronJob(*p, *inst, image)
+		if err != nil {
+			return errors.Wrapf(err, "generating cron job for instance %s failed", inst.Name)
+		}
+		if _, ok := held[inst.Name]; ok {
+			suspend := true
+			newCronJob.Spec.Suspend = &suspend
+		}
+		if err := c.syncActionsSecret(newCronJob.Name, p, rp.Spec.Actions, rp.Spec.RollbackActions); err != nil {
+			return errors.Wrapf(err, "synchronizing actions of instance %s failed", inst.Name)
+		}
+		if err := k8sutil.CreateOrUpdateCronJob(cronJobClient, newCronJob); err != nil {
+			return errors.Wrapf(err, "synchronizing cron job for instance %s failed", inst.Name)
+		}
+		selected[newCronJob.Name] = true
+	}
 
-	glog.Infof("sync PersistenceAction", key)
+	return c.destroyCronJobs(p.Namespace, p.Name, selected)
+}
+
+// syncJobs holds the action back until its ApplicationTime, if any, and then
+// creates a one-shot Job for every selected instance which is not held back,
+// unless the status of p records it as applied on the instance. The Jobs
+// check the history table themselves. Jobs created for a previous application
+// time or for instances which are no longer selected are removed.
+func (c *Operator) syncJobs(key string, p *v1alpha1.PersistenceAction, instances []*v1alpha1.PersistenceInstance, held map[string]string, r *redactor) error {
+	if rollbackRequested(p) {
+		return c.syncRollbackJobs(key, p, instances, held, r)
+	}
 
-	// Create CronJob if it doesn't exist.
-	cronJobClient := c.kclient.BatchV2alpha1().CronJobs(p.Namespace)
-	newCronJob, err := makeCronJob(*p)
+	at := applicationTime(*p)
+	selected := make(map[string]bool, len(instances))
+	for _, inst := range instances {
+		selected[executionName(*p, *inst)] = true
+	}
+	err := c.destroyJobs(p.Namespace, p.Name, func(j batchv1.Job) bool {
+		return selected[j.Name] && jobCurrent(p, &j)
+	})
 	if err != nil {
 		return err
 	}
-	if err := k8sutil.CreateOrUpdateCronJob(cronJobClient, newCronJob); err != nil {
-		return errors.Wrap(err, "synchronizing cron job failed")
+
+	if p.Spec.ApplicationTime != nil {
+		if d := p.Spec.ApplicationTime.Sub(time.Now()); d > 0 {
+			glog.V(4).Infof("PersistenceAction %s scheduled for %s", key, at)
+			c.queue.AddAfter(key, d)
+			return nil
+		}
+	}
+
+	jobClient := c.kclient.BatchV1().Jobs(p.Namespace)
+	for _, inst := range instances {
+		image, err := executorImage(c.config, inst.Spec.PersistenceType)
+		if err != nil {
+			return errors.Wrapf(err, "generating job for instance %s failed", inst.Name)
+		}
+		job, err := makeJob(*p, *inst, image)
+		if err != nil {
+			return errors.Wrapf(err, "generating job for instance %s failed", inst.Name)
+		}
+
+		existing, err := jobClient.Get(context.TODO(), job.Name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "retrieving job for instance %s failed", inst.Name)
+		}
+		if err == nil {
+			if !jobCurrent(p, existing) {
+				return fmt.Errorf("job %s of previous actions is still being deleted", job.Name)
+			}
+			continue
+		}
+		if _, ok := held[inst.Name]; ok {
+			continue
+		}
+		if is := previousInstanceStatus(p, inst.Name); is != nil && is.Applied && !reapply(p, is.Checksum) {
+			continue
+		}
+
+		rp, err := renderActions(c.kclient, p, inst, r)
+		if err != nil {
+			return errors.Wrapf(err, "rendering actions for instance %s failed", inst.Name)
+		}
+		if err := c.syncActionsSecret(job.Name, p, rp.Spec.Actions, rp.Spec.RollbackActions); err != nil {
+			return errors.Wrapf(err, "synchronizing actions of instance %s failed", inst.Name)
+		}
+		if _, err := jobClient.Create(context.TODO(), job, metav1.CreateOptions{}); err != nil {
+			return errors.Wrapf(err, "creating job for instance %s failed", inst.Name)
+		}
+		c.actionEvent(p, inst, v1.EventTypeNormal, eventReasonJobCreated, "Created job %s", job.Name)
+		glog.Infof("PersistenceAction %s started on instance %s", key, inst.Name)
+	}
+	return nil
+}
+
+// jobCurrent returns whether the Job j applies the current actions of p at
+// its current application time. Jobs applying previous actions are only
+// outdated if p is to be reapplied.
+func jobCurrent(p *v1alpha1.PersistenceAction, j *batchv1.Job) bool {
+	if j.Annotations[applicationTimeAnnotation] != applicationTime(*p) {
+		return false
 	}
+	return !reapply(p, j.Annotations[checksumAnnotation])
+}
+
+// syncRollbackJobs replaces the Jobs applying p by Jobs rolling it back on
+// every selected instance which is not held back and on which it is applied.
+func (c *Operator) syncRollbackJobs(key string, p *v1alpha1.PersistenceAction, instances []*v1alpha1.PersistenceInstance, held map[string]string, r *redactor) error {
+	selected := make(map[string]bool, len(instances))
+	for _, inst := range instances {
+		selected[rollbackName(*p, *inst)] = true
+	}
+	err := c.destroyJobs(p.Namespace, p.Name, func(j batchv1.Job) bool {
+		return selected[j.Name]
+	})
+	if err != nil {
+		return err
+	}
+
+	jobClient := c.kclient.BatchV1().Jobs(p.Namespace)
+	for _, inst := range instances {
+		if is := previousInstanceStatus(p, inst.Name); is == nil || !is.Applied {
+			continue
+		}
+		if _, ok := held[inst.Name]; ok {
+			continue
+		}
+		rp, err := renderActions(c.kclient, p, inst, r)
+		if err != nil {
+			return errors.Wrapf(err, "rendering actions for instance %s failed", inst.Name)
+		}
+		image, err := executorImage(c.config, inst.Spec.PersistenceType)
+		if err != nil {
+			return errors.Wrapf(err, "generating rollback job for instance %s failed", inst.Name)
+		}
+		job, err := makeRollbackJob(*p, *inst, image)
+		if err != nil {
+			return errors.Wrapf(err, "generating rollback job for instance %s failed", inst.Name)
+		}
 
+		_, err = jobClient.Get(context.TODO(), job.Name, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "retrieving rollback job for instance %s failed", inst.Name)
+		}
+		if err := c.syncActionsSecret(job.Name, p, rp.Spec.RollbackActions, nil); err != nil {
+			return errors.Wrapf(err, "synchronizing rollback actions of instance %s failed", inst.Name)
+		}
+		if _, err := jobClient.Create(context.TODO(), job, metav1.CreateOptions{}); err != nil {
+			return errors.Wrapf(err, "creating rollback job for instance %s failed", inst.Name)
+		}
+		c.actionEvent(p, inst, v1.EventTypeNormal, eventReasonJobCreated, "Created rollback job %s", job.Name)
+		glog.Infof("PersistenceAction %s rolling back on instance %s", key, inst.Name)
+	}
 	return nil
 }
 
+// persistenceInstances resolves the PersistenceInstances selected by the
+// PersistenceInstanceSelector of p, ordered by name.
+func (c *Operator) persistenceInstances(p *v1alpha1.PersistenceAction) ([]*v1alpha1.PersistenceInstance, error) {
+	selector, err := metav1.LabelSelectorAsSelector(p.Spec.PersistenceInstanceSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid persistence instance selector")
+	}
+
+	objs, err := c.persistenceInstanceInf.GetIndexer().ByIndex(cache.NamespaceIndex, p.Namespace)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing persistence instances failed")
+	}
+
+	var res []*v1alpha1.PersistenceInstance
+	for _, obj := range objs {
+		i := obj.(*v1alpha1.PersistenceInstance)
+		if selector.Matches(labels.Set(i.Labels)) {
+			res = append(res, i)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
 func (c *Operator) destroyPersistenceActionJob(ns, name string) error {
-	// Create CronJob if it doesn't exist.
-	cronJobClient := c.kclient.BatchV2alpha1().CronJobs(ns)
-	if err := k8sutil.DeleteCronJob(cronJobClient, name); err != nil {
-		return errors.Wrap(err, "Deleting cron job failed")
+	if err := c.destroyCronJobs(ns, name, nil); err != nil {
+		return err
+	}
+	if err := c.destroyJobs(ns, name, func(batchv1.Job) bool { return false }); err != nil {
+		return err
+	}
+	return c.destroyActionsSecrets(ns, name)
+}
+
+// destroyCronJobs deletes the CronJobs of the PersistenceAction name, except
+// the ones listed in keep.
+func (c *Operator) destroyCronJobs(ns, name string, keep map[string]bool) error {
+	cronJobClient := c.kclient.BatchV1beta1().CronJobs(ns)
+	cronJobs, err := cronJobClient.List(context.TODO(), metav1.ListOptions{LabelSelector: actionSelector(name)})
+	if err != nil {
+		return errors.Wrap(err, "listing cron jobs failed")
+	}
+	for _, cj := range cronJobs.Items {
+		if keep[cj.Name] {
+			continue
+		}
+		if err := k8sutil.DeleteCronJob(cronJobClient, cj.Name); err != nil {
+			return errors.Wrapf(err, "deleting cron job %s failed", cj.Name)
+		}
+		if err := k8sutil.DeleteSecret(c.kclient.CoreV1().Secrets(ns), actionsSecretName(cj.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// destroyJobs deletes the Jobs of the PersistenceAction name for which keep
+// returns false.
+func (c *Operator) destroyJobs(ns, name string, keep func(batchv1.Job) bool) error {
+	jobClient := c.kclient.BatchV1().Jobs(ns)
+	jobs, err := jobClient.List(context.TODO(), metav1.ListOptions{LabelSelector: actionSelector(name)})
+	if err != nil {
+		return errors.Wrap(err, "listing jobs failed")
+	}
+	for _, j := range jobs.Items {
+		if keep(j) {
+			continue
+		}
+		if err := k8sutil.DeleteJob(jobClient, j.Name); err != nil {
+			return errors.Wrapf(err, "deleting job %s failed", j.Name)
+		}
+		if err := k8sutil.DeleteSecret(c.kclient.CoreV1().Secrets(ns), actionsSecretName(j.Name)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -238,9 +795,9 @@ func (c *Operator) handlePersistenceActionAdd(obj interface{}) {
 		return
 	}
 	glog.Infof("Persistence added : %s", key)
-	//TODO check if there is a job
-	//if not, add one at the time the job is meant to run
+	// sync holds the action back until its application time.
 	c.enqueue(key)
+	c.enqueueDependents(obj.(*v1alpha1.PersistenceAction))
 }
 
 func (c *Operator) handlePersistenceActionDelete(obj interface{}) {
@@ -249,9 +806,16 @@ func (c *Operator) handlePersistenceActionDelete(obj interface{}) {
 		return
 	}
 	glog.Infof("Persistence deleted : %s", key)
-	//TODO check if there is a job
-	//if so, remove it
 	c.enqueue(key)
+	if ns, name, err := cache.SplitMetaNamespaceKey(key); err == nil {
+		c.metrics.forget(ns, name)
+	}
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	if p, ok := obj.(*v1alpha1.PersistenceAction); ok {
+		c.enqueueDependents(p)
+	}
 }
 
 func (c *Operator) handlePersistenceActionUpdate(old, cur interface{}) {
@@ -260,9 +824,62 @@ func (c *Operator) handlePersistenceActionUpdate(old, cur interface{}) {
 		return
 	}
 	glog.Infof("Persistence updated : %s", key)
-	//TODO check if there is a job
-	//if so, remove it, and add a new one
+	// sync reschedules the action if its application time was edited.
 	c.enqueue(key)
+	// Dependents wait for the status of the action.
+	c.enqueueDependents(cur.(*v1alpha1.PersistenceAction))
+}
+
+func (c *Operator) handleJobAdd(obj interface{}) {
+	c.enqueueJobAction(obj)
+	// The CronJobs of other actions on the instance are suspended while the
+	// Job runs.
+	c.enqueueJobInstanceActions(obj)
+}
+
+func (c *Operator) handleJobDelete(obj interface{}) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	c.enqueueJobAction(obj)
+	c.enqueueJobInstanceActions(obj)
+}
+
+func (c *Operator) handleJobUpdate(old, cur interface{}) {
+	c.enqueueJobAction(cur)
+	if !jobFinished(old.(*batchv1.Job)) && jobFinished(cur.(*batchv1.Job)) {
+		c.enqueueJobInstanceActions(cur)
+	}
+}
+
+// enqueueJobAction enqueues the PersistenceAction the given Job belongs to.
+func (c *Operator) enqueueJobAction(obj interface{}) {
+	keys, err := jobActionIndexFunc(obj)
+	if err != nil {
+		glog.Errorf("resolving persistence action of job failed: %s", err)
+		return
+	}
+	for _, key := range keys {
+		c.enqueue(key)
+	}
+}
+
+// enqueueJobInstanceActions enqueues the PersistenceActions selecting the
+// instance the given Job ran on, which are held back while it is running.
+func (c *Operator) enqueueJobInstanceActions(obj interface{}) {
+	j, ok := obj.(*batchv1.Job)
+	if !ok {
+		return
+	}
+	name, ok := j.Labels[instanceLabel]
+	if !ok {
+		return
+	}
+	inst, exists, err := c.persistenceInstanceInf.GetIndexer().GetByKey(j.Namespace + "/" + name)
+	if err != nil || !exists {
+		return
+	}
+	c.enqueueInstanceActions(inst.(*v1alpha1.PersistenceInstance))
 }
 
 // enqueue adds a key to the queue. If obj is a key already it gets added directly.
@@ -282,42 +899,3 @@ func (c *Operator) enqueue(obj interface{}) {
 
 	c.queue.Add(key)
 }
-
-func (c *Operator) createTPRs() error {
-
-	tprs := []*extensionsobj.ThirdPartyResource{
-		{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: tprPersistenceInstance,
-			},
-			Versions: []extensionsobj.APIVersion{
-				{Name: v1alpha1.TPRVersion},
-			},
-			Description: "Persistence Instance",
-		},
-		{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: tprPersistenceAction,
-			},
-			Versions: []extensionsobj.APIVersion{
-				{Name: v1alpha1.TPRVersion},
-			},
-			Description: "Persistence Action",
-		},
-	}
-	tprClient := c.kclient.Extensions().ThirdPartyResources()
-
-	for _, tpr := range tprs {
-		if _, err := tprClient.Create(tpr); err != nil && !apierrors.IsAlreadyExists(err) {
-			return err
-		}
-		glog.Infof("TPR created : %s ", tpr.Name)
-	}
-
-	// We have to wait for the TPRs to be ready. Otherwise the initial watch may fail.
-	err := k8sutil.WaitForTPRReady(c.kclient.CoreV1().RESTClient(), v1alpha1.TPRGroup, v1alpha1.TPRVersion, v1alpha1.TPRPersistenceInstanceName)
-	if err != nil {
-		return err
-	}
-	return k8sutil.WaitForTPRReady(c.kclient.CoreV1().RESTClient(), v1alpha1.TPRGroup, v1alpha1.TPRVersion, v1alpha1.TPRPersistenceActionName)
-}
@@ -0,0 +1,132 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/third_party/workqueue"
+	batchv1 "k8s.io/api/batch/v1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// emptyInformer returns an informer of objects of the type of obj, listing
+// the empty list and watching nothing.
+func emptyInformer(obj runtime.Object, list runtime.Object) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return list.DeepCopyObject(), nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}, obj, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+// establishedCRDs returns a client of CRDs which are established as soon as
+// they are created or updated.
+func establishedCRDs() *apiextensionsfake.Clientset {
+	crdclient := apiextensionsfake.NewSimpleClientset()
+	crdclient.PrependReactor("*", "customresourcedefinitions", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		var crd *apiextensionsv1beta1.CustomResourceDefinition
+		switch a := action.(type) {
+		case k8stesting.GetAction:
+			crd = &apiextensionsv1beta1.CustomResourceDefinition{ObjectMeta: metav1.ObjectMeta{Name: a.GetName()}}
+		case k8stesting.UpdateAction:
+			crd = a.GetObject().(*apiextensionsv1beta1.CustomResourceDefinition).DeepCopy()
+		default:
+			return false, nil, nil
+		}
+		crd.Status.Conditions = []apiextensionsv1beta1.CustomResourceDefinitionCondition{
+			{Type: apiextensionsv1beta1.Established, Status: apiextensionsv1beta1.ConditionTrue},
+		}
+		return true, crd, nil
+	})
+	return crdclient
+}
+
+func TestRunStops(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// Whether the operator is stopped before its CRDs are established,
+		// rather than once the workers run.
+		early bool
+	}{
+		{name: "workers running"},
+		{name: "waiting for CRDs", early: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Operator{
+				kclient:                fake.NewSimpleClientset(),
+				crdclient:              establishedCRDs(),
+				persistenceActionInf:   emptyInformer(&v1alpha1.PersistenceAction{}, &v1alpha1.PersistenceActionList{}),
+				persistenceInstanceInf: emptyInformer(&v1alpha1.PersistenceInstance{}, &v1alpha1.PersistenceInstanceList{}),
+				jobInf:                 emptyInformer(&batchv1.Job{}, &batchv1.JobList{}),
+				configMapInf:           emptyInformer(&metav1.PartialObjectMetadata{}, &metav1.PartialObjectMetadataList{}),
+				secretInf:              emptyInformer(&metav1.PartialObjectMetadata{}, &metav1.PartialObjectMetadataList{}),
+				config:                 Config{Workers: 2},
+				queue:                  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence"),
+				instanceQueue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "persistence-instance"),
+				recorder:               record.NewFakeRecorder(10),
+				metrics:                newOperatorMetrics(),
+			}
+
+			stopc := make(chan struct{})
+			if tc.early {
+				close(stopc)
+			}
+			done := make(chan error, 1)
+			go func() { done <- c.run(context.Background(), stopc) }()
+
+			if !tc.early {
+				// The workers run once they took the keys off the queues. The
+				// CRDs are polled for every few seconds until then.
+				c.queue.Add("shop/create-users")
+				c.instanceQueue.Add("shop/orders-db")
+				err := wait.Poll(100*time.Millisecond, 20*time.Second, func() (bool, error) {
+					return c.queue.Len() == 0 && c.instanceQueue.Len() == 0, nil
+				})
+				if err != nil {
+					t.Fatal("the workers did not start")
+				}
+				close(stopc)
+			}
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(20 * time.Second):
+				t.Fatal("the operator did not stop")
+			}
+			if !c.queue.ShuttingDown() || !c.instanceQueue.ShuttingDown() {
+				t.Error("expected the queues to be shut down")
+			}
+		})
+	}
+}
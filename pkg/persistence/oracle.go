@@ -0,0 +1,186 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	goora "github.com/sijms/go-ora/v2"
+)
+
+const (
+	// oracleDriverName is the name oracleTLSDriver is registered with in
+	// database/sql.
+	oracleDriverName = "persistence-oracle"
+	// oracleTLSOption is the connection option naming the registered TLS
+	// configuration.
+	oracleTLSOption = "TLS CONFIG"
+)
+
+var (
+	// oracleBlockTerminator terminates PL/SQL blocks, as in SQL*Plus.
+	oracleBlockTerminator = regexp.MustCompile(`(?m)^\s*/\s*$`)
+	// oraclePLSQL matches the start of a PL/SQL block, which may contain
+	// semicolons of its own.
+	oraclePLSQL = regexp.MustCompile(`(?is)^(begin|declare|create\s+(or\s+replace\s+)?(procedure|function|package|trigger|type))\b`)
+)
+
+func init() {
+	// Oracle commits implicitly around schema changes, so transactions can't
+	// guard them.
+	sql.Register(oracleDriverName, oracleTLSDriver{})
+	RegisterDriver("Oracle", &sqlDriver{
+		driverName:    oracleDriverName,
+		versionQuery:  "SELECT banner FROM v$version WHERE ROWNUM = 1",
+		transactional: false,
+		executorImage: oracleBaseImage,
+		dsn:           oracleDSN,
+		split:         splitOracle,
+		// Oracle has no CREATE TABLE IF NOT EXISTS, ORA-00955 signals an
+		// existing table.
+		historyDDL: `BEGIN
+	EXECUTE IMMEDIATE 'CREATE TABLE ` + historyTable + ` (
+		id NUMBER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		action VARCHAR2(253) NOT NULL,
+		version VARCHAR2(63) NOT NULL,
+		checksum CHAR(64) NOT NULL,
+		kind VARCHAR2(16) NOT NULL,
+		applied_by VARCHAR2(253) NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)';
+EXCEPTION
+	WHEN OTHERS THEN
+		IF SQLCODE != -955 THEN
+			RAISE;
+		END IF;
+END;`,
+		// Unquoted identifiers are stored in upper case.
+		historyExistsQuery: `SELECT COUNT(*) FROM all_tables WHERE owner = SYS_CONTEXT('USERENV', 'CURRENT_SCHEMA') AND table_name = UPPER('` + historyTable + `')`,
+		placeholder: func(n int) string {
+			return fmt.Sprintf(":%d", n)
+		},
+	})
+}
+
+// oracleDSN connects to the service named by the database of the instance,
+// passing its parameters as connection options. Oracle schemas are users, so
+// a schema has to be selected by connecting as its owner. The TLS
+// configuration is registered under the name of the instance, which the TLS
+// CONFIG option refers to. Without one, TLS may still be configured by the
+// SSL and WALLET options of the driver.
+func oracleDSN(i *v1alpha1.PersistenceInstance, c Credentials) (string, error) {
+	if i.Spec.Schema != "" {
+		return "", fmt.Errorf("schemas are not supported by Oracle, connect as the schema owner instead")
+	}
+	params := make(map[string]string, len(i.Spec.Parameters)+2)
+	for k, v := range i.Spec.Parameters {
+		params[k] = v
+	}
+	if t := c.TLS; t != nil {
+		params["SSL"] = "false"
+		if t.Mode != TLSModeDisable {
+			tc, err := t.Config()
+			if err != nil {
+				return "", err
+			}
+			name := tlsConfigName(i)
+			registerTLSConfig(name, tc)
+			params[oracleTLSOption] = name
+		}
+	}
+	u := url.URL{
+		Scheme:   "oracle",
+		User:     url.UserPassword(c.Username, c.Password),
+		Host:     address(i),
+		Path:     "/" + i.Spec.Database,
+		RawQuery: encodeParameters(params),
+	}
+	return u.String(), nil
+}
+
+// oracleTLSDriver opens connections with go-ora. go-ora verifies server
+// certificates against the host it connects to, so connections with a TLS
+// configuration are secured by the operator instead, which go-ora then talks
+// to as if it was a plain connection.
+type oracleTLSDriver struct{}
+
+func (d oracleTLSDriver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
+}
+
+// OpenConnector lets database/sql pass the context of connecting on, so it
+// bounds dialing.
+func (oracleTLSDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	name := q.Get(oracleTLSOption)
+	if name == "" {
+		return goora.NewConnector(dsn), nil
+	}
+	tc, err := lookupTLSConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	q.Del(oracleTLSOption)
+	u.RawQuery = q.Encode()
+	c := goora.NewConnector(u.String()).(*goora.OracleConnector)
+	c.Dialer(oracleTLSDialer{config: tc})
+	return c, nil
+}
+
+// oracleTLSDialer dials connections secured with config for go-ora. Unlike
+// Postgres, Oracle expects the TLS handshake right away.
+type oracleTLSDialer struct {
+	config *tls.Config
+}
+
+func (d oracleTLSDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialTLS(ctx, network, address, d.config, nil)
+}
+
+// splitOracle splits an action the way SQL*Plus does. PL/SQL blocks are
+// terminated by a slash on a line of its own and kept whole, everything else
+// is split on semicolons.
+func splitOracle(action string) []string {
+	var res []string
+	for _, chunk := range oracleBlockTerminator.Split(action, -1) {
+		chunk = strings.TrimSpace(chunk)
+		if chunk == "" {
+			continue
+		}
+		if oraclePLSQL.MatchString(chunk) {
+			res = append(res, chunk)
+			continue
+		}
+		res = append(res, splitSQL(chunk, splitOptions{})...)
+	}
+	return res
+}
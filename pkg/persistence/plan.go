@@ -0,0 +1,127 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Planner reports what PersistenceActions would do, without executing them.
+type Planner struct {
+	kclient kubernetes.Interface
+	mclient *v1alpha1.PersistenceV1alpha1Client
+}
+
+// NewPlanner creates a new Planner.
+func NewPlanner(kclient kubernetes.Interface, mclient *v1alpha1.PersistenceV1alpha1Client) *Planner {
+	return &Planner{
+		kclient: kclient,
+		mclient: mclient,
+	}
+}
+
+// Plan reports what the named PersistenceAction would do on the instances it
+// currently selects. Histories are read within ctx.
+func (pl *Planner) Plan(ctx context.Context, namespace, name string) (*v1alpha1.PersistenceActionPlan, error) {
+	p, err := pl.mclient.PersistenceActions(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(p.Spec.PersistenceInstanceSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid persistence instance selector")
+	}
+	obj, err := pl.mclient.PersistenceInstances(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing persistence instances failed")
+	}
+
+	var instances []*v1alpha1.PersistenceInstance
+	for _, i := range obj.(*v1alpha1.PersistenceInstanceList).Items {
+		if selector.Matches(labels.Set(i.Labels)) {
+			instances = append(instances, i)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+
+	p, r, err := resolveActions(pl.kclient, p)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving actions failed")
+	}
+	return planAction(ctx, pl.kclient, p, instances, r), nil
+}
+
+// planAction reports what p would do on the given instances. Problems with
+// single instances are reported in the plan instead of failing it. Statements
+// are redacted by r, and so are the reasons, which may quote them.
+func planAction(ctx context.Context, kclient kubernetes.Interface, p *v1alpha1.PersistenceAction, instances []*v1alpha1.PersistenceInstance, r *redactor) *v1alpha1.PersistenceActionPlan {
+	res := &v1alpha1.PersistenceActionPlan{
+		Instances: make([]v1alpha1.PersistenceActionInstancePlan, 0, len(instances)),
+	}
+	// Instances of the same type share their warnings.
+	linted := map[string]bool{}
+	for _, inst := range instances {
+		ip := v1alpha1.PersistenceActionInstancePlan{Instance: inst.Name}
+
+		d, err := LookupDriver(inst.Spec.PersistenceType)
+		if err != nil {
+			ip.Reason = r.redact(err.Error())
+			res.Instances = append(res.Instances, ip)
+			continue
+		}
+		rp, err := renderActions(kclient, p, inst, r)
+		if err != nil {
+			ip.Reason = r.redact(err.Error())
+			res.Instances = append(res.Instances, ip)
+			continue
+		}
+		stmts := statements(d, rp.Spec.Actions)
+		for _, stmt := range stmts {
+			ip.Statements = append(ip.Statements, r.redact(stmt))
+		}
+		if !linted[inst.Spec.PersistenceType] {
+			linted[inst.Spec.PersistenceType] = true
+			res.Warnings = append(res.Warnings, lintStatements(inst.Spec.PersistenceType, d, stmts)...)
+		}
+
+		switch {
+		case p.Spec.Applied:
+			ip.Applied = true
+		case p.Spec.Schedule != "":
+			// Scheduled actions are repeated regardless of their history.
+		case !instanceReachable(inst):
+			ip.Reason = fmt.Sprintf("history not checked: %s", instanceUnreachableReason(inst))
+		default:
+			// Whether the action was applied is unknown if the history
+			// can't be read.
+			e, err := recordedHistory(ctx, kclient, p, inst)
+			if err != nil {
+				ip.Reason = r.redact(fmt.Sprintf("history not checked: %s", err))
+			} else {
+				ip.Applied = e != nil
+			}
+		}
+		res.Instances = append(res.Instances, ip)
+	}
+	return res
+}
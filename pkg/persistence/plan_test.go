@@ -0,0 +1,94 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+)
+
+func TestPlanActionHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, c *Operator, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance)
+		applied bool
+		reason  string
+	}{
+		{
+			name: "not applied",
+		},
+		{
+			name: "applied",
+			prepare: func(t *testing.T, c *Operator, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance) {
+				if _, err := c.syncInProcess(context.Background(), "shop/create-users", p, []*v1alpha1.PersistenceInstance{inst}, nil, &redactor{}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			applied: true,
+		},
+		{
+			name: "marked as applied",
+			prepare: func(t *testing.T, c *Operator, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance) {
+				p.Spec.Applied = true
+			},
+			applied: true,
+		},
+		{
+			name: "history unreadable",
+			prepare: func(t *testing.T, c *Operator, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance) {
+				inst.Spec.URL = filepath.Join(t.TempDir(), "missing", "shop.db")
+			},
+			reason: "history not checked: ",
+		},
+		{
+			name: "unreachable",
+			prepare: func(t *testing.T, c *Operator, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance) {
+				inst.Status = nil
+			},
+			reason: "history not checked: instance has not been probed yet",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, inst := sqliteOperator(t)
+			inst.Status = &v1alpha1.PersistenceInstanceStatus{Reachable: true}
+			p := testAction()
+			p.Spec.Actions = []string{"CREATE TABLE users (id INT PRIMARY KEY);"}
+			if test.prepare != nil {
+				test.prepare(t, c, &p, inst)
+			}
+
+			plan := planAction(context.Background(), c.kclient, &p, []*v1alpha1.PersistenceInstance{inst}, &redactor{})
+			if len(plan.Instances) != 1 {
+				t.Fatalf("expected the plan of 1 instance, got %d", len(plan.Instances))
+			}
+			ip := plan.Instances[0]
+			if ip.Applied != test.applied {
+				t.Errorf("expected applied to be %t, got %t", test.applied, ip.Applied)
+			}
+			if test.reason == "" && ip.Reason != "" || !strings.HasPrefix(ip.Reason, test.reason) {
+				t.Errorf("expected reason %q, got %q", test.reason, ip.Reason)
+			}
+			if len(ip.Statements) != 1 {
+				t.Errorf("expected 1 statement, got %v", ip.Statements)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+)
+
+const (
+	// postgresDriverName is the name postgresTLSDriver is registered with
+	// in database/sql.
+	postgresDriverName = "persistence-postgres"
+	// postgresTLSOption is the connection parameter naming the registered
+	// TLS configuration.
+	postgresTLSOption = "tls"
+)
+
+func init() {
+	sql.Register(postgresDriverName, postgresTLSDriver{})
+	RegisterDriver("Postgres", &sqlDriver{
+		driverName:    postgresDriverName,
+		versionQuery:  "SELECT version()",
+		transactional: true,
+		executorImage: postgresBaseImage,
+		dsn:           postgresDSN,
+		split: func(action string) []string {
+			return splitSQL(action, splitOptions{dollarQuotes: true})
+		},
+		historyDDL: `CREATE TABLE IF NOT EXISTS ` + historyTable + ` (
+	id SERIAL PRIMARY KEY,
+	action VARCHAR(253) NOT NULL,
+	version VARCHAR(63) NOT NULL,
+	checksum CHAR(64) NOT NULL,
+	kind VARCHAR(16) NOT NULL,
+	applied_by VARCHAR(253) NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+)`,
+		historyExistsQuery: `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = '` + historyTable + `'`,
+		placeholder: func(n int) string {
+			return fmt.Sprintf("$%d", n)
+		},
+	})
+}
+
+// postgresDSN passes the parameters of the instance as connection parameters.
+// The schema becomes the search path. The TLS configuration is registered
+// under the name of the instance, which the tls parameter refers to.
+func postgresDSN(i *v1alpha1.PersistenceInstance, c Credentials) (string, error) {
+	params := make(map[string]string, len(i.Spec.Parameters)+5)
+	for k, v := range i.Spec.Parameters {
+		params[k] = v
+	}
+	if i.Spec.Schema != "" {
+		params["search_path"] = i.Spec.Schema
+	}
+	if t := c.TLS; t != nil {
+		if t.Mode == TLSModeDisable {
+			params["sslmode"] = "disable"
+		} else {
+			tc, err := t.Config()
+			if err != nil {
+				return "", err
+			}
+			name := tlsConfigName(i)
+			registerTLSConfig(name, tc)
+			params[postgresTLSOption] = name
+		}
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.Username, c.Password),
+		Host:     address(i),
+		Path:     "/" + i.Spec.Database,
+		RawQuery: encodeParameters(params),
+	}
+	return u.String(), nil
+}
+
+// postgresTLSDriver opens connections with lib/pq. lib/pq verifies server
+// certificates against the host it connects to, so connections with a TLS
+// configuration are secured by the operator instead, which lib/pq then talks
+// to as if it was a plain connection.
+type postgresTLSDriver struct{}
+
+func (d postgresTLSDriver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
+}
+
+// OpenConnector lets database/sql pass the context of connecting on, so it
+// bounds dialing.
+func (postgresTLSDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	// lib/pq passes unknown parameters to the server, so the tls parameter
+	// is removed.
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	name := q.Get(postgresTLSOption)
+	if name == "" {
+		return pq.NewConnector(dsn)
+	}
+	tc, err := lookupTLSConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	q.Del(postgresTLSOption)
+	q.Set("sslmode", "disable")
+	u.RawQuery = q.Encode()
+	c, err := pq.NewConnector(u.String())
+	if err != nil {
+		return nil, err
+	}
+	c.Dialer(postgresTLSDialer{config: tc})
+	return c, nil
+}
+
+// postgresTLSDialer dials connections secured with config for lib/pq.
+type postgresTLSDialer struct {
+	config *tls.Config
+}
+
+func (d postgresTLSDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialTimeout(network, address, 0)
+}
+
+func (d postgresTLSDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+func (d postgresTLSDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialTLS(ctx, network, address, d.config, postgresSSLRequest)
+}
+
+// postgresSSLRequestMessage is the message asking a Postgres server to switch to
+// TLS: its length followed by the SSLRequest code 80877103.
+var postgresSSLRequestMessage = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// postgresSSLRequest negotiates TLS on the plain connection conn, which the
+// TLS handshake follows.
+func postgresSSLRequest(conn net.Conn) error {
+	if _, err := conn.Write(postgresSSLRequestMessage); err != nil {
+		return err
+	}
+	resp := make([]byte, 1)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 'S' {
+		return fmt.Errorf("server does not support TLS")
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	_ "modernc.org/sqlite"
+)
+
+var enableSQLite sync.Once
+
+// EnableSQLite registers the SQLite driver. The database files of SQLite
+// instances are files in the container of the operator, which anyone allowed
+// to create PersistenceInstances could read and write with the privileges of
+// the operator. The driver is therefore only registered on request, to try
+// out actions or in tests.
+func EnableSQLite() {
+	enableSQLite.Do(func() {
+		// SQLite is embedded into the operator and its database files are not
+		// available to executor Jobs, so it is meant for the InProcess executor.
+		RegisterDriver("SQLite", &sqlDriver{
+			driverName:    "sqlite",
+			versionQuery:  "SELECT sqlite_version()",
+			transactional: true,
+			dsn:           sqliteDSN,
+			split: func(action string) []string {
+				return splitSQL(action, splitOptions{backticks: true})
+			},
+			historyDDL: `CREATE TABLE IF NOT EXISTS ` + historyTable + ` (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	action TEXT NOT NULL,
+	version TEXT NOT NULL,
+	checksum TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	applied_by TEXT NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+)`,
+			historyExistsQuery: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = '` + historyTable + `'`,
+			placeholder:        questionMark,
+		})
+	})
+}
+
+// sqliteDSN uses the URL of the instance as path to the database file, or
+// ":memory:" for an in-memory database. The parameters are passed to the
+// driver, e.g. _pragma. A database file holds a single database without
+// schemas and is not connected to over the network.
+func sqliteDSN(i *v1alpha1.PersistenceInstance, c Credentials) (string, error) {
+	if i.Spec.URL == "" {
+		return "", fmt.Errorf("no database file given")
+	}
+	if i.Spec.Database != "" || i.Spec.Schema != "" {
+		return "", fmt.Errorf("database and schema are not supported by SQLite")
+	}
+	if c.TLS != nil {
+		return "", fmt.Errorf("TLS is not supported by SQLite")
+	}
+	if len(i.Spec.Parameters) == 0 {
+		return i.Spec.URL, nil
+	}
+	return "file:" + i.Spec.URL + "?" + encodeParameters(i.Spec.Parameters), nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+)
+
+// actionIndex indexes the Jobs by the PersistenceAction they belong to.
+const actionIndex = "action"
+
+// jobActionIndexFunc returns the key of the PersistenceAction a Job was
+// created for.
+func jobActionIndexFunc(obj interface{}) ([]string, error) {
+	j, ok := obj.(*batchv1.Job)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+	name, ok := j.Labels[actionLabel]
+	if !ok {
+		return nil, nil
+	}
+	return []string{j.Namespace + "/" + name}, nil
+}
+
+// actionStatus evaluates the status of p on the selected instances from the
+// Jobs executing it. Only the most recent Job of every instance is taken into
+// account. Instances without a Job keep their previous status once p is
+// applied on them. Jobs rolling p back take
+// precedence over the ones applying it.
+func actionStatus(p *v1alpha1.PersistenceAction, instances []*v1alpha1.PersistenceInstance, jobs []*batchv1.Job) *v1alpha1.PersistenceActionStatus {
+	res := &v1alpha1.PersistenceActionStatus{}
+	if p.Spec.Applied {
+		res.Applied = true
+		return res
+	}
+
+	latest := map[string]*batchv1.Job{}
+	rollbacks := map[string]*batchv1.Job{}
+	for _, j := range jobs {
+		inst := j.Labels[instanceLabel]
+		m := latest
+		if j.Labels[kindLabel] == historyKindRollback {
+			m = rollbacks
+		}
+		if l, ok := m[inst]; !ok || l.CreationTimestamp.Before(&j.CreationTimestamp) {
+			m[inst] = j
+		}
+	}
+
+	statuses := make([]v1alpha1.PersistenceActionInstanceStatus, 0, len(instances))
+	for _, inst := range instances {
+		var is v1alpha1.PersistenceActionInstanceStatus
+		if j, ok := latest[inst.Name]; ok {
+			is = instanceStatus(inst.Name, j)
+		} else if prev := previousInstanceStatus(p, inst.Name); prev != nil && prev.Applied && !reapply(p, prev.Checksum) {
+			is = *prev
+		} else {
+			is = instanceStatus(inst.Name, nil)
+		}
+		if j, ok := rollbacks[inst.Name]; ok {
+			is = rollbackStatus(is, j)
+		}
+		statuses = append(statuses, is)
+	}
+	return aggregateStatus(statuses)
+}
+
+// jobStatus evaluates the status of p from the Jobs executing it. The
+// databases are not consulted, Jobs finding p applied already in the history
+// table succeed without running it.
+func (c *Operator) jobStatus(key string, p *v1alpha1.PersistenceAction, instances []*v1alpha1.PersistenceInstance) (*v1alpha1.PersistenceActionStatus, error) {
+	objs, err := c.jobInf.GetIndexer().ByIndex(actionIndex, key)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*batchv1.Job, 0, len(objs))
+	for _, o := range objs {
+		jobs = append(jobs, o.(*batchv1.Job))
+	}
+	return actionStatus(p, instances, jobs), nil
+}
+
+// previousInstanceStatus returns the last persisted status of p on the named
+// instance, or nil if there is none.
+func previousInstanceStatus(p *v1alpha1.PersistenceAction, instance string) *v1alpha1.PersistenceActionInstanceStatus {
+	if p.Status == nil {
+		return nil
+	}
+	for i := range p.Status.Instances {
+		if p.Status.Instances[i].Instance == instance {
+			return &p.Status.Instances[i]
+		}
+	}
+	return nil
+}
+
+// aggregateStatus summarizes the status of an action on the selected
+// instances. The action is applied once it is applied on every instance.
+func aggregateStatus(instances []v1alpha1.PersistenceActionInstanceStatus) *v1alpha1.PersistenceActionStatus {
+	res := &v1alpha1.PersistenceActionStatus{
+		Applied:   len(instances) > 0,
+		Instances: instances,
+	}
+	for _, is := range instances {
+		res.Applied = res.Applied && is.Applied
+		res.Attempts += is.Attempts
+		if res.Reason == "" && is.Reason != "" {
+			res.Reason = fmt.Sprintf("instance %s: %s", is.Instance, is.Reason)
+		}
+		if is.ExecutionTime != nil && (res.ExecutionTime == nil || is.ExecutionTime.Before(res.ExecutionTime)) {
+			res.ExecutionTime = is.ExecutionTime
+		}
+		if is.CompletionTime != nil && (res.CompletionTime == nil || res.CompletionTime.Before(is.CompletionTime)) {
+			res.CompletionTime = is.CompletionTime
+		}
+	}
+	if !res.Applied {
+		res.CompletionTime = nil
+	}
+
+	return res
+}
+
+// instanceStatus evaluates the status of an action on a single instance from
+// the Job executing it, which may be nil if the action did not start yet.
+func instanceStatus(instance string, j *batchv1.Job) v1alpha1.PersistenceActionInstanceStatus {
+	res := v1alpha1.PersistenceActionInstanceStatus{Instance: instance}
+	if j == nil {
+		return res
+	}
+
+	res.ExecutionTime = j.Status.StartTime
+	res.Attempts = j.Status.Active + j.Status.Succeeded + j.Status.Failed
+	if j.Status.Succeeded > 0 {
+		res.Applied = true
+		res.CompletionTime = j.Status.CompletionTime
+		res.Checksum = j.Annotations[checksumAnnotation]
+	}
+	for _, c := range j.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == v1.ConditionTrue {
+			res.Reason = fmt.Sprintf("%s: %s", c.Reason, c.Message)
+		}
+	}
+	if res.Reason == "" && j.Status.Failed > 0 {
+		res.Reason = fmt.Sprintf("%d attempts failed", j.Status.Failed)
+	}
+	return res
+}
+
+// rollbackStatus evaluates the status of an action on a single instance with
+// the status applied from the Job rolling it back.
+func rollbackStatus(applied v1alpha1.PersistenceActionInstanceStatus, j *batchv1.Job) v1alpha1.PersistenceActionInstanceStatus {
+	if j.Status.Succeeded > 0 {
+		return v1alpha1.PersistenceActionInstanceStatus{
+			Instance:     applied.Instance,
+			RolledBack:   true,
+			RollbackTime: j.Status.CompletionTime,
+		}
+	}
+	rb := instanceStatus(applied.Instance, j)
+	if rb.Reason != "" {
+		applied.Reason = "rollback failed: " + rb.Reason
+	}
+	return applied
+}
+
+// updateActionStatus persists status onto p, unless it is up to date already.
+// The status is marked as observed for the current generation of p.
+func (c *Operator) updateActionStatus(p *v1alpha1.PersistenceAction, status *v1alpha1.PersistenceActionStatus) error {
+	status.ObservedGeneration = p.Generation
+	cur, err := json.Marshal(p.Status)
+	if err != nil {
+		return err
+	}
+	next, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(cur, next) {
+		return nil
+	}
+
+	// Objects from the informer cache must not be modified.
+	update := *p
+	update.Status = status
+	if _, err := c.mclient.PersistenceActions(p.Namespace).UpdateStatus(&update); err != nil {
+		return errors.Wrap(err, "updating persistence action status failed")
+	}
+	return nil
+}
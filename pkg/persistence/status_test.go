@@ -0,0 +1,280 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testJob returns the Job applying the test action on the named instance,
+// created at the given time.
+func testJob(instance string, created metav1.Time, status batchv1.JobStatus) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "create-users-" + instance,
+			Namespace:         "shop",
+			CreationTimestamp: created,
+			Labels:            map[string]string{actionLabel: "create-users", instanceLabel: instance},
+			Annotations:       map[string]string{checksumAnnotation: "sha256:abc"},
+		},
+		Status: status,
+	}
+}
+
+func TestInstanceStatus(t *testing.T) {
+	started := metav1.NewTime(time.Date(2017, 7, 1, 3, 0, 0, 0, time.UTC))
+	completed := metav1.NewTime(started.Add(time.Minute))
+
+	for _, tc := range []struct {
+		name     string
+		job      *batchv1.Job
+		expected v1alpha1.PersistenceActionInstanceStatus
+	}{
+		{
+			name:     "not started",
+			expected: v1alpha1.PersistenceActionInstanceStatus{Instance: "orders-db"},
+		},
+		{
+			name: "running",
+			job:  testJob("orders-db", started, batchv1.JobStatus{StartTime: &started, Active: 1}),
+			expected: v1alpha1.PersistenceActionInstanceStatus{
+				Instance:      "orders-db",
+				ExecutionTime: &started,
+				Attempts:      1,
+			},
+		},
+		{
+			name: "succeeded",
+			job:  testJob("orders-db", started, batchv1.JobStatus{StartTime: &started, CompletionTime: &completed, Succeeded: 1}),
+			expected: v1alpha1.PersistenceActionInstanceStatus{
+				Instance:       "orders-db",
+				Applied:        true,
+				ExecutionTime:  &started,
+				CompletionTime: &completed,
+				Attempts:       1,
+				Checksum:       "sha256:abc",
+			},
+		},
+		{
+			name: "failed",
+			job: testJob("orders-db", started, batchv1.JobStatus{
+				StartTime: &started,
+				Failed:    1,
+				Conditions: []batchv1.JobCondition{{
+					Type:    batchv1.JobFailed,
+					Status:  v1.ConditionTrue,
+					Reason:  "BackoffLimitExceeded",
+					Message: "Job has reached the specified backoff limit",
+				}},
+			}),
+			expected: v1alpha1.PersistenceActionInstanceStatus{
+				Instance:      "orders-db",
+				ExecutionTime: &started,
+				Attempts:      1,
+				Reason:        "BackoffLimitExceeded: Job has reached the specified backoff limit",
+			},
+		},
+		{
+			name: "failed attempts",
+			job:  testJob("orders-db", started, batchv1.JobStatus{StartTime: &started, Active: 1, Failed: 2}),
+			expected: v1alpha1.PersistenceActionInstanceStatus{
+				Instance:      "orders-db",
+				ExecutionTime: &started,
+				Attempts:      3,
+				Reason:        "2 attempts failed",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := instanceStatus("orders-db", tc.job); !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("expected status\n%+v\ngot\n%+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestActionStatus(t *testing.T) {
+	earlier := metav1.NewTime(time.Date(2017, 7, 1, 3, 0, 0, 0, time.UTC))
+	later := metav1.NewTime(earlier.Add(time.Hour))
+	orders, billing := testInstance(), testInstance()
+	billing.Name = "billing-db"
+	instances := []*v1alpha1.PersistenceInstance{&orders, &billing}
+
+	action := testAction()
+	checksum := checksumOf(&action)
+	succeeded := batchv1.JobStatus{StartTime: &earlier, CompletionTime: &later, Succeeded: 1}
+	failed := batchv1.JobStatus{StartTime: &later, Failed: 1}
+
+	for _, tc := range []struct {
+		name     string
+		status   *v1alpha1.PersistenceActionStatus
+		marked   bool
+		jobs     []*batchv1.Job
+		applied  bool
+		attempts int32
+		reason   string
+	}{
+		{
+			name:     "applied everywhere",
+			jobs:     []*batchv1.Job{testJob("orders-db", earlier, succeeded), testJob("billing-db", earlier, succeeded)},
+			applied:  true,
+			attempts: 2,
+		},
+		{
+			name:     "failed on one instance",
+			jobs:     []*batchv1.Job{testJob("orders-db", earlier, succeeded), testJob("billing-db", earlier, failed)},
+			attempts: 2,
+			reason:   "instance billing-db: 1 attempts failed",
+		},
+		{
+			name:     "most recent job",
+			jobs:     []*batchv1.Job{testJob("orders-db", later, failed), testJob("orders-db", earlier, succeeded), testJob("billing-db", earlier, succeeded)},
+			attempts: 2,
+			reason:   "instance orders-db: 1 attempts failed",
+		},
+		{
+			name:     "not started on one instance",
+			jobs:     []*batchv1.Job{testJob("orders-db", earlier, succeeded)},
+			attempts: 1,
+		},
+		// Jobs are removed after a while, the persisted status is kept.
+		{
+			name: "job removed",
+			status: &v1alpha1.PersistenceActionStatus{Instances: []v1alpha1.PersistenceActionInstanceStatus{
+				{Instance: "billing-db", Applied: true, Attempts: 1, Checksum: checksum},
+			}},
+			jobs:     []*batchv1.Job{testJob("orders-db", earlier, succeeded)},
+			applied:  true,
+			attempts: 2,
+		},
+		{
+			name:    "marked as applied",
+			marked:  true,
+			applied: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := testAction()
+			p.Status = tc.status
+			p.Spec.Applied = tc.marked
+			status := actionStatus(&p, instances, tc.jobs)
+			if status.Applied != tc.applied {
+				t.Errorf("expected applied to be %t, got %t", tc.applied, status.Applied)
+			}
+			if status.Attempts != tc.attempts {
+				t.Errorf("expected %d attempts, got %d", tc.attempts, status.Attempts)
+			}
+			if status.Reason != tc.reason {
+				t.Errorf("expected reason %q, got %q", tc.reason, status.Reason)
+			}
+			if tc.applied && !tc.marked && (status.CompletionTime == nil || !status.CompletionTime.Equal(&later)) {
+				t.Errorf("expected the action to be completed at %s, got %v", later, status.CompletionTime)
+			}
+			if !tc.applied && status.CompletionTime != nil {
+				t.Errorf("expected no completion time, got %s", status.CompletionTime)
+			}
+		})
+	}
+}
+
+func TestActionStatusJSON(t *testing.T) {
+	b, err := json.Marshal(v1alpha1.PersistenceActionStatus{Applied: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"applied":true`) || strings.Contains(string(b), "paused") {
+		t.Fatalf("expected the status to be serialized as applied, got %s", b)
+	}
+}
+
+func TestUpdateActionStatus(t *testing.T) {
+	mclient := &fakeActions{}
+	c := &Operator{mclient: mclient}
+	p := testAction()
+	p.Generation = 2
+
+	status := &v1alpha1.PersistenceActionStatus{Applied: true}
+	if err := c.updateActionStatus(&p, status); err != nil {
+		t.Fatal(err)
+	}
+	if len(mclient.updated) != 1 {
+		t.Fatalf("expected the status to be updated once, got %d updates", len(mclient.updated))
+	}
+	if got := mclient.updated[0].Status; got.ObservedGeneration != 2 || !got.Applied {
+		t.Errorf("expected the applied status of generation 2 to be persisted, got %+v", got)
+	}
+	if p.Status != nil {
+		t.Error("expected the cached action not to be modified")
+	}
+
+	// Unchanged statuses are not written again.
+	p.Status = mclient.updated[0].Status
+	if err := c.updateActionStatus(&p, &v1alpha1.PersistenceActionStatus{Applied: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(mclient.updated) != 1 {
+		t.Fatalf("expected the unchanged status not to be updated, got %d updates", len(mclient.updated))
+	}
+}
+
+func TestRollbackStatus(t *testing.T) {
+	started := metav1.NewTime(time.Date(2017, 7, 1, 3, 0, 0, 0, time.UTC))
+	completed := metav1.NewTime(started.Add(time.Minute))
+	applied := v1alpha1.PersistenceActionInstanceStatus{Instance: "orders-db", Applied: true, Checksum: "sha256:abc"}
+
+	for _, tc := range []struct {
+		name     string
+		job      batchv1.JobStatus
+		expected v1alpha1.PersistenceActionInstanceStatus
+	}{
+		{
+			name:     "running",
+			job:      batchv1.JobStatus{StartTime: &started, Active: 1},
+			expected: applied,
+		},
+		{
+			name:     "rolled back",
+			job:      batchv1.JobStatus{StartTime: &started, CompletionTime: &completed, Succeeded: 1},
+			expected: v1alpha1.PersistenceActionInstanceStatus{Instance: "orders-db", RolledBack: true, RollbackTime: &completed},
+		},
+		{
+			name: "failed",
+			job:  batchv1.JobStatus{StartTime: &started, Failed: 1},
+			expected: v1alpha1.PersistenceActionInstanceStatus{
+				Instance: "orders-db",
+				Applied:  true,
+				Checksum: "sha256:abc",
+				Reason:   "rollback failed: 1 attempts failed",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			j := testJob("orders-db", started, tc.job)
+			j.Labels[kindLabel] = historyKindRollback
+			if got := rollbackStatus(applied, j); !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("expected status\n%+v\ngot\n%+v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/pkg/k8sutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// sweep deletes the CronJobs, Jobs and Secrets generated for
+// PersistenceActions which don't exist anymore. They are deleted along with
+// their action by the operator and the garbage collector, but may be left
+// behind, e.g. if the operator was down when the action was deleted and
+// they predate owner references.
+func (c *Operator) sweep() {
+	opts := metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{managedByLabel: managedBy}).String(),
+	}
+
+	cronJobs, err := c.kclient.BatchV1beta1().CronJobs(metav1.NamespaceAll).List(context.TODO(), opts)
+	if err != nil {
+		glog.Errorf("sweeping cron jobs failed: %s", err)
+	} else {
+		for _, cj := range cronJobs.Items {
+			if !c.orphaned(cj.ObjectMeta) {
+				continue
+			}
+			glog.Infof("deleting orphaned cron job %s/%s", cj.Namespace, cj.Name)
+			if err := k8sutil.DeleteCronJob(c.kclient.BatchV1beta1().CronJobs(cj.Namespace), cj.Name); err != nil {
+				glog.Errorf("deleting orphaned cron job %s/%s failed: %s", cj.Namespace, cj.Name, err)
+			}
+		}
+	}
+
+	jobs, err := c.kclient.BatchV1().Jobs(metav1.NamespaceAll).List(context.TODO(), opts)
+	if err != nil {
+		glog.Errorf("sweeping jobs failed: %s", err)
+	} else {
+		for _, j := range jobs.Items {
+			if !c.orphaned(j.ObjectMeta) {
+				continue
+			}
+			glog.Infof("deleting orphaned job %s/%s", j.Namespace, j.Name)
+			if err := k8sutil.DeleteJob(c.kclient.BatchV1().Jobs(j.Namespace), j.Name); err != nil {
+				glog.Errorf("deleting orphaned job %s/%s failed: %s", j.Namespace, j.Name, err)
+			}
+		}
+	}
+
+	secrets, err := c.kclient.CoreV1().Secrets(metav1.NamespaceAll).List(context.TODO(), opts)
+	if err != nil {
+		glog.Errorf("sweeping secrets failed: %s", err)
+		return
+	}
+	for _, s := range secrets.Items {
+		if !c.orphaned(s.ObjectMeta) {
+			continue
+		}
+		glog.Infof("deleting orphaned secret %s/%s", s.Namespace, s.Name)
+		if err := k8sutil.DeleteSecret(c.kclient.CoreV1().Secrets(s.Namespace), s.Name); err != nil {
+			glog.Errorf("deleting orphaned secret %s/%s failed: %s", s.Namespace, s.Name, err)
+		}
+	}
+}
+
+// orphaned returns whether the PersistenceAction the object with metadata m
+// was generated for doesn't exist anymore, or was replaced by one of the same
+// name.
+func (c *Operator) orphaned(m metav1.ObjectMeta) bool {
+	name, ok := m.Labels[actionLabel]
+	if !ok {
+		return false
+	}
+	obj, exists, err := c.persistenceActionInf.GetIndexer().GetByKey(m.Namespace + "/" + name)
+	if err != nil {
+		return false
+	}
+	if !exists {
+		return true
+	}
+	uid := obj.(*v1alpha1.PersistenceAction).UID
+	for _, ref := range m.OwnerReferences {
+		if ref.Kind == v1alpha1.TPRPersistenceActionsKind && ref.UID != uid {
+			return true
+		}
+	}
+	return false
+}
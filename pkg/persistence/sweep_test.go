@@ -0,0 +1,165 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// checkOwned verifies the object with metadata m is managed by the operator
+// and controlled by p.
+func checkOwned(t *testing.T, kind string, m metav1.ObjectMeta, p v1alpha1.PersistenceAction) {
+	t.Helper()
+	if m.Labels[managedByLabel] != managedBy {
+		t.Errorf("%s %s is not labelled %s=%s", kind, m.Name, managedByLabel, managedBy)
+	}
+	if m.Labels[actionLabel] != p.Name {
+		t.Errorf("%s %s is not labelled %s=%s", kind, m.Name, actionLabel, p.Name)
+	}
+	if len(m.OwnerReferences) != 1 {
+		t.Fatalf("%s %s: expected one owner reference, got %v", kind, m.Name, m.OwnerReferences)
+	}
+	ref := m.OwnerReferences[0]
+	if ref.Kind != v1alpha1.TPRPersistenceActionsKind || ref.Name != p.Name || ref.UID != p.UID {
+		t.Errorf("%s %s is owned by %s %s (%s), expected %s %s (%s)", kind, m.Name, ref.Kind, ref.Name, ref.UID, v1alpha1.TPRPersistenceActionsKind, p.Name, p.UID)
+	}
+	if ref.Controller == nil || !*ref.Controller || ref.BlockOwnerDeletion == nil || !*ref.BlockOwnerDeletion {
+		t.Errorf("%s %s: expected the action to be the controller blocking its deletion", kind, m.Name)
+	}
+}
+
+func TestOwnerReferences(t *testing.T) {
+	p, i := testAction(), testInstance()
+
+	job, err := makeJob(p, i, testExecutorImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOwned(t, "job", job.ObjectMeta, p)
+
+	rollback, err := makeRollbackJob(p, i, testExecutorImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOwned(t, "rollback job", rollback.ObjectMeta, p)
+
+	p.Spec.Schedule = "0 3 * * *"
+	cronJob, err := makeCronJob(p, i, testExecutorImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOwned(t, "cron job", cronJob.ObjectMeta, p)
+	// The Jobs of a CronJob are owned by the CronJob, but still labelled to
+	// be swept.
+	if l := cronJob.Spec.JobTemplate.Labels; l[managedByLabel] != managedBy || l[actionLabel] != p.Name {
+		t.Errorf("expected the jobs of cron job %s to be labelled for sweeping, got labels %v", cronJob.Name, l)
+	}
+
+	c := &Operator{kclient: fake.NewSimpleClientset()}
+	if err := c.syncActionsSecret(job.Name, &p, []string{"CREATE TABLE users (id INT)"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := c.kclient.CoreV1().Secrets(p.Namespace).Get(context.TODO(), actionsSecretName(job.Name), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOwned(t, "secret", secret.ObjectMeta, p)
+}
+
+func TestSweep(t *testing.T) {
+	p := testAction()
+	replacement := types.UID("0c4d2a7e-5a6e-11e7-907b-a6006ad3dba0")
+
+	// meta returns the metadata of an object named name generated for the
+	// action named action and owned by the action with the given UID.
+	meta := func(name, action string, owner types.UID, managed bool) metav1.ObjectMeta {
+		m := metav1.ObjectMeta{Name: name, Namespace: p.Namespace, Labels: map[string]string{}}
+		if action != "" {
+			m.Labels[actionLabel] = action
+		}
+		if managed {
+			m.Labels[managedByLabel] = managedBy
+		}
+		if owner != "" {
+			m.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: v1alpha1.TPRGroup + "/" + v1alpha1.TPRVersion,
+				Kind:       v1alpha1.TPRPersistenceActionsKind,
+				Name:       action,
+				UID:        owner,
+			}}
+		}
+		return m
+	}
+
+	for _, tc := range []struct {
+		name    string
+		meta    metav1.ObjectMeta
+		deleted bool
+	}{
+		{name: "owned by the action", meta: meta("owned", p.Name, p.UID, true)},
+		{name: "predating owner references", meta: meta("unowned", p.Name, "", true)},
+		{name: "action deleted", meta: meta("deleted", "drop-users", "", true), deleted: true},
+		{name: "action replaced", meta: meta("replaced", p.Name, replacement, true), deleted: true},
+		{name: "not generated for an action", meta: meta("unlabelled", "", "", true)},
+		{name: "not managed by the operator", meta: meta("foreign", "drop-users", "", false)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			objs := []runtime.Object{
+				&batchv1beta1.CronJob{ObjectMeta: tc.meta},
+				&batchv1.Job{ObjectMeta: tc.meta},
+				&v1.Secret{ObjectMeta: tc.meta},
+			}
+			c := &Operator{
+				kclient:              fake.NewSimpleClientset(objs...),
+				persistenceActionInf: cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceAction{}, 0, cache.Indexers{}),
+			}
+			c.persistenceActionInf.GetIndexer().Add(&p)
+
+			c.sweep()
+
+			cronJobs, err := c.kclient.BatchV1beta1().CronJobs(p.Namespace).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			jobs, err := c.kclient.BatchV1().Jobs(p.Namespace).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			secrets, err := c.kclient.CoreV1().Secrets(p.Namespace).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for kind, n := range map[string]int{"cron jobs": len(cronJobs.Items), "jobs": len(jobs.Items), "secrets": len(secrets.Items)} {
+				if tc.deleted && n != 0 {
+					t.Errorf("expected the orphaned %s to be deleted, %d left", kind, n)
+				}
+				if !tc.deleted && n != 1 {
+					t.Errorf("expected the %s to be kept, %d left", kind, n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// teardownFinalizer holds back the deletion of PersistenceActions and
+	// PersistenceInstances until their OnDelete actions ran.
+	teardownFinalizer = "persistence.mmerrill3.com/teardown"
+	// skipTeardownAnnotation lets a PersistenceAction or PersistenceInstance
+	// be deleted without running its OnDelete actions.
+	skipTeardownAnnotation = "persistence.mmerrill3.com/skip-teardown"
+)
+
+// hasFinalizer returns whether the finalizer f is set on the object m.
+func hasFinalizer(m metav1.ObjectMeta, f string) bool {
+	for _, cur := range m.Finalizers {
+		if cur == f {
+			return true
+		}
+	}
+	return false
+}
+
+// withFinalizer returns a copy of the finalizers of m with f added or
+// removed, depending on set.
+func withFinalizer(m metav1.ObjectMeta, f string, set bool) []string {
+	res := make([]string, 0, len(m.Finalizers)+1)
+	for _, cur := range m.Finalizers {
+		if cur != f {
+			res = append(res, cur)
+		}
+	}
+	if set {
+		res = append(res, f)
+	}
+	return res
+}
+
+// teardownSkipped returns whether the OnDelete actions of the object m are
+// skipped on its deletion.
+func teardownSkipped(m metav1.ObjectMeta) bool {
+	_, ok := m.Annotations[skipTeardownAnnotation]
+	return ok
+}
+
+// teardownFailedCondition reports the failure of OnDelete actions.
+func teardownFailedCondition(err error) v1alpha1.PersistenceCondition {
+	return v1alpha1.PersistenceCondition{
+		Type:    conditionTornDown,
+		Status:  conditionStatus(false),
+		Reason:  "TeardownFailed",
+		Message: err.Error(),
+	}
+}
+
+// syncActionFinalizer sets the teardown finalizer on p if it has OnDelete
+// actions, and removes it otherwise. It returns the updated action.
+func (c *Operator) syncActionFinalizer(p *v1alpha1.PersistenceAction) (*v1alpha1.PersistenceAction, error) {
+	set := len(p.Spec.OnDelete) > 0
+	if hasFinalizer(p.ObjectMeta, teardownFinalizer) == set {
+		return p, nil
+	}
+	// Objects from the informer cache must not be modified.
+	update := *p
+	update.Finalizers = withFinalizer(p.ObjectMeta, teardownFinalizer, set)
+	res, err := c.mclient.PersistenceActions(p.Namespace).Update(&update)
+	if err != nil {
+		return nil, errors.Wrap(err, "updating finalizers of persistence action failed")
+	}
+	return res, nil
+}
+
+// syncInstanceFinalizer sets the teardown finalizer on i if it has OnDelete
+// actions, and removes it otherwise. It returns the updated instance.
+func (c *Operator) syncInstanceFinalizer(i *v1alpha1.PersistenceInstance) (*v1alpha1.PersistenceInstance, error) {
+	set := len(i.Spec.OnDelete) > 0
+	if hasFinalizer(i.ObjectMeta, teardownFinalizer) == set {
+		return i, nil
+	}
+	update := *i
+	update.Finalizers = withFinalizer(i.ObjectMeta, teardownFinalizer, set)
+	res, err := c.mclient.PersistenceInstances(i.Namespace).Update(&update)
+	if err != nil {
+		return nil, errors.Wrap(err, "updating finalizers of persistence instance failed")
+	}
+	return res, nil
+}
+
+// teardownAction runs the OnDelete actions of the deleted PersistenceAction
+// p on the selected instances and releases p once they succeeded on every
+// instance, or were skipped by annotation. Failures are reported in the
+// status of p and retried.
+func (c *Operator) teardownAction(ctx context.Context, key string, p *v1alpha1.PersistenceAction) error {
+	if !hasFinalizer(p.ObjectMeta, teardownFinalizer) {
+		return nil
+	}
+
+	if teardownSkipped(p.ObjectMeta) {
+		glog.Infof("PersistenceAction %s deleted without teardown", key)
+	} else {
+		if err := c.teardownActionInstances(ctx, key, p); err != nil {
+			c.recorder.Eventf(actionRef(p), v1.EventTypeWarning, eventReasonTeardownFailed, "%s", err)
+			status := &v1alpha1.PersistenceActionStatus{}
+			if p.Status != nil {
+				*status = *p.Status
+			}
+			status.Reason = fmt.Sprintf("teardown failed: %s", err)
+			status.Conditions = setCondition(status.Conditions, teardownFailedCondition(err))
+			if uerr := c.updateActionStatus(p, status); uerr != nil {
+				return uerr
+			}
+			return err
+		}
+		glog.Infof("PersistenceAction %s torn down", key)
+		c.recorder.Event(actionRef(p), v1.EventTypeNormal, eventReasonTornDown, "OnDelete actions succeeded")
+	}
+
+	update := *p
+	update.Finalizers = withFinalizer(p.ObjectMeta, teardownFinalizer, false)
+	if _, err := c.mclient.PersistenceActions(p.Namespace).Update(&update); err != nil {
+		return errors.Wrap(err, "removing finalizer of persistence action failed")
+	}
+	return nil
+}
+
+// teardownActionInstances runs the OnDelete actions of p on every selected
+// instance.
+func (c *Operator) teardownActionInstances(ctx context.Context, key string, p *v1alpha1.PersistenceAction) error {
+	rp, r, err := resolveActions(c.kclient, p)
+	if err != nil {
+		return err
+	}
+	instances, err := c.persistenceInstances(rp)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, inst := range instances {
+		locked := instanceKeys([]*v1alpha1.PersistenceInstance{inst})
+		if !c.locks.tryLock(v1alpha1.TPRPersistenceActionsKind+"/"+key, locked) {
+			errs = append(errs, fmt.Errorf("instance %s is busy", inst.Name))
+			continue
+		}
+		glog.Infof("PersistenceAction %s tearing down on instance %s", key, inst.Name)
+		err := c.teardown(ctx, rp, inst, r)
+		c.locks.unlock(locked)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "tearing down on instance %s failed", inst.Name))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// teardown renders the OnDelete actions of the resolved action p for the
+// PersistenceInstance inst, runs them against it and records the teardown in
+// its history table. Instances on which p is
+// not applied according to their history table are left alone, so are the
+// ones it was torn down on already. As failed teardowns are retried, the
+// OnDelete actions should be idempotent on non-transactional persistence
+// types.
+func (c *Operator) teardown(ctx context.Context, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance, r *redactor) error {
+	rp, err := renderActions(c.kclient, p, inst, r)
+	if err != nil {
+		return errors.Wrap(err, "rendering actions failed")
+	}
+
+	s, d, err := openSession(ctx, c.kclient, inst, c.config.ConnectTimeout)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.EnsureHistory(ctx); err != nil {
+		return errors.Wrap(err, "creating history table failed")
+	}
+	e, err := s.History(ctx, historyAction(p))
+	if err != nil {
+		return errors.Wrap(err, "reading history table failed")
+	}
+	// Actions marked as applied predate the history table.
+	if !p.Spec.Applied && (e == nil || e.Kind != historyKindApply) {
+		glog.V(4).Infof("PersistenceAction %s not applied to instance %s, nothing to tear down", historyAction(p), inst.Name)
+		return nil
+	}
+
+	return execTransaction(ctx, s, d, statements(d, rp.Spec.OnDelete), r, c.config.StatementTimeout, &HistoryEntry{
+		Action:    historyAction(p),
+		Version:   p.Spec.Version,
+		Checksum:  checksumOf(p),
+		Kind:      historyKindTeardown,
+		AppliedBy: c.identity,
+		AppliedAt: time.Now(),
+	})
+}
+
+// teardownInstance runs the OnDelete actions of the deleted
+// PersistenceInstance i and releases i once they succeeded, or were skipped
+// by annotation. Failures are reported in the status of i and retried.
+func (c *Operator) teardownInstance(ctx context.Context, key string, i *v1alpha1.PersistenceInstance) error {
+	if !hasFinalizer(i.ObjectMeta, teardownFinalizer) {
+		return nil
+	}
+
+	if teardownSkipped(i.ObjectMeta) {
+		glog.Infof("PersistenceInstance %s deleted without teardown", key)
+	} else {
+		// Actions syncing on the instance are completed first.
+		locked := []string{key}
+		if !c.locks.tryLock(v1alpha1.TPRPersistenceInstancesKind+"/"+key, locked) {
+			return fmt.Errorf("instance %s is busy", key)
+		}
+		defer c.locks.unlock(locked)
+
+		glog.Infof("PersistenceInstance %s tearing down", key)
+		s, d, err := openSession(ctx, c.kclient, i, c.config.ConnectTimeout)
+		if err == nil {
+			err = execTransaction(ctx, s, d, statements(d, i.Spec.OnDelete), nil, c.config.StatementTimeout, nil)
+			s.Close()
+		}
+		if err != nil {
+			c.recorder.Eventf(instanceRef(i), v1.EventTypeWarning, eventReasonTeardownFailed, "%s", err)
+			status := &v1alpha1.PersistenceInstanceStatus{}
+			if i.Status != nil {
+				*status = *i.Status
+			}
+			status.Conditions = setCondition(status.Conditions, teardownFailedCondition(err))
+			if uerr := c.updateInstanceStatus(i, status); uerr != nil {
+				return uerr
+			}
+			return errors.Wrap(err, "teardown failed")
+		}
+		glog.Infof("PersistenceInstance %s torn down", key)
+		c.recorder.Event(instanceRef(i), v1.EventTypeNormal, eventReasonTornDown, "OnDelete actions succeeded")
+	}
+
+	update := *i
+	update.Finalizers = withFinalizer(i.ObjectMeta, teardownFinalizer, false)
+	if _, err := c.mclient.PersistenceInstances(i.Namespace).Update(&update); err != nil {
+		return errors.Wrap(err, "removing finalizer of persistence instance failed")
+	}
+	return nil
+}
+
+// execTransaction executes stmts in the session s, followed by recording e in
+// the history table unless it is nil. Both happen within a single transaction
+// if the driver d supports them. Statement errors are redacted by r, every
+// statement is cancelled after timeout unless it is zero.
+func execTransaction(ctx context.Context, s Session, d Driver, stmts []string, r *redactor, timeout time.Duration, e *HistoryEntry) error {
+	if d.Transactional() {
+		if err := s.Begin(ctx); err != nil {
+			return errors.Wrap(err, "starting transaction failed")
+		}
+	}
+	abort := func(err error) error {
+		if d.Transactional() {
+			if rerr := s.Rollback(); rerr != nil {
+				glog.Errorf("rolling back transaction failed: %s", rerr)
+			}
+		}
+		return err
+	}
+
+	// The outcome of the single statements is not reported.
+	res := &v1alpha1.PersistenceActionInstanceStatus{}
+	if err := execStatements(ctx, s, stmts, res, r, timeout); err != nil {
+		return abort(err)
+	}
+	if e != nil {
+		if err := s.RecordHistory(ctx, *e); err != nil {
+			return abort(errors.Wrap(err, "recording history failed"))
+		}
+	}
+	if d.Transactional() {
+		if err := s.Commit(); err != nil {
+			return errors.Wrap(err, "committing transaction failed")
+		}
+	}
+	return nil
+}
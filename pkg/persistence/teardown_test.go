@@ -0,0 +1,281 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// execSQLite executes stmt in the database of inst.
+func execSQLite(t *testing.T, inst *v1alpha1.PersistenceInstance, stmt string) {
+	db, err := sql.Open("sqlite", inst.Spec.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(stmt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithFinalizer(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		finalizers []string
+		set        bool
+		expected   []string
+	}{
+		{name: "added", set: true, expected: []string{teardownFinalizer}},
+		{name: "added after others", finalizers: []string{"foregroundDeletion"}, set: true, expected: []string{"foregroundDeletion", teardownFinalizer}},
+		{name: "not duplicated", finalizers: []string{teardownFinalizer, "foregroundDeletion"}, set: true, expected: []string{"foregroundDeletion", teardownFinalizer}},
+		{name: "removed", finalizers: []string{"foregroundDeletion", teardownFinalizer}, expected: []string{"foregroundDeletion"}},
+		{name: "absent", expected: []string{}},
+	} {
+		m := metav1.ObjectMeta{Finalizers: tc.finalizers}
+		orig := append([]string(nil), tc.finalizers...)
+		res := withFinalizer(m, teardownFinalizer, tc.set)
+		if !reflect.DeepEqual(res, tc.expected) {
+			t.Errorf("%s: expected finalizers %v, got %v", tc.name, tc.expected, res)
+		}
+		if !reflect.DeepEqual(m.Finalizers, orig) {
+			t.Errorf("%s: expected the finalizers of the object to be left alone, got %v", tc.name, m.Finalizers)
+		}
+		if has := hasFinalizer(metav1.ObjectMeta{Finalizers: res}, teardownFinalizer); has != tc.set {
+			t.Errorf("%s: expected the finalizer to be set to be %t", tc.name, tc.set)
+		}
+	}
+}
+
+func TestTeardownSkipped(t *testing.T) {
+	for _, tc := range []struct {
+		annotations map[string]string
+		expected    bool
+	}{
+		{},
+		{annotations: map[string]string{"note": "keep"}},
+		{annotations: map[string]string{skipTeardownAnnotation: ""}, expected: true},
+		{annotations: map[string]string{skipTeardownAnnotation: "true"}, expected: true},
+	} {
+		if got := teardownSkipped(metav1.ObjectMeta{Annotations: tc.annotations}); got != tc.expected {
+			t.Errorf("annotations %v: expected teardown skipped to be %t, got %t", tc.annotations, tc.expected, got)
+		}
+	}
+}
+
+func TestSyncFinalizers(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		onDelete []string
+		has      bool
+		// Whether the object is expected to be updated.
+		updated bool
+	}{
+		{name: "set", onDelete: []string{"DROP TABLE users;"}, updated: true},
+		{name: "kept", onDelete: []string{"DROP TABLE users;"}, has: true},
+		{name: "removed", has: true, updated: true},
+		{name: "absent"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var finalizers []string
+			if tc.has {
+				finalizers = []string{teardownFinalizer}
+			}
+			set := len(tc.onDelete) > 0
+
+			actions := &fakeActions{}
+			p := testAction()
+			p.Spec.OnDelete, p.Finalizers = tc.onDelete, finalizers
+			res, err := (&Operator{mclient: actions}).syncActionFinalizer(&p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(actions.updated) > 0 != tc.updated {
+				t.Errorf("action: expected an update to be %t, got %d updates", tc.updated, len(actions.updated))
+			}
+			if hasFinalizer(res.ObjectMeta, teardownFinalizer) != set {
+				t.Errorf("action: expected the finalizer to be set to be %t, got %v", set, res.Finalizers)
+			}
+			if hasFinalizer(p.ObjectMeta, teardownFinalizer) != tc.has {
+				t.Errorf("action: expected the cached action to be left alone, got %v", p.Finalizers)
+			}
+
+			instances := &fakeInstances{}
+			i := testInstance()
+			i.Spec.OnDelete, i.Finalizers = tc.onDelete, finalizers
+			ri, err := (&Operator{mclient: instances}).syncInstanceFinalizer(&i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(instances.updated) > 0 != tc.updated {
+				t.Errorf("instance: expected an update to be %t, got %d updates", tc.updated, len(instances.updated))
+			}
+			if hasFinalizer(ri.ObjectMeta, teardownFinalizer) != set {
+				t.Errorf("instance: expected the finalizer to be set to be %t, got %v", set, ri.Finalizers)
+			}
+		})
+	}
+}
+
+func TestTeardownInstance(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		finalizer   bool
+		annotations map[string]string
+		onDelete    []string
+		err         string
+		// Whether the users table is expected to be dropped.
+		dropped bool
+		// Whether the finalizer is expected to be removed.
+		released bool
+		events   []string
+	}{
+		{
+			name:     "no finalizer",
+			onDelete: []string{"DROP TABLE users;"},
+		},
+		{
+			name:      "torn down",
+			finalizer: true,
+			onDelete:  []string{"DROP TABLE users;"},
+			dropped:   true,
+			released:  true,
+			events:    []string{"Normal TornDown OnDelete actions succeeded"},
+		},
+		{
+			name:        "skipped",
+			finalizer:   true,
+			annotations: map[string]string{skipTeardownAnnotation: ""},
+			onDelete:    []string{"DROP TABLE users;"},
+			released:    true,
+		},
+		{
+			name:      "failed",
+			finalizer: true,
+			onDelete:  []string{"DROP TABLE users;", "DROP TABLE customers;"},
+			err:       "no such table: customers",
+			events:    []string{"Warning TeardownFailed"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, inst := sqliteOperator(t)
+			mclient := &fakeInstances{}
+			recorder := record.NewFakeRecorder(10)
+			c.mclient, c.recorder = mclient, recorder
+			execSQLite(t, inst, "CREATE TABLE users (id INT PRIMARY KEY)")
+
+			inst.Spec.OnDelete = tc.onDelete
+			inst.Annotations = tc.annotations
+			if tc.finalizer {
+				inst.Finalizers = []string{teardownFinalizer}
+			}
+			err := c.teardownInstance(context.Background(), "shop/orders-db", inst)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if exists := tableExists(t, inst, "users"); exists == tc.dropped {
+				t.Errorf("expected the users table to be dropped to be %t", tc.dropped)
+			}
+			var released bool
+			for _, u := range mclient.updated {
+				if !hasFinalizer(u.ObjectMeta, teardownFinalizer) {
+					released = true
+				}
+			}
+			if released != tc.released {
+				t.Errorf("expected the instance to be released to be %t", tc.released)
+			}
+			if tc.err != "" {
+				if len(mclient.updated) != 1 {
+					t.Fatalf("expected the failure to be reported in the status, got %d updates", len(mclient.updated))
+				}
+				cond := findCondition(mclient.updated[0].Status.Conditions, conditionTornDown)
+				if cond == nil || cond.Status != conditionStatus(false) || !strings.Contains(cond.Message, tc.err) {
+					t.Errorf("expected a failed %s condition, got %+v", conditionTornDown, cond)
+				}
+			}
+			events := recordedEvents(recorder)
+			if len(events) != len(tc.events) {
+				t.Fatalf("expected events %v, got %v", tc.events, events)
+			}
+			for n, e := range tc.events {
+				if !strings.HasPrefix(events[n], e) {
+					t.Errorf("expected event %q, got %q", e, events[n])
+				}
+			}
+		})
+	}
+}
+
+func TestTeardownAction(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		applied     bool
+		annotations map[string]string
+		// Whether the OnDelete actions are expected to run, recording the
+		// history entries of the given kinds.
+		tornDown bool
+		kinds    []string
+	}{
+		{name: "applied", applied: true, tornDown: true, kinds: []string{historyKindTeardown}},
+		{name: "not applied"},
+		{name: "skipped", applied: true, annotations: map[string]string{skipTeardownAnnotation: ""}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, inst := sqliteOperator(t)
+			mclient := &fakeActions{}
+			c.mclient = mclient
+			c.persistenceInstanceInf = cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1alpha1.PersistenceInstance{}, 0, cache.Indexers{
+				cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+			})
+			c.persistenceInstanceInf.GetIndexer().Add(inst)
+			execSQLite(t, inst, "CREATE TABLE users (id INT PRIMARY KEY)")
+
+			p := testAction()
+			p.Spec.Applied = tc.applied
+			p.Spec.OnDelete = []string{"DROP TABLE users;"}
+			p.Annotations = tc.annotations
+			p.Finalizers = []string{teardownFinalizer}
+			if err := c.teardownAction(context.Background(), "shop/create-users", &p); err != nil {
+				t.Fatal(err)
+			}
+
+			if exists := tableExists(t, inst, "users"); exists == tc.tornDown {
+				t.Errorf("expected the OnDelete actions to run to be %t", tc.tornDown)
+			}
+			if tc.tornDown {
+				if kinds := historyKinds(t, inst, historyAction(&p)); !reflect.DeepEqual(kinds, tc.kinds) {
+					t.Errorf("expected history entries %v, got %v", tc.kinds, kinds)
+				}
+			}
+			if len(mclient.updated) != 1 || hasFinalizer(mclient.updated[0].ObjectMeta, teardownFinalizer) {
+				t.Errorf("expected the action to be released, got %d updates", len(mclient.updated))
+			}
+		})
+	}
+}
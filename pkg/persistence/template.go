@@ -0,0 +1,157 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// templateSecretLabel opts a Secret in to being read by the secret function of
+// actions which don't reference it otherwise.
+const templateSecretLabel = "persistence.mmerrill3.com/template"
+
+// templateData is what actions are rendered with.
+type templateData struct {
+	Action   templateAction
+	Instance templateInstance
+	Values   map[string]string
+}
+
+type templateAction struct {
+	Name      string
+	Namespace string
+	Version   string
+}
+
+type templateInstance struct {
+	Name            string
+	Namespace       string
+	Labels          map[string]string
+	PersistenceType string
+	URL             string
+	Port            int32
+	Database        string
+	Schema          string
+	Parameters      map[string]string
+}
+
+// renderActions returns a copy of the resolved action p whose Actions,
+// RollbackActions and OnDelete actions are rendered for the PersistenceInstance inst. Secrets
+// looked up while rendering are registered with r.
+func renderActions(kclient kubernetes.Interface, p *v1alpha1.PersistenceAction, inst *v1alpha1.PersistenceInstance, r *redactor) (*v1alpha1.PersistenceAction, error) {
+	data := templateData{
+		Action: templateAction{
+			Name:      p.Name,
+			Namespace: p.Namespace,
+			Version:   p.Spec.Version,
+		},
+		Instance: templateInstance{
+			Name:            inst.Name,
+			Namespace:       inst.Namespace,
+			Labels:          inst.Labels,
+			PersistenceType: inst.Spec.PersistenceType,
+			URL:             inst.Spec.URL,
+			Port:            inst.Spec.Port,
+			Database:        inst.Spec.Database,
+			Schema:          inst.Spec.Schema,
+			Parameters:      inst.Spec.Parameters,
+		},
+		Values: p.Spec.Values,
+	}
+	// The secret function only reads the Secrets the action reads values
+	// from, the credentials of the instance and Secrets opting in, so
+	// actions can't read arbitrary Secrets of their namespace.
+	referenced := map[string]bool{}
+	for _, src := range p.Spec.ValuesFrom {
+		if src.SecretRef != nil {
+			referenced[src.SecretRef.Name] = true
+		}
+	}
+	if inst.Namespace == p.Namespace {
+		for _, ref := range []*v1.SecretKeySelector{inst.Spec.UsernameSecretRef, inst.Spec.PasswordSecretRef} {
+			if ref != nil {
+				referenced[ref.Name] = true
+			}
+		}
+	}
+	funcs := template.FuncMap{
+		"secret": func(name, key string) (string, error) {
+			s, err := kclient.CoreV1().Secrets(p.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+			if err != nil {
+				return "", errors.Wrapf(err, "retrieving secret %s failed", name)
+			}
+			if !referenced[name] && s.Labels[templateSecretLabel] != "true" {
+				return "", fmt.Errorf("secret %s is neither referenced by the action or instance nor labelled %s=true", name, templateSecretLabel)
+			}
+			v, ok := s.Data[key]
+			if !ok {
+				return "", fmt.Errorf("secret %s has no key %s", name, key)
+			}
+			r.add(string(v))
+			return string(v), nil
+		},
+	}
+
+	render := func(field string, actions []string) ([]string, error) {
+		res := make([]string, 0, len(actions))
+		for n, a := range actions {
+			name := fmt.Sprintf("%s[%d]", field, n)
+			t, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(a)
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			if err := t.Execute(&buf, data); err != nil {
+				// The error may quote the partially rendered action.
+				return nil, fmt.Errorf("rendering %s failed: %s", name, r.redact(err.Error()))
+			}
+			// Statements of actions read from Secrets are hidden once
+			// rendered, too.
+			if r.isAction(a) {
+				r.addAction(buf.String())
+			}
+			res = append(res, buf.String())
+		}
+		return res, nil
+	}
+
+	actions, err := render("actions", p.Spec.Actions)
+	if err != nil {
+		return nil, err
+	}
+	rollbackActions, err := render("rollbackActions", p.Spec.RollbackActions)
+	if err != nil {
+		return nil, err
+	}
+	onDelete, err := render("onDelete", p.Spec.OnDelete)
+	if err != nil {
+		return nil, err
+	}
+
+	res := *p
+	res.Spec.Actions = actions
+	res.Spec.RollbackActions = rollbackActions
+	res.Spec.OnDelete = onDelete
+	return &res, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRenderActions(t *testing.T) {
+	p, inst := testAction(), testInstance()
+	p.Spec.Actions = []string{
+		"CREATE SCHEMA {{ .Instance.Database }}_{{ .Values.tenant }};",
+		"GRANT USAGE ON SCHEMA {{ .Instance.Schema }} TO {{ .Values.role }};",
+	}
+	p.Spec.RollbackActions = []string{"DROP SCHEMA {{ .Instance.Database }}_{{ .Values.tenant }};"}
+	p.Spec.OnDelete = []string{"-- {{ .Action.Name }} {{ .Action.Version }} on {{ .Instance.Name }}:{{ .Instance.Port }}"}
+	p.Spec.Values = map[string]string{"tenant": "acme", "role": "reporting"}
+
+	rp, err := renderActions(fake.NewSimpleClientset(), &p, &inst, &redactor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		field    string
+		got      []string
+		expected []string
+	}{
+		{"actions", rp.Spec.Actions, []string{"CREATE SCHEMA orders_acme;", "GRANT USAGE ON SCHEMA public TO reporting;"}},
+		{"rollbackActions", rp.Spec.RollbackActions, []string{"DROP SCHEMA orders_acme;"}},
+		{"onDelete", rp.Spec.OnDelete, []string{"-- create-users 1 on orders-db:5432"}},
+	} {
+		if strings.Join(tc.got, "\n") != strings.Join(tc.expected, "\n") {
+			t.Errorf("expected %s %q, got %q", tc.field, tc.expected, tc.got)
+		}
+	}
+	if p.Spec.Actions[0] != "CREATE SCHEMA {{ .Instance.Database }}_{{ .Values.tenant }};" {
+		t.Error("expected the action not to be modified")
+	}
+}
+
+func TestRenderActionsMissingValue(t *testing.T) {
+	p, inst := testAction(), testInstance()
+	p.Spec.Actions = []string{"CREATE SCHEMA {{ .Values.tenant }};"}
+	p.Spec.Values = map[string]string{"role": "reporting"}
+
+	_, err := renderActions(fake.NewSimpleClientset(), &p, &inst, &redactor{})
+	if err == nil || !strings.Contains(err.Error(), "rendering actions[0] failed") || !strings.Contains(err.Error(), "tenant") {
+		t.Fatalf("expected rendering to fail on the missing value, got %v", err)
+	}
+}
+
+func TestValuesPrecedence(t *testing.T) {
+	p, inst := testAction(), testInstance()
+	p.Spec.Actions = []string{"{{ .Values.a }} {{ .Values.b }} {{ .Values.c }} {{ .Values.d }}"}
+	p.Spec.Values = map[string]string{"a": "values"}
+	p.Spec.ValuesFrom = []v1alpha1.PersistenceActionValuesSource{
+		{ConfigMapRef: &v1.LocalObjectReference{Name: "defaults"}},
+		{SecretRef: &v1.LocalObjectReference{Name: "overrides"}},
+	}
+	kclient := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "defaults"},
+			Data:       map[string]string{"a": "defaults", "b": "defaults", "c": "defaults"},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "overrides"},
+			Data:       map[string][]byte{"a": []byte("overrides"), "b": []byte("overrides"), "d": []byte("overrides")},
+		},
+	)
+
+	resolved, r, err := resolveActions(kclient, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := renderActions(kclient, resolved, &inst, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Values take precedence over ValuesFrom, later sources over earlier
+	// ones.
+	if expected := "values overrides defaults overrides"; rp.Spec.Actions[0] != expected {
+		t.Errorf("expected %q, got %q", expected, rp.Spec.Actions[0])
+	}
+}
+
+func TestRenderSecret(t *testing.T) {
+	secret := func(name string, labels map[string]string) *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: name, Labels: labels},
+			Data:       map[string][]byte{"password": []byte("s3cr3t-" + name)},
+		}
+	}
+	kclient := fake.NewSimpleClientset(
+		secret("orders-db", nil),
+		secret("reporting", nil),
+		secret("shared", map[string]string{templateSecretLabel: "true"}),
+		secret("unrelated", nil),
+	)
+
+	for _, tc := range []struct {
+		name       string
+		secret     string
+		instanceNS string
+		err        bool
+	}{
+		{name: "instance credentials", secret: "orders-db"},
+		{name: "values from", secret: "reporting"},
+		{name: "labelled", secret: "shared"},
+		{name: "unreferenced", secret: "unrelated", err: true},
+		{name: "credentials of an instance in another namespace", secret: "orders-db", instanceNS: "billing", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, inst := testAction(), testInstance()
+			p.Spec.Actions = []string{`ALTER ROLE app PASSWORD '{{ secret "` + tc.secret + `" "password" }}';`}
+			p.Spec.ValuesFrom = []v1alpha1.PersistenceActionValuesSource{{
+				SecretRef: &v1.LocalObjectReference{Name: "reporting"},
+			}}
+			if tc.instanceNS != "" {
+				inst.Namespace = tc.instanceNS
+			}
+			r := &redactor{}
+
+			rp, err := renderActions(kclient, &p, &inst, r)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected reading the secret to be denied")
+				}
+				if strings.Contains(err.Error(), "s3cr3t") {
+					t.Fatalf("expected the error not to contain the secret, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := "ALTER ROLE app PASSWORD 's3cr3t-" + tc.secret + "';"; rp.Spec.Actions[0] != expected {
+				t.Errorf("expected %q, got %q", expected, rp.Spec.Actions[0])
+			}
+			if got := r.redact(rp.Spec.Actions[0]); strings.Contains(got, "s3cr3t") {
+				t.Errorf("expected the secret to be redacted, got %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testCertificate issues a certificate for name, signed by parent and
+// parentKey or self-signed if parent is nil, and returns it PEM encoded
+// along with its key.
+func testCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestTLSMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode     string
+		expected string
+		err      bool
+	}{
+		{mode: "", expected: TLSModeVerifyFull},
+		{mode: TLSModeDisable, expected: TLSModeDisable},
+		{mode: TLSModeRequire, expected: TLSModeRequire},
+		{mode: TLSModeVerifyCA, expected: TLSModeVerifyCA},
+		{mode: TLSModeVerifyFull, expected: TLSModeVerifyFull},
+		{mode: "verify-full", err: true},
+	} {
+		mode, err := tlsMode(&v1alpha1.PersistenceInstanceTLS{Mode: tc.mode})
+		if tc.err {
+			if err == nil {
+				t.Errorf("mode %q: expected an error, got %s", tc.mode, mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("mode %q: %s", tc.mode, err)
+			continue
+		}
+		if mode != tc.expected {
+			t.Errorf("mode %q: expected %s, got %s", tc.mode, tc.expected, mode)
+		}
+	}
+}
+
+func TestInstanceTLS(t *testing.T) {
+	_, _, certPEM, keyPEM := testCertificate(t, "app", nil, nil)
+	kclient := fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "orders-db-ca", Namespace: "shop"},
+			Data:       map[string][]byte{"ca.crt": certPEM},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "orders-db-client", Namespace: "shop"},
+			Type:       v1.SecretTypeTLS,
+			Data:       map[string][]byte{v1.TLSCertKey: certPEM, v1.TLSPrivateKeyKey: keyPEM},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "orders-db-nokey", Namespace: "shop"},
+			Data:       map[string][]byte{v1.TLSCertKey: certPEM},
+		},
+	)
+
+	for _, tc := range []struct {
+		name     string
+		tls      func(t *v1alpha1.PersistenceInstanceTLS)
+		expected *TLS
+		err      string
+	}{
+		{
+			name:     "all secrets",
+			expected: &TLS{Mode: TLSModeVerifyFull, ServerName: "orders-db", CA: certPEM, Cert: certPEM, Key: keyPEM},
+		},
+		{
+			name: "default mode and no secrets",
+			tls: func(t *v1alpha1.PersistenceInstanceTLS) {
+				t.Mode, t.CASecretRef, t.ClientCertSecretRef = "", nil, nil
+			},
+			expected: &TLS{Mode: TLSModeVerifyFull, ServerName: "orders-db"},
+		},
+		{
+			name: "unknown mode",
+			tls:  func(t *v1alpha1.PersistenceInstanceTLS) { t.Mode = "Prefer" },
+			err:  `unknown TLS mode "Prefer"`,
+		},
+		{
+			name: "missing CA key",
+			tls:  func(t *v1alpha1.PersistenceInstanceTLS) { t.CASecretRef.Key = "ca.pem" },
+			err:  "caSecretRef: secret orders-db-ca has no key ca.pem",
+		},
+		{
+			name: "missing client secret",
+			tls:  func(t *v1alpha1.PersistenceInstanceTLS) { t.ClientCertSecretRef.Name = "billing-db-client" },
+			err:  "clientCertSecretRef: retrieving secret billing-db-client failed",
+		},
+		{
+			name: "missing client key",
+			tls:  func(t *v1alpha1.PersistenceInstanceTLS) { t.ClientCertSecretRef.Name = "orders-db-nokey" },
+			err:  "clientCertSecretRef: secret orders-db-nokey has no key tls.key",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			i := testInstance()
+			if tc.tls != nil {
+				tc.tls(i.Spec.TLS)
+			}
+			res, err := instanceTLS(kclient, &i)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Mode != tc.expected.Mode || res.ServerName != tc.expected.ServerName ||
+				string(res.CA) != string(tc.expected.CA) || string(res.Cert) != string(tc.expected.Cert) || string(res.Key) != string(tc.expected.Key) {
+				t.Errorf("expected %+v, got %+v", tc.expected, res)
+			}
+		})
+	}
+
+	i := testInstance()
+	i.Spec.TLS = nil
+	if res, err := instanceTLS(kclient, &i); res != nil || err != nil {
+		t.Errorf("expected no TLS configuration without a tls block, got %+v, %v", res, err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	ca, caKey, caPEM, _ := testCertificate(t, "ca", nil, nil)
+	server, _, _, _ := testCertificate(t, "orders-db.shop.svc", ca, caKey)
+	foreign, _, _, _ := testCertificate(t, "orders-db.shop.svc", nil, nil)
+	_, _, clientPEM, clientKeyPEM := testCertificate(t, "app", ca, caKey)
+
+	for _, tc := range []struct {
+		mode string
+		// Whether the standard verification, including the server name, is
+		// left to crypto/tls.
+		verifyName bool
+		// Whether the chain is verified by a callback instead.
+		verifyChain bool
+	}{
+		{mode: TLSModeRequire},
+		{mode: TLSModeVerifyCA, verifyChain: true},
+		{mode: TLSModeVerifyFull, verifyName: true},
+	} {
+		cfg, err := (&TLS{Mode: tc.mode, ServerName: "orders-db", CA: caPEM, Cert: clientPEM, Key: clientKeyPEM}).Config()
+		if err != nil {
+			t.Errorf("%s: %s", tc.mode, err)
+			continue
+		}
+		if cfg.ServerName != "orders-db" {
+			t.Errorf("%s: expected server name orders-db, got %q", tc.mode, cfg.ServerName)
+		}
+		if cfg.RootCAs == nil || len(cfg.Certificates) != 1 {
+			t.Errorf("%s: expected the CA and the client certificate to be configured", tc.mode)
+		}
+		if cfg.InsecureSkipVerify == tc.verifyName {
+			t.Errorf("%s: expected InsecureSkipVerify %t, got %t", tc.mode, !tc.verifyName, cfg.InsecureSkipVerify)
+		}
+		if (cfg.VerifyPeerCertificate != nil) != tc.verifyChain {
+			t.Errorf("%s: expected chain verification %t", tc.mode, tc.verifyChain)
+			continue
+		}
+		if !tc.verifyChain {
+			continue
+		}
+		// The server name differs from the certificate, which VerifyCA
+		// ignores, but the certificate has to be issued by the CA.
+		if err := cfg.VerifyPeerCertificate([][]byte{server.Raw}, nil); err != nil {
+			t.Errorf("%s: expected a certificate issued by the CA to be accepted, got %s", tc.mode, err)
+		}
+		if err := cfg.VerifyPeerCertificate([][]byte{foreign.Raw}, nil); err == nil {
+			t.Errorf("%s: expected a certificate not issued by the CA to be rejected", tc.mode)
+		}
+		if err := cfg.VerifyPeerCertificate(nil, nil); err == nil {
+			t.Errorf("%s: expected a missing certificate to be rejected", tc.mode)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		tls  TLS
+		err  string
+	}{
+		{name: "invalid CA", tls: TLS{Mode: TLSModeVerifyFull, CA: []byte("not a certificate")}, err: "no valid CA certificate found"},
+		{name: "key mismatch", tls: TLS{Mode: TLSModeVerifyFull, Cert: clientPEM, Key: []byte("not a key")}, err: "loading client certificate failed"},
+	} {
+		if _, err := tc.tls.Config(); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestTLSDSN(t *testing.T) {
+	_, _, caPEM, _ := testCertificate(t, "ca", nil, nil)
+	name := "persistence-shop-orders-db"
+
+	for _, tc := range []struct {
+		persistenceType string
+		mode            string
+		expected        string
+		registered      bool
+		err             string
+	}{
+		{persistenceType: "Postgres", mode: TLSModeDisable, expected: "sslmode=disable"},
+		{persistenceType: "Postgres", mode: TLSModeVerifyFull, expected: "tls=" + name, registered: true},
+		{persistenceType: "MySQL", mode: TLSModeDisable, expected: "tls=false"},
+		{persistenceType: "MySQL", mode: TLSModeVerifyCA, expected: "tls=" + name},
+		{persistenceType: "Oracle", mode: TLSModeDisable, expected: "SSL=false"},
+		{persistenceType: "Oracle", mode: TLSModeRequire, expected: "TLS+CONFIG=" + name, registered: true},
+		{persistenceType: "Mongo", mode: TLSModeVerifyFull, expected: "tls=" + name, registered: true},
+		{persistenceType: "SQLite", mode: TLSModeVerifyFull, err: "TLS is not supported by SQLite"},
+	} {
+		i := testInstance()
+		i.Spec.Schema = ""
+		if tc.persistenceType == "SQLite" {
+			i.Spec.URL, i.Spec.Database = "/var/lib/shop.db", ""
+		}
+		d, err := LookupDriver(tc.persistenceType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfigsMu.Lock()
+		delete(tlsConfigs, name)
+		tlsConfigsMu.Unlock()
+
+		dsn, err := d.DSN(&i, Credentials{Username: "app", TLS: &TLS{Mode: tc.mode, CA: caPEM}})
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error %q, got %v", tc.persistenceType, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %s", tc.persistenceType, tc.mode, err)
+			continue
+		}
+		if !strings.Contains(dsn, tc.expected) {
+			t.Errorf("%s %s: expected DSN %q to contain %q", tc.persistenceType, tc.mode, dsn, tc.expected)
+		}
+		if tc.registered {
+			cfg, err := lookupTLSConfig(name)
+			if err != nil {
+				t.Errorf("%s %s: %s", tc.persistenceType, tc.mode, err)
+			} else if cfg.RootCAs == nil {
+				t.Errorf("%s %s: expected the registered configuration to trust the CA", tc.persistenceType, tc.mode)
+			}
+		}
+	}
+}
+
+func TestMakePodSpecTLS(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		tls      *v1alpha1.PersistenceInstanceTLS
+		expected map[string]string
+		volumes  []string
+	}{
+		{
+			name:     "no TLS",
+			expected: map[string]string{},
+		},
+		{
+			name:     "default mode",
+			tls:      &v1alpha1.PersistenceInstanceTLS{},
+			expected: map[string]string{"PERSISTENCE_TLS_MODE": TLSModeVerifyFull, "PERSISTENCE_TLS_SERVER_NAME": ""},
+		},
+		{
+			name: "all secrets",
+			tls:  testInstance().Spec.TLS,
+			expected: map[string]string{
+				"PERSISTENCE_TLS_MODE":        TLSModeVerifyFull,
+				"PERSISTENCE_TLS_SERVER_NAME": "orders-db",
+				"PERSISTENCE_TLS_CA_FILE":     "",
+				"PERSISTENCE_TLS_CERT_FILE":   "",
+				"PERSISTENCE_TLS_KEY_FILE":    "",
+			},
+			volumes: []string{"orders-db-ca", "orders-db-client"},
+		},
+	} {
+		i := testInstance()
+		i.Spec.TLS = tc.tls
+		spec, err := makePodSpec(testAction(), i, testExecutorImage)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		env := map[string]string{}
+		for _, e := range spec.Containers[0].Env {
+			if strings.HasPrefix(e.Name, "PERSISTENCE_TLS_") {
+				env[e.Name] = e.Value
+			}
+		}
+		for k, v := range tc.expected {
+			got, ok := env[k]
+			if !ok {
+				t.Errorf("%s: expected %s to be set", tc.name, k)
+			} else if v != "" && got != v {
+				t.Errorf("%s: expected %s=%s, got %s", tc.name, k, v, got)
+			}
+		}
+		if len(env) != len(tc.expected) {
+			t.Errorf("%s: expected TLS variables %v, got %v", tc.name, tc.expected, env)
+		}
+		secrets := map[string]bool{}
+		for _, v := range spec.Volumes {
+			if v.Secret != nil {
+				secrets[v.Secret.SecretName] = true
+			}
+		}
+		for _, s := range tc.volumes {
+			if !secrets[s] {
+				t.Errorf("%s: expected secret %s to be mounted", tc.name, s)
+			}
+		}
+	}
+}
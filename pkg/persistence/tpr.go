@@ -0,0 +1,363 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"github.com/mmerrill3/persistence-operator/pkg/k8sutil"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	clientcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	tprPersistenceInstance = "persistence-instance." + v1alpha1.TPRGroup
+	tprPersistenceAction   = "persistence-action." + v1alpha1.TPRGroup
+)
+
+// tprMigrations lists the TPRs whose objects are backed up, and how their
+// objects are read and restored.
+var tprMigrations = []struct {
+	tpr     string
+	list    func(v1alpha1.PersistenceV1alpha1Interface) ([]metav1.Object, error)
+	restore func(v1alpha1.PersistenceV1alpha1Interface, []byte) error
+	objects string
+}{
+	{tpr: tprPersistenceInstance, list: listPersistenceInstances, restore: restorePersistenceInstances, objects: "persistence instances"},
+	{tpr: tprPersistenceAction, list: listPersistenceActions, restore: restorePersistenceActions, objects: "persistence actions"},
+}
+
+const (
+	// tprBackupKey is the key of the Secrets backing up the objects of a
+	// TPR, holding them as JSON list.
+	tprBackupKey = "objects.json"
+	// tprBackupLabel marks the Secrets backing up the objects of a TPR,
+	// naming the TPR.
+	tprBackupLabel = "persistence.mmerrill3.com/backup"
+	// tprBackupPartsAnnotation holds the number of Secrets the objects of a
+	// TPR are backed up in.
+	tprBackupPartsAnnotation = "persistence.mmerrill3.com/backup-parts"
+	// tprBackupPartSize bounds the size of the objects backed up in a single
+	// Secret, leaving room for its metadata within the 1 MiB limit of the
+	// API server.
+	tprBackupPartSize = 900 << 10
+)
+
+// tprBackupName returns the name of the Secret backing up the objects of the
+// TPR tpr with the given index.
+func tprBackupName(tpr string, part int) string {
+	return fmt.Sprintf("persistence-operator-backup-%s-%d", tprShortName(tpr), part)
+}
+
+// tprShortName returns the name of the TPR tpr without its group.
+func tprShortName(tpr string) string {
+	return strings.SplitN(tpr, ".", 2)[0]
+}
+
+// splitBackup encodes items as JSON lists of at most tprBackupPartSize
+// bytes, in order. It fails if a single item exceeds this size.
+func splitBackup(items []metav1.Object) ([][]byte, error) {
+	var (
+		parts [][]byte
+		part  []byte
+	)
+	for _, item := range items {
+		b, err := json.Marshal(item)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encoding %s/%s failed", item.GetNamespace(), item.GetName())
+		}
+		// The brackets of the list and a comma are added to every item.
+		if len(b)+2 > tprBackupPartSize {
+			return nil, fmt.Errorf("%s/%s exceeds the size of a backup with %d bytes", item.GetNamespace(), item.GetName(), len(b))
+		}
+		if len(part)+len(b)+2 > tprBackupPartSize {
+			parts = append(parts, append(part, ']'))
+			part = nil
+		}
+		if part == nil {
+			part = append([]byte{'['}, b...)
+		} else {
+			part = append(append(part, ','), b...)
+		}
+	}
+	if part == nil {
+		part = []byte{'['}
+	}
+	return append(parts, append(part, ']')), nil
+}
+
+// tprBackups returns the Secrets backing up the objects of the TPR tpr, in
+// order. It fails if the backup is incomplete.
+func tprBackups(client clientcorev1.SecretInterface, tpr string) ([]v1.Secret, error) {
+	list, err := client.List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{tprBackupLabel: tprShortName(tpr)}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	backups := list.Items
+	if len(backups) == 0 {
+		return nil, nil
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backupPart(backups[i]) < backupPart(backups[j])
+	})
+	for n, b := range backups {
+		parts, err := strconv.Atoi(b.Annotations[tprBackupPartsAnnotation])
+		if err != nil || parts != len(backups) || b.Name != tprBackupName(tpr, n) {
+			return nil, fmt.Errorf("backup of TPR %s is incomplete, secret %s doesn't match the %d secrets found", tpr, b.Name, len(backups))
+		}
+	}
+	return backups, nil
+}
+
+// backupPart returns the index of the backup Secret s.
+func backupPart(s v1.Secret) int {
+	n, err := strconv.Atoi(s.Name[strings.LastIndex(s.Name, "-")+1:])
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// BackupTPRs backs up the PersistenceInstances and PersistenceActions stored
+// as ThirdPartyResources in Secrets in namespace, split across as many
+// Secrets as their size requires. The TPRs are left as they are. It requires
+// a cluster still serving TPRs, i.e. older than Kubernetes 1.8. The operator
+// restores the objects from the backups once the cluster serves the CRDs.
+func BackupTPRs(kclient kubernetes.Interface, mclient v1alpha1.PersistenceV1alpha1Interface, namespace string) error {
+	if namespace == "" {
+		return fmt.Errorf("the namespace of the backups is required")
+	}
+	secretClient := kclient.CoreV1().Secrets(namespace)
+
+	for _, m := range tprMigrations {
+		exists, err := tprExists(kclient, m.tpr)
+		if err != nil {
+			return errors.Wrapf(err, "retrieving TPR %s failed", m.tpr)
+		}
+		if !exists {
+			glog.Infof("TPR not found : %s ", m.tpr)
+			continue
+		}
+		items, err := m.list(mclient)
+		if err != nil {
+			return errors.Wrapf(err, "reading %s failed", m.objects)
+		}
+		parts, err := splitBackup(items)
+		if err != nil {
+			return errors.Wrapf(err, "backing up %s failed", m.objects)
+		}
+		// Backups left behind by a previous attempt may consist of more
+		// parts.
+		if err := deleteTPRBackups(secretClient, m.tpr); err != nil {
+			return errors.Wrapf(err, "removing outdated backup of %s failed", m.objects)
+		}
+		for n, b := range parts {
+			backup := &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: tprBackupName(m.tpr, n),
+					Labels: map[string]string{
+						managedByLabel: managedBy,
+						tprBackupLabel: tprShortName(m.tpr),
+					},
+					Annotations: map[string]string{tprBackupPartsAnnotation: strconv.Itoa(len(parts))},
+				},
+				Data: map[string][]byte{tprBackupKey: b},
+			}
+			if err := k8sutil.CreateOrUpdateSecret(secretClient, backup); err != nil {
+				return errors.Wrapf(err, "backing up %s failed", m.objects)
+			}
+		}
+		if _, err := tprBackups(secretClient, m.tpr); err != nil {
+			return errors.Wrapf(err, "verifying backup of %s failed", m.objects)
+		}
+		glog.Infof("TPR backed up : %s in %d secrets", m.tpr, len(parts))
+	}
+	return nil
+}
+
+// tprExists returns whether the TPR tpr exists. The typed clients no longer
+// know TPRs, which were removed in Kubernetes 1.8.
+func tprExists(kclient kubernetes.Interface, tpr string) (bool, error) {
+	err := kclient.ExtensionsV1beta1().RESTClient().Get().
+		Resource("thirdpartyresources").
+		Name(tpr).
+		Do(context.TODO()).
+		Error()
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// restoreTPRBackups recreates the PersistenceInstances and
+// PersistenceActions backed up by BackupTPRs in namespace, unless they
+// exist, and removes the backups once all of them are recreated. Incomplete
+// backups fail the restore before any object is recreated. A restore failing
+// part way is resumed on the next start. It does nothing once the backups
+// are gone.
+func restoreTPRBackups(kclient kubernetes.Interface, mclient v1alpha1.PersistenceV1alpha1Interface, namespace string) error {
+	if namespace == "" {
+		return fmt.Errorf("the namespace of the operator is required to restore the TPR backups")
+	}
+	secretClient := kclient.CoreV1().Secrets(namespace)
+
+	backups := make([][]v1.Secret, len(tprMigrations))
+	for n, m := range tprMigrations {
+		var err error
+		if backups[n], err = tprBackups(secretClient, m.tpr); err != nil {
+			return errors.Wrapf(err, "retrieving backup of %s failed", m.objects)
+		}
+	}
+
+	for n, m := range tprMigrations {
+		if backups[n] == nil {
+			continue
+		}
+		for _, backup := range backups[n] {
+			if err := m.restore(mclient, backup.Data[tprBackupKey]); err != nil {
+				return errors.Wrapf(err, "restoring %s failed", m.objects)
+			}
+		}
+		if err := deleteTPRBackups(secretClient, m.tpr); err != nil {
+			return errors.Wrapf(err, "removing backup of %s failed", m.objects)
+		}
+		glog.Infof("TPR restored : %s ", m.tpr)
+	}
+	return nil
+}
+
+// deleteTPRBackups deletes the Secrets backing up the objects of the TPR tpr.
+func deleteTPRBackups(client clientcorev1.SecretInterface, tpr string) error {
+	list, err := client.List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{tprBackupLabel: tprShortName(tpr)}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range list.Items {
+		if err := k8sutil.DeleteSecret(client, s.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listPersistenceInstances reads all PersistenceInstances.
+func listPersistenceInstances(mclient v1alpha1.PersistenceV1alpha1Interface) ([]metav1.Object, error) {
+	obj, err := mclient.PersistenceInstances(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var res []metav1.Object
+	for _, i := range obj.(*v1alpha1.PersistenceInstanceList).Items {
+		res = append(res, i)
+	}
+	return res, nil
+}
+
+// restorePersistenceInstances recreates the PersistenceInstances of the
+// backup b which are missing.
+func restorePersistenceInstances(mclient v1alpha1.PersistenceV1alpha1Interface, b []byte) error {
+	var items []*v1alpha1.PersistenceInstance
+	if err := json.Unmarshal(b, &items); err != nil {
+		return errors.Wrap(err, "decoding backup failed")
+	}
+	for _, i := range items {
+		client := mclient.PersistenceInstances(i.Namespace)
+		if _, err := client.Get(i.Name); err == nil {
+			continue
+		} else if !apierrors.IsNotFound(err) {
+			return err
+		}
+		status := i.Status
+		i.ObjectMeta = restoredObjectMeta(i.ObjectMeta)
+		created, err := client.Create(i)
+		if err != nil {
+			return errors.Wrapf(err, "creating %s/%s failed", i.Namespace, i.Name)
+		}
+		// The status subresource is ignored on creation.
+		created.Status = status
+		if _, err := client.UpdateStatus(created); err != nil {
+			return errors.Wrapf(err, "updating status of %s/%s failed", i.Namespace, i.Name)
+		}
+	}
+	return nil
+}
+
+// listPersistenceActions reads all PersistenceActions.
+func listPersistenceActions(mclient v1alpha1.PersistenceV1alpha1Interface) ([]metav1.Object, error) {
+	obj, err := mclient.PersistenceActions(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var res []metav1.Object
+	for _, p := range obj.(*v1alpha1.PersistenceActionList).Items {
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+// restorePersistenceActions recreates the PersistenceActions of the backup b
+// which are missing.
+func restorePersistenceActions(mclient v1alpha1.PersistenceV1alpha1Interface, b []byte) error {
+	var items []*v1alpha1.PersistenceAction
+	if err := json.Unmarshal(b, &items); err != nil {
+		return errors.Wrap(err, "decoding backup failed")
+	}
+	for _, p := range items {
+		client := mclient.PersistenceActions(p.Namespace)
+		if _, err := client.Get(p.Name); err == nil {
+			continue
+		} else if !apierrors.IsNotFound(err) {
+			return err
+		}
+		status := p.Status
+		p.ObjectMeta = restoredObjectMeta(p.ObjectMeta)
+		created, err := client.Create(p)
+		if err != nil {
+			return errors.Wrapf(err, "creating %s/%s failed", p.Namespace, p.Name)
+		}
+		// The status subresource is ignored on creation.
+		created.Status = status
+		if _, err := client.UpdateStatus(created); err != nil {
+			return errors.Wrapf(err, "updating status of %s/%s failed", p.Namespace, p.Name)
+		}
+	}
+	return nil
+}
+
+// restoredObjectMeta strips the fields assigned by the API server from m.
+func restoredObjectMeta(m metav1.ObjectMeta) metav1.ObjectMeta {
+	m.ResourceVersion = ""
+	m.UID = ""
+	m.SelfLink = ""
+	m.CreationTimestamp = metav1.Time{}
+	m.Generation = 0
+	return m
+}
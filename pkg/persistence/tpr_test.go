@@ -0,0 +1,105 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSplitBackup(t *testing.T) {
+	var items []metav1.Object
+	for n := 0; n < 40; n++ {
+		p := testAction()
+		p.Name = fmt.Sprintf("action-%d", n)
+		// Large actions spread the backup across several Secrets.
+		p.Spec.Actions = []string{strings.Repeat("-- padding\n", 8<<10)}
+		items = append(items, &p)
+	}
+
+	parts, err := splitBackup(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("expected the backup to be split, got %d parts", len(parts))
+	}
+	var names []string
+	for n, b := range parts {
+		if len(b) > tprBackupPartSize {
+			t.Errorf("part %d has %d bytes, expected at most %d", n, len(b), tprBackupPartSize)
+		}
+		var restored []*v1alpha1.PersistenceAction
+		if err := json.Unmarshal(b, &restored); err != nil {
+			t.Fatalf("decoding part %d failed: %s", n, err)
+		}
+		for _, p := range restored {
+			names = append(names, p.Name)
+		}
+	}
+	if len(names) != len(items) {
+		t.Fatalf("expected %d actions in the backup, got %d", len(items), len(names))
+	}
+	for n, name := range names {
+		if name != items[n].GetName() {
+			t.Errorf("expected %s at position %d, got %s", items[n].GetName(), n, name)
+		}
+	}
+
+	if parts, err := splitBackup(nil); err != nil || len(parts) != 1 || string(parts[0]) != "[]" {
+		t.Errorf("expected an empty backup to be a single empty list, got %q, %v", parts, err)
+	}
+
+	p := testAction()
+	p.Spec.Actions = []string{strings.Repeat("x", tprBackupPartSize)}
+	if _, err := splitBackup([]metav1.Object{&p}); err == nil {
+		t.Error("expected an action exceeding the size of a backup to fail the backup")
+	}
+}
+
+func TestTPRBackupsIncomplete(t *testing.T) {
+	backup := func(part, parts int) *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        tprBackupName(tprPersistenceAction, part),
+				Namespace:   "persistence",
+				Labels:      map[string]string{tprBackupLabel: tprShortName(tprPersistenceAction)},
+				Annotations: map[string]string{tprBackupPartsAnnotation: strconv.Itoa(parts)},
+			},
+		}
+	}
+
+	kclient := fake.NewSimpleClientset(backup(1, 2), backup(0, 2))
+	backups, err := tprBackups(kclient.CoreV1().Secrets("persistence"), tprPersistenceAction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0].Name != tprBackupName(tprPersistenceAction, 0) {
+		t.Fatalf("expected both parts of the backup in order, got %v", backups)
+	}
+
+	kclient = fake.NewSimpleClientset(backup(0, 3), backup(2, 3))
+	if _, err := tprBackups(kclient.CoreV1().Secrets("persistence"), tprPersistenceAction); err == nil {
+		t.Error("expected a backup missing a part to fail")
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// ValidateInstance checks the spec of i. The secrets it references are not
+// consulted.
+func ValidateInstance(i *v1alpha1.PersistenceInstance) error {
+	var errs []error
+	if i.Spec.PersistenceType == "" {
+		errs = append(errs, fmt.Errorf("spec.persistenceType: required"))
+	} else if _, err := LookupDriver(i.Spec.PersistenceType); err != nil {
+		errs = append(errs, fmt.Errorf("spec.persistenceType: %s", err))
+	}
+	if i.Spec.URL == "" {
+		errs = append(errs, fmt.Errorf("spec.url: required"))
+	}
+	if i.Spec.Port < 0 || i.Spec.Port > 65535 {
+		errs = append(errs, fmt.Errorf("spec.port: %d is not between 0 and 65535", i.Spec.Port))
+	}
+	errs = append(errs, validateSecretKeySelector("spec.usernameSecretRef", i.Spec.UsernameSecretRef)...)
+	errs = append(errs, validateSecretKeySelector("spec.passwordSecretRef", i.Spec.PasswordSecretRef)...)
+	if t := i.Spec.TLS; t != nil {
+		if _, err := tlsMode(t); err != nil {
+			errs = append(errs, fmt.Errorf("spec.tls.mode: %s", err))
+		}
+		errs = append(errs, validateSecretKeySelector("spec.tls.caSecretRef", t.CASecretRef)...)
+		if t.ClientCertSecretRef != nil && t.ClientCertSecretRef.Name == "" {
+			errs = append(errs, fmt.Errorf("spec.tls.clientCertSecretRef.name: required"))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// DefaultInstance sets the defaults of the spec of i.
+func DefaultInstance(i *v1alpha1.PersistenceInstance) {
+	if i.Spec.TLS != nil && i.Spec.TLS.Mode == "" {
+		i.Spec.TLS.Mode = TLSModeVerifyFull
+	}
+}
+
+// ValidateAction checks the spec of p. Whether its selector matches any
+// instance is left to the caller.
+func ValidateAction(p *v1alpha1.PersistenceAction) error {
+	var errs []error
+	if len(p.Spec.Actions) == 0 && len(p.Spec.ActionsFrom) == 0 {
+		errs = append(errs, fmt.Errorf("spec.actions: required unless spec.actionsFrom is given"))
+	}
+	if p.Spec.PersistenceInstanceSelector == nil {
+		errs = append(errs, fmt.Errorf("spec.persistenceInstanceSelector: required"))
+	} else if _, err := metav1.LabelSelectorAsSelector(p.Spec.PersistenceInstanceSelector); err != nil {
+		errs = append(errs, fmt.Errorf("spec.persistenceInstanceSelector: %s", err))
+	}
+	if p.Spec.Schedule != "" {
+		if _, err := cronSchedule(*p); err != nil {
+			errs = append(errs, fmt.Errorf("spec.schedule: %s", err))
+		}
+		if _, err := cronConcurrencyPolicy(*p); err != nil {
+			errs = append(errs, fmt.Errorf("spec.concurrencyPolicy: %s", err))
+		}
+	}
+	if l := p.Spec.SuccessfulJobsHistoryLimit; l != nil && *l < 0 {
+		errs = append(errs, fmt.Errorf("spec.successfulJobsHistoryLimit: must not be negative"))
+	}
+	if l := p.Spec.FailedJobsHistoryLimit; l != nil && *l < 0 {
+		errs = append(errs, fmt.Errorf("spec.failedJobsHistoryLimit: must not be negative"))
+	}
+	if _, err := checksumPolicy(p); err != nil {
+		errs = append(errs, fmt.Errorf("spec.checksumPolicy: %s", err))
+	}
+	if p.Spec.Executor != "" {
+		if _, err := executorMode(p, Config{}); err != nil {
+			errs = append(errs, fmt.Errorf("spec.executor: %s", err))
+		}
+	}
+	for n, src := range p.Spec.ActionsFrom {
+		if count := countSet(src.ConfigMapKeyRef != nil, src.SecretKeyRef != nil, src.ConfigMapKeysRef != nil, src.SecretKeysRef != nil); count != 1 {
+			errs = append(errs, fmt.Errorf("spec.actionsFrom[%d]: exactly one source must be given, got %d", n, count))
+		}
+	}
+	for n, src := range p.Spec.ValuesFrom {
+		if count := countSet(src.ConfigMapRef != nil, src.SecretRef != nil); count != 1 {
+			errs = append(errs, fmt.Errorf("spec.valuesFrom[%d]: exactly one source must be given, got %d", n, count))
+		}
+	}
+	for n, d := range p.Spec.DependsOn {
+		if count := countSet(d.Name != "", d.Selector != nil); count != 1 {
+			errs = append(errs, fmt.Errorf("spec.dependsOn[%d]: exactly one of name and selector must be given", n))
+		}
+		if d.Name == p.Name && d.Name != "" {
+			errs = append(errs, fmt.Errorf("spec.dependsOn[%d]: the action can't depend on itself", n))
+		}
+		if d.Selector != nil {
+			if _, err := metav1.LabelSelectorAsSelector(d.Selector); err != nil {
+				errs = append(errs, fmt.Errorf("spec.dependsOn[%d].selector: %s", n, err))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// ValidateActionUpdate checks the update of old to cur. The actions, their
+// sources and the values they are rendered with can't be changed once
+// applied, unless the checksum policy asks to reapply them.
+func ValidateActionUpdate(old, cur *v1alpha1.PersistenceAction) error {
+	applied := old.Spec.Applied || (old.Status != nil && old.Status.Applied)
+	if !applied {
+		return nil
+	}
+	if policy, err := checksumPolicy(cur); err == nil && policy == checksumPolicyReapply {
+		return nil
+	}
+	var errs []error
+	for _, f := range []struct {
+		field    string
+		old, cur interface{}
+	}{
+		{"spec.actions", old.Spec.Actions, cur.Spec.Actions},
+		{"spec.actionsFrom", old.Spec.ActionsFrom, cur.Spec.ActionsFrom},
+		{"spec.values", old.Spec.Values, cur.Spec.Values},
+		{"spec.valuesFrom", old.Spec.ValuesFrom, cur.Spec.ValuesFrom},
+	} {
+		if !reflect.DeepEqual(f.old, f.cur) {
+			errs = append(errs, fmt.Errorf("%s: immutable once the action is applied, unless the checksum policy is %s", f.field, checksumPolicyReapply))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// DefaultAction sets the defaults of the spec of p.
+func DefaultAction(p *v1alpha1.PersistenceAction) {
+	if p.Spec.ChecksumPolicy == "" {
+		p.Spec.ChecksumPolicy = checksumPolicyFail
+	}
+	if p.Spec.Schedule == "" {
+		return
+	}
+	if p.Spec.ConcurrencyPolicy == "" {
+		p.Spec.ConcurrencyPolicy = string(batchv1beta1.ForbidConcurrent)
+	}
+	if p.Spec.SuccessfulJobsHistoryLimit == nil {
+		limit := int32(defaultSuccessfulJobsHistoryLimit)
+		p.Spec.SuccessfulJobsHistoryLimit = &limit
+	}
+	if p.Spec.FailedJobsHistoryLimit == nil {
+		limit := int32(defaultFailedJobsHistoryLimit)
+		p.Spec.FailedJobsHistoryLimit = &limit
+	}
+}
+
+func validateSecretKeySelector(field string, ref *v1.SecretKeySelector) []error {
+	if ref == nil {
+		return nil
+	}
+	var errs []error
+	if ref.Name == "" {
+		errs = append(errs, fmt.Errorf("%s.name: required", field))
+	}
+	if ref.Key == "" {
+		errs = append(errs, fmt.Errorf("%s.key: required", field))
+	}
+	return errs
+}
+
+// countSet returns how many of the given fields are set.
+func countSet(fields ...bool) int {
+	n := 0
+	for _, set := range fields {
+		if set {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 The persistence-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mmerrill3/persistence-operator/pkg/client/persistence/v1alpha1"
+	"k8s.io/api/core/v1"
+)
+
+func TestValidateActionUpdate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		applied bool
+		policy  string
+		update  func(p *v1alpha1.PersistenceAction)
+		field   string
+	}{
+		{
+			name:    "actions",
+			applied: true,
+			update:  func(p *v1alpha1.PersistenceAction) { p.Spec.Actions = []string{"CREATE TABLE orders (id INT);"} },
+			field:   "spec.actions",
+		},
+		{
+			name:    "actions from",
+			applied: true,
+			update: func(p *v1alpha1.PersistenceAction) {
+				p.Spec.ActionsFrom = []v1alpha1.PersistenceActionSource{{
+					ConfigMapKeysRef: &v1alpha1.PersistenceActionKeysSelector{Name: "migrations"},
+				}}
+			},
+			field: "spec.actionsFrom",
+		},
+		{
+			name:    "values",
+			applied: true,
+			update:  func(p *v1alpha1.PersistenceAction) { p.Spec.Values = map[string]string{"owner": "shop"} },
+			field:   "spec.values",
+		},
+		{
+			name:    "values from",
+			applied: true,
+			update: func(p *v1alpha1.PersistenceAction) {
+				p.Spec.ValuesFrom = []v1alpha1.PersistenceActionValuesSource{{
+					SecretRef: &v1.LocalObjectReference{Name: "credentials"},
+				}}
+			},
+			field: "spec.valuesFrom",
+		},
+		{
+			name:    "other fields",
+			applied: true,
+			update:  func(p *v1alpha1.PersistenceAction) { p.Spec.Version = "2" },
+		},
+		{
+			name:   "not applied yet",
+			update: func(p *v1alpha1.PersistenceAction) { p.Spec.Values = map[string]string{"owner": "shop"} },
+		},
+		{
+			name:    "reapplied",
+			applied: true,
+			policy:  checksumPolicyReapply,
+			update:  func(p *v1alpha1.PersistenceAction) { p.Spec.Values = map[string]string{"owner": "shop"} },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			old := testAction()
+			old.Status = &v1alpha1.PersistenceActionStatus{Applied: tc.applied}
+			cur := *old.DeepCopy()
+			if tc.policy != "" {
+				cur.Spec.ChecksumPolicy = tc.policy
+			}
+			tc.update(&cur)
+
+			err := ValidateActionUpdate(&old, &cur)
+			if tc.field == "" {
+				if err != nil {
+					t.Fatalf("expected the update to be valid, got %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tc.field+": immutable") {
+				t.Fatalf("expected %s to be immutable, got %v", tc.field, err)
+			}
+		})
+	}
+}
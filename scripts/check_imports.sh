@@ -0,0 +1,10 @@
+#!/bin/sh
+
+# The API types of the client-go generation before k8s.io/api must not be
+# mixed with the ones of k8s.io/api pinned in go.mod.
+impRes=$(grep -rln --include='*.go' --exclude-dir=vendor '"k8s.io/client-go/pkg/' .)
+if [ -n "${impRes}" ]; then
+	echo "import checking failed, use the types of k8s.io/api instead of k8s.io/client-go/pkg:"
+	echo "${impRes}" | sed 's/^/  /'
+	exit 255
+fi